@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// defaultTemplateCountry keys the template used for countries without their own
+const defaultTemplateCountry = "*"
+
+// addressTemplateFlag collects repeated --address-template options. Each is
+// a Go template, optionally prefixed with the country code it applies to:
+//
+//	--address-template '{{.Road}}, {{.District}}, {{.Province}}'
+//	--address-template 'th={{.HouseNumber}} {{.Road}} {{.Subdistrict}} {{.District}} {{.Province}} {{.Postcode}}'
+type addressTemplateFlag map[string]string
+
+func (f addressTemplateFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + f[k]
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (f addressTemplateFlag) Set(value string) error {
+	country := defaultTemplateCountry
+	// A country prefix is two letters before "=", so "=" inside a template isn't mistaken for one
+	if len(value) > 3 && value[2] == '=' && isLetter(value[0]) && isLetter(value[1]) {
+		country = strings.ToLower(value[:2])
+		value = value[3:]
+	}
+	if _, dup := f[country]; dup {
+		return fmt.Errorf("more than one template for %s", country)
+	}
+	f[country] = value
+	return nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// templateFuncs are available in address templates
+var templateFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// strip removes a word from the start or end of a value: {{strip .District "District"}}
+	"strip": stripWord,
+	// join joins the non-empty values with sep: {{join " " .HouseNumber .Road}}
+	"join": func(sep string, values ...string) string {
+		var parts []string
+		for _, v := range values {
+			if v = strings.TrimSpace(v); v != "" {
+				parts = append(parts, v)
+			}
+		}
+		return strings.Join(parts, sep)
+	},
+}
+
+// parseAddressTemplates compiles the --address-template options and checks
+// them against an empty address, so unknown fields fail at startup
+func parseAddressTemplates(sources addressTemplateFlag) (map[string]*template.Template, error) {
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	templates := make(map[string]*template.Template, len(sources))
+	for country, src := range sources {
+		tmpl, err := template.New(country).Funcs(templateFuncs).Option("missingkey=error").Parse(src)
+		if err != nil {
+			return nil, fmt.Errorf("--address-template for %s: %w", country, err)
+		}
+		if err := tmpl.Execute(&bytes.Buffer{}, Address{}); err != nil {
+			return nil, fmt.Errorf("--address-template for %s: %w", country, err)
+		}
+		templates[country] = tmpl
+	}
+	return templates, nil
+}
+
+// formatWithTemplate formats an address with the template for its country, or
+// the default template. ok is false when no template applies.
+func formatWithTemplate(templates map[string]*template.Template, addr Address) (string, bool, error) {
+	tmpl := templates[strings.ToLower(addr.CountryCode)]
+	if tmpl == nil {
+		tmpl = templates[defaultTemplateCountry]
+	}
+	if tmpl == nil {
+		return "", false, nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, addr); err != nil {
+		return "", false, err
+	}
+	return tidyAddress(buf.String()), true, nil
+}
+
+// tidyAddress cleans up what empty fields leave behind in a template: runs of
+// spaces and empty comma-separated parts such as "12 , , Bangkok"
+func tidyAddress(s string) string {
+	parts := strings.Split(s, ",")
+	kept := parts[:0]
+	for _, part := range parts {
+		if part = strings.Join(strings.Fields(part), " "); part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
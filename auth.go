@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// apiKey is a client of the servers, from the --api-keys file; a zero limit
+// means no limit
+type apiKey struct {
+	Name              string `yaml:"name"`
+	Key               string `yaml:"key"`
+	RequestsPerMinute int    `yaml:"requests_per_minute"` // API calls
+	RowsPerDay        int    `yaml:"rows_per_day"`        // rows geocoded per UTC day
+	MaxJobs           int    `yaml:"max_jobs"`            // jobs queued or running at once
+}
+
+// apiClient tracks the usage of an API key; counts are kept in memory and
+// start over when the server restarts
+type apiClient struct {
+	apiKey
+	mu       sync.Mutex
+	tokens   float64   // requests that can be made right away
+	refilled time.Time // when tokens was last topped up
+	day      string    // UTC date rows counts for
+	rows     int
+	jobs     int
+}
+
+// clientUsage is what GET /usage reports
+type clientUsage struct {
+	Name              string `json:"name"`
+	RequestsPerMinute int    `json:"requests_per_minute,omitempty"`
+	RowsPerDay        int    `json:"rows_per_day,omitempty"`
+	RowsToday         int    `json:"rows_today"`
+	MaxJobs           int    `json:"max_jobs,omitempty"`
+	Jobs              int    `json:"jobs"`
+}
+
+// apiClients are the clients of the --api-keys file by the SHA-256 of their
+// key, so looking up a key doesn't compare it byte by byte
+type apiClients map[[sha256.Size]byte]*apiClient
+
+// loadAPIKeys reads an --api-keys file: a list of keys with their limits
+func loadAPIKeys(path string) (apiClients, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("--api-keys: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var keys []apiKey
+	if err := dec.Decode(&keys); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("--api-keys %s: %w", path, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("--api-keys %s: no keys", path)
+	}
+	clients := make(apiClients, len(keys))
+	names := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("--api-keys %s: key %d has no name", path, i+1)
+		}
+		if len(k.Key) < 16 {
+			return nil, fmt.Errorf("--api-keys %s: the key of %s must be at least 16 characters", path, k.Name)
+		}
+		if k.RequestsPerMinute < 0 || k.RowsPerDay < 0 || k.MaxJobs < 0 {
+			return nil, fmt.Errorf("--api-keys %s: negative limit for %s", path, k.Name)
+		}
+		sum := sha256.Sum256([]byte(k.Key))
+		if names[k.Name] || clients[sum] != nil {
+			return nil, fmt.Errorf("--api-keys %s: %s is listed twice", path, k.Name)
+		}
+		names[k.Name] = true
+		clients[sum] = &apiClient{apiKey: k, tokens: float64(k.RequestsPerMinute)}
+	}
+	return clients, nil
+}
+
+// lookup returns the client with the given key, or nil
+func (c apiClients) lookup(key string) *apiClient {
+	if key == "" {
+		return nil
+	}
+	return c[sha256.Sum256([]byte(key))]
+}
+
+// requestKey returns the API key of a request: "Authorization: Bearer KEY",
+// an X-API-Key header, or an api_key query parameter for links and
+// EventSource, which can't set headers
+func requestKey(r *http.Request) string {
+	if scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(key)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// allow takes a request from the client's rate limit. The limit lets a
+// minute's worth of requests through at once and refills continuously;
+// when it is used up, allow returns how long to wait.
+func (c *apiClient) allow(now time.Time) time.Duration {
+	if c == nil || c.RequestsPerMinute == 0 {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	perSecond := float64(c.RequestsPerMinute) / 60
+	if !c.refilled.IsZero() {
+		c.tokens = math.Min(float64(c.RequestsPerMinute), c.tokens+now.Sub(c.refilled).Seconds()*perSecond)
+	}
+	c.refilled = now
+	if c.tokens < 1 {
+		return time.Duration((1 - c.tokens) / perSecond * float64(time.Second))
+	}
+	c.tokens--
+	return 0
+}
+
+// resetDay starts a new row count at midnight UTC; c.mu must be held
+func (c *apiClient) resetDay(now time.Time) {
+	if day := now.UTC().Format("2006-01-02"); day != c.day {
+		c.day, c.rows = day, 0
+	}
+}
+
+// quotaError describes a used-up daily quota
+func (c *apiClient) quotaError() error {
+	return fmt.Errorf("%s has used its %d rows for today; the quota resets at 00:00 UTC", c.Name, c.RowsPerDay)
+}
+
+// takeRows counts n rows against the daily quota, or fails without counting
+// them if they don't fit
+func (c *apiClient) takeRows(n int) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetDay(time.Now())
+	if c.RowsPerDay > 0 && c.rows+n > c.RowsPerDay {
+		return c.quotaError()
+	}
+	c.rows += n
+	return nil
+}
+
+// startJob counts a submitted job, failing if the client has as many jobs
+// as it may or no rows left for today
+func (c *apiClient) startJob() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetDay(time.Now())
+	if c.RowsPerDay > 0 && c.rows >= c.RowsPerDay {
+		return c.quotaError()
+	}
+	if c.MaxJobs > 0 && c.jobs >= c.MaxJobs {
+		return fmt.Errorf("%s already has %d jobs queued or running; wait for one to finish", c.Name, c.jobs)
+	}
+	c.jobs++
+	return nil
+}
+
+// endJob releases a job counted by startJob
+func (c *apiClient) endJob() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.jobs--
+	c.mu.Unlock()
+}
+
+func (c *apiClient) usage() clientUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetDay(time.Now())
+	return clientUsage{
+		Name:              c.Name,
+		RequestsPerMinute: c.RequestsPerMinute,
+		RowsPerDay:        c.RowsPerDay,
+		RowsToday:         c.rows,
+		MaxJobs:           c.MaxJobs,
+		Jobs:              c.jobs,
+	}
+}
+
+// clientContextKey keys the *apiClient of a request's context
+type clientContextKey struct{}
+
+// withClient returns a context carrying the client a request came from
+func withClient(ctx context.Context, c *apiClient) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, c)
+}
+
+// clientFrom returns the client of a request, or nil without --api-keys
+func clientFrom(ctx context.Context) *apiClient {
+	c, _ := ctx.Value(clientContextKey{}).(*apiClient)
+	return c
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// azureAPIVersion is the Blob service REST version requests are made with
+const azureAPIVersion = "2021-08-06"
+
+// azureStore talks to Azure Blob Storage; az://container/blob paths name a
+// blob in the account of AZURE_STORAGE_ACCOUNT, or of
+// AZURE_STORAGE_CONNECTION_STRING. Requests are signed with the account key,
+// or carry AZURE_STORAGE_SAS_TOKEN.
+type azureStore struct {
+	client   *http.Client
+	account  string
+	key      []byte // account key, nil when a SAS token is used
+	sas      string
+	endpoint string
+}
+
+func newAzureStore(client *http.Client) (*azureStore, error) {
+	a := &azureStore{
+		client:  client,
+		account: os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		sas:     strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"),
+	}
+	accountKey := os.Getenv("AZURE_STORAGE_KEY")
+	if conn := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); conn != "" {
+		for _, field := range strings.Split(conn, ";") {
+			name, value, _ := strings.Cut(field, "=")
+			switch name {
+			case "AccountName":
+				a.account = value
+			case "AccountKey":
+				accountKey = value
+			case "SharedAccessSignature":
+				a.sas = strings.TrimPrefix(value, "?")
+			case "BlobEndpoint":
+				a.endpoint = strings.TrimSuffix(value, "/")
+			}
+		}
+	}
+	if a.account == "" && a.endpoint == "" {
+		return nil, fmt.Errorf("no Azure storage account; set AZURE_STORAGE_ACCOUNT or AZURE_STORAGE_CONNECTION_STRING")
+	}
+	if a.endpoint == "" {
+		a.endpoint = "https://" + a.account + ".blob.core.windows.net"
+	}
+	if accountKey != "" && a.sas == "" {
+		key, err := base64.StdEncoding.DecodeString(accountKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure storage account key: %w", err)
+		}
+		a.key = key
+	}
+	if a.key == nil && a.sas == "" {
+		return nil, fmt.Errorf("no Azure credentials; set AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN")
+	}
+	return a, nil
+}
+
+// blobURL returns the URL of a blob with the given query
+func (a *azureStore) blobURL(container, blob string, query url.Values) string {
+	u := a.endpoint + "/" + url.PathEscape(container) + "/" + awsEscape(blob, false)
+	q := query.Encode()
+	if a.sas != "" {
+		if q != "" {
+			q += "&"
+		}
+		q += a.sas
+	}
+	if q != "" {
+		u += "?" + q
+	}
+	return u
+}
+
+// request builds a request, signed with the account key unless a SAS token is used
+func (a *azureStore) request(method, rawURL string, body []byte, header http.Header) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, r)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	if a.key != nil {
+		a.sign(req, len(body))
+	}
+	return req, nil
+}
+
+// sign adds the Shared Key Authorization header
+func (a *azureStore) sign(req *http.Request, contentLength int) {
+	length := ""
+	if contentLength > 0 {
+		length = fmt.Sprint(contentLength)
+	}
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(req.Header.Get(name)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + a.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date; x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+a.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// send makes a request and returns a successful response
+func (a *azureStore) send(method, rawURL string, body []byte, header http.Header) (*http.Response, error) {
+	resp, err := sendObjectRequest(a.client, func() (*http.Request, error) {
+		return a.request(method, rawURL, body, header)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, objectResponseError(resp.Request, resp)
+	}
+	return resp, nil
+}
+
+func (a *azureStore) get(container, blob string, w io.Writer) error {
+	resp, err := a.send("GET", a.blobURL(container, blob, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (a *azureStore) put(container, blob string, f *os.File, size int64) error {
+	if size <= objectChunkSize {
+		body, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		resp, err := a.send("PUT", a.blobURL(container, blob, nil), body, http.Header{"X-Ms-Blob-Type": {"BlockBlob"}})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// Large files are staged as blocks and committed together; blocks that
+	// are never committed are discarded by the service after a week
+	var blockIDs []string
+	buf := make([]byte, objectChunkSize)
+	for offset := int64(0); offset < size; offset += objectChunkSize {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(blockIDs))))
+		query := url.Values{"comp": {"block"}, "blockid": {id}}
+		resp, err := a.send("PUT", a.blobURL(container, blob, query), buf[:n], nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		blockIDs = append(blockIDs, id)
+		fmt.Printf("  uploaded %s of %s\n", formatBytes(offset+int64(n)), formatBytes(size))
+	}
+	list, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: blockIDs})
+	if err != nil {
+		return err
+	}
+	resp, err := a.send("PUT", a.blobURL(container, blob, url.Values{"comp": {"blocklist"}}), list, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
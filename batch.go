@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// batchWait is how long the first lookup of a batch waits for others to
+// fill it before the batch is sent anyway
+const batchWait = 100 * time.Millisecond
+
+// batchPollInterval and batchPollTimeout pace the polling of providers that
+// answer batches asynchronously
+const (
+	batchPollInterval = time.Second
+	batchPollTimeout  = 10 * time.Minute
+)
+
+// batchGeocoder is a Geocoder whose API also looks up many coordinates in
+// one request, used with --request-batch
+type batchGeocoder interface {
+	Geocoder
+	// maxBatch is the most coordinates the API takes per request
+	maxBatch() int
+	// batchEndpoint is --batch-endpoint, or the API's batch URL next to
+	// the reverse endpoint
+	batchEndpoint() string
+	batchRequest(points []Coordinates) (*http.Request, error)
+	// splitBatch returns the answers of a batch response in the order of the
+	// request, or the request to poll while the provider is still working
+	splitBatch(body []byte) (parts []json.RawMessage, poll *http.Request, err error)
+	// parseBatchPart maps the answer for one coordinate, like parse
+	parseBatchPart(part json.RawMessage) (GeocodeResponse, error)
+}
+
+// geocodeBatcher gathers the lookups of concurrent workers into batch
+// requests of up to --request-batch coordinates. A batch is sent when it is
+// full or batchWait after its first lookup; up to workers/size batches are in
+// flight, with the request delay between them.
+type geocodeBatcher struct {
+	svc   *Service
+	size  int
+	queue chan batchLookup
+	slots chan struct{}
+	start sync.Once
+}
+
+// batchLookup is a coordinate waiting for its batch
+type batchLookup struct {
+	coords Coordinates
+	done   chan batchAnswer
+}
+
+type batchAnswer struct {
+	result geocodeResult
+	err    error
+}
+
+// newGeocodeBatcher returns the batcher of a provider, or nil when its
+// lookups are made one at a time
+func newGeocodeBatcher(s *Service) *geocodeBatcher {
+	if s.cfg.RequestBatch <= 1 {
+		return nil
+	}
+	if _, ok := s.cfg.geocoder.(batchGeocoder); !ok {
+		return nil
+	}
+	inFlight := s.cfg.Workers / s.cfg.RequestBatch
+	if inFlight < 1 {
+		inFlight = 1
+	}
+	return &geocodeBatcher{
+		svc:   s,
+		size:  s.cfg.RequestBatch,
+		queue: make(chan batchLookup),
+		slots: make(chan struct{}, inFlight),
+	}
+}
+
+// geocode looks up a coordinate as part of the next batch
+func (b *geocodeBatcher) geocode(coords Coordinates) (geocodeResult, error) {
+	b.start.Do(func() { go b.run() })
+	l := batchLookup{coords: coords, done: make(chan batchAnswer, 1)}
+	b.queue <- l
+	answer := <-l.done
+	return answer.result, answer.err
+}
+
+func (b *geocodeBatcher) run() {
+	for first := range b.queue {
+		batch := []batchLookup{first}
+		timer := time.NewTimer(batchWait)
+	fill:
+		for len(batch) < b.size {
+			select {
+			case l := <-b.queue:
+				batch = append(batch, l)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+
+		b.slots <- struct{}{}
+		go func() {
+			defer func() { <-b.slots }()
+			b.send(batch)
+		}()
+		time.Sleep(b.svc.cfg.RequestDelay)
+	}
+}
+
+// send looks up a batch and hands each lookup its answer. Every coordinate
+// counts as one request against --max-requests and --daily-budget, as
+// providers bill batches per coordinate.
+func (b *geocodeBatcher) send(batch []batchLookup) {
+	var points []Coordinates
+	var waiting []batchLookup
+	for _, l := range batch {
+		if !b.svc.spendRequest() {
+			l.done <- batchAnswer{err: errBudgetSpent}
+			continue
+		}
+		points = append(points, l.coords)
+		waiting = append(waiting, l)
+	}
+	if len(points) == 0 {
+		return
+	}
+	results, errs, err := b.svc.reverseGeocodeBatch(points)
+	for i, l := range waiting {
+		if err != nil {
+			l.done <- batchAnswer{err: err}
+			continue
+		}
+		l.done <- batchAnswer{result: results[i], err: errs[i]}
+	}
+}
+
+// reverseGeocodeBatch looks up points in one batch request, with the
+// retries of reverseGeocode. The error is for the whole batch; otherwise
+// results[i] or errs[i] is the answer for points[i].
+func (s *Service) reverseGeocodeBatch(points []Coordinates) ([]geocodeResult, []error, error) {
+	g := s.cfg.geocoder.(batchGeocoder)
+	maxRetries := s.cfg.Retries
+	var lastErr error
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(s.cfg.RetryDelay * time.Duration(1<<uint(attempt-1)))
+		}
+		parts, err := s.sendBatch(g, points)
+		if errors.Is(err, errRateLimited) {
+			time.Sleep(time.Duration(attempt+1) * s.cfg.RateLimitWait)
+			lastErr = fmt.Errorf("API rate limit exceeded after %d retries", maxRetries)
+			continue
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			return nil, nil, err
+		}
+		if err != nil {
+			lastErr = err
+			continue // Retry on network, server and decode errors
+		}
+
+		results := make([]geocodeResult, len(points))
+		errs := make([]error, len(points))
+		for i, part := range parts {
+			p := points[i]
+			s.rawResponses.add(p.Lat, p.Lng, g.batchEndpoint(), http.StatusOK, part)
+			resp, err := g.parseBatchPart(part)
+			if err == nil {
+				results[i], err = s.geocodeResultFrom(p.Lat, p.Lng, resp, attempt+1)
+			}
+			errs[i] = err
+		}
+		return results, errs, nil
+	}
+	return nil, nil, lastErr
+}
+
+// sendBatch makes a batch request and polls for the answers until they are
+// ready
+func (s *Service) sendBatch(g batchGeocoder, points []Coordinates) ([]json.RawMessage, error) {
+	req, err := g.batchRequest(points)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	deadline := time.Now().Add(batchPollTimeout)
+	for {
+		req.Header.Set("User-Agent", s.cfg.UserAgent)
+		for name, value := range s.cfg.Headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, s.redactKey(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return nil, errRateLimited
+		case resp.StatusCode >= 500:
+			return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted:
+			return nil, permanentError{fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))}
+		}
+
+		parts, poll, err := g.splitBatch(body)
+		if err != nil {
+			return nil, err
+		}
+		if poll == nil {
+			if len(parts) != len(points) {
+				return nil, fmt.Errorf("batch answer has %d results for %d coordinates", len(parts), len(points))
+			}
+			return parts, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("batch answer not ready after %s", batchPollTimeout)
+		}
+		time.Sleep(batchPollInterval)
+		req = poll
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import "time"
+
+const (
+	initialBatchSize = 1000
+	minBatchSize     = 100
+	maxBatchSize     = 50000
+)
+
+// batchSizer adapts the batch size to measured throughput so that progress is
+// checkpointed roughly once per interval of work, while the time spent saving
+// checkpoints stays below maxOverhead of the total run time
+type batchSizer struct {
+	interval    time.Duration
+	maxOverhead float64
+	fixed       int
+
+	size       int
+	rowsPerSec float64
+	saveCost   time.Duration
+}
+
+func newBatchSizer(cfg *Config) *batchSizer {
+	size := initialBatchSize
+	if cfg.BatchSize > 0 {
+		size = cfg.BatchSize
+	}
+	return &batchSizer{
+		interval:    cfg.CheckpointInterval,
+		maxOverhead: cfg.CheckpointOverhead,
+		fixed:       cfg.BatchSize,
+		size:        size,
+	}
+}
+
+// observeBatch records how long a batch of rows took to process
+func (b *batchSizer) observeBatch(rows int, elapsed time.Duration) {
+	if rows == 0 || elapsed <= 0 {
+		return
+	}
+	rate := float64(rows) / elapsed.Seconds()
+	if b.rowsPerSec == 0 {
+		b.rowsPerSec = rate
+	} else {
+		// Smooth out batches that were mostly cache hits or mostly retries
+		b.rowsPerSec = 0.5*b.rowsPerSec + 0.5*rate
+	}
+}
+
+// observeSave records how long a checkpoint save took
+func (b *batchSizer) observeSave(elapsed time.Duration) {
+	b.saveCost = elapsed
+}
+
+// next returns the size of the next batch
+func (b *batchSizer) next() int {
+	if b.fixed > 0 || b.rowsPerSec == 0 {
+		return b.size
+	}
+
+	// Checkpoint once per interval, unless saving is so expensive that doing
+	// so would exceed the overhead budget
+	target := b.interval
+	if b.maxOverhead > 0 {
+		if minInterval := time.Duration(float64(b.saveCost) / b.maxOverhead); minInterval > target {
+			target = minInterval
+		}
+	}
+
+	size := int(b.rowsPerSec * target.Seconds())
+	// Grow or shrink gradually so one unusual batch doesn't swing the size
+	if size > b.size*4 {
+		size = b.size * 4
+	}
+	if size < b.size/4 {
+		size = b.size / 4
+	}
+	if size < minBatchSize {
+		size = minBatchSize
+	}
+	if size > maxBatchSize {
+		size = maxBatchSize
+	}
+	b.size = size
+	return size
+}
+
+// shouldCheckpoint reports whether progress should be saved with the given
+// number of rows still to process. Saving is skipped when the remaining work
+// is expected to finish faster than the save itself would take.
+func (b *batchSizer) shouldCheckpoint(remaining int) bool {
+	if remaining <= 0 {
+		return false
+	}
+	if b.rowsPerSec == 0 || b.saveCost == 0 {
+		return true
+	}
+	remainingTime := time.Duration(float64(remaining) / b.rowsPerSec * float64(time.Second))
+	return remainingTime > b.saveCost
+}
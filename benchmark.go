@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultBenchmarkSample is how many coordinates are looked up per provider
+// when the spec doesn't say
+const defaultBenchmarkSample = 100
+
+// benchmarkSpec is a provider comparison run by `latlg-address benchmark
+// spec.yaml`:
+//
+//	name: provider-choice
+//	input:
+//	  file: data/sites.xlsx
+//	sample: 200
+//	providers:
+//	  - name: locationiq
+//	    options: {preset: locationiq-free}
+//	    cost_per_1000: 0.5
+//	  - name: self-hosted
+//	    options: {preset: nominatim-selfhosted, endpoint: "http://nominatim.internal/reverse"}
+//	    cost_per_1000: 0.02
+type benchmarkSpec struct {
+	Name   string        `yaml:"name"`
+	Input  pipelineInput `yaml:"input"`
+	Sample int           `yaml:"sample"` // coordinates looked up per provider
+	Seed   int64         `yaml:"seed"`   // picks the sample; the same seed picks the same rows
+	// Report is the workbook the comparison is written to; default
+	// data/<name>_benchmark.xlsx
+	Report    string              `yaml:"report"`
+	Providers []benchmarkProvider `yaml:"providers"`
+}
+
+// benchmarkProvider is a provider to compare: command line options without
+// the leading dashes, and what it charges
+type benchmarkProvider struct {
+	Name        string                 `yaml:"name"`
+	Options     map[string]interface{} `yaml:"options"`
+	CostPer1000 float64                `yaml:"cost_per_1000"` // per 1,000 requests, in any currency
+}
+
+// benchmarkLookup is one provider's answer for a sample coordinate
+type benchmarkLookup struct {
+	result  geocodeResult
+	err     error
+	latency time.Duration
+}
+
+// benchmarkStats summarizes the lookups of one provider
+type benchmarkStats struct {
+	name              string
+	endpoint          string
+	asked             int // lookups made; fewer than the sample if a budget ran out
+	failed            int
+	median, p95       time.Duration
+	districtAgreement float64 // % of comparisons with the other providers that matched; NaN without any
+	provinceAgreement float64
+	requests          int64 // requests sent, retries included
+	costPer1000       float64
+	sampleCost        float64
+	projectedCost     float64 // for every row of the input
+	requestsPerLookup float64
+}
+
+// loadBenchmark reads and checks a benchmark file
+func loadBenchmark(path string) (*benchmarkSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var spec benchmarkSpec
+	if err := dec.Decode(&spec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if spec.Input.File == "" {
+		return nil, fmt.Errorf("%s: input.file is required", path)
+	}
+	if (spec.Input.Latitude == "") != (spec.Input.Longitude == "") {
+		return nil, fmt.Errorf("%s: input.latitude and input.longitude must be given together", path)
+	}
+	if len(spec.Providers) == 0 {
+		return nil, fmt.Errorf("%s: no providers", path)
+	}
+	names := make(map[string]bool, len(spec.Providers))
+	for i, p := range spec.Providers {
+		if p.Name == "" {
+			return nil, fmt.Errorf("%s: provider %d has no name", path, i+1)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("%s: provider %s is listed twice", path, p.Name)
+		}
+		if p.CostPer1000 < 0 {
+			return nil, fmt.Errorf("%s: provider %s has a negative cost", path, p.Name)
+		}
+		names[p.Name] = true
+	}
+	if spec.Sample < 0 {
+		return nil, fmt.Errorf("%s: sample must not be negative", path)
+	}
+	if spec.Sample == 0 {
+		spec.Sample = defaultBenchmarkSample
+	}
+	if spec.Seed == 0 {
+		spec.Seed = 1
+	}
+	if spec.Name == "" {
+		spec.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if spec.Report == "" {
+		spec.Report = filepath.Join("data", spec.Name+"_benchmark.xlsx")
+	}
+	return &spec, nil
+}
+
+// runBenchmark looks up the same sample of coordinates with every provider
+// of the benchmark file given on the command line and compares latency,
+// failures, agreement on district and province, and cost. The cache is not
+// used, so every lookup reaches the provider. Provider options override the
+// command line.
+func runBenchmark(cfg *Config) error {
+	spec, err := loadBenchmark(cfg.InputFile)
+	if err != nil {
+		return err
+	}
+	p := &pipeline{cfg: cfg, spec: &pipelineSpec{Input: spec.Input}}
+	if err := p.load(); err != nil {
+		return err
+	}
+
+	services := make([]*Service, len(spec.Providers))
+	for i, provider := range spec.Providers {
+		pcfg, err := parseConfig(append(append([]string{}, cfg.args...), optionArgs(provider.Options)...))
+		if err != nil {
+			return fmt.Errorf("provider %s: %w", provider.Name, err)
+		}
+		services[i] = NewService(nil, pcfg)
+	}
+
+	points := benchmarkSample(services[0], p, spec.Sample, spec.Seed)
+	if len(points) == 0 {
+		return fmt.Errorf("%s has no valid coordinates", spec.Input.File)
+	}
+	fmt.Printf("Benchmark %s: %d of %d rows from %s, %d providers\n", spec.Name, len(points), len(p.rows), spec.Input.File, len(services))
+
+	lookups := make([][]benchmarkLookup, len(services))
+	for i, svc := range services {
+		fmt.Printf("Querying %s (%s)...\n", spec.Providers[i].Name, svc.cfg.Endpoint)
+		start := time.Now()
+		lookups[i] = svc.benchmark(points)
+		svc.saveBudgets()
+		if svc.outOfBudget.Load() {
+			fmt.Printf("Warning: %s %s; the remaining coordinates were not looked up\n", spec.Providers[i].Name, svc.failures.reason)
+		}
+		fmt.Printf("  done in %s\n", time.Since(start).Round(time.Millisecond))
+	}
+
+	stats := benchmarkStatistics(spec, services, lookups, len(p.rows))
+	printBenchmark(os.Stdout, stats, len(p.rows))
+	if err := os.MkdirAll(filepath.Dir(spec.Report), 0755); err != nil {
+		return err
+	}
+	err = writeFileAtomic(spec.Report, func(w io.Writer) error {
+		return writeBenchmarkReport(w, spec, stats, points, lookups, len(p.rows))
+	})
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", spec.Report, err)
+	}
+	fmt.Printf("✓ Report saved to: %s\n", spec.Report)
+	return nil
+}
+
+// benchmarkSample picks up to n rows with valid coordinates at random
+func benchmarkSample(s *Service, p *pipeline, n int, seed int64) []Coordinates {
+	order := rand.New(rand.NewSource(seed)).Perm(len(p.rows))
+	var points []Coordinates
+	for _, i := range order {
+		if len(points) == n {
+			break
+		}
+		text := strings.TrimSpace(p.coords(p.rows[i]))
+		if text == "" {
+			continue
+		}
+		if c, err := s.parseCoordinates(text); err == nil {
+			points = append(points, c)
+		}
+	}
+	return points
+}
+
+// benchmark looks up every point with the provider's workers and request
+// delay, timing each lookup without the delay
+func (s *Service) benchmark(points []Coordinates) []benchmarkLookup {
+	lookups := make([]benchmarkLookup, len(points))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < s.cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if s.failures.isAborted() {
+					lookups[i].err = errBudgetSpent
+					continue
+				}
+				time.Sleep(s.cfg.RequestDelay)
+				start := time.Now()
+				lookups[i].result, lookups[i].err = s.reverseGeocode(points[i].Lat, points[i].Lng)
+				lookups[i].latency = time.Since(start)
+			}
+		}()
+	}
+	for i := range points {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return lookups
+}
+
+// benchmarkStatistics summarizes the lookups of every provider
+func benchmarkStatistics(spec *benchmarkSpec, services []*Service, lookups [][]benchmarkLookup, totalRows int) []benchmarkStats {
+	stats := make([]benchmarkStats, len(services))
+	for i, svc := range services {
+		st := &stats[i]
+		st.name, st.endpoint = spec.Providers[i].Name, svc.cfg.Endpoint
+		st.costPer1000 = spec.Providers[i].CostPer1000
+		var latencies []time.Duration
+		for _, l := range lookups[i] {
+			if errors.Is(l.err, errBudgetSpent) {
+				continue
+			}
+			st.asked++
+			latencies = append(latencies, l.latency)
+			if l.err != nil {
+				st.failed++
+			}
+		}
+		st.median, st.p95 = percentile(latencies, 50), percentile(latencies, 95)
+		st.requests = svc.requests.Load()
+		st.sampleCost = float64(st.requests) / 1000 * st.costPer1000
+		if st.asked > 0 {
+			st.requestsPerLookup = float64(st.requests) / float64(st.asked)
+			st.projectedCost = st.requestsPerLookup * float64(totalRows) / 1000 * st.costPer1000
+		}
+		st.districtAgreement = agreement(lookups, i, func(r geocodeResult) string { return r.district })
+		st.provinceAgreement = agreement(lookups, i, func(r geocodeResult) string { return r.province })
+	}
+	return stats
+}
+
+// percentile returns the p-th percentile of durations, or 0 for none
+func percentile(durations []time.Duration, p int) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// agreement returns how often, in percent, provider i gave the same value as
+// each other provider for the points both answered with a value. Case and
+// spacing are ignored. It is NaN when there was nothing to compare.
+func agreement(lookups [][]benchmarkLookup, i int, value func(geocodeResult) string) float64 {
+	compared, matched := 0, 0
+	for point := range lookups[i] {
+		mine := comparableValue(lookups[i][point], value)
+		if mine == "" {
+			continue
+		}
+		for j := range lookups {
+			if j == i {
+				continue
+			}
+			if theirs := comparableValue(lookups[j][point], value); theirs != "" {
+				compared++
+				if theirs == mine {
+					matched++
+				}
+			}
+		}
+	}
+	if compared == 0 {
+		return math.NaN()
+	}
+	return float64(matched) / float64(compared) * 100
+}
+
+// comparableValue returns a lookup's value in lower case with single spaces, or
+// "" if the lookup failed
+func comparableValue(l benchmarkLookup, value func(geocodeResult) string) string {
+	if l.err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.Join(strings.Fields(value(l.result)), " "))
+}
+
+// formatPercent formats a percentage, or "-" for NaN
+func formatPercent(v float64) string {
+	if math.IsNaN(v) {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", v)
+}
+
+// printBenchmark prints the comparison as a table
+func printBenchmark(w io.Writer, stats []benchmarkStats, totalRows int) {
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Provider\tLookups\tFailed\tMedian\tp95\tDistrict agree\tProvince agree\tRequests\tCost\tCost for %d rows\t\n", totalRows)
+	for _, st := range stats {
+		failed := "-"
+		if st.asked > 0 {
+			failed = fmt.Sprintf("%.1f%%", float64(st.failed)/float64(st.asked)*100)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%d\t%.2f\t%.2f\t\n", st.name, st.asked, failed,
+			st.median.Round(time.Millisecond), st.p95.Round(time.Millisecond),
+			formatPercent(st.districtAgreement), formatPercent(st.provinceAgreement),
+			st.requests, st.sampleCost, st.projectedCost)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// writeBenchmarkReport writes a workbook with a Summary sheet and a Points
+// sheet holding every provider's district and province for each coordinate,
+// to look into where they disagree
+func writeBenchmarkReport(w io.Writer, spec *benchmarkSpec, stats []benchmarkStats, points []Coordinates, lookups [][]benchmarkLookup, totalRows int) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	summary := "Summary"
+	if err := f.SetSheetName(f.GetSheetName(0), summary); err != nil {
+		return err
+	}
+	rows := [][]interface{}{{
+		"Provider", "Endpoint", "Lookups", "Failed", "Failure Rate %", "Median Latency ms", "P95 Latency ms",
+		"District Agreement %", "Province Agreement %", "Requests", "Requests per Lookup", "Cost per 1000",
+		"Sample Cost", fmt.Sprintf("Estimated Cost for %d Rows", totalRows),
+	}}
+	for _, st := range stats {
+		rate := 0.0
+		if st.asked > 0 {
+			rate = round1(float64(st.failed) / float64(st.asked) * 100)
+		}
+		rows = append(rows, []interface{}{
+			st.name, st.endpoint, st.asked, st.failed, rate, st.median.Milliseconds(), st.p95.Milliseconds(),
+			reportPercent(st.districtAgreement), reportPercent(st.provinceAgreement), st.requests,
+			round1(st.requestsPerLookup), st.costPer1000, st.sampleCost, st.projectedCost,
+		})
+	}
+	if err := setSheetRows(f, summary, rows); err != nil {
+		return err
+	}
+
+	pointsSheet := "Points"
+	if _, err := f.NewSheet(pointsSheet); err != nil {
+		return err
+	}
+	header := []interface{}{"Latitude", "Longitude"}
+	for _, p := range spec.Providers {
+		header = append(header, p.Name+" District", p.Name+" Province", p.Name+" ms")
+	}
+	rows = [][]interface{}{header}
+	for i, c := range points {
+		row := []interface{}{c.Lat, c.Lng}
+		for j := range lookups {
+			l := lookups[j][i]
+			switch {
+			case errors.Is(l.err, errBudgetSpent):
+				row = append(row, "", "", "")
+			case l.err != nil:
+				row = append(row, "error: "+l.err.Error(), "", l.latency.Milliseconds())
+			default:
+				row = append(row, l.result.district, l.result.province, l.latency.Milliseconds())
+			}
+		}
+		rows = append(rows, row)
+	}
+	if err := setSheetRows(f, pointsSheet, rows); err != nil {
+		return err
+	}
+	return f.Write(w)
+}
+
+// setSheetRows writes rows to a sheet from A1
+func setSheetRows(f *excelize.File, sheet string, rows [][]interface{}) error {
+	for i, row := range rows {
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := f.SetSheetRow(sheet, cell, &row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// reportPercent returns a percentage for the report; NaN leaves the cell empty
+func reportPercent(v float64) interface{} {
+	if math.IsNaN(v) {
+		return ""
+	}
+	return round1(v)
+}
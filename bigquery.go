@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBigQueryEndpoint is the root of the BigQuery REST API
+const defaultBigQueryEndpoint = "https://bigquery.googleapis.com/bigquery/v2"
+
+// bigQueryScope is the OAuth scope needed to run queries and insert rows
+const bigQueryScope = "https://www.googleapis.com/auth/bigquery"
+
+// maxBigQueryInsert is the number of rows per insertAll request, well below
+// the 10 MB request limit for typical rows
+const maxBigQueryInsert = 500
+
+// bqField is a column of a BigQuery table schema
+type bqField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode,omitempty"`
+}
+
+// bqQueryResponse is a page of query results, from jobs.query or jobs.getQueryResults
+type bqQueryResponse struct {
+	JobComplete  bool `json:"jobComplete"`
+	JobReference struct {
+		ProjectID string `json:"projectId"`
+		JobID     string `json:"jobId"`
+		Location  string `json:"location"`
+	} `json:"jobReference"`
+	Schema *struct {
+		Fields []bqField `json:"fields"`
+	} `json:"schema"`
+	TotalRows string `json:"totalRows"`
+	PageToken string `json:"pageToken"`
+	Rows      []struct {
+		F []struct {
+			V interface{} `json:"v"`
+		} `json:"f"`
+	} `json:"rows"`
+}
+
+// bqTableRef is a project.dataset.table name
+type bqTableRef struct {
+	ProjectID string `json:"projectId"`
+	DatasetID string `json:"datasetId"`
+	TableID   string `json:"tableId"`
+}
+
+// parseTableRef reads "project.dataset.table" or "dataset.table"
+func parseTableRef(name, defaultProject string) (bqTableRef, error) {
+	parts := strings.Split(strings.Trim(name, "`"), ".")
+	switch len(parts) {
+	case 2:
+		return bqTableRef{defaultProject, parts[0], parts[1]}, nil
+	case 3:
+		return bqTableRef{parts[0], parts[1], parts[2]}, nil
+	}
+	return bqTableRef{}, fmt.Errorf("invalid table %q (expected project.dataset.table or dataset.table)", name)
+}
+
+func (t bqTableRef) String() string {
+	return t.ProjectID + "." + t.DatasetID + "." + t.TableID
+}
+
+// bigQuery is a client of the BigQuery REST API
+type bigQuery struct {
+	cfg      *Config
+	client   *http.Client
+	token    *gcpToken // nil against an emulator without credentials
+	endpoint string
+	project  string
+}
+
+// newBigQuery connects with the credentials found by newGCPToken
+func newBigQuery(cfg *Config, client *http.Client) (*bigQuery, error) {
+	bq := &bigQuery{cfg: cfg, client: client, endpoint: strings.TrimSuffix(cfg.BQEndpoint, "/"), project: cfg.BQProject}
+	token, project, err := newGCPToken(client, cfg.BQCredentials, bigQueryScope)
+	switch {
+	case err == nil:
+		bq.token = token
+		if bq.project == "" {
+			bq.project = project
+		}
+	case errors.Is(err, errNoGCPCredentials) && cfg.BQEndpoint != defaultBigQueryEndpoint:
+		// Emulators accept requests without a token
+	default:
+		return nil, err
+	}
+	if bq.project == "" {
+		return nil, fmt.Errorf("--bq-project is required; the credentials don't name a project")
+	}
+	return bq, nil
+}
+
+// call sends a request to the API and decodes the response into out. Rate
+// limits and server errors are retried like geocoding requests.
+func (bq *bigQuery) call(method, path string, in, out interface{}) (int, error) {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return 0, err
+		}
+	}
+	maxRetries := bq.cfg.Retries
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
+	var lastErr error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(bq.cfg.RetryDelay * time.Duration(1<<uint(attempt-1)))
+		}
+		req, err := http.NewRequest(method, bq.endpoint+path, bytes.NewReader(payload))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", bq.cfg.UserAgent)
+		if bq.token != nil {
+			token, err := bq.token.get()
+			if err != nil {
+				return 0, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := bq.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("BigQuery returned status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+			continue
+		case resp.StatusCode == http.StatusNotFound:
+			return resp.StatusCode, fmt.Errorf("BigQuery: not found: %s", path)
+		case resp.StatusCode != http.StatusOK:
+			return resp.StatusCode, fmt.Errorf("BigQuery returned status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+		}
+		if out != nil {
+			if err := json.Unmarshal(body, out); err != nil {
+				return resp.StatusCode, fmt.Errorf("decoding BigQuery response: %w", err)
+			}
+		}
+		return resp.StatusCode, nil
+	}
+	return 0, lastErr
+}
+
+// query starts a standard SQL query and returns its first page of results
+func (bq *bigQuery) query(sql string) (*bqQueryResponse, error) {
+	var resp bqQueryResponse
+	_, err := bq.call("POST", "/projects/"+url.PathEscape(bq.project)+"/queries", map[string]interface{}{
+		"query":        sql,
+		"useLegacySql": false,
+		"maxResults":   bq.cfg.BQPageSize,
+		"timeoutMs":    10000,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.JobComplete || resp.Schema == nil {
+		return bq.page(&resp, "")
+	}
+	return &resp, nil
+}
+
+// page fetches the results of a query job from pageToken, waiting for the job to finish
+func (bq *bigQuery) page(job *bqQueryResponse, pageToken string) (*bqQueryResponse, error) {
+	params := url.Values{
+		"maxResults": {strconv.Itoa(bq.cfg.BQPageSize)},
+		"timeoutMs":  {"10000"},
+	}
+	if job.JobReference.Location != "" {
+		params.Set("location", job.JobReference.Location)
+	}
+	if pageToken != "" {
+		params.Set("pageToken", pageToken)
+	}
+	path := "/projects/" + url.PathEscape(job.JobReference.ProjectID) + "/queries/" + url.PathEscape(job.JobReference.JobID) + "?" + params.Encode()
+	for {
+		var resp bqQueryResponse
+		if _, err := bq.call("GET", path, nil, &resp); err != nil {
+			return nil, err
+		}
+		if resp.JobComplete {
+			resp.JobReference = job.JobReference
+			return &resp, nil
+		}
+	}
+}
+
+// ensureTable creates the destination table with the given schema unless it exists
+func (bq *bigQuery) ensureTable(ref bqTableRef, fields []bqField) error {
+	tablePath := "/projects/" + url.PathEscape(ref.ProjectID) + "/datasets/" + url.PathEscape(ref.DatasetID) + "/tables"
+	status, err := bq.call("GET", tablePath+"/"+url.PathEscape(ref.TableID), nil, nil)
+	if err == nil {
+		return nil
+	}
+	if status != http.StatusNotFound {
+		return err
+	}
+	_, err = bq.call("POST", tablePath, map[string]interface{}{
+		"tableReference": ref,
+		"schema":         map[string]interface{}{"fields": fields},
+	}, nil)
+	if err == nil {
+		fmt.Printf("Created table %s\n", ref)
+	}
+	return err
+}
+
+// insert streams rows into a table. Insert IDs make a retried request
+// idempotent, so a row is never stored twice.
+func (bq *bigQuery) insert(ref bqTableRef, ids []string, rows []map[string]interface{}) error {
+	path := "/projects/" + url.PathEscape(ref.ProjectID) + "/datasets/" + url.PathEscape(ref.DatasetID) +
+		"/tables/" + url.PathEscape(ref.TableID) + "/insertAll"
+	for start := 0; start < len(rows); start += maxBigQueryInsert {
+		end := start + maxBigQueryInsert
+		if end > len(rows) {
+			end = len(rows)
+		}
+		req := make([]map[string]interface{}, 0, end-start)
+		for i := start; i < end; i++ {
+			req = append(req, map[string]interface{}{"insertId": ids[i], "json": rows[i]})
+		}
+		var resp struct {
+			InsertErrors []struct {
+				Index  int `json:"index"`
+				Errors []struct {
+					Reason  string `json:"reason"`
+					Message string `json:"message"`
+				} `json:"errors"`
+			} `json:"insertErrors"`
+		}
+		if _, err := bq.call("POST", path, map[string]interface{}{"rows": req}, &resp); err != nil {
+			return err
+		}
+		for _, ie := range resp.InsertErrors {
+			for _, e := range ie.Errors {
+				if e.Reason != "stopped" { // rows rejected only because another row failed
+					return fmt.Errorf("inserting into %s: row %d: %s", ref, start+ie.Index+1, e.Message)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkBigQueryOptions validates the --bq-* flags of a BigQuery run
+func (c *Config) checkBigQueryOptions() error {
+	if c.BQDestination == "" {
+		return fmt.Errorf("--bq-source needs --bq-destination, the table to write the enriched rows to")
+	}
+	if c.BQPageSize < 1 {
+		return fmt.Errorf("--bq-page-size must be at least 1")
+	}
+	return nil
+}
+
+// bqSourceQuery returns --bq-source as a query; a table name selects the whole table
+func (c *Config) bqSourceQuery() string {
+	if strings.ContainsAny(strings.TrimSpace(c.BigQuery), " \t\n") {
+		return c.BigQuery
+	}
+	return "SELECT * FROM `" + strings.Trim(c.BigQuery, "`") + "`"
+}
+
+// runBigQuery reads the rows of a BigQuery query page by page, geocodes each
+// page and streams the enriched rows into the destination table, so the size
+// of the dataset is not limited by memory or by a spreadsheet
+func runBigQuery(cfg *Config) error {
+	s := NewService(nil, cfg)
+	bq, err := newBigQuery(cfg, s.client)
+	if err != nil {
+		return err
+	}
+	dest, err := parseTableRef(cfg.BQDestination, bq.project)
+	if err != nil {
+		return fmt.Errorf("--bq-destination: %w", err)
+	}
+	if err := s.warmCache(); err != nil {
+		return err
+	}
+	defer s.persistCache()
+	if err := s.openRawResponses(); err != nil {
+		return err
+	}
+	defer s.closeRawResponses()
+
+	fmt.Printf("Running query in project %s\n", bq.project)
+	page, err := bq.query(cfg.bqSourceQuery())
+	if err != nil {
+		return err
+	}
+	if page.Schema == nil {
+		return fmt.Errorf("the query returned no schema")
+	}
+	fields := page.Schema.Fields
+	header := make([]string, len(fields))
+	geography := -1
+	for i, f := range fields {
+		if f.Type == "RECORD" || f.Type == "STRUCT" || f.Mode == "REPEATED" {
+			return fmt.Errorf("column %s is a %s %s; select scalar columns only", f.Name, f.Mode, f.Type)
+		}
+		if f.Type == "GEOGRAPHY" && geography == -1 {
+			geography = i
+		}
+		header[i] = f.Name
+	}
+
+	// A GEOGRAPHY point is the coordinate; otherwise columns are found by name like in CSV input
+	in := &streamInput{header: header}
+	if geography >= 0 {
+		in.coords = func(row []string) string { return wktPointCoordinates(row[geography]) }
+	} else if in, err = s.detectStreamCoordinates(in); err != nil {
+		return err
+	}
+
+	extra := cfg.extraColumns()
+	outFields := append([]bqField{}, fields...)
+	taken := make(map[string]bool)
+	for _, f := range fields {
+		taken[strings.ToLower(f.Name)] = true
+	}
+	resultNames := []string{"address", "district", "province"}
+	for _, c := range extra {
+		resultNames = append(resultNames, c.key)
+	}
+	for _, name := range append(resultNames, "error") {
+		if taken[name] {
+			return fmt.Errorf("the query already has a column %s; rename it, the result is written there", name)
+		}
+		outFields = append(outFields, bqField{Name: name, Type: "STRING", Mode: "NULLABLE"})
+	}
+	if err := bq.ensureTable(dest, outFields); err != nil {
+		return err
+	}
+	fmt.Printf("Query returned %s rows; writing to %s\n", page.TotalRows, dest)
+
+	processed, failed := 0, 0
+	for {
+		rows := make([]map[string]interface{}, len(page.Rows))
+		ids := make([]string, len(page.Rows))
+		results := make([]rowResult, len(page.Rows))
+		inputs := make([][]string, len(page.Rows))
+		for i, r := range page.Rows {
+			inputs[i] = make([]string, len(fields))
+			rows[i] = make(map[string]interface{}, len(outFields))
+			for j, f := range fields {
+				if j >= len(r.F) || r.F[j].V == nil {
+					continue
+				}
+				v, _ := r.F[j].V.(string)
+				inputs[i][j] = v
+				rows[i][f.Name] = bqValue(f.Type, v)
+			}
+			ids[i] = fmt.Sprintf("%s-%d", page.JobReference.JobID, processed+i)
+		}
+
+		// Geocode the page with the worker pool
+		var wg sync.WaitGroup
+		next := make(chan int)
+		for w := 0; w < cfg.Workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					if s.failures.isAborted() {
+						results[i] = rowResult{rowIndex: processed + i, skipped: true, message: "skipped: run aborted"}
+						continue
+					}
+					results[i] = s.resolveRow(processed+i, in.coords(inputs[i]))
+				}
+			}()
+		}
+		for i := range page.Rows {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+
+		for i, res := range results {
+			row := rows[i]
+			if res.skipped {
+				s.failures.observe(res)
+				failed++
+				row["error"] = res.message
+				fmt.Fprintf(os.Stderr, "Row %d: %s\n", processed+i+1, res.message)
+				continue
+			}
+			row["address"], row["district"], row["province"] = res.address, res.district, res.province
+			for _, c := range extra {
+				row[c.key] = fmt.Sprint(c.value(res))
+			}
+		}
+		if err := bq.insert(dest, ids, rows); err != nil {
+			return err
+		}
+		processed += len(page.Rows)
+		fmt.Printf("Wrote %d rows (%d failed)\n", processed, failed)
+
+		if s.failures.isAborted() || page.PageToken == "" {
+			break
+		}
+		if page, err = bq.page(page, page.PageToken); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("✓ Processed %d rows (%d failed) into %s\n", processed, failed, dest)
+	s.reportElevationErrors()
+	return s.failures.err()
+}
+
+// bqValue converts a query result value for insertAll. Values come back as
+// strings, which insertAll accepts for every scalar type except TIMESTAMP,
+// returned as epoch seconds.
+func bqValue(fieldType, v string) interface{} {
+	if fieldType == "TIMESTAMP" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			return secs
+		}
+	}
+	return v
+}
+
+// wktPointCoordinates turns a GEOGRAPHY point, "POINT(104.9 11.5)", into
+// "lat,lng"; other geometries are returned as is and fail to parse
+func wktPointCoordinates(wkt string) string {
+	inner := strings.TrimSpace(wkt)
+	if !strings.HasPrefix(strings.ToUpper(inner), "POINT") {
+		return inner
+	}
+	inner = strings.TrimSpace(inner[len("POINT"):])
+	inner = strings.TrimSuffix(strings.TrimPrefix(inner, "("), ")")
+	xy := strings.Fields(inner)
+	if len(xy) != 2 {
+		return wkt
+	}
+	return xy[1] + "," + xy[0]
+}
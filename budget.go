@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// budgetFile records the requests made to each provider per UTC day for
+// --daily-budget, so the budget holds across runs
+const budgetFile = "data/request_budget.json"
+
+// budgetLease is how many requests are recorded in the budget file before
+// they are made, so a crash can't lose track of requests that were paid for
+const budgetLease = 50
+
+// errBudgetSpent is the lookup error once the run's or the day's request
+// budget is used up
+var errBudgetSpent = errors.New("request budget used up")
+
+// budgetDay is the usage of a provider on one day in the budget file
+type budgetDay struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+}
+
+// requestBudget enforces --daily-budget: at most limit geocoding requests per
+// UTC day to one provider
+type requestBudget struct {
+	mu       sync.Mutex
+	path     string
+	provider string
+	limit    int64
+	day      string // UTC date used counts for
+	used     int64  // requests made on day
+	saved    int64  // requests recorded in the file; never less than used
+	warned   bool   // the file could not be written
+	// redis counts the requests instead of the file when --redis-url is
+	// set, so every instance using the server shares the budget
+	redis *redisClient
+}
+
+// budgetKeyTTL is how long a day's count is kept in Redis
+const budgetKeyTTL = 48 * time.Hour
+
+// loadRequestBudget reads how much of the day's budget earlier runs used
+func loadRequestBudget(path, provider string, limit int) (*requestBudget, error) {
+	b := &requestBudget{path: path, provider: provider, limit: int64(limit), day: budgetToday(time.Now())}
+	days, err := readBudgetFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if d := days[provider]; d.Day == b.day {
+		b.used, b.saved = d.Requests, d.Requests
+	}
+	return b, nil
+}
+
+func budgetToday(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// readBudgetFile returns the usage recorded in a budget file by provider;
+// a missing file has none
+func readBudgetFile(path string) (map[string]budgetDay, error) {
+	days := make(map[string]budgetDay)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return days, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &days); err != nil {
+		return nil, err
+	}
+	return days, nil
+}
+
+// redisKey is the Redis counter of a day's requests to the provider
+func (b *requestBudget) redisKey(day string) string {
+	return redisKeyPrefix + "budget:" + b.provider + ":" + day
+}
+
+// take counts a request against the day's budget; it reports false without
+// counting it once the budget is used up. A new budget starts at midnight UTC.
+// With Redis the count is shared; while Redis fails, requests are counted in
+// the file as without it.
+func (b *requestBudget) take(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	if b.redis != nil {
+		if n, err := b.redis.incr(b.redisKey(budgetToday(now)), budgetKeyTTL); err == nil {
+			return n <= b.limit
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if day := budgetToday(now); day != b.day {
+		b.day, b.used, b.saved = day, 0, 0
+	}
+	if b.used >= b.limit {
+		return false
+	}
+	b.used++
+	if b.used > b.saved {
+		b.record(min(b.used-1+budgetLease, b.limit))
+	}
+	return true
+}
+
+// save records the requests actually made, releasing the unused lease
+func (b *requestBudget) save() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.record(b.used)
+}
+
+// record writes n as the day's usage; b.mu must be held
+func (b *requestBudget) record(n int64) {
+	err := os.MkdirAll(filepath.Dir(b.path), 0755)
+	if err == nil {
+		var days map[string]budgetDay
+		if days, err = readBudgetFile(b.path); err == nil {
+			days[b.provider] = budgetDay{Day: b.day, Requests: n}
+			err = writeFileAtomic(b.path, func(w io.Writer) error {
+				enc := json.NewEncoder(w)
+				enc.SetIndent("", "  ")
+				return enc.Encode(days)
+			})
+		}
+	}
+	if err != nil {
+		if !b.warned {
+			fmt.Printf("Warning: Could not record request budget in %s: %v\n", b.path, err)
+			b.warned = true
+		}
+		return
+	}
+	b.saved = n
+}
+
+// usage returns the requests made today and the daily limit
+func (b *requestBudget) usage() (used, limit int64) {
+	if b.redis != nil {
+		reply, err := b.redis.call("GET", b.redisKey(budgetToday(time.Now())))
+		if data, ok := reply.([]byte); ok && err == nil {
+			used, _ = strconv.ParseInt(string(data), 10, 64)
+		}
+		if err == nil {
+			// Requests refused once the budget was used up are counted too
+			return min(used, b.limit), b.limit
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if budgetToday(time.Now()) != b.day {
+		return 0, b.limit
+	}
+	return b.used, b.limit
+}
+
+// spendRequest takes a geocoding request from the run's --max-requests and
+// the day's --daily-budget. Once either is used up the run is stopped and
+// spendRequest reports false. A route's requests count against its run.
+func (s *Service) spendRequest() bool {
+	run := s
+	if s.owner != nil {
+		run = s.owner
+	}
+	n := run.requests.Add(1)
+	if max := int64(run.cfg.MaxRequests); max > 0 && n > max {
+		run.outOfBudget.Store(true)
+		run.failures.abort(fmt.Sprintf("stopped after using its --max-requests budget of %d requests", max))
+		return false
+	}
+	if !s.cfg.budget.take(time.Now()) {
+		run.outOfBudget.Store(true)
+		run.failures.abort(fmt.Sprintf("stopped after using the --daily-budget of %d requests to %s for today (UTC)", s.cfg.DailyBudget, s.cfg.providerName()))
+		return false
+	}
+	return true
+}
+
+// stopForQuota stops a --serve job once its client's rows_per_day quota is
+// used up. Like a spent request budget, the rows so far are saved and the
+// checkpoint is kept for the rest.
+func (s *Service) stopForQuota(err error) {
+	run := s
+	if s.owner != nil {
+		run = s.owner
+	}
+	run.outOfBudget.Store(true)
+	run.failures.abort("stopped: " + err.Error())
+}
+
+// budgeted returns the run's providers that have a daily budget, each once
+func (s *Service) budgeted() []*Service {
+	var providers []*Service
+	seen := make(map[*requestBudget]bool)
+	for _, provider := range append([]*Service{s}, s.routeList()...) {
+		if b := provider.cfg.budget; b != nil && !seen[b] {
+			seen[b] = true
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+// saveBudgets records the requests the run made in the budget file
+func (s *Service) saveBudgets() {
+	for _, provider := range s.budgeted() {
+		provider.cfg.budget.save()
+	}
+}
+
+// reportBudget tells how much of the day's budget is left before a run
+func (s *Service) reportBudget() {
+	for _, provider := range s.budgeted() {
+		used, limit := provider.cfg.budget.usage()
+		fmt.Printf("Daily budget: %d of %d requests to %s used today\n", used, limit, provider.cfg.providerName())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bundleSummaryName is the run summary inside a --zip bundle
+const bundleSummaryName = "summary.json"
+
+// bundlePath returns where the --zip bundle of a run is written:
+// data/<name>_<timestamp>.zip
+func bundlePath(excelFile string, now time.Time) string {
+	name := strings.TrimSuffix(filepath.Base(excelFile), filepath.Ext(excelFile))
+	return filepath.Join("data", fmt.Sprintf("%s_%s.zip", name, now.Format("20060102-150405")))
+}
+
+// bundleFiles lists the files of a run that go into its bundle: the output
+// or its parts, the failed geocodes, the coordinate report and the exports.
+// Files the run didn't write are left out.
+func (s *Service) bundleFiles(excelFile string) []string {
+	files := s.parts
+	if len(files) == 0 {
+		files = []string{s.savedTo}
+	}
+	candidates := []string{deadLetterPath(excelFile), s.cfg.ExportGeoJSON, s.cfg.ExportMap}
+	if s.cfg.CoordinateReport {
+		candidates = append(candidates, coordinateReportPath(excelFile))
+	}
+	for _, path := range candidates {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// writeBundle packages the files of a run and a summary of it into one zip
+// file to attach to a ticket or an email, and returns its path. Files are
+// stored under their base names.
+func (s *Service) writeBundle(excelFile string, sum runSummary) (string, error) {
+	path := bundlePath(excelFile, sum.Finished.Local())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	summary, err := json.MarshalIndent(sum, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	files := s.bundleFiles(excelFile)
+	err = writeFileAtomic(path, func(w io.Writer) error {
+		zw := zip.NewWriter(w)
+		seen := map[string]bool{bundleSummaryName: true}
+		for _, file := range files {
+			name := filepath.Base(file)
+			if seen[name] {
+				return fmt.Errorf("%s: two files named %s", file, name)
+			}
+			seen[name] = true
+			if err := addBundleFile(zw, file, name); err != nil {
+				return err
+			}
+		}
+		sw, err := zw.CreateHeader(&zip.FileHeader{Name: bundleSummaryName, Method: zip.Deflate, Modified: sum.Finished})
+		if err != nil {
+			return err
+		}
+		if _, err := sw.Write(append(summary, '\n')); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// addBundleFile copies a file into the bundle
+func addBundleFile(zw *zip.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name, header.Method = name, zip.Deflate
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
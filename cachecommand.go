@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// cacheAge is a range of ages of the results in a cache file, for
+// `cache stats`
+type cacheAge struct {
+	label string
+	upTo  time.Duration // 0 for the last range
+}
+
+var cacheAges = []cacheAge{
+	{"less than a day", 24 * time.Hour},
+	{"1 to 7 days", 7 * 24 * time.Hour},
+	{"7 to 30 days", 30 * 24 * time.Hour},
+	{"30 to 90 days", 90 * 24 * time.Hour},
+	{"90 to 180 days", 180 * 24 * time.Hour},
+	{"180 days to a year", 365 * 24 * time.Hour},
+	{"over a year", 0},
+}
+
+// runCache inspects and trims a --cache-file, for `latlg-address cache
+// stats <file>` and `latlg-address cache prune --older-than 180d <file>`.
+// Like diff, it queries no provider and takes only its own options.
+func runCache(args []string) error {
+	if len(args) == 0 {
+		printCacheUsage(nil)
+		return fmt.Errorf("cache needs a command: stats or prune")
+	}
+	switch args[0] {
+	case "stats":
+		return runCacheStats(args[1:])
+	case "prune":
+		return runCachePrune(args[1:])
+	case "-h", "-help", "--help":
+		printCacheUsage(nil)
+		return flag.ErrHelp
+	}
+	printCacheUsage(nil)
+	return fmt.Errorf("unknown cache command %q (expected stats or prune)", args[0])
+}
+
+// parseCacheArgs parses the options of a cache command, which may come
+// before or after the cache file
+func parseCacheArgs(fs *flag.FlagSet, args []string) (string, error) {
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			printCacheUsage(fs)
+			return "", err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) != 1 {
+		printCacheUsage(fs)
+		return "", fmt.Errorf("cache %s takes one cache file (got %d)", fs.Name(), len(files))
+	}
+	if _, err := os.Stat(files[0]); err != nil {
+		return "", err
+	}
+	return files[0], nil
+}
+
+// runCacheStats prints how many results a cache file holds, how large it
+// is, how often its results were reused and how old they are
+func runCacheStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	path, err := parseCacheArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	c := newCoordinateCache()
+	if _, _, err := c.load(path); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	counts := make([]int, len(cacheAges))
+	unknown, hits := 0, 0
+	var oldest, newest time.Time
+	for key, result := range c.cache {
+		hits += c.hits[key]
+		at := result.geocodedAt
+		if at.IsZero() {
+			unknown++
+			continue
+		}
+		if oldest.IsZero() || at.Before(oldest) {
+			oldest = at
+		}
+		if at.After(newest) {
+			newest = at
+		}
+		age := now.Sub(at)
+		for i, a := range cacheAges {
+			if a.upTo == 0 || age < a.upTo {
+				counts[i]++
+				break
+			}
+		}
+	}
+
+	entries := len(c.cache)
+	fmt.Printf("Cache %s\n", path)
+	fmt.Printf("  Entries:  %d\n", entries)
+	fmt.Printf("  Size:     %s\n", formatBytes(info.Size()))
+	if entries > 0 {
+		// Each entry was geocoded once; every hit is a lookup it saved
+		fmt.Printf("  Hit rate: %.1f%% (%d lookups answered from the cache, %d geocoded)\n",
+			100*float64(hits)/float64(hits+entries), hits, entries)
+	}
+	if !oldest.IsZero() {
+		fmt.Printf("  Oldest:   %s\n", oldest.Format("2006-01-02"))
+		fmt.Printf("  Newest:   %s\n", newest.Format("2006-01-02"))
+	}
+	fmt.Println("\nGeocoded")
+	for i, a := range cacheAges {
+		fmt.Printf("  %-20s %8d\n", a.label, counts[i])
+	}
+	if unknown > 0 {
+		fmt.Printf("  %-20s %8d\n", "unknown", unknown)
+	}
+	return nil
+}
+
+// runCachePrune drops the results of a cache file geocoded before a cutoff,
+// so they are looked up again with current map data. Results of unknown
+// age are dropped too, as --refresh-older-than treats them.
+func runCachePrune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var olderThan time.Duration
+	fs.Var((*ageValue)(&olderThan), "older-than", "drop results geocoded longer ago than this age, e.g. 180d or 12w")
+	dryRun := fs.Bool("dry-run", false, "report what would be dropped without changing the file")
+	path, err := parseCacheArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if olderThan <= 0 {
+		printCacheUsage(fs)
+		return fmt.Errorf("cache prune needs --older-than, e.g. --older-than 180d")
+	}
+	c := newCoordinateCache()
+	if _, _, err := c.load(path); err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	total, unknown := len(c.cache), 0
+	for key, result := range c.cache {
+		if !result.geocodedAt.Before(cutoff) {
+			continue
+		}
+		if result.geocodedAt.IsZero() {
+			unknown++
+		}
+		delete(c.cache, key)
+		delete(c.hits, key)
+	}
+	dropped := total - len(c.cache)
+	verb := "Dropped"
+	if *dryRun {
+		verb = "Would drop"
+	}
+	fmt.Printf("%s %d of %d results geocoded before %s", verb, dropped, total, cutoff.Format("2006-01-02"))
+	if unknown > 0 {
+		fmt.Printf(" (%d of unknown age)", unknown)
+	}
+	fmt.Printf("; %d left\n", len(c.cache))
+	if *dryRun || dropped == 0 {
+		return nil
+	}
+	if err := c.save(path); err != nil {
+		return fmt.Errorf("saving %s: %w", path, err)
+	}
+	if info, err := os.Stat(path); err == nil {
+		fmt.Printf("✓ %s is now %s\n", path, formatBytes(info.Size()))
+	}
+	return nil
+}
+
+// printCacheUsage prints the usage of the cache commands and, given the
+// flag set of one, its options
+func printCacheUsage(fs *flag.FlagSet) {
+	fmt.Println("Usage: latlg-address cache stats <cache-file>")
+	fmt.Println("       latlg-address cache prune --older-than 180d [--dry-run] <cache-file>")
+	if fs == nil {
+		return
+	}
+	fmt.Println()
+	fmt.Println("Options:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+	fs.SetOutput(io.Discard)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheRecord is one geocoding result in a cache file
+type cacheRecord struct {
+	Key      string `json:"key"`
+	Address  string `json:"address"`
+	District string `json:"district"`
+	Province string `json:"province"`
+	Country  string `json:"country,omitempty"`
+	Postcode string `json:"postcode,omitempty"`
+	Quality  *int   `json:"quality,omitempty"`
+	// Elevation is nil unless the result was stored by a run with --elevation
+	Elevation *float64 `json:"elevation,omitempty"`
+	Provider  string   `json:"provider,omitempty"`
+	// GeocodedAt is nil for entries written before it was recorded
+	GeocodedAt *time.Time `json:"geocoded_at,omitempty"`
+	// Hits is how often runs reused the result instead of geocoding it
+	Hits int `json:"hits,omitempty"`
+	placeInfo
+}
+
+// newCacheRecord returns the record of a cached result
+func newCacheRecord(key string, result geocodeResult) cacheRecord {
+	rec := cacheRecord{Key: key, Address: result.address, District: result.district, Province: result.province, Country: result.country, Postcode: result.postcode, Quality: result.quality, Elevation: result.elevation, Provider: result.provider, placeInfo: result.place}
+	if !result.geocodedAt.IsZero() {
+		at := result.geocodedAt
+		rec.GeocodedAt = &at
+	}
+	return rec
+}
+
+// result returns the cached result a record holds
+func (rec cacheRecord) result() geocodeResult {
+	result := geocodeResult{address: rec.Address, district: rec.District, province: rec.Province, country: rec.Country, postcode: rec.Postcode, place: rec.placeInfo, quality: rec.Quality, elevation: rec.Elevation, provider: rec.Provider}
+	if rec.GeocodedAt != nil {
+		result.geocodedAt = *rec.GeocodedAt
+	}
+	return result
+}
+
+// load adds the entries of a cache file to the cache and returns how many were
+// read, and how many were left out as older than the cache's ttl. A missing
+// file is not an error, so the first run can create it.
+func (c *coordinateCache) load(path string) (loaded, expired int, err error) {
+	r, err := openCompressed(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	dec := json.NewDecoder(bufio.NewReaderSize(r, 256*1024))
+	for {
+		var rec cacheRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return loaded, expired, nil
+		} else if err != nil {
+			return loaded, expired, fmt.Errorf("%s: %w", path, err)
+		}
+		result := rec.result()
+		if c.expired(result, now) {
+			expired++
+			continue
+		}
+		c.cache[rec.Key] = result
+		if rec.Hits > 0 {
+			c.hits[rec.Key] = rec.Hits
+		}
+		loaded++
+	}
+}
+
+// save writes every cached result to path, compressed when it ends in .zst.
+// Results that expired since they were loaded are left out.
+func (c *coordinateCache) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return writeFileAtomic(path, func(w io.Writer) error {
+		buf := bufio.NewWriterSize(w, 256*1024)
+		zw, err := compressWriter(buf, path)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(zw)
+		enc.SetEscapeHTML(false)
+		now := time.Now()
+		for key, result := range c.cache {
+			if c.expired(result, now) {
+				continue
+			}
+			rec := newCacheRecord(key, result)
+			rec.Hits = c.hits[key]
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		return buf.Flush()
+	})
+}
+
+// size returns the number of cached coordinates
+func (c *coordinateCache) size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.cache)
+}
+
+// olderThan counts the results geocoded before t, including those of unknown age
+func (c *coordinateCache) olderThan(t time.Time) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := 0
+	for _, result := range c.cache {
+		if result.geocodedAt.Before(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// warmCache loads --cache-file so results from earlier runs are reused
+func (s *Service) warmCache() error {
+	if s.cfg.CacheFile == "" {
+		if s.cfg.RefreshOlderThan > 0 {
+			return fmt.Errorf("--refresh-older-than needs --cache-file")
+		}
+		return nil
+	}
+	n, expired, err := s.cache.load(s.cfg.CacheFile)
+	if err != nil {
+		return fmt.Errorf("loading cache: %w", err)
+	}
+	if expired > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d cached results older than --cache-ttl %s\n", expired, ageValue(s.cfg.CacheTTL))
+	}
+	if s.cfg.RefreshOlderThan > 0 {
+		s.refreshBefore = time.Now().Add(-s.cfg.RefreshOlderThan)
+	}
+	if n > 0 {
+		fmt.Fprintf(os.Stderr, "Loaded %d cached results from %s\n", n, s.cfg.CacheFile)
+		if stale := s.cache.olderThan(s.refreshBefore); stale > 0 {
+			fmt.Fprintf(os.Stderr, "%d of them are older than %s and will be geocoded again if requested\n", stale, ageValue(s.cfg.RefreshOlderThan))
+		}
+	}
+	return nil
+}
+
+// stale reports whether a cached result is too old to reuse under
+// --refresh-older-than. Results of unknown age count as stale.
+func (s *Service) stale(result geocodeResult) bool {
+	return !s.refreshBefore.IsZero() && result.geocodedAt.Before(s.refreshBefore)
+}
+
+// ageValue is a flag.Value for ages such as 180d or 12w, as well as anything
+// time.ParseDuration accepts
+type ageValue time.Duration
+
+func (a ageValue) String() string {
+	d := time.Duration(a)
+	if day := 24 * time.Hour; d > 0 && d%day == 0 {
+		return strconv.FormatInt(int64(d/day), 10) + "d"
+	}
+	return d.String()
+}
+
+func (a *ageValue) Set(value string) error {
+	days := map[string]int64{"d": 1, "w": 7}
+	for suffix, n := range days {
+		if num := strings.TrimSuffix(value, suffix); num != value {
+			count, err := strconv.ParseInt(num, 10, 64)
+			if err != nil || count < 0 {
+				return fmt.Errorf("invalid age %q", value)
+			}
+			*a = ageValue(time.Duration(count*n) * 24 * time.Hour)
+			return nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid age %q (use e.g. 180d, 12w or 36h)", value)
+	}
+	*a = ageValue(d)
+	return nil
+}
+
+// persistCache writes the cache back to --cache-file
+func (s *Service) persistCache() {
+	if s.cfg.CacheFile == "" {
+		return
+	}
+	if err := s.cache.save(s.cfg.CacheFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not save cache to %s: %v\n", s.cfg.CacheFile, err)
+	}
+}
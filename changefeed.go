@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// addressParts are the resolved values of one row
+type addressParts struct {
+	Address  string `json:"address"`
+	District string `json:"district"`
+	Province string `json:"province"`
+}
+
+// rowState is a row of a processed workbook as seen by the change feed
+type rowState struct {
+	row   int
+	input string
+	addressParts
+}
+
+// snapshot maps a row key (the --change-key column, or the row number) to its state
+type snapshot map[string]rowState
+
+// addressChange is one change feed record: a row whose district or province
+// differs from the previous processed version of the file
+type addressChange struct {
+	File      string       `json:"file"`
+	Output    string       `json:"output"`
+	Sheet     string       `json:"sheet"`
+	Row       int          `json:"row"`
+	Key       string       `json:"key,omitempty"`
+	Input     string       `json:"input"`
+	Changed   []string     `json:"changed"`
+	Previous  addressParts `json:"previous"`
+	Current   addressParts `json:"current"`
+	Timestamp time.Time    `json:"timestamp"`
+}
+
+// columnIndex returns the column whose header equals name (case-insensitive), or -1
+func columnIndex(headerRow []string, name string) int {
+	for i, cell := range headerRow {
+		if strings.EqualFold(strings.TrimSpace(cell), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// snapshotColumns are the 0-based columns a snapshot reads; -1 if absent
+type snapshotColumns struct {
+	key, coords, address, district, province int
+}
+
+// takeSnapshot builds a snapshot of rows 2..n; value returns the current
+// content of a cell given its 1-based row and 0-based column
+func takeSnapshot(numRows int, cols snapshotColumns, value func(row, col int) string) snapshot {
+	snap := make(snapshot, numRows)
+	for rowNum := 2; rowNum <= numRows; rowNum++ {
+		key := strconv.Itoa(rowNum)
+		if cols.key >= 0 {
+			if key = strings.TrimSpace(value(rowNum, cols.key)); key == "" {
+				continue
+			}
+		}
+		snap[key] = rowState{
+			row:   rowNum,
+			input: value(rowNum, cols.coords),
+			addressParts: addressParts{
+				Address:  value(rowNum, cols.address),
+				District: value(rowNum, cols.district),
+				Province: value(rowNum, cols.province),
+			},
+		}
+	}
+	return snap
+}
+
+// rowsValue reads cells from rows returned by GetRows
+func rowsValue(rows [][]string) func(row, col int) string {
+	return func(row, col int) string {
+		if col < 0 || row-1 >= len(rows) || col >= len(rows[row-1]) {
+			return ""
+		}
+		return rows[row-1][col]
+	}
+}
+
+// changeKeyColumn returns the --change-key column of a header row, or -1 to key rows by number
+func (s *Service) changeKeyColumn(headerRow []string) (int, error) {
+	if s.cfg.ChangeKey == "" {
+		return -1, nil
+	}
+	col := columnIndex(headerRow, s.cfg.ChangeKey)
+	if col == -1 {
+		return -1, fmt.Errorf("--change-key column %q not found", s.cfg.ChangeKey)
+	}
+	return col, nil
+}
+
+// previousSnapshot reads the results of the last run from the existing
+// output file. It returns nil if there is no previous version.
+func (s *Service) previousSnapshot(outputFile string) (snapshot, error) {
+	if _, err := os.Stat(outputFile); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	prev, err := NewRepository(outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading previous output: %w", err)
+	}
+	defer prev.Close()
+
+	rows := prev.GetRows()
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	keyCol, err := s.changeKeyColumn(rows[0])
+	if err != nil {
+		return nil, err
+	}
+	cols := snapshotColumns{key: keyCol, coords: -1}
+	for i, cell := range rows[0] {
+		if isCoordinateHeader(cell) {
+			cols.coords = i
+			break
+		}
+	}
+	cols.address, cols.district, cols.province = findResultColumns(rows[0])
+	return takeSnapshot(len(rows), cols, rowsValue(rows)), nil
+}
+
+// currentSnapshot returns the results of this run: the values written during
+// processing, or the original cell contents for rows that weren't written
+func (s *Service) currentSnapshot(cols snapshotColumns) snapshot {
+	rows := s.repo.GetRows()
+	base := rowsValue(rows)
+	value := func(row, col int) string {
+		if v, ok := s.repo.edits[row][col+1]; ok {
+			return fmt.Sprint(v)
+		}
+		return base(row, col)
+	}
+	return takeSnapshot(len(rows), cols, value)
+}
+
+// diffSnapshots lists rows whose district or province changed. Rows that are
+// new, or that have no result this time (e.g. a failed geocode), are not changes.
+func diffSnapshots(prev, cur snapshot) []addressChange {
+	var changes []addressChange
+	for key, now := range cur {
+		before, ok := prev[key]
+		if !ok || (now.District == "" && now.Province == "") {
+			continue
+		}
+		var changed []string
+		if now.District != before.District {
+			changed = append(changed, "district")
+		}
+		if now.Province != before.Province {
+			changed = append(changed, "province")
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		if now.Address != before.Address {
+			changed = append(changed, "address")
+		}
+		changes = append(changes, addressChange{
+			Row:      now.row,
+			Key:      key,
+			Input:    now.input,
+			Changed:  changed,
+			Previous: before.addressParts,
+			Current:  now.addressParts,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Row < changes[j].Row })
+	return changes
+}
+
+// emitChanges writes the change feed records to --change-feed: a JSONL file
+// (appended), "-" for stdout, or an http(s) URL that receives them as a POST
+func (s *Service) emitChanges(changes []addressChange, excelFile, output string) error {
+	if len(changes) == 0 {
+		fmt.Println("Change feed: no district/province changes since the previous version")
+		return nil
+	}
+
+	now := time.Now().UTC()
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false)
+	for _, c := range changes {
+		c.File, c.Output, c.Sheet, c.Timestamp = excelFile, output, s.repo.GetSheetName(), now
+		if s.cfg.ChangeKey == "" {
+			c.Key = ""
+		}
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+	}
+
+	dest := s.cfg.ChangeFeed
+	switch {
+	case dest == "-":
+		if _, err := os.Stdout.Write(body.Bytes()); err != nil {
+			return err
+		}
+	case strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://"):
+		resp, err := s.client.Post(dest, "application/x-ndjson", &body)
+		if err != nil {
+			return fmt.Errorf("posting change feed: %w", err)
+		}
+		defer drainAndClose(resp.Body)
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("posting change feed: %s returned %d: %s", dest, resp.StatusCode, strings.TrimSpace(string(msg)))
+		}
+	default:
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(body.Bytes()); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("✓ Change feed: %d rows with changed district/province sent to %s\n", len(changes), dest)
+	return nil
+}
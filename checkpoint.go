@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// checkpointPath returns data/<name>_checkpoint.jsonl.zst for an input file
+func (c *Config) checkpointPath(excelFile string) string {
+	dir := c.checkpointDir
+	if dir == "" {
+		dir = "data"
+	}
+	fileName := filepath.Base(excelFile)
+	return filepath.Join(dir, strings.TrimSuffix(fileName, ".xlsx")+"_checkpoint.jsonl.zst")
+}
+
+// checkpoint records results of a large run so it can be resumed after a
+// crash. It uses the journal format: a header line followed by written cells.
+// Each flush appends a new zstd frame with only the rows finished since the
+// previous flush, so checkpoints stay cheap however far the run has got, and
+// the workbook itself is only written once, at the end of the run.
+type checkpoint struct {
+	path string
+	cols []int // 1-based address columns, which a finished row has written
+	rows []int // rows finished since the last flush
+}
+
+// createCheckpoint starts a new checkpoint file, replacing any previous one
+func createCheckpoint(path string, header journalHeader, cols []int) (*checkpoint, error) {
+	cp := &checkpoint{path: path, cols: cols}
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		return cp.writeFrame(w, header)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating checkpoint: %w", err)
+	}
+	return cp, nil
+}
+
+// add marks a row as finished; a nil checkpoint ignores it
+func (cp *checkpoint) add(rowNum int) {
+	if cp == nil {
+		return
+	}
+	cp.rows = append(cp.rows, rowNum)
+}
+
+// flush appends every cell written to the rows finished since the last
+// flush, so optional columns such as Status and Quality survive a resume
+func (cp *checkpoint) flush(repo *Repository) error {
+	if cp == nil || len(cp.rows) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(cp.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var cells []interface{}
+	var cols []int
+	for _, row := range cp.rows {
+		cols = cols[:0]
+		for col := range repo.edits[row] {
+			cols = append(cols, col)
+		}
+		sort.Ints(cols)
+		for _, col := range cols {
+			cells = append(cells, journalCell{Row: row, Col: col, Value: repo.edits[row][col]})
+		}
+	}
+	if err := cp.writeFrame(f, cells...); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	cp.rows = cp.rows[:0]
+	return nil
+}
+
+// writeFrame writes values as JSON lines in one compressed frame
+func (cp *checkpoint) writeFrame(w io.Writer, values ...interface{}) error {
+	buf := bufio.NewWriterSize(w, 256*1024)
+	zw, err := compressWriter(buf, cp.path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(zw)
+	enc.SetEscapeHTML(false)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// remove deletes the checkpoint once the output has been saved
+func (cp *checkpoint) remove() {
+	if err := os.Remove(cp.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Warning: Could not remove checkpoint %s: %v\n", cp.path, err)
+	}
+}
+
+// saveCheckpoint saves the progress of a large run: the rows finished since
+// the last checkpoint and the cache file. Only the new rows are written, so
+// a checkpoint costs the same at the end of a run as at its start.
+func (s *Service) saveCheckpoint() error {
+	if err := s.checkpoint.flush(s.repo); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	s.persistCache()
+	return nil
+}
+
+// readJournalHeader reads only the header of a journal or checkpoint
+func readJournalHeader(path string) (journalHeader, error) {
+	r, err := openCompressed(path)
+	if err != nil {
+		return journalHeader{}, err
+	}
+	defer r.Close()
+
+	var header journalHeader
+	if err := json.NewDecoder(r).Decode(&header); err != nil {
+		return header, fmt.Errorf("reading header: %w", err)
+	}
+	return header, nil
+}
+
+// readJournal streams a journal or checkpoint, calling fn for every cell.
+// A checkpoint cut short by a crash ends in a truncated frame; the cells
+// before it are still returned and truncated reports the damage.
+func readJournal(path string, fn func(journalCell) error) (header journalHeader, truncated bool, err error) {
+	r, err := openCompressed(path)
+	if err != nil {
+		return header, false, err
+	}
+	defer r.Close()
+
+	dec := json.NewDecoder(bufio.NewReaderSize(r, 256*1024))
+	if err := dec.Decode(&header); err != nil {
+		return header, false, fmt.Errorf("reading header: %w", err)
+	}
+	for {
+		var cell journalCell
+		if err := dec.Decode(&cell); err == io.EOF {
+			return header, false, nil
+		} else if err != nil {
+			return header, true, nil
+		}
+		if err := fn(cell); err != nil {
+			return header, false, err
+		}
+	}
+}
+
+// resumeCheckpoint applies the results of an interrupted run to the workbook
+// and marks their rows as done. The checkpoint is rewritten as a single frame
+// so a frame truncated by the crash doesn't hide the frames appended after it.
+func (s *Service) resumeCheckpoint(path, excelFile string, cols []int) (*checkpoint, error) {
+	s.resumed = make(map[int]bool)
+	header, truncated, err := readJournal(path, func(cell journalCell) error {
+		name, err := excelize.CoordinatesToCellName(cell.Col, cell.Row)
+		if err != nil {
+			return err
+		}
+		s.resumed[cell.Row] = true
+		return s.repo.SetCellValue(name, cell.Value)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint %s: %w", path, err)
+	}
+	if header.Source != excelFile || header.Sheet != s.repo.GetSheetName() {
+		return nil, fmt.Errorf("checkpoint %s is for %s (sheet %q), not %s", path, header.Source, header.Sheet, excelFile)
+	}
+	if truncated {
+		fmt.Println("Warning: The last checkpoint was cut short; its rows will be processed again")
+	}
+	fmt.Printf("Resuming from %s: %d rows already done (checkpoint from %s)\n",
+		path, len(s.resumed), header.Created.Local().Format(time.DateTime))
+
+	cp, err := createCheckpoint(path, header, cols)
+	if err != nil {
+		return nil, err
+	}
+	for row := range s.resumed {
+		cp.add(row)
+	}
+	if err := cp.flush(s.repo); err != nil {
+		return nil, fmt.Errorf("rewriting checkpoint: %w", err)
+	}
+	return cp, nil
+}
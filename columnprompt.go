@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// coordinateSampleRows is how many data rows are read to tell whether a
+// column holds coordinates
+const coordinateSampleRows = 5
+
+// previewCellWidth is how many characters of a cell the column prompt shows
+const previewCellWidth = 24
+
+// coordinateCandidate is a column that may hold the coordinates
+type coordinateCandidate struct {
+	col    int
+	header bool // the header looks like a coordinate header
+	values bool // some of the first data values parse as coordinates
+}
+
+// better reports whether c is a likelier coordinate column than o: values
+// that parse count for more than a header, so "Latest Location Update"
+// loses to a column of 'lat,lng' values
+func (c coordinateCandidate) better(o coordinateCandidate) bool {
+	if c.values != o.values {
+		return c.values
+	}
+	return c.header && !o.header
+}
+
+// coordinateCandidates returns the columns whose header looks like
+// coordinates or whose first data values parse as coordinates, in sheet
+// order
+func (s *Service) coordinateCandidates(rows [][]string) []coordinateCandidate {
+	numCols := 0
+	for _, row := range rows[:min(len(rows), coordinateSampleRows+1)] {
+		numCols = max(numCols, len(row))
+	}
+	var candidates []coordinateCandidate
+	for col := 0; col < numCols; col++ {
+		c := coordinateCandidate{col: col, header: col < len(rows[0]) && isCoordinateHeader(rows[0][col])}
+		for _, row := range rows[1:min(len(rows), coordinateSampleRows+1)] {
+			if col >= len(row) || strings.TrimSpace(row[col]) == "" {
+				continue
+			}
+			if _, err := s.parseCoordinates(strings.TrimSpace(row[col])); err == nil {
+				c.values = true
+				break
+			}
+		}
+		if c.header || c.values {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+// canPrompt reports whether a run may ask questions on the terminal: not
+// with --no-prompt, and not in the job server or a scheduled run
+func (c *Config) canPrompt() bool {
+	return !c.NoPrompt && c.Serve == "" && c.Schedule == "" && isTerminal(os.Stdin)
+}
+
+// pickColumn shows the header and first data rows of the sheet, marking the
+// candidate columns, and asks for a column by letter or header. An empty
+// answer, or the end of input, takes def.
+func pickColumn(rows [][]string, candidates []int, def int, question string) int {
+	marked := make(map[int]bool, len(candidates))
+	for _, col := range candidates {
+		marked[col] = true
+	}
+	header := rows[0]
+	samples := rows[1:min(len(rows), 4)]
+	for col := range header {
+		name, _ := excelize.ColumnNumberToName(col + 1)
+		mark := " "
+		if marked[col] {
+			mark = "*"
+		}
+		cells := make([]string, len(samples))
+		for i, row := range samples {
+			if col < len(row) {
+				cells[i] = previewCell(row[col])
+			}
+		}
+		fmt.Printf(" %s %-3s %-*s  %s\n", mark, name, previewCellWidth, previewCell(header[col]), strings.Join(cells, " | "))
+	}
+
+	defName, _ := excelize.ColumnNumberToName(def + 1)
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("%s Enter a column letter or header [%s]: ", question, defName)
+		line, err := reader.ReadString('\n')
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			if err != nil {
+				fmt.Println()
+			}
+			return def
+		}
+		if col, ok := findColumn(header, answer); ok {
+			return col
+		}
+		fmt.Printf("No column %q\n", answer)
+		if err != nil {
+			return def
+		}
+	}
+}
+
+// findColumn finds a column by its letter, such as C, or its header
+func findColumn(header []string, answer string) (int, bool) {
+	for i, cell := range header {
+		if strings.EqualFold(strings.TrimSpace(cell), answer) {
+			return i, true
+		}
+	}
+	if col, err := excelize.ColumnNameToNumber(strings.ToUpper(answer)); err == nil && col <= len(header) {
+		return col - 1, true
+	}
+	return 0, false
+}
+
+// previewCell shortens a cell for the column prompt
+func previewCell(value string) string {
+	value = strings.Join(strings.Fields(value), " ")
+	if r := []rune(value); len(r) > previewCellWidth {
+		return string(r[:previewCellWidth-1]) + "…"
+	}
+	return value
+}
+
+// chooseAddressColumn asks which column takes the address when several
+// headers mention an address, such as "Email Address" and "Address". Without
+// a terminal the last of them is kept, as before.
+func (s *Service) chooseAddressColumn(rows [][]string, addressCol, latLngCol int) int {
+	var candidates []int
+	for i, cell := range rows[0] {
+		if i != latLngCol && strings.Contains(strings.ToLower(cell), "address") {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) < 2 || !s.cfg.canPrompt() {
+		return addressCol
+	}
+	fmt.Println("\nSeveral columns could take the address (marked *):")
+	return pickColumn(rows, candidates, addressCol, "Which column should the address be written to?")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// flexInt decodes a JSON number that some Nominatim-compatible providers
+// send as a string, e.g. LocationIQ's "osm_id": "123"
+type flexInt int64
+
+func (n *flexInt) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	if len(data) == 0 || string(data) == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s: %w", data, err)
+	}
+	*n = flexInt(v)
+	return nil
+}
+
+var _ json.Unmarshaler = (*flexInt)(nil)
+
+// extraColumn is an optional result column written after Address, District and Province
+type extraColumn struct {
+	header string
+	key    string // field name in JSONL stream output
+	value  func(rowResult) interface{}
+	col    int // 0-based, set by setupColumns
+}
+
+// placeColumns describe the OSM object each row resolved to
+func placeColumns() []*extraColumn {
+	return []*extraColumn{
+		{header: "Class", key: "class", value: func(r rowResult) interface{} { return r.place.Class }},
+		{header: "Type", key: "type", value: func(r rowResult) interface{} { return r.place.Type }},
+		{header: "Place Rank", key: "place_rank", value: func(r rowResult) interface{} { return intOrEmpty(int64(r.place.PlaceRank)) }},
+		{header: "OSM Type", key: "osm_type", value: func(r rowResult) interface{} { return r.place.OSMType }},
+		{header: "OSM ID", key: "osm_id", value: func(r rowResult) interface{} { return intOrEmpty(r.place.OSMID) }},
+	}
+}
+
+// provenanceColumns record how and when each row's result was derived
+func provenanceColumns() []*extraColumn {
+	return []*extraColumn{
+		{header: "Provider", key: "provider", value: func(r rowResult) interface{} { return r.provider }},
+		{header: "Geocoded At", key: "geocoded_at", value: func(r rowResult) interface{} {
+			if r.geocodedAt.IsZero() {
+				return ""
+			}
+			return r.geocodedAt.Format(time.RFC3339)
+		}},
+		{header: "Cache Hit", key: "cache_hit", value: func(r rowResult) interface{} { return r.cached }},
+		{header: "Retries", key: "retries", value: func(r rowResult) interface{} {
+			if r.attempts == 0 {
+				return 0
+			}
+			return r.attempts - 1
+		}},
+	}
+}
+
+// intOrEmpty leaves the cell empty for results that carry no value, e.g.
+// ones loaded from an older cache file
+func intOrEmpty(v int64) interface{} {
+	if v == 0 {
+		return ""
+	}
+	return v
+}
+
+// extraColumns returns the optional columns selected on the command line
+func (c *Config) extraColumns() []*extraColumn {
+	var cols []*extraColumn
+	provinces := &provinceMatcher{}
+	if c.CanonicalProvince {
+		cols = append(cols, canonicalProvinceColumns(provinces)...)
+	}
+	if c.ProvinceCode {
+		cols = append(cols, provinceCodeColumn(provinces))
+	}
+	if c.PostcodeColumns {
+		cols = append(cols, postcodeColumns(provinces, c.postcodes)...)
+	}
+	if c.Transliterate {
+		cols = append(cols, transliterationColumns(provinces)...)
+	}
+	if c.PlaceColumns {
+		cols = append(cols, placeColumns()...)
+	}
+	if c.QualityColumn {
+		cols = append(cols, qualityColumn())
+	}
+	if c.ProvenanceColumns {
+		cols = append(cols, provenanceColumns()...)
+	}
+	cols = append(cols, c.gridCodeColumns()...)
+	if c.UTMColumns {
+		cols = append(cols, utmColumns()...)
+	}
+	if c.NearestTimezone {
+		cols = append(cols, nearestTimezoneColumn())
+	}
+	if c.Elevation {
+		cols = append(cols, elevationColumn())
+	}
+	if c.MapLink != "" {
+		cols = append(cols, mapLinkColumn(c.MapLink))
+	}
+	if c.NearestPlace {
+		cols = append(cols, nearestPlaceColumn(c.places))
+	}
+	return cols
+}
+
+// setupColumns places the optional columns after the result columns, reusing
+// columns with the same header from an earlier run, followed by Status
+func (s *Service) setupColumns(headerRow []string, provinceCol int) {
+	s.nextCol = provinceCol + 1
+	if len(headerRow) > s.nextCol {
+		s.nextCol = len(headerRow)
+	}
+
+	s.extraCols = s.cfg.extraColumns()
+	for _, c := range s.extraCols {
+		if c.col = columnIndex(headerRow, c.header); c.col != -1 {
+			continue
+		}
+		c.col = s.nextCol
+		s.nextCol++
+		if err := s.writeCell(1, c.col, c.header); err != nil {
+			fmt.Printf("Warning: Could not add %s column: %v\n", c.header, err)
+			continue
+		}
+		fmt.Printf("Added %s column at column %d\n", c.header, c.col+1)
+	}
+
+	s.setupStatusColumn(headerRow)
+}
+
+// writeExtraCells writes the optional columns of a row
+func (s *Service) writeExtraCells(rowNum int, result rowResult) error {
+	for _, c := range s.extraCols {
+		if err := s.writeCell(rowNum, c.col, c.value(result)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
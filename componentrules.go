@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultRulesCountry keys the rule for countries without their own
+const defaultRulesCountry = "default"
+
+// builtinComponentRules maps address keys to District and Province per country
+//
+//go:embed rules/components.yaml
+var builtinComponentRules []byte
+
+// defaultComponentRules are used when no rules were configured
+var defaultComponentRules = func() componentRules {
+	rules, err := parseComponentRules(builtinComponentRules)
+	if err != nil {
+		panic(fmt.Sprintf("rules/components.yaml: %v", err))
+	}
+	return rules
+}()
+
+// componentRules are the component rules by lowercase country code
+type componentRules map[string]*componentRule
+
+// componentRule lists the address keys tried for District and Province
+type componentRule struct {
+	District                []componentKey `yaml:"district"`
+	Province                []componentKey `yaml:"province"`
+	DistrictFromDisplayName bool           `yaml:"district_from_display_name"`
+}
+
+// componentKey is an address key, used only while Unless is empty if set
+type componentKey struct {
+	Key    string `yaml:"key"`
+	Unless string `yaml:"unless"`
+}
+
+// UnmarshalYAML accepts a plain key as well as {key: ..., unless: ...}
+func (k *componentKey) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		k.Key = node.Value
+		return nil
+	}
+	type plain componentKey
+	return node.Decode((*plain)(k))
+}
+
+// loadComponentRules returns the built-in rules, with the countries of the
+// --component-rules file replacing theirs
+func loadComponentRules(path string) (componentRules, error) {
+	if path == "" {
+		return defaultComponentRules, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("--component-rules: %w", err)
+	}
+	custom, err := parseComponentRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("--component-rules %s: %w", path, err)
+	}
+	rules := make(componentRules, len(defaultComponentRules)+len(custom))
+	for country, rule := range defaultComponentRules {
+		rules[country] = rule
+	}
+	for country, rule := range custom {
+		rules[country] = rule
+	}
+	return rules, nil
+}
+
+// parseComponentRules decodes and checks a rules file
+func parseComponentRules(data []byte) (componentRules, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var raw map[string]*componentRule
+	if err := dec.Decode(&raw); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	rules := make(componentRules, len(raw))
+	for country, rule := range raw {
+		country = strings.ToLower(country)
+		if country != defaultRulesCountry && len(country) != 2 {
+			return nil, fmt.Errorf("%q is not a two-letter country code or %q", country, defaultRulesCountry)
+		}
+		if rule == nil || len(rule.District) == 0 || len(rule.Province) == 0 {
+			return nil, fmt.Errorf("%s: district and province keys are required", country)
+		}
+		for _, k := range append(append([]componentKey{}, rule.District...), rule.Province...) {
+			if k.Key == "" {
+				return nil, fmt.Errorf("%s: empty address key", country)
+			}
+		}
+		rules[country] = rule
+	}
+	return rules, nil
+}
+
+// forCountry returns the rule for a country code, or the default rule
+func (r componentRules) forCountry(code string) *componentRule {
+	if rule, ok := r[strings.ToLower(code)]; ok {
+		return rule
+	}
+	return r[defaultRulesCountry]
+}
+
+// pick returns the value of the first key that applies and has a value
+func pick(keys []componentKey, addr Address) string {
+	for _, k := range keys {
+		if k.Unless != "" && addr.Field(k.Unless) != "" {
+			continue
+		}
+		if v := addr.Field(k.Key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
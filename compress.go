@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// isZstdPath reports whether a file is zstd-compressed, judging by its extension
+func isZstdPath(path string) bool {
+	return strings.HasSuffix(path, ".zst")
+}
+
+// openCompressed opens a file for streaming reads, decompressing .zst files on the fly
+func openCompressed(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isZstdPath(path) {
+		return f, nil
+	}
+	dec, err := zstd.NewReader(bufio.NewReaderSize(f, 256*1024), zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &zstdReadCloser{dec: dec, file: f}, nil
+}
+
+type zstdReadCloser struct {
+	dec  *zstd.Decoder
+	file *os.File
+}
+
+func (z *zstdReadCloser) Read(p []byte) (int, error) { return z.dec.Read(p) }
+
+func (z *zstdReadCloser) Close() error {
+	z.dec.Close()
+	return z.file.Close()
+}
+
+// compressWriter wraps w so that writes to a .zst path are compressed as they
+// are streamed. Closing the returned writer ends the zstd frame but leaves w open.
+func compressWriter(w io.Writer, path string) (io.WriteCloser, error) {
+	if !isZstdPath(path) {
+		return nopWriteCloser{w}, nil
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// concurrencyLimiter tunes how many requests to a provider are in flight
+// for --adaptive-concurrency, the way TCP tunes its congestion window. After
+// each round of as many responses as the limit, it doubles the limit (slow
+// start) or, once the provider pushed back, adds one; a round with a 429, a
+// server error or timeout, or latency above twice the best seen, halves it.
+type concurrencyLimiter struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	limit     int
+	max       int
+	inFlight  int
+	slowStart bool
+	round     int  // responses since the limit last changed
+	settle    int  // responses the current round lasts
+	pushback  bool // the provider was overloaded during the round
+
+	latency time.Duration // smoothed latency of successful responses
+	best    time.Duration // lowest smoothed latency at the current limit
+
+	lowest, highest int // range of the limit, for the summary
+	requests        int
+}
+
+// newConcurrencyLimiter returns the limiter of a provider, or nil when its
+// concurrency is fixed
+func newConcurrencyLimiter(cfg *Config) *concurrencyLimiter {
+	if !cfg.AdaptiveConcurrency {
+		return nil
+	}
+	l := &concurrencyLimiter{
+		limit:     cfg.startWorkers,
+		max:       cfg.MaxWorkers,
+		slowStart: true,
+		settle:    cfg.startWorkers,
+		lowest:    cfg.startWorkers,
+		highest:   cfg.startWorkers,
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits for a free slot. The returned function ends the request;
+// overloaded is true when the provider refused it or failed under load.
+// Safe for concurrent use and a no-op on nil.
+func (l *concurrencyLimiter) acquire() func(overloaded bool) {
+	if l == nil {
+		return func(bool) {}
+	}
+	l.mu.Lock()
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	l.mu.Unlock()
+
+	start := time.Now()
+	return func(overloaded bool) { l.release(time.Since(start), overloaded) }
+}
+
+func (l *concurrencyLimiter) release(elapsed time.Duration, overloaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.requests++
+	l.cond.Signal()
+
+	if overloaded {
+		l.pushback = true
+	} else {
+		if l.latency == 0 {
+			l.latency = elapsed
+		} else {
+			// Smooth out single slow responses
+			l.latency = (4*l.latency + elapsed) / 5
+		}
+		if l.best == 0 || l.latency < l.best {
+			l.best = l.latency
+		}
+	}
+	l.round++
+	if l.round < l.settle {
+		return
+	}
+
+	switch {
+	case l.pushback || l.latency > 2*l.best:
+		// Responses to requests sent at the old limit are still coming in;
+		// judge the new one once they are through
+		l.settle = l.limit
+		l.limit = max(1, l.limit/2)
+		l.slowStart = false
+		l.latency, l.best = 0, 0
+	case l.limit < l.max:
+		if l.slowStart {
+			l.limit = min(l.max, 2*l.limit)
+		} else {
+			l.limit++
+		}
+		l.settle = l.limit
+		l.cond.Broadcast()
+	}
+	l.round, l.pushback = 0, false
+	l.lowest, l.highest = min(l.lowest, l.limit), max(l.highest, l.limit)
+}
+
+// isTimeout reports whether a request failed for taking too long, which
+// counts as the provider being overloaded
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// reportConcurrency prints where --adaptive-concurrency settled for each
+// provider of the run
+func (s *Service) reportConcurrency() {
+	for _, provider := range append([]*Service{s}, s.routeList()...) {
+		l := provider.limiter
+		if l == nil {
+			continue
+		}
+		l.mu.Lock()
+		if l.requests > 0 {
+			fmt.Printf("✓ %s: %d requests in flight at the end (%d–%d during the run, at most %d)\n",
+				provider.cfg.providerName(), l.limit, l.lowest, l.highest, l.max)
+		}
+		l.mu.Unlock()
+	}
+}
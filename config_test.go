@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriterIsCheckedInEveryMode(t *testing.T) {
+	for _, mode := range [][]string{
+		{"sites.xlsx"},
+		{"--serve", "127.0.0.1:0"},
+		{"--grpc", "127.0.0.1:0"},
+		{"--stdin"},
+	} {
+		if _, err := parseConfig(append([]string{"--writer", "bogus"}, mode...)); err == nil {
+			t.Errorf("%v: --writer bogus was accepted", mode)
+		}
+		cfg, err := parseConfig(append([]string{"--preserve-formatting"}, mode...))
+		if err != nil {
+			t.Errorf("%v --preserve-formatting: %v", mode, err)
+			continue
+		}
+		if cfg.Writer != writerPatch {
+			t.Errorf("%v: --preserve-formatting left the writer at %s", mode, cfg.Writer)
+		}
+	}
+}
+
+func TestFormatSheetIsRefusedWithThePatchWriter(t *testing.T) {
+	if _, err := parseConfig([]string{"--writer", "patch", "--format-sheet", "sites.xlsx"}); err == nil {
+		t.Error("--format-sheet with --writer patch was accepted")
+	}
+	for _, args := range [][]string{
+		{"--writer", "patch", "sites.xlsx"},
+		{"--writer", "patch", "--format-sheet=false", "sites.xlsx"},
+		{"--format-sheet", "sites.xlsx"},
+	} {
+		if _, err := parseConfig(args); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}
+
+func TestGeohashRangeError(t *testing.T) {
+	for _, flag := range []string{"--geohash", "--coarse"} {
+		_, err := parseConfig([]string{flag, "13", "sites.xlsx"})
+		if err == nil || !strings.Contains(err.Error(), "0 to turn it off, or 1-12") {
+			t.Errorf("%s 13: %v, want an error naming 0 and 1-12", flag, err)
+		}
+		if _, err := parseConfig([]string{flag, "0", "sites.xlsx"}); err != nil {
+			t.Errorf("%s 0: %v", flag, err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runConvert writes a table in another format, for `latlg-address convert
+// --output data/sites.parquet data/sites.xlsx`. The input is read like a
+// pipeline input and written like an export step, so every column is kept
+// and the coordinates are found the same way.
+func runConvert(cfg *Config) error {
+	if cfg.Output == "" || strings.HasSuffix(cfg.Output, "/") {
+		return fmt.Errorf("convert needs the file to write, e.g. --output data/sites.parquet")
+	}
+	if filepath.Clean(cfg.Output) == filepath.Clean(cfg.InputFile) {
+		return fmt.Errorf("--output must not be the input file")
+	}
+	name := strings.TrimSuffix(filepath.Base(cfg.InputFile), filepath.Ext(cfg.InputFile))
+	spec := &pipelineSpec{Name: name, Input: pipelineInput{File: cfg.InputFile, Coordinates: cfg.CoordinateColumn}}
+	p := &pipeline{cfg: cfg, spec: spec}
+	if err := p.load(); err != nil {
+		return err
+	}
+	fmt.Printf("Read %d rows and %d columns from %s\n", len(p.rows), len(p.header), cfg.InputFile)
+	return exportStep{cfg.Output}.run(p)
+}
+
+// tableBuilder collects objects into a table whose columns are their keys,
+// in the order they are first seen
+type tableBuilder struct {
+	header []string
+	index  map[string]int
+	rows   [][]string
+}
+
+func newTableBuilder() *tableBuilder {
+	return &tableBuilder{index: make(map[string]int)}
+}
+
+// set puts a value into a row, adding its column if it is new
+func (t *tableBuilder) set(row int, key, value string) {
+	col, ok := t.index[key]
+	if !ok {
+		col = len(t.header)
+		t.index[key] = col
+		t.header = append(t.header, key)
+	}
+	if col >= len(t.rows[row]) {
+		t.rows[row] = append(t.rows[row], make([]string, col+1-len(t.rows[row]))...)
+	}
+	t.rows[row][col] = value
+}
+
+// setObject puts the members of a JSON object into a row
+func (t *tableBuilder) setObject(row int, data []byte) error {
+	keys, values, err := decodeObject(data)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		t.set(row, key, jsonCell(values[key]))
+	}
+	return nil
+}
+
+// table returns the header and rows; load pads the short rows
+func (t *tableBuilder) table() [][]string {
+	return append([][]string{t.header}, t.rows...)
+}
+
+// readJSONLines reads a JSON Lines file of flat objects, one row per line.
+// Lines written by --stdin --format jsonl are turned back into the columns
+// of the CSV format: the input fields, Address, District, Province, the
+// extra columns and Error.
+func readJSONLines(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := newTableBuilder()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		_, values, err := decodeObject(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		row := len(t.rows)
+		t.rows = append(t.rows, nil)
+		if isStreamResult(values) {
+			err = t.setStreamResult(row, values)
+		} else {
+			err = t.setObject(row, text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return t.table(), nil
+}
+
+// isStreamResult reports whether an object is a streamResult
+func isStreamResult(values map[string]json.RawMessage) bool {
+	_, line := values["line"]
+	_, input := values["input"]
+	_, address := values["address"]
+	return line && input && address
+}
+
+// setStreamResult fills a row from a streamResult
+func (t *tableBuilder) setStreamResult(row int, values map[string]json.RawMessage) error {
+	if raw, ok := values["fields"]; ok {
+		if err := t.setObject(row, raw); err != nil {
+			return fmt.Errorf("fields: %w", err)
+		}
+	} else {
+		t.set(row, "LatLng", jsonCell(values["input"]))
+	}
+	t.set(row, "Address", jsonCell(values["address"]))
+	t.set(row, "District", jsonCell(values["district"]))
+	t.set(row, "Province", jsonCell(values["province"]))
+	if raw, ok := values["extra"]; ok {
+		if err := t.setObject(row, raw); err != nil {
+			return fmt.Errorf("extra: %w", err)
+		}
+	}
+	t.set(row, "Error", jsonCell(values["error"]))
+	return nil
+}
+
+// readGeoJSON reads the features of a GeoJSON FeatureCollection, one row per
+// feature with its properties as columns. When no property holds the
+// coordinates, a LatLng column is made from the Point geometries.
+func readGeoJSON(path string) ([][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var collection struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry *struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties json.RawMessage `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("%s is not a GeoJSON FeatureCollection", path)
+	}
+
+	t := newTableBuilder()
+	points := make([]string, len(collection.Features))
+	for i, feature := range collection.Features {
+		t.rows = append(t.rows, nil)
+		if len(feature.Properties) > 0 && string(feature.Properties) != "null" {
+			if err := t.setObject(i, feature.Properties); err != nil {
+				return nil, fmt.Errorf("%s feature %d: properties: %w", path, i+1, err)
+			}
+		}
+		if g := feature.Geometry; g != nil && g.Type == "Point" && len(g.Coordinates) >= 2 {
+			points[i] = formatLatLng(g.Coordinates[1], g.Coordinates[0])
+		}
+	}
+
+	for _, name := range t.header {
+		if isCoordinateHeader(name) {
+			return t.table(), nil
+		}
+	}
+	for i, point := range points {
+		t.set(i, "LatLng", point)
+	}
+	return t.table(), nil
+}
+
+// decodeObject decodes a JSON object, returning its keys in order
+func decodeObject(data []byte) ([]string, map[string]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, fmt.Errorf("not a JSON object")
+	}
+	var keys []string
+	values := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		if _, seen := values[key]; !seen {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+	return keys, values, nil
+}
+
+// jsonCell returns the text of a JSON value as a cell: strings without
+// quotes, numbers as written, null as empty and objects and arrays as JSON
+func jsonCell(raw json.RawMessage) string {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s
+		}
+	}
+	return string(raw)
+}
+
+// writeJSONL writes one JSON object per row, its keys in column order
+func (p *pipeline) writeJSONL(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	quote := func(s string) []byte {
+		buf.Reset()
+		enc.Encode(s)
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	}
+	for _, row := range p.rows {
+		bw.WriteByte('{')
+		for i, cell := range row {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			bw.Write(quote(p.header[i]))
+			bw.WriteByte(':')
+			bw.Write(quote(cell))
+		}
+		bw.WriteString("}\n")
+	}
+	return bw.Flush()
+}
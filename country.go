@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// parseExpectedCountries parses the comma-separated ISO 3166-1 alpha-2 codes
+// of --expect-country into a set of lowercase codes, as Nominatim returns them
+func parseExpectedCountries(list string) (map[string]bool, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	codes := make(map[string]bool)
+	for _, code := range strings.Split(list, ",") {
+		code = strings.ToLower(strings.TrimSpace(code))
+		if len(code) != 2 || code[0] < 'a' || code[0] > 'z' || code[1] < 'a' || code[1] > 'z' {
+			return nil, fmt.Errorf("--expect-country: %q is not a two-letter country code (e.g. KH, TH)", code)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// countryMismatch describes why a result lies outside --expect-country, or
+// returns "" if it doesn't. Results without a country code, such as ones
+// cached by an older version, are not flagged.
+func (s *Service) countryMismatch(coords Coordinates, result geocodeResult) string {
+	if len(s.cfg.expectCountries) == 0 || result.country == "" || s.cfg.expectCountries[result.country] {
+		return ""
+	}
+	msg := fmt.Sprintf("country mismatch: resolved to %s, expected %s",
+		strings.ToUpper(result.country), strings.ToUpper(s.cfg.ExpectCountry))
+	// A longitude that is also a valid latitude is the usual sign of swapped columns
+	if math.Abs(coords.Lng) <= 90 {
+		msg += " (are latitude and longitude swapped?)"
+	}
+	return msg
+}
+
+// writeSkippedStatus records why a row was skipped. Country mismatches are
+// always flagged in the Status column, which is added if needed, so a
+// foreign address never passes unnoticed.
+func (s *Service) writeSkippedStatus(rowNum int, result rowResult) {
+	if result.countryMismatch {
+		s.countryMismatches++
+		if s.statusCol == -1 {
+			s.addStatusColumn()
+		}
+	}
+	s.writeStatus(rowNum, statusMessage(result))
+}
+
+// reportCountryMismatches summarizes rows that resolved outside --expect-country
+func (s *Service) reportCountryMismatches() {
+	if s.countryMismatches == 0 {
+		return
+	}
+	fmt.Printf("⚠ %d rows resolved outside %s and were left empty; see the %s column\n",
+		s.countryMismatches, strings.ToUpper(s.cfg.ExpectCountry), statusHeader)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// defaultCRS is WGS84 latitude/longitude, the coordinate system Nominatim expects
+const defaultCRS = "EPSG:4326"
+
+// projection converts coordinates from an input CRS to WGS84
+type projection interface {
+	// toWGS84 converts an x,y pair (easting, northing) to latitude and longitude in degrees
+	toWGS84(x, y float64) (lat, lng float64)
+}
+
+// parseCRS returns the projection for an EPSG code such as "EPSG:32648",
+// or nil for WGS84 latitude/longitude
+func parseCRS(code string) (projection, error) {
+	num := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(code)), "EPSG:")
+	epsg, err := strconv.Atoi(num)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRS %q (expected an EPSG code such as EPSG:32648)", code)
+	}
+
+	switch {
+	case epsg == 4326:
+		return nil, nil
+	case epsg == 3857 || epsg == 900913 || epsg == 3785:
+		return webMercator{}, nil
+	case epsg >= 32601 && epsg <= 32660:
+		return newUTM(epsg-32600, false), nil
+	case epsg >= 32701 && epsg <= 32760:
+		return newUTM(epsg-32700, true), nil
+	}
+	return nil, fmt.Errorf("unsupported CRS %q (supported: EPSG:4326, EPSG:3857, WGS 84 / UTM EPSG:326xx and EPSG:327xx)", code)
+}
+
+// WGS84 ellipsoid
+const (
+	wgs84A = 6378137.0
+	wgs84F = 1 / 298.257223563
+)
+
+// webMercator is EPSG:3857, the spherical Mercator used by web maps
+type webMercator struct{}
+
+func (webMercator) toWGS84(x, y float64) (lat, lng float64) {
+	lng = x / wgs84A * 180 / math.Pi
+	lat = (2*math.Atan(math.Exp(y/wgs84A)) - math.Pi/2) * 180 / math.Pi
+	return lat, lng
+}
+
+// utm is a WGS 84 / UTM zone, projected and inverted with the Krüger series,
+// which is accurate to well under a millimetre within the zone
+type utm struct {
+	lng0     float64 // central meridian in radians
+	northing float64 // false northing
+	a        float64 // rectifying radius
+	alpha    [3]float64
+	beta     [3]float64
+	delta    [3]float64
+}
+
+// UTM scale factor on the central meridian and false easting
+const (
+	utmK0           = 0.9996
+	utmFalseEasting = 500000.0
+)
+
+func newUTM(zone int, south bool) *utm {
+	n := wgs84F / (2 - wgs84F)
+	n2, n3 := n*n, n*n*n
+	u := &utm{
+		lng0: float64(zone*6-183) * math.Pi / 180,
+		a:    wgs84A / (1 + n) * (1 + n2/4 + n2*n2/64),
+		alpha: [3]float64{
+			n/2 - 2*n2/3 + 5*n3/16,
+			13*n2/48 - 3*n3/5,
+			61 * n3 / 240,
+		},
+		beta: [3]float64{
+			n/2 - 2*n2/3 + 37*n3/96,
+			n2/48 + n3/15,
+			17 * n3 / 480,
+		},
+		delta: [3]float64{
+			2*n - 2*n2/3 - 2*n3,
+			7*n2/3 - 8*n3/5,
+			56 * n3 / 15,
+		},
+	}
+	if south {
+		u.northing = 10000000
+	}
+	return u
+}
+
+func (u *utm) toWGS84(x, y float64) (lat, lng float64) {
+	xi := (y - u.northing) / (utmK0 * u.a)
+	eta := (x - utmFalseEasting) / (utmK0 * u.a)
+
+	xiP, etaP := xi, eta
+	for j, b := range u.beta {
+		k := 2 * float64(j+1)
+		xiP -= b * math.Sin(k*xi) * math.Cosh(k*eta)
+		etaP -= b * math.Cos(k*xi) * math.Sinh(k*eta)
+	}
+
+	chi := math.Asin(math.Sin(xiP) / math.Cosh(etaP))
+	phi := chi
+	for j, d := range u.delta {
+		phi += d * math.Sin(2*float64(j+1)*chi)
+	}
+	lambda := u.lng0 + math.Atan2(math.Sinh(etaP), math.Cos(xiP))
+
+	return phi * 180 / math.Pi, lambda * 180 / math.Pi
+}
+
+// fromWGS84 projects latitude and longitude in degrees to easting and northing
+func (u *utm) fromWGS84(lat, lng float64) (x, y float64) {
+	phi := lat * math.Pi / 180
+	lambda := lng*math.Pi/180 - u.lng0
+
+	e := math.Sqrt(wgs84F * (2 - wgs84F)) // first eccentricity
+	sinPhi := math.Sin(phi)
+	t := math.Sinh(math.Atanh(sinPhi) - e*math.Atanh(e*sinPhi))
+	xiP := math.Atan2(t, math.Cos(lambda))
+	etaP := math.Atanh(math.Sin(lambda) / math.Sqrt(1+t*t))
+
+	xi, eta := xiP, etaP
+	for j, a := range u.alpha {
+		k := 2 * float64(j+1)
+		xi += a * math.Sin(k*xiP) * math.Cosh(k*etaP)
+		eta += a * math.Cos(k*xiP) * math.Sinh(k*etaP)
+	}
+	return utmFalseEasting + utmK0*u.a*eta, u.northing + utmK0*u.a*xi
+}
+
+// utmZone returns the standard UTM zone of a coordinate and whether it is in
+// the southern hemisphere. The Norway and Svalbard exceptions are not applied.
+func utmZone(lat, lng float64) (zone int, south bool) {
+	zone = int(math.Floor((lng+180)/6)) + 1
+	if zone > 60 {
+		zone = 60
+	}
+	if zone < 1 {
+		zone = 1
+	}
+	return zone, lat < 0
+}
+
+// reproject converts a parsed "x,y" pair to WGS84 and checks the result is on the globe
+func reproject(p projection, x, y float64) (Coordinates, error) {
+	lat, lng := p.toWGS84(x, y)
+	if math.IsNaN(lat) || math.IsNaN(lng) || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return Coordinates{}, fmt.Errorf("coordinates %g,%g are outside the input CRS", x, y)
+	}
+	return Coordinates{Lat: lat, Lng: lng}, nil
+}
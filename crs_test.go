@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseCRS(t *testing.T) {
+	for code, want := range map[string]projection{
+		"EPSG:4326":  nil,
+		" epsg:4326": nil,
+		"EPSG:3857":  webMercator{},
+		"900913":     webMercator{},
+	} {
+		got, err := parseCRS(code)
+		if err != nil || got != want {
+			t.Errorf("parseCRS(%q) = %v, %v, want %v", code, got, err, want)
+		}
+	}
+	for code, zone := range map[string]struct {
+		lng0  float64
+		south bool
+	}{
+		"EPSG:32648": {105, false},
+		"EPSG:32601": {-177, false},
+		"EPSG:32756": {153, true},
+		"EPSG:32760": {177, true},
+	} {
+		p, err := parseCRS(code)
+		u, ok := p.(*utm)
+		if err != nil || !ok {
+			t.Errorf("parseCRS(%q) = %v, %v, want a UTM zone", code, p, err)
+			continue
+		}
+		if lng0 := u.lng0 * 180 / math.Pi; math.Abs(lng0-zone.lng0) > 1e-9 || (u.northing != 0) != zone.south {
+			t.Errorf("parseCRS(%q) = central meridian %g, false northing %g", code, lng0, u.northing)
+		}
+	}
+	for _, code := range []string{"", "WGS84", "EPSG:32600", "EPSG:32661", "EPSG:27700"} {
+		if _, err := parseCRS(code); err == nil {
+			t.Errorf("parseCRS(%q) succeeded", code)
+		}
+	}
+}
+
+func TestWebMercator(t *testing.T) {
+	// The edges of the square web map world
+	const edge = 20037508.342789244
+	for _, tt := range []struct{ x, y, lat, lng float64 }{
+		{0, 0, 0, 0},
+		{edge, 0, 0, 180},
+		{-edge, edge, 85.0511287798066, -180},
+		{1113194.9079327357, 1118889.9748579594, 10, 10},
+	} {
+		lat, lng := webMercator{}.toWGS84(tt.x, tt.y)
+		if math.Abs(lat-tt.lat) > 1e-9 || math.Abs(lng-tt.lng) > 1e-9 {
+			t.Errorf("toWGS84(%g, %g) = %.10f,%.10f, want %.10f,%.10f", tt.x, tt.y, lat, lng, tt.lat, tt.lng)
+		}
+	}
+}
+
+func TestUTMOnTheCentralMeridian(t *testing.T) {
+	// On the central meridian the northing is the WGS84 meridian arc from
+	// the equator, scaled by 0.9996
+	u := newUTM(48, false)
+	for _, tt := range []struct{ lat, arc float64 }{
+		{0, 0},
+		{45, 4984944.378},
+		{90, 10001965.729},
+	} {
+		x, y := u.fromWGS84(tt.lat, 105)
+		if math.Abs(x-utmFalseEasting) > 1e-3 || math.Abs(y-utmK0*tt.arc) > 1e-3 {
+			t.Errorf("fromWGS84(%g, 105) = %.3f, %.3f, want 500000, %.3f", tt.lat, x, y, utmK0*tt.arc)
+		}
+	}
+	s := newUTM(48, true)
+	if x, y := s.fromWGS84(-45, 105); math.Abs(x-utmFalseEasting) > 1e-3 || math.Abs(y-(10000000-utmK0*4984944.378)) > 1e-3 {
+		t.Errorf("southern fromWGS84(-45, 105) = %.3f, %.3f", x, y)
+	}
+}
+
+func TestUTMRoundTrips(t *testing.T) {
+	for _, south := range []bool{false, true} {
+		u := newUTM(48, south)
+		for _, lat := range []float64{0.5, 11.5564, 45, 79.9} {
+			if south {
+				lat = -lat
+			}
+			// Across the zone, which spans 102°E to 108°E
+			for _, lng := range []float64{102, 104.9282, 105, 108} {
+				x, y := u.fromWGS84(lat, lng)
+				gotLat, gotLng := u.toWGS84(x, y)
+				// 1e-8° is about a millimetre
+				if math.Abs(gotLat-lat) > 1e-8 || math.Abs(gotLng-lng) > 1e-8 {
+					t.Errorf("%g,%g went to %.3f, %.3f and back to %.10f,%.10f", lat, lng, x, y, gotLat, gotLng)
+				}
+			}
+		}
+	}
+}
+
+func TestUTMZone(t *testing.T) {
+	for _, tt := range []struct {
+		lat, lng float64
+		zone     int
+		south    bool
+	}{
+		{11.5564, 104.9282, 48, false},
+		{-33.8568, 151.2153, 56, true},
+		{51.5, -0.1, 30, false},
+		{51.5, 0.1, 31, false},
+		{0, -180, 1, false},
+		{0, 180, 60, false},
+	} {
+		if zone, south := utmZone(tt.lat, tt.lng); zone != tt.zone || south != tt.south {
+			t.Errorf("utmZone(%g, %g) = %d, %v, want %d, %v", tt.lat, tt.lng, zone, south, tt.zone, tt.south)
+		}
+	}
+}
+
+func TestReprojectRefusesPointsOffTheGlobe(t *testing.T) {
+	if _, err := reproject(webMercator{}, 0, 0); err != nil {
+		t.Errorf("reproject(0, 0): %v", err)
+	}
+	if c, err := reproject(webMercator{}, 3*20037508.342789244, 0); err == nil {
+		t.Errorf("reproject past the edge of the map = %+v, want an error", c)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// defaultDBBatchSize is the number of rows written per UPDATE when --batch-size is not set
+const defaultDBBatchSize = 500
+
+// maxDBBatchSize keeps an UPDATE within the 65535 parameters PostgreSQL and MySQL allow
+const maxDBBatchSize = 65535 / 4
+
+// dbRow is a row read from the --db-url table
+type dbRow struct {
+	seq    int
+	key    string
+	coords string
+}
+
+// dbItem is a geocoded row waiting to be written back
+type dbItem struct {
+	key    string
+	result rowResult
+}
+
+// sqlDialect is what differs between the databases --db-url can read from
+type sqlDialect interface {
+	// driver is the database/sql driver name
+	driver() string
+	// dsn converts a --db-url into the driver's connection string
+	dsn(u *url.URL) (string, error)
+	// quote quotes an identifier
+	quote(ident string) string
+	// geometryPoint returns the latitude and longitude select expressions of a geometry column
+	geometryPoint(ctx context.Context, db *sql.DB, column string) (string, error)
+	// updateQuery builds one UPDATE writing the results of n rows; the
+	// parameters are key, address, district and province per row
+	updateQuery(c *Config, n int, keyType string) string
+}
+
+// dialectFor returns the dialect of a --db-url scheme
+func dialectFor(scheme string) (sqlDialect, bool) {
+	switch scheme {
+	case "postgres", "postgresql":
+		return postgresDialect{}, true
+	case "mysql", "mariadb":
+		return mysqlDialect{}, true
+	}
+	return nil, false
+}
+
+// checkDatabaseOptions validates the --db-* flags of a database run
+func (c *Config) checkDatabaseOptions() error {
+	u, err := url.Parse(c.DatabaseURL)
+	if err != nil {
+		return fmt.Errorf("--db-url: %w", err)
+	}
+	d, ok := dialectFor(u.Scheme)
+	if !ok {
+		return fmt.Errorf("--db-url: unsupported database %q (expected postgres:// or mysql://)", u.Scheme)
+	}
+	if _, err := d.dsn(u); err != nil {
+		return fmt.Errorf("--db-url: %w", err)
+	}
+	c.dialect = d
+	if c.DBTable == "" {
+		return fmt.Errorf("--db-url needs --db-table, the table to write the results to")
+	}
+	if (c.DBLatitude == "") != (c.DBLongitude == "") {
+		return fmt.Errorf("--db-latitude and --db-longitude must be given together")
+	}
+	sources := 0
+	for _, v := range []string{c.DBCoordinates, c.DBLatitude, c.DBGeometry} {
+		if v != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("use only one of --db-coordinates, --db-latitude/--db-longitude and --db-geometry")
+	}
+	if sources == 0 && c.DBQuery == "" {
+		return fmt.Errorf("--db-url needs --db-coordinates, --db-latitude and --db-longitude, --db-geometry or --db-query")
+	}
+	columns := strings.Split(c.DBColumns, ",")
+	if len(columns) != 3 {
+		return fmt.Errorf("--db-columns needs three columns for address, district and province, got %q", c.DBColumns)
+	}
+	for i, col := range columns {
+		if c.dbColumns[i] = strings.TrimSpace(col); c.dbColumns[i] == "" {
+			return fmt.Errorf("--db-columns needs three columns for address, district and province, got %q", c.DBColumns)
+		}
+	}
+	return nil
+}
+
+// quoteTable quotes a table name that may be schema-qualified
+func quoteTable(d sqlDialect, name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = d.quote(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// dbSelectQuery returns the --db-query, or a query for the rows of --db-table
+// that have no address yet
+func (c *Config) dbSelectQuery(ctx context.Context, db *sql.DB) (string, error) {
+	if c.DBQuery != "" {
+		return c.DBQuery, nil
+	}
+	d := c.dialect
+	var coords string
+	switch {
+	case c.DBGeometry != "":
+		point, err := d.geometryPoint(ctx, db, c.DBGeometry)
+		if err != nil {
+			return "", err
+		}
+		coords = point
+	case c.DBLatitude != "":
+		coords = d.quote(c.DBLatitude) + ", " + d.quote(c.DBLongitude)
+	default:
+		coords = d.quote(c.DBCoordinates)
+	}
+	return fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IS NULL",
+		d.quote(c.DBKey), coords, quoteTable(d, c.DBTable), d.quote(c.dbColumns[0])), nil
+}
+
+// runDatabase geocodes the rows selected from a PostgreSQL or MySQL table and writes
+// address, district and province back in batches. Rows are committed as each
+// batch completes, so an interrupted run continues where it stopped when the
+// default query (rows without an address) is used.
+func runDatabase(cfg *Config) error {
+	u, err := url.Parse(cfg.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	dsn, err := cfg.dialect.dsn(u)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(cfg.dialect.driver(), dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("connecting to database: %w", err)
+	}
+
+	s := NewService(nil, cfg)
+	if err := s.warmCache(); err != nil {
+		return err
+	}
+	defer s.persistCache()
+	if err := s.openRawResponses(); err != nil {
+		return err
+	}
+	defer s.closeRawResponses()
+
+	query, err := cfg.dbSelectQuery(ctx, db)
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("selecting rows: %w", err)
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	if len(types) != 2 && len(types) != 3 {
+		return fmt.Errorf("the query must return the key and either 'lat,lng' text or latitude and longitude, got %d columns", len(types))
+	}
+	keyType := strings.ToLower(types[0].DatabaseTypeName())
+	fmt.Printf("Geocoding rows of %s\n", cfg.DBTable)
+
+	numWorkers := cfg.Workers
+	jobs := make(chan dbRow, numWorkers)
+	results := make(chan dbItem, numWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range jobs {
+				if s.failures.isAborted() {
+					continue
+				}
+				results <- dbItem{key: row.key, result: s.resolveRow(row.seq, row.coords)}
+			}
+		}()
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		dest := make([]sql.NullString, len(types))
+		args := make([]interface{}, len(dest))
+		for i := range dest {
+			args[i] = &dest[i]
+		}
+		for seq := 0; rows.Next(); seq++ {
+			if err := rows.Scan(args...); err != nil {
+				readErr <- fmt.Errorf("reading rows: %w", err)
+				return
+			}
+			if ctx.Err() != nil || s.failures.isAborted() {
+				break
+			}
+			coords := dest[1].String
+			if len(dest) == 3 {
+				coords = ""
+				if dest[1].Valid && dest[2].Valid {
+					coords = dest[1].String + "," + dest[2].String
+				}
+			}
+			jobs <- dbRow{seq: seq, key: dest[0].String, coords: coords}
+		}
+		if ctx.Err() != nil {
+			readErr <- nil
+			return
+		}
+		readErr <- rows.Err()
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultDBBatchSize
+	}
+	if batchSize > maxDBBatchSize {
+		batchSize = maxDBBatchSize
+	}
+	var batch []dbItem
+	var writeErr error
+	processed, failed, updated := 0, 0, 0
+	flush := func() {
+		if len(batch) == 0 || writeErr != nil {
+			batch = batch[:0]
+			return
+		}
+		args := make([]interface{}, 0, len(batch)*4)
+		for _, item := range batch {
+			args = append(args, item.key, item.result.address, item.result.district, item.result.province)
+		}
+		// The batch is written even after Ctrl+C, so finished lookups aren't lost
+		if _, err := db.Exec(cfg.dialect.updateQuery(cfg, len(batch), keyType), args...); err != nil {
+			writeErr = fmt.Errorf("updating %s: %w", cfg.DBTable, err)
+			s.failures.abort(writeErr.Error())
+		} else {
+			updated += len(batch)
+			fmt.Printf("Updated %d rows\n", updated)
+		}
+		batch = batch[:0]
+	}
+	for item := range results {
+		processed++
+		if item.result.skipped {
+			s.failures.observe(item.result)
+			failed++
+			fmt.Fprintf(os.Stderr, "Key %s: %s\n", item.key, item.result.message)
+			continue
+		}
+		batch = append(batch, item)
+		if len(batch) >= batchSize {
+			flush()
+		}
+	}
+	flush()
+
+	if err := <-readErr; err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if ctx.Err() != nil {
+		fmt.Printf("Interrupted after %d rows; run again to continue\n", processed)
+	}
+	fmt.Printf("✓ Processed %d rows (%d updated, %d failed)\n", processed, updated, failed)
+	s.reportElevationErrors()
+	return s.failures.err()
+}
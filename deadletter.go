@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadLetter is a failed geocode persisted for later replay
+type deadLetter struct {
+	File      string    `json:"file"`
+	Output    string    `json:"output"`
+	Sheet     string    `json:"sheet"`
+	Row       int       `json:"row"`
+	Input     string    `json:"input"`
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// deadLetterQueue appends failed geocodes to a JSONL file as they happen
+type deadLetterQueue struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	enc    *json.Encoder
+	source string
+	output string
+	sheet  string
+	count  int
+}
+
+// deadLetterPath returns data/<name>_deadletter.jsonl for an input file
+func deadLetterPath(excelFile string) string {
+	fileName := filepath.Base(excelFile)
+	return filepath.Join("data", strings.TrimSuffix(fileName, ".xlsx")+"_deadletter.jsonl")
+}
+
+// openDeadLetterQueue starts a fresh dead letter file for a run
+func openDeadLetterQueue(path, source, output, sheet string) (*deadLetterQueue, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("creating dead letter file: %w", err)
+	}
+	return &deadLetterQueue{
+		path:   path,
+		file:   f,
+		enc:    json.NewEncoder(f),
+		source: source,
+		output: output,
+		sheet:  sheet,
+	}, nil
+}
+
+// add persists a failed row
+func (q *deadLetterQueue) add(row int, result rowResult) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.count++
+	return q.enc.Encode(deadLetter{
+		File:      q.source,
+		Output:    q.output,
+		Sheet:     q.sheet,
+		Row:       row,
+		Input:     result.input,
+		Lat:       result.coords.Lat,
+		Lng:       result.coords.Lng,
+		Error:     result.message,
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+// close closes the file, removing it when the run had no failures
+func (q *deadLetterQueue) close() error {
+	if err := q.file.Close(); err != nil {
+		return err
+	}
+	if q.count == 0 {
+		return os.Remove(q.path)
+	}
+	return nil
+}
+
+// recordFailure adds a row whose geocode failed to the dead letter queue.
+// Rows with empty or unparseable coordinates are not retryable and are skipped.
+func (s *Service) recordFailure(rowNum int, result rowResult) {
+	if s.deadLetters == nil || result.geocodeErr == nil {
+		return
+	}
+	if err := s.deadLetters.add(rowNum, result); err != nil {
+		fmt.Printf("Warning: Could not record failed row %d: %v\n", rowNum, err)
+	}
+}
+
+// readDeadLetters loads every entry of a dead letter file
+func readDeadLetters(path string) ([]deadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []deadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// runReplay retries every entry of a dead letter file, writes the recovered
+// addresses into the output workbook recorded with each entry and rewrites the
+// dead letter file with the entries that still fail
+func runReplay(cfg *Config) error {
+	entries, err := readDeadLetters(cfg.InputFile)
+	if err != nil {
+		return fmt.Errorf("reading dead letter file: %w", err)
+	}
+	if len(entries) == 0 {
+		fmt.Println("Nothing to replay")
+		return nil
+	}
+
+	var outputs []string
+	byOutput := make(map[string][]deadLetter)
+	for _, entry := range entries {
+		if _, ok := byOutput[entry.Output]; !ok {
+			outputs = append(outputs, entry.Output)
+		}
+		byOutput[entry.Output] = append(byOutput[entry.Output], entry)
+	}
+
+	var remaining []deadLetter
+	recovered := 0
+	for _, output := range outputs {
+		failed, err := replayInto(cfg, output, byOutput[output])
+		if err != nil {
+			return err
+		}
+		recovered += len(byOutput[output]) - len(failed)
+		remaining = append(remaining, failed...)
+	}
+
+	if len(remaining) == 0 {
+		if err := os.Remove(cfg.InputFile); err != nil {
+			return fmt.Errorf("removing dead letter file: %w", err)
+		}
+	} else {
+		err := writeFileAtomic(cfg.InputFile, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			for _, entry := range remaining {
+				if err := enc.Encode(entry); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("rewriting dead letter file: %w", err)
+		}
+	}
+
+	fmt.Printf("✓ Replayed %d entries: %d recovered, %d still failing\n", len(entries), recovered, len(remaining))
+	return nil
+}
+
+// replayInto retries entries whose results belong in the given output workbook
+// and returns the entries that failed again
+func replayInto(cfg *Config, output string, entries []deadLetter) ([]deadLetter, error) {
+	repo, err := NewRepository(output)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", output, err)
+	}
+	defer repo.Close()
+	repo.SetPreserveFormatting(cfg.Writer == writerPatch)
+
+	service := NewService(repo, cfg)
+	_, addressCol, districtCol, provinceCol, err := service.findColumns(repo.GetRows())
+	if err != nil {
+		return nil, err
+	}
+	if addressCol == -1 || districtCol == -1 || provinceCol == -1 {
+		return nil, fmt.Errorf("%s has no Address/District/Province columns", output)
+	}
+
+	service.setupColumns(repo.GetRows()[0], provinceCol)
+
+	var failed []deadLetter
+	for _, entry := range entries {
+		result := service.resolveRow(entry.Row-1, entry.Input)
+		if result.skipped {
+			fmt.Printf("Row %d: %s\n", entry.Row, result.message)
+			entry.Error = result.message
+			entry.Timestamp = time.Now().UTC()
+			failed = append(failed, entry)
+			continue
+		}
+		if err := service.writeAddressCells(entry.Row, addressCol, districtCol, provinceCol, result); err != nil {
+			fmt.Printf("Row %d: ✗ %v\n", entry.Row, err)
+			entry.Error = err.Error()
+			entry.Timestamp = time.Now().UTC()
+			failed = append(failed, entry)
+			continue
+		}
+		fmt.Printf("Row %d: ✓ (%.6f, %.6f) -> %s\n", entry.Row, result.coords.Lat, result.coords.Lng, result.address)
+	}
+
+	if len(failed) < len(entries) {
+		if err := repo.SaveAs(output); err != nil {
+			return nil, fmt.Errorf("saving %s: %w", output, err)
+		}
+		fmt.Printf("✓ Output saved to: %s\n", output)
+	}
+	return failed, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"time"
+)
+
+// diagnosticsInterval is how often --pprof logs memory and goroutine stats
+const diagnosticsInterval = 30 * time.Second
+
+// startDiagnostics serves the Go profiler on addr and logs runtime stats
+// every diagnosticsInterval, to find out where a large run's memory goes.
+// Profiles are read with go tool pprof, e.g.
+// go tool pprof http://localhost:6060/debug/pprof/heap
+func startDiagnostics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("--pprof: %w", err)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	fmt.Fprintf(os.Stderr, "Profiler on http://%s/debug/pprof/\n", ln.Addr())
+
+	go func() {
+		started := time.Now()
+		for range time.Tick(diagnosticsInterval) {
+			logRuntimeStats(time.Since(started))
+		}
+	}()
+	return nil
+}
+
+// logRuntimeStats writes one line of memory and goroutine stats to stderr,
+// so it doesn't mix with --stdin output
+func logRuntimeStats(uptime time.Duration) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(os.Stderr, "[runtime %s] heap %s in use, %s from the OS, %d GCs, %d goroutines\n",
+		uptime.Round(time.Second), formatBytes(int64(m.HeapInuse)), formatBytes(int64(m.Sys)),
+		m.NumGC, runtime.NumGoroutine())
+}
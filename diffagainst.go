@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// reusedColumn is a result column copied from the --diff-against output
+type reusedColumn struct {
+	header    string
+	cur, prev int // 0-based columns of this run and the previous output
+}
+
+// reusePreviousOutput copies the results of rows whose coordinates are the
+// same as in the --diff-against output and marks them done, so only new and
+// changed rows are geocoded. Rows are matched by --change-key when set, and
+// otherwise by their coordinates; previous rows without an address are
+// looked up again.
+func (s *Service) reusePreviousOutput(rows [][]string, latLngCol, addressCol, districtCol, provinceCol int) error {
+	prev, err := NewRepository(s.cfg.DiffAgainst)
+	if err != nil {
+		return fmt.Errorf("--diff-against: %w", err)
+	}
+	defer prev.Close()
+
+	prevRows := prev.GetRows()
+	header := prevRows[0]
+	prevCoords := -1
+	for i, cell := range header {
+		if isCoordinateHeader(cell) {
+			prevCoords = i
+			break
+		}
+	}
+	if prevCoords == -1 {
+		return fmt.Errorf("--diff-against: %s has no coordinate column", s.cfg.DiffAgainst)
+	}
+	prevKey, err := s.changeKeyColumn(header)
+	if err != nil {
+		return fmt.Errorf("--diff-against %s: %w", s.cfg.DiffAgainst, err)
+	}
+	curKey, err := s.changeKeyColumn(rows[0])
+	if err != nil {
+		return err
+	}
+
+	prevAddress, prevDistrict, prevProvince := findResultColumns(header)
+	cols := []reusedColumn{
+		{"Address", addressCol, prevAddress},
+		{"District", districtCol, prevDistrict},
+		{"Province", provinceCol, prevProvince},
+	}
+	for _, c := range s.extraCols {
+		cols = append(cols, reusedColumn{c.header, c.col, columnIndex(header, c.header)})
+	}
+	if s.statusCol != -1 {
+		cols = append(cols, reusedColumn{statusHeader, s.statusCol, findStatusColumn(header)})
+	}
+	for _, c := range cols {
+		if c.prev == -1 {
+			return fmt.Errorf("--diff-against: %s has no %s column; process the file without --diff-against once to fill it", s.cfg.DiffAgainst, c.header)
+		}
+	}
+
+	cell := func(rows [][]string, i, col int) string {
+		if col < 0 || col >= len(rows[i]) {
+			return ""
+		}
+		return strings.TrimSpace(rows[i][col])
+	}
+	coordKey := func(text string) (string, bool) {
+		coords, err := s.parseCoordinates(text)
+		if err != nil {
+			return "", false
+		}
+		return fmt.Sprintf("%.6f,%.6f", coords.Lat, coords.Lng), true
+	}
+
+	// Index the previous rows that have a result
+	byKey := make(map[string]int)
+	prevCoordKeys := make(map[int]string)
+	for i := 1; i < len(prevRows); i++ {
+		key, ok := coordKey(cell(prevRows, i, prevCoords))
+		if !ok || cell(prevRows, i, prevAddress) == "" {
+			continue
+		}
+		prevCoordKeys[i] = key
+		if prevKey >= 0 {
+			key = cell(prevRows, i, prevKey)
+		}
+		if _, seen := byKey[key]; !seen && key != "" {
+			byKey[key] = i
+		}
+	}
+
+	if s.resumed == nil {
+		s.resumed = make(map[int]bool)
+	}
+	reused, geocode := 0, 0
+	for i := 1; i < len(rows); i++ {
+		if s.resumed[i+1] {
+			continue
+		}
+		coords, ok := coordKey(cell(rows, i, latLngCol))
+		if !ok {
+			continue
+		}
+		key := coords
+		if curKey >= 0 {
+			key = cell(rows, i, curKey)
+		}
+		p, found := byKey[key]
+		if !found || prevCoordKeys[p] != coords {
+			geocode++
+			continue
+		}
+		for _, c := range cols {
+			value, err := previousCellValue(prev, p+1, c.prev, cell(prevRows, p, c.prev))
+			if err != nil {
+				return fmt.Errorf("--diff-against: %w", err)
+			}
+			if url, ok := value.(string); ok && c.header == mapLinkHeader {
+				value = hyperlink{url: url}
+			}
+			if err := s.writeCell(i+1, c.cur, value); err != nil {
+				return err
+			}
+		}
+		s.resumed[i+1] = true
+		reused++
+	}
+	fmt.Printf("✓ %d rows unchanged since %s; %d new or changed rows to geocode\n", reused, s.cfg.DiffAgainst, geocode)
+	return nil
+}
+
+// previousCellValue returns a cell of the previous output as it is stored,
+// so numbers and booleans are copied as such rather than as their text
+func previousCellValue(prev *Repository, rowNum, col int, text string) (interface{}, error) {
+	if text == "" {
+		return nil, nil
+	}
+	name, err := excelize.CoordinatesToCellName(col+1, rowNum)
+	if err != nil {
+		return nil, err
+	}
+	f := prev.GetFile()
+	typ, err := f.GetCellType(prev.GetSheetName(), name)
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case excelize.CellTypeNumber, excelize.CellTypeUnset, excelize.CellTypeBool:
+		raw, err := f.GetCellValue(prev.GetSheetName(), name, excelize.Options{RawCellValue: true})
+		if err != nil {
+			return nil, err
+		}
+		if typ == excelize.CellTypeBool {
+			return raw == "1", nil
+		}
+		if n, err := strconv.ParseFloat(raw, 64); err == nil {
+			return n, nil
+		}
+	}
+	return text, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// coordinateGroup is one unique coordinate of a sheet and the rows that
+// have it, each looked up once and its result copied to every row
+type coordinateGroup struct {
+	coords Coordinates
+	rows   []int         // row indexes, in sheet order
+	inputs []string      // the coordinate text of each row
+	points []Coordinates // the coordinates of each row, which --coarse groups by cell
+}
+
+// groupRows pre-scans the coordinates of rows, the first of which is
+// rows[first] of the sheet (the header being rows[0]), and groups them by the cache key, so identical coordinates
+// (to six decimals, or in the same --coarse cell) are dispatched once. Rows without valid coordinates come
+// back as skipped results; rows finished by a resumed run are left out.
+func (s *Service) groupRows(rows [][]string, first, latLngCol int) ([]*coordinateGroup, []rowResult) {
+	var groups []*coordinateGroup
+	var invalid []rowResult
+	byKey := make(map[string]*coordinateGroup)
+	for i, row := range rows {
+		rowIndex := first + i
+		if s.resumed[rowIndex+1] {
+			continue
+		}
+		coordStr := strings.TrimSpace(s.rowCoordinates(row, latLngCol))
+		coords, skipped, ok := s.parseRow(rowIndex, coordStr)
+		if !ok {
+			invalid = append(invalid, skipped)
+			continue
+		}
+		key := s.cache.key(coords.Lat, coords.Lng)
+		g := byKey[key]
+		if g == nil {
+			g = &coordinateGroup{coords: coords}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.rows = append(g.rows, rowIndex)
+		g.inputs = append(g.inputs, coordStr)
+		g.points = append(g.points, coords)
+	}
+	if s.cfg.GeohashOrder {
+		sortByGeohash(groups)
+	}
+	return groups, invalid
+}
+
+// sortByGeohash orders groups along the geohash curve, so nearby points are
+// looked up one after another and the provider's caches stay warm
+func sortByGeohash(groups []*coordinateGroup) {
+	keys := make(map[*coordinateGroup]string, len(groups))
+	for _, g := range groups {
+		keys[g] = geohash(g.coords.Lat, g.coords.Lng, maxGeohashPrecision)
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return keys[groups[i]] < keys[groups[j]] })
+}
+
+// dispatchGroups looks up each group on numWorkers workers and sends a
+// result for every row to results, skipped rows first. It returns once all
+// results are sent, so the caller can close results. Groups are handed out
+// as workers free up, so with a small results buffer the lookups wait for
+// the caller to write results instead of piling them up in memory. The
+// groups themselves are all built up front by groupRows, so memory grows
+// with the unique coordinates of the sheet, or of the batch.
+func (s *Service) dispatchGroups(groups []*coordinateGroup, invalid []rowResult, numWorkers int, results chan<- rowResult) {
+	for _, r := range invalid {
+		results <- r
+	}
+
+	jobs := make(chan *coordinateGroup, numWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := range jobs {
+				if s.failures.isAborted() {
+					continue
+				}
+				s.cfg.pause.wait()
+				if err := s.cfg.progress.takeRows(len(g.rows)); err != nil {
+					// The rows are left for when the job is resumed
+					s.stopForQuota(err)
+					continue
+				}
+				result := s.resolveCoordinates(g.rows[0], g.inputs[0], g.coords)
+				for i, rowIndex := range g.rows {
+					r := result
+					r.rowIndex, r.input, r.coords = rowIndex, g.inputs[i], g.points[i]
+					if i > 0 && !r.skipped {
+						// The later rows are served like cache hits
+						r.cached, r.attempts = true, 0
+					}
+					results <- r
+				}
+			}
+		}()
+	}
+	for _, g := range groups {
+		jobs <- g
+	}
+	close(jobs)
+	wg.Wait()
+}
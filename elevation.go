@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// defaultElevationEndpoint is the public Open-Elevation API. OpenTopoData
+// (e.g. https://api.opentopodata.org/v1/srtm90m) answers in the same format.
+const defaultElevationEndpoint = "https://api.open-elevation.com/api/v1/lookup"
+
+// elevationResponse is the lookup response of Open-Elevation and OpenTopoData
+type elevationResponse struct {
+	Results []struct {
+		Elevation *float64 `json:"elevation"` // null where the dataset has no data
+	} `json:"results"`
+}
+
+// withElevation adds the elevation to a result when --elevation is set and
+// the result doesn't have one yet, e.g. one cached before elevations were
+// requested. A failed elevation lookup leaves the column empty rather than
+// failing the row, and is retried on the next run with the same cache.
+func (s *Service) withElevation(coords Coordinates, result geocodeResult) geocodeResult {
+	if !s.cfg.Elevation || result.elevation != nil {
+		return result
+	}
+	elevation, err := s.fetchElevation(coords.Lat, coords.Lng)
+	if err != nil {
+		if atomic.AddInt64(&s.elevationErrors, 1) == 1 {
+			fmt.Fprintf(os.Stderr, "Warning: elevation lookup failed: %v\n", err)
+		}
+		return result
+	}
+	result.elevation = &elevation
+	if result.cached {
+		s.cache.set(coords.Lat, coords.Lng, result)
+	}
+	return result
+}
+
+// fetchElevation asks the --elevation-endpoint for the height of a point in
+// metres, with the same retries and rate limiting as geocoding requests
+func (s *Service) fetchElevation(lat, lng float64) (float64, error) {
+	maxRetries := s.cfg.Retries
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
+	reqURL := s.cfg.ElevationEndpoint + "?" + url.Values{"locations": {fmt.Sprintf("%.6f,%.6f", lat, lng)}}.Encode()
+
+	var lastErr error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(s.cfg.RetryDelay * time.Duration(1<<uint(attempt-1)))
+		}
+		time.Sleep(s.cfg.RequestDelay)
+
+		req, err := http.NewRequest("GET", reqURL, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("User-Agent", s.cfg.UserAgent)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.rawResponses.add(lat, lng, s.cfg.ElevationEndpoint, resp.StatusCode, body)
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			lastErr = fmt.Errorf("elevation API rate limit exceeded")
+			time.Sleep(time.Duration(attempt+1) * s.cfg.RateLimitWait)
+			continue
+		case resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("elevation API returned status %d", resp.StatusCode)
+			continue
+		case resp.StatusCode != http.StatusOK:
+			return 0, fmt.Errorf("elevation API returned status %d: %s", resp.StatusCode, body)
+		}
+
+		var er elevationResponse
+		if err := json.Unmarshal(body, &er); err != nil {
+			return 0, fmt.Errorf("decoding elevation response: %w", err)
+		}
+		if len(er.Results) == 0 || er.Results[0].Elevation == nil {
+			return 0, fmt.Errorf("no elevation data for %.6f,%.6f", lat, lng)
+		}
+		return *er.Results[0].Elevation, nil
+	}
+	return 0, lastErr
+}
+
+// elevationColumn adds the elevation of each row in metres
+func elevationColumn() *extraColumn {
+	return &extraColumn{header: "Elevation", key: "elevation", value: func(r rowResult) interface{} {
+		if r.elevation == nil {
+			return ""
+		}
+		return *r.elevation
+	}}
+}
+
+// reportElevationErrors summarizes rows left without an elevation
+func (s *Service) reportElevationErrors() {
+	if n := atomic.LoadInt64(&s.elevationErrors); n > 0 {
+		fmt.Fprintf(os.Stderr, "⚠ %d rows have no elevation\n", n)
+	}
+}
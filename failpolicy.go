@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// failurePolicy aborts a run once too many geocodes have failed, so an expired
+// API key or a blocked IP doesn't grind through every remaining row
+type failurePolicy struct {
+	maxErrors int64 // 0 means unlimited
+	errors    int64
+	aborted   chan struct{}
+	once      sync.Once
+	reason    string
+}
+
+func newFailurePolicy(cfg *Config) *failurePolicy {
+	maxErrors := int64(cfg.MaxErrors)
+	if cfg.FailFast {
+		maxErrors = 1
+	}
+	return &failurePolicy{
+		maxErrors: maxErrors,
+		aborted:   make(chan struct{}),
+	}
+}
+
+// observe counts a failed geocode and aborts the run when the limit is reached
+func (p *failurePolicy) observe(result rowResult) {
+	if result.geocodeErr == nil || p.maxErrors == 0 {
+		return
+	}
+	if n := atomic.AddInt64(&p.errors, 1); n >= p.maxErrors {
+		p.abort(fmt.Sprintf("aborted after %d failed geocodes (last: %v)", n, result.geocodeErr))
+	}
+}
+
+// abort stops the run; only the first reason is kept
+func (p *failurePolicy) abort(reason string) {
+	p.once.Do(func() {
+		p.reason = reason
+		close(p.aborted)
+	})
+}
+
+// isAborted reports whether the run has been aborted
+func (p *failurePolicy) isAborted() bool {
+	select {
+	case <-p.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// err returns the abort reason as an error, or nil if the run was not aborted
+func (p *failurePolicy) err() error {
+	if !p.isAborted() {
+		return nil
+	}
+	return &abortError{reason: p.reason}
+}
+
+// abortError is the error of an aborted run
+type abortError struct {
+	reason string
+}
+
+func (e *abortError) Error() string {
+	return e.reason
+}
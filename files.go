@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupDir is where originals are copied before they are modified
+const backupDir = "data/backup"
+
+// writeFileAtomic writes a file by streaming into a temporary file in the same
+// directory and renaming it over path once the write has fully succeeded, so a
+// crash mid-write never leaves a truncated file behind
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	tmpName := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("syncing temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temporary file: %w", err)
+	}
+	// CreateTemp uses 0600; give the output the usual permissions
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return fmt.Errorf("setting file permissions: %w", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("renaming temporary file: %w", err)
+	}
+	committed = true
+	return nil
+}
+
+// versionPath names version n of an output: data/file.xlsx is version 1,
+// data/file_v2.xlsx version 2 and so on
+func versionPath(path string, n int) string {
+	if n == 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_v%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// outputVersions returns the newest version of an output that taken reports
+// as saved, or "" if there is none, and the first version after it
+func outputVersions(path string, taken func(string) bool) (latest, next string) {
+	n := 1
+	for ; taken(versionPath(path, n)); n++ {
+		latest = versionPath(path, n)
+	}
+	return latest, versionPath(path, n)
+}
+
+// backupFile copies the file at path into data/backup/ with a timestamp
+// suffix and returns the path of the copy
+func backupFile(path string) (string, error) {
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return "", fmt.Errorf("creating backup directory: %w", err)
+	}
+
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+	backupPath := filepath.Join(backupDir, fmt.Sprintf("%s_%s%s", name, time.Now().Format("20060102-150405"), ext))
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening original: %w", err)
+	}
+	defer src.Close()
+
+	err = writeFileAtomic(backupPath, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("writing backup: %w", err)
+	}
+	return backupPath, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpMetadataURL is the metadata server of Compute Engine, Cloud Run and GKE
+const gcpMetadataURL = "http://metadata.google.internal/computeMetadata/v1/"
+
+// errNoGCPCredentials is returned when no Google credentials could be found
+var errNoGCPCredentials = errors.New("no Google Cloud credentials found; pass a service account key with --bq-credentials, set GOOGLE_APPLICATION_CREDENTIALS or run 'gcloud auth application-default login'")
+
+// gcpCredentialsFile is a service account key or the authorized_user file
+// written by `gcloud auth application-default login`
+type gcpCredentialsFile struct {
+	Type           string `json:"type"`
+	ProjectID      string `json:"project_id"`
+	ClientEmail    string `json:"client_email"`
+	PrivateKey     string `json:"private_key"`
+	TokenURI       string `json:"token_uri"`
+	ClientID       string `json:"client_id"`
+	ClientSecret   string `json:"client_secret"`
+	RefreshToken   string `json:"refresh_token"`
+	QuotaProjectID string `json:"quota_project_id"`
+}
+
+// gcpToken hands out OAuth access tokens, fetching a new one shortly before
+// the current one expires
+type gcpToken struct {
+	mu      sync.Mutex
+	fetch   func() (string, time.Duration, error)
+	token   string
+	expires time.Time
+}
+
+// get returns a valid access token
+func (t *gcpToken) get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expires) > time.Minute {
+		return t.token, nil
+	}
+	token, lifetime, err := t.fetch()
+	if err != nil {
+		return "", fmt.Errorf("getting Google access token: %w", err)
+	}
+	t.token, t.expires = token, time.Now().Add(lifetime)
+	return token, nil
+}
+
+// newGCPToken finds Google credentials the way the gcloud tools do: the
+// given file, GOOGLE_APPLICATION_CREDENTIALS, the gcloud application default
+// credentials, then the metadata server. It also returns the project of the
+// credentials, if they name one.
+func newGCPToken(client *http.Client, credentialsFile, scope string) (*gcpToken, string, error) {
+	path := credentialsFile
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			adc := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(adc); err == nil {
+				path = adc
+			}
+		}
+	}
+	if path == "" {
+		return newMetadataToken(client)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var creds gcpCredentialsFile
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+	switch creds.Type {
+	case "service_account":
+		key, err := parseRSAPrivateKey(creds.PrivateKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", path, err)
+		}
+		if creds.TokenURI == "" {
+			creds.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+		return &gcpToken{fetch: func() (string, time.Duration, error) {
+			assertion, err := signJWT(key, creds.ClientEmail, scope, creds.TokenURI)
+			if err != nil {
+				return "", 0, err
+			}
+			return requestToken(client, creds.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}}, creds.ProjectID, nil
+	case "authorized_user":
+		return &gcpToken{fetch: func() (string, time.Duration, error) {
+			return requestToken(client, "https://oauth2.googleapis.com/token", url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {creds.ClientID},
+				"client_secret": {creds.ClientSecret},
+				"refresh_token": {creds.RefreshToken},
+			})
+		}}, creds.QuotaProjectID, nil
+	}
+	return nil, "", fmt.Errorf("%s: unsupported credentials type %q", path, creds.Type)
+}
+
+// newMetadataToken uses the service account of the machine the tool runs on
+func newMetadataToken(client *http.Client) (*gcpToken, string, error) {
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest("GET", gcpMetadataURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("metadata server returned status %d", resp.StatusCode)
+		}
+		return body, nil
+	}
+	project, err := get("project/project-id")
+	if err != nil {
+		return nil, "", errNoGCPCredentials
+	}
+	return &gcpToken{fetch: func() (string, time.Duration, error) {
+		body, err := get("instance/service-accounts/default/token")
+		if err != nil {
+			return "", 0, err
+		}
+		return decodeToken(body)
+	}}, string(project), nil
+}
+
+// requestToken exchanges a grant for an access token
+func requestToken(client *http.Client, tokenURI string, form url.Values) (string, time.Duration, error) {
+	resp, err := client.PostForm(tokenURI, form)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, body)
+	}
+	return decodeToken(body)
+}
+
+func decodeToken(body []byte) (string, time.Duration, error) {
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", 0, fmt.Errorf("decoding token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return "", 0, fmt.Errorf("token response has no access_token")
+	}
+	return tr.AccessToken, time.Duration(tr.ExpiresIn) * time.Second, nil
+}
+
+// parseRSAPrivateKey reads the PEM key of a service account
+func parseRSAPrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid private_key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private_key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private_key is not an RSA key")
+	}
+	return key, nil
+}
+
+// signJWT builds the RS256-signed assertion a service account trades for a token
+func signJWT(key *rsa.PrivateKey, email, scope, audience string) (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": scope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{unsigned, enc.EncodeToString(sig)}, "."), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// gcsScope is the OAuth scope for reading and writing Cloud Storage objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsStore talks to the Cloud Storage JSON API. Credentials are found like
+// the BigQuery ones; STORAGE_EMULATOR_HOST points it at an emulator, which
+// needs no credentials.
+type gcsStore struct {
+	client   *http.Client
+	token    *gcpToken // nil for an emulator
+	endpoint string
+}
+
+func newGCSStore(client *http.Client) (*gcsStore, error) {
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return &gcsStore{client: client, endpoint: strings.TrimSuffix(host, "/")}, nil
+	}
+	token, _, err := newGCPToken(client, "", gcsScope)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsStore{client: client, token: token, endpoint: "https://storage.googleapis.com"}, nil
+}
+
+// request builds an authorized request
+func (g *gcsStore) request(method, rawURL string, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, r)
+	if err != nil {
+		return nil, err
+	}
+	if g.token != nil {
+		token, err := g.token.get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func (g *gcsStore) get(bucket, key string, w io.Writer) error {
+	rawURL := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", g.endpoint, url.PathEscape(bucket), url.PathEscape(key))
+	resp, err := sendObjectRequest(g.client, func() (*http.Request, error) {
+		return g.request("GET", rawURL, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectResponseError(resp.Request, resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (g *gcsStore) put(bucket, key string, f *os.File, size int64) error {
+	uploadURL := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?name=%s", g.endpoint, url.PathEscape(bucket), url.QueryEscape(key))
+	if size <= objectChunkSize {
+		body, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		resp, err := sendObjectRequest(g.client, func() (*http.Request, error) {
+			return g.request("POST", uploadURL+"&uploadType=media", body)
+		})
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return objectResponseError(resp.Request, resp)
+		}
+		resp.Body.Close()
+		return nil
+	}
+	return g.putResumable(uploadURL+"&uploadType=resumable", f, size)
+}
+
+// putResumable uploads a large file in objectChunkSize chunks to a
+// resumable upload session
+func (g *gcsStore) putResumable(startURL string, f *os.File, size int64) error {
+	resp, err := sendObjectRequest(g.client, func() (*http.Request, error) {
+		req, err := g.request("POST", startURL, []byte{})
+		if err == nil {
+			req.Header.Set("X-Upload-Content-Length", fmt.Sprint(size))
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return objectResponseError(resp.Request, resp)
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("starting resumable upload: no session URL in response")
+	}
+
+	buf := make([]byte, objectChunkSize)
+	for offset := int64(0); offset < size; {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		chunk := buf[:n]
+		contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, size)
+		resp, err := sendObjectRequest(g.client, func() (*http.Request, error) {
+			req, err := g.request("PUT", session, chunk)
+			if err == nil {
+				req.Header.Set("Content-Range", contentRange)
+			}
+			return req, err
+		})
+		if err != nil {
+			return err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			resp.Body.Close()
+			return nil
+		case http.StatusPermanentRedirect:
+			// More is expected; Range says how much was stored, which may
+			// be less than what was sent
+			resp.Body.Close()
+			next := offset + int64(n)
+			var last int64
+			if _, err := fmt.Sscanf(resp.Header.Get("Range"), "bytes=0-%d", &last); err == nil {
+				next = last + 1
+			}
+			offset = next
+			fmt.Printf("  uploaded %s of %s\n", formatBytes(offset), formatBytes(size))
+		default:
+			return objectResponseError(resp.Request, resp)
+		}
+	}
+	return fmt.Errorf("upload session ended before the object was stored")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// geoapifyGeocoder speaks the Geoapify reverse geocoding API
+// (https://apidocs.geoapify.com/docs/geocoding/reverse-geocoding/) and its
+// asynchronous batch API, authenticated with an API key
+type geoapifyGeocoder struct {
+	cfg *Config
+}
+
+// geoapifyResult is one address in Geoapify's JSON format
+type geoapifyResult struct {
+	Formatted   string  `json:"formatted"`
+	ResultType  string  `json:"result_type"` // building, street, suburb, city, county, state, ...
+	Category    string  `json:"category"`
+	HouseNumber string  `json:"housenumber"`
+	Street      string  `json:"street"`
+	Suburb      string  `json:"suburb"`
+	District    string  `json:"district"`
+	City        string  `json:"city"`
+	County      string  `json:"county"`
+	State       string  `json:"state"`
+	Postcode    string  `json:"postcode"`
+	Country     string  `json:"country"`
+	CountryCode string  `json:"country_code"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	Datasource  struct {
+		OSMType string `json:"osm_type"` // N, W or R
+		OSMID   int64  `json:"osm_id"`
+	} `json:"datasource"`
+}
+
+func (g geoapifyGeocoder) request(lat, lng float64) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("lat", fmt.Sprintf("%.6f", lat))
+	params.Set("lon", fmt.Sprintf("%.6f", lng))
+	params.Set("format", "json")
+	params.Set("lang", "en")
+	params.Set("apiKey", g.cfg.APIKey)
+	return http.NewRequest("GET", g.cfg.Endpoint+"?"+params.Encode(), nil)
+}
+
+func (g geoapifyGeocoder) parse(body []byte) (GeocodeResponse, error) {
+	var gr struct {
+		Results []json.RawMessage `json:"results"`
+	}
+	if err := json.Unmarshal(body, &gr); err != nil {
+		return GeocodeResponse{}, err
+	}
+	if len(gr.Results) == 0 {
+		return GeocodeResponse{}, nil
+	}
+	return g.parseBatchPart(gr.Results[0])
+}
+
+func (g geoapifyGeocoder) maxBatch() int {
+	return 1000
+}
+
+// batchEndpoint is the batch job URL, /v1/batch/geocode/reverse next to
+// /v1/geocode/reverse
+func (g geoapifyGeocoder) batchEndpoint() string {
+	if g.cfg.BatchEndpoint != "" {
+		return g.cfg.BatchEndpoint
+	}
+	return strings.Replace(g.cfg.Endpoint, "/v1/geocode/", "/v1/batch/geocode/", 1)
+}
+
+// batchRequest starts a batch job for the points, sent as [lon, lat] pairs
+func (g geoapifyGeocoder) batchRequest(points []Coordinates) (*http.Request, error) {
+	pairs := make([][2]float64, len(points))
+	for i, p := range points {
+		pairs[i] = [2]float64{p.Lng, p.Lat}
+	}
+	body, err := json.Marshal(pairs)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("lang", "en")
+	params.Set("apiKey", g.cfg.APIKey)
+	req, err := http.NewRequest("POST", g.batchEndpoint()+"?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// splitBatch returns the results of a finished job. While the job runs,
+// Geoapify answers with its id and the URL to poll for the results.
+func (g geoapifyGeocoder) splitBatch(body []byte) ([]json.RawMessage, *http.Request, error) {
+	if b := bytes.TrimSpace(body); len(b) > 0 && b[0] == '[' {
+		var parts []json.RawMessage
+		err := json.Unmarshal(b, &parts)
+		return parts, nil, err
+	}
+	var job struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		URL    string `json:"url"`
+	}
+	if err := json.Unmarshal(body, &job); err != nil {
+		return nil, nil, err
+	}
+	if job.ID == "" {
+		return nil, nil, fmt.Errorf("batch answer has no results and no job id: %s", string(body))
+	}
+	pollURL := job.URL
+	if pollURL == "" {
+		params := url.Values{}
+		params.Set("id", job.ID)
+		params.Set("apiKey", g.cfg.APIKey)
+		pollURL = g.batchEndpoint() + "?" + params.Encode()
+	}
+	poll, err := http.NewRequest("GET", pollURL, nil)
+	return nil, poll, err
+}
+
+// parseBatchPart maps a Geoapify result onto the Nominatim address keys:
+// state is the province, county the district, district and suburb the parts
+// of a city
+func (g geoapifyGeocoder) parseBatchPart(part json.RawMessage) (GeocodeResponse, error) {
+	var r geoapifyResult
+	if err := json.Unmarshal(part, &r); err != nil {
+		return GeocodeResponse{}, err
+	}
+	return GeocodeResponse{
+		DisplayName: r.Formatted,
+		Class:       r.Category,
+		Type:        r.ResultType,
+		OSMType:     photonOSMTypes[r.Datasource.OSMType],
+		OSMID:       flexInt(r.Datasource.OSMID),
+		Lat:         strconv.FormatFloat(r.Lat, 'f', -1, 64),
+		Lon:         strconv.FormatFloat(r.Lon, 'f', -1, 64),
+		Address: Address{
+			HouseNumber:  r.HouseNumber,
+			Road:         r.Street,
+			Suburb:       r.Suburb,
+			CityDistrict: r.District,
+			City:         r.City,
+			County:       r.County,
+			State:        r.State,
+			Postcode:     r.Postcode,
+			Country:      r.Country,
+			CountryCode:  strings.ToLower(r.CountryCode),
+		},
+	}, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// geoJSONExport streams the geocoded rows of a run into a GeoJSON
+// FeatureCollection for --export-geojson. Features go to a temporary file
+// as rows complete, so memory stays flat on large sheets, and the file only
+// replaces path once the workbook itself has been saved.
+type geoJSONExport struct {
+	path  string
+	tmp   *os.File
+	buf   *bufio.Writer
+	enc   *json.Encoder
+	count int
+	err   error // first write error; later features are skipped
+}
+
+func openGeoJSONExport(path string) (*geoJSONExport, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary file: %w", err)
+	}
+	buf := bufio.NewWriterSize(tmp, 256*1024)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	e := &geoJSONExport{path: path, tmp: tmp, buf: buf, enc: enc}
+	_, e.err = buf.WriteString(`{"type":"FeatureCollection","features":[` + "\n")
+	return e, nil
+}
+
+// add writes a geocoded row as a point with its row number, input, result
+// and optional columns as properties; a no-op on nil
+func (e *geoJSONExport) add(rowNum int, result rowResult, extra []*extraColumn) {
+	if e == nil || e.err != nil {
+		return
+	}
+	props := map[string]interface{}{
+		"Row":         rowNum,
+		"Coordinates": result.input,
+		"Address":     result.address,
+		"District":    result.district,
+		"Province":    result.province,
+	}
+	for _, c := range extra {
+		props[c.header] = c.value(result)
+	}
+	feature := geoJSONFeature{
+		Type:       "Feature",
+		Geometry:   &geoJSONPoint{Type: "Point", Coordinates: [2]float64{result.coords.Lng, result.coords.Lat}},
+		Properties: props,
+	}
+	if e.count > 0 {
+		if e.err = e.buf.WriteByte(','); e.err != nil {
+			return
+		}
+	}
+	if e.err = e.enc.Encode(feature); e.err == nil {
+		e.count++
+	}
+}
+
+// commit finishes the collection and moves it into place
+func (e *geoJSONExport) commit() error {
+	if e.err == nil {
+		_, e.err = e.buf.WriteString("]}\n")
+	}
+	if e.err == nil {
+		e.err = e.buf.Flush()
+	}
+	if e.err == nil {
+		e.err = e.tmp.Sync()
+	}
+	if err := e.tmp.Close(); e.err == nil {
+		e.err = err
+	}
+	if e.err == nil {
+		e.err = os.Chmod(e.tmp.Name(), 0644)
+	}
+	if e.err == nil {
+		e.err = os.Rename(e.tmp.Name(), e.path)
+	}
+	if e.err != nil {
+		os.Remove(e.tmp.Name())
+	}
+	return e.err
+}
+
+// discard removes the temporary file of an export that wasn't committed
+func (e *geoJSONExport) discard() {
+	if e == nil {
+		return
+	}
+	e.tmp.Close()
+	os.Remove(e.tmp.Name())
+}
+
+// openGeoJSONExport starts the --export-geojson file, if requested
+func (s *Service) openGeoJSONExport() error {
+	if s.cfg.ExportGeoJSON == "" {
+		return nil
+	}
+	export, err := openGeoJSONExport(s.cfg.ExportGeoJSON)
+	if err != nil {
+		return fmt.Errorf("--export-geojson: %w", err)
+	}
+	s.geoJSON = export
+	return nil
+}
+
+// commitGeoJSONExport writes the --export-geojson file after the workbook was saved
+func (s *Service) commitGeoJSONExport() {
+	if s.geoJSON == nil {
+		return
+	}
+	export := s.geoJSON
+	s.geoJSON = nil
+	if err := export.commit(); err != nil {
+		fmt.Printf("Warning: Could not write %s: %v\n", export.path, err)
+		return
+	}
+	fmt.Printf("✓ %d geocoded points exported to %s\n", export.count, export.path)
+}
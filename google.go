@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// googleGeocoder speaks the Google Geocoding API
+// (https://developers.google.com/maps/documentation/geocoding/requests-reverse-geocoding)
+type googleGeocoder struct {
+	cfg *Config
+}
+
+// googleResponse is the answer of the Google Geocoding API
+type googleResponse struct {
+	Status       string         `json:"status"`
+	ErrorMessage string         `json:"error_message"`
+	Results      []googleResult `json:"results"`
+}
+
+type googleResult struct {
+	FormattedAddress  string            `json:"formatted_address"`
+	AddressComponents []googleComponent `json:"address_components"`
+	Types             []string          `json:"types"`
+	PlaceID           string            `json:"place_id"`
+	Geometry          struct {
+		Location struct {
+			Lat float64 `json:"lat"`
+			Lng float64 `json:"lng"`
+		} `json:"location"`
+	} `json:"geometry"`
+}
+
+type googleComponent struct {
+	LongName  string   `json:"long_name"`
+	ShortName string   `json:"short_name"`
+	Types     []string `json:"types"`
+}
+
+func (c googleComponent) is(componentType string) bool {
+	for _, t := range c.Types {
+		if t == componentType {
+			return true
+		}
+	}
+	return false
+}
+
+// googleFilter keeps results with a component of a type and value, as in
+// --google-components country:TH
+type googleFilter struct {
+	componentType string
+	value         string
+}
+
+// googleFilterTypes are the component types --google-components accepts;
+// administrative_area matches any level
+var googleFilterTypes = []string{"country", "administrative_area", "locality", "postal_code", "route"}
+
+// parseGoogleComponents parses "country:TH|administrative_area:Chiang Mai"
+func parseGoogleComponents(spec string) ([]googleFilter, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var filters []googleFilter
+	for _, part := range strings.Split(spec, "|") {
+		componentType, value, ok := strings.Cut(part, ":")
+		componentType, value = strings.TrimSpace(componentType), strings.TrimSpace(value)
+		known := false
+		for _, t := range googleFilterTypes {
+			known = known || t == componentType
+		}
+		if !ok || value == "" || !known {
+			return nil, fmt.Errorf("--google-components: %q is not type:value with a type of %s", part, strings.Join(googleFilterTypes, ", "))
+		}
+		filters = append(filters, googleFilter{componentType, value})
+	}
+	return filters, nil
+}
+
+// matches reports whether a result has a component the filter asks for
+func (f googleFilter) matches(r googleResult) bool {
+	for _, c := range r.AddressComponents {
+		typeMatches := c.is(f.componentType)
+		if f.componentType == "administrative_area" {
+			for _, t := range c.Types {
+				typeMatches = typeMatches || strings.HasPrefix(t, "administrative_area_level_")
+			}
+		}
+		if typeMatches && (strings.EqualFold(c.LongName, f.value) || strings.EqualFold(c.ShortName, f.value)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g googleGeocoder) request(lat, lng float64) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("latlng", fmt.Sprintf("%.6f,%.6f", lat, lng))
+	params.Set("language", "en")
+	if g.cfg.GoogleResultType != "" {
+		params.Set("result_type", g.cfg.GoogleResultType)
+	}
+	if g.cfg.GoogleLocationType != "" {
+		params.Set("location_type", g.cfg.GoogleLocationType)
+	}
+	params.Set("key", g.cfg.APIKey)
+	return http.NewRequest("GET", g.cfg.Endpoint+"?"+params.Encode(), nil)
+}
+
+// parse maps the most specific result left by --google-components onto the
+// Nominatim address keys: administrative_area_level_1 is the state
+// (province), level 2 the county (district, amphoe, khan or srok) and level 3
+// the subdistrict. Bangkok's khet and khwaeng come as sublocality levels 1 and
+// 2 and map to city_district and suburb, as Nominatim has them.
+func (g googleGeocoder) parse(body []byte) (GeocodeResponse, error) {
+	var gr googleResponse
+	if err := json.Unmarshal(body, &gr); err != nil {
+		return GeocodeResponse{}, err
+	}
+	switch gr.Status {
+	case "OK":
+	case "ZERO_RESULTS":
+		return GeocodeResponse{}, nil
+	case "OVER_QUERY_LIMIT":
+		return GeocodeResponse{}, errRateLimited
+	case "UNKNOWN_ERROR":
+		return GeocodeResponse{}, fmt.Errorf("Google returned %s: %s", gr.Status, gr.ErrorMessage)
+	default: // REQUEST_DENIED, INVALID_REQUEST, OVER_DAILY_LIMIT
+		return GeocodeResponse{}, permanentError{fmt.Errorf("Google returned %s: %s", gr.Status, gr.ErrorMessage)}
+	}
+
+	for _, r := range gr.Results {
+		matches := true
+		for _, f := range g.cfg.googleComponents {
+			matches = matches && f.matches(r)
+		}
+		if matches {
+			return googleGeocodeResponse(r), nil
+		}
+	}
+	return GeocodeResponse{}, nil
+}
+
+func googleGeocodeResponse(r googleResult) GeocodeResponse {
+	resp := GeocodeResponse{
+		DisplayName: r.FormattedAddress,
+		Lat:         strconv.FormatFloat(r.Geometry.Location.Lat, 'f', -1, 64),
+		Lon:         strconv.FormatFloat(r.Geometry.Location.Lng, 'f', -1, 64),
+	}
+	if len(r.Types) > 0 {
+		resp.Type = r.Types[0] // e.g. street_address, premise, locality
+	}
+	a := &resp.Address
+	fields := []struct {
+		componentType string
+		field         *string
+	}{
+		{"street_number", &a.HouseNumber},
+		{"route", &a.Road},
+		{"neighborhood", &a.Neighbourhood},
+		{"sublocality_level_2", &a.Suburb},
+		{"sublocality_level_1", &a.CityDistrict},
+		{"locality", &a.City},
+		{"administrative_area_level_3", &a.Subdistrict},
+		{"administrative_area_level_2", &a.County},
+		{"administrative_area_level_1", &a.State},
+		{"postal_code", &a.Postcode},
+		{"country", &a.Country},
+	}
+	for _, c := range r.AddressComponents {
+		for _, f := range fields {
+			if *f.field == "" && c.is(f.componentType) {
+				*f.field = c.LongName
+			}
+		}
+		if c.is("country") {
+			a.CountryCode = strings.ToLower(c.ShortName)
+		}
+	}
+	return resp
+}
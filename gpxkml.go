@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// trackFileHeader is the sheet built from a GPX or KML file
+var trackFileHeader = []string{"Source", "Name", "Time", "Elevation", "Description", "LatLng"}
+
+// isTrackFile reports whether path is a GPX, KML or KMZ file from a GPS
+// device or mapping app rather than a workbook
+func isTrackFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpx", ".kml", ".kmz":
+		return true
+	}
+	return false
+}
+
+// openTrackFile reads the points of a GPX, KML or KMZ file into a new
+// workbook, one row per point, which is then geocoded like any sheet
+func openTrackFile(path string) (*Repository, error) {
+	var rows [][]string
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpx":
+		rows, err = readFileWith(path, readGPX)
+	case ".kml":
+		rows, err = readFileWith(path, readKML)
+	case ".kmz":
+		rows, err = readKMZ(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s contains no points", path)
+	}
+	fmt.Printf("Read %d points from %s\n", len(rows), path)
+
+	f := excelize.NewFile()
+	sheetName := "Points"
+	if err := f.SetSheetName(f.GetSheetName(0), sheetName); err != nil {
+		f.Close()
+		return nil, err
+	}
+	rows = append([][]string{trackFileHeader}, rows...)
+	for i, row := range rows {
+		cells := make([]interface{}, len(row))
+		for j, v := range row {
+			if v != "" {
+				cells[j] = v
+			}
+		}
+		// Keep elevations numeric so they can be charted
+		if ele, err := strconv.ParseFloat(row[3], 64); err == nil && i > 0 {
+			cells[3] = ele
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := f.SetSheetRow(sheetName, cell, &cells); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &Repository{
+		file:      f,
+		path:      path,
+		sheetName: sheetName,
+		rows:      rows,
+		edits:     make(cellEdits),
+	}, nil
+}
+
+func readFileWith(path string, read func(io.Reader) ([][]string, error)) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return read(f)
+}
+
+// formatLatLng writes a point the way coordinate cells are read
+func formatLatLng(lat, lng float64) string {
+	return strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lng, 'f', -1, 64)
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Ele  string  `xml:"ele"`
+	Time string  `xml:"time"`
+	Name string  `xml:"name"`
+	Desc string  `xml:"desc"`
+}
+
+type gpxFile struct {
+	Waypoints []gpxPoint `xml:"wpt"`
+	Routes    []struct {
+		Name   string     `xml:"name"`
+		Points []gpxPoint `xml:"rtept"`
+	} `xml:"rte"`
+	Tracks []struct {
+		Name     string `xml:"name"`
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// readGPX returns a row for every waypoint, route point and track point
+func readGPX(r io.Reader) ([][]string, error) {
+	var gpx gpxFile
+	if err := xml.NewDecoder(r).Decode(&gpx); err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	add := func(source string, p gpxPoint) {
+		rows = append(rows, []string{source, strings.TrimSpace(p.Name), strings.TrimSpace(p.Time),
+			strings.TrimSpace(p.Ele), strings.TrimSpace(p.Desc), formatLatLng(p.Lat, p.Lon)})
+	}
+	for _, p := range gpx.Waypoints {
+		add("waypoint", p)
+	}
+	for _, rte := range gpx.Routes {
+		for _, p := range rte.Points {
+			add(joinSource("route", rte.Name), p)
+		}
+	}
+	for _, trk := range gpx.Tracks {
+		for _, seg := range trk.Segments {
+			for _, p := range seg.Points {
+				add(joinSource("track", trk.Name), p)
+			}
+		}
+	}
+	return rows, nil
+}
+
+func joinSource(kind, name string) string {
+	if name = strings.TrimSpace(name); name != "" {
+		return kind + ": " + name
+	}
+	return kind
+}
+
+type kmlPlacemark struct {
+	Name        string `xml:"name"`
+	Description string `xml:"description"`
+	When        string `xml:"TimeStamp>when"`
+	// Geometries, possibly inside a MultiGeometry; polygons have no single point and are skipped
+	Points      []string `xml:"Point>coordinates"`
+	Lines       []string `xml:"LineString>coordinates"`
+	MultiPoints []string `xml:"MultiGeometry>Point>coordinates"`
+	MultiLines  []string `xml:"MultiGeometry>LineString>coordinates"`
+}
+
+// readKML returns a row for every point placemark and every vertex of a
+// line placemark, wherever they are nested in documents and folders
+func readKML(r io.Reader) ([][]string, error) {
+	dec := xml.NewDecoder(r)
+	var rows [][]string
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "Placemark" {
+			continue
+		}
+		var pm kmlPlacemark
+		if err := dec.DecodeElement(&pm, &start); err != nil {
+			return nil, err
+		}
+		add := func(source, coords string) error {
+			for _, tuple := range strings.Fields(coords) {
+				parts := strings.Split(tuple, ",")
+				if len(parts) < 2 {
+					return fmt.Errorf("placemark %q: invalid coordinates %q", pm.Name, tuple)
+				}
+				lng, err1 := strconv.ParseFloat(parts[0], 64)
+				lat, err2 := strconv.ParseFloat(parts[1], 64)
+				if err1 != nil || err2 != nil {
+					return fmt.Errorf("placemark %q: invalid coordinates %q", pm.Name, tuple)
+				}
+				var ele string
+				if len(parts) > 2 {
+					ele = parts[2]
+				}
+				rows = append(rows, []string{source, strings.TrimSpace(pm.Name), strings.TrimSpace(pm.When),
+					ele, strings.TrimSpace(pm.Description), formatLatLng(lat, lng)})
+			}
+			return nil
+		}
+		for _, c := range append(pm.Points, pm.MultiPoints...) {
+			if err := add("placemark", c); err != nil {
+				return nil, err
+			}
+		}
+		for _, c := range append(pm.Lines, pm.MultiLines...) {
+			if err := add(joinSource("line", pm.Name), c); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// readKMZ reads the main KML document of a KMZ archive
+func readKMZ(path string) ([][]string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	// The main document is doc.kml by convention, or else the first .kml file
+	var doc *zip.File
+	for _, f := range zr.File {
+		if strings.EqualFold(filepath.Ext(f.Name), ".kml") && (doc == nil || strings.EqualFold(f.Name, "doc.kml")) {
+			doc = f
+		}
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("no KML document in archive")
+	}
+	rc, err := doc.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return readKML(rc)
+}
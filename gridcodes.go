@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// maxGeohashPrecision is the longest geohash --geohash accepts; 12 characters
+// is a cell of a few centimetres
+const maxGeohashPrecision = 12
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes a coordinate as a geohash of the given number of characters
+func geohash(lat, lng float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+	var b strings.Builder
+	bits, ch := 0, 0
+	even := true // bits alternate between longitude and latitude, longitude first
+	for b.Len() < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lngRange, lng
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bits++; bits == 5 {
+			b.WriteByte(geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return b.String()
+}
+
+// Open Location Code (Plus Code) constants, see
+// https://github.com/google/open-location-code/blob/main/docs/specification.md
+const (
+	plusCodeAlphabet = "23456789CFGHJMPQRVWX"
+	plusCodePairs    = 5    // a 10-digit code, a cell of about 14 m
+	plusCodeGrid     = 8000 // cells per degree at 10 digits
+)
+
+// plusCode encodes a coordinate as a full 10-digit Plus Code such as
+// "7P28QPG4+4Q", the precision used for navigation
+func plusCode(lat, lng float64) string {
+	// Work in whole cells so digits don't suffer from floating point error
+	latCells := int64(math.Floor(math.Round((lat+90)*plusCodeGrid*1e6) / 1e6))
+	lngCells := int64(math.Floor(math.Round((lng+180)*plusCodeGrid*1e6) / 1e6))
+	if maxLat := int64(180 * plusCodeGrid); latCells >= maxLat {
+		latCells = maxLat - 1 // the north pole belongs to the cell below it
+	} else if latCells < 0 {
+		latCells = 0
+	}
+	fullCircle := int64(360 * plusCodeGrid)
+	lngCells = ((lngCells % fullCircle) + fullCircle) % fullCircle
+
+	digits := make([]byte, 2*plusCodePairs)
+	for i := plusCodePairs - 1; i >= 0; i-- {
+		digits[2*i] = plusCodeAlphabet[latCells%20]
+		digits[2*i+1] = plusCodeAlphabet[lngCells%20]
+		latCells /= 20
+		lngCells /= 20
+	}
+	return string(digits[:8]) + "+" + string(digits[8:])
+}
+
+// gridCodeColumns are the Geohash and Plus Code columns selected on the command line
+func (c *Config) gridCodeColumns() []*extraColumn {
+	var cols []*extraColumn
+	if c.Geohash > 0 {
+		precision := c.Geohash
+		cols = append(cols, &extraColumn{header: "Geohash", key: "geohash", value: func(r rowResult) interface{} {
+			return geohash(r.coords.Lat, r.coords.Lng, precision)
+		}})
+	}
+	if c.PlusCode {
+		cols = append(cols, &extraColumn{header: "Plus Code", key: "plus_code", value: func(r rowResult) interface{} {
+			return plusCode(r.coords.Lat, r.coords.Lng)
+		}})
+	}
+	return cols
+}
+
+// coarseResult keeps what a --coarse lookup holds for its whole geohash
+// cell: the district, province and country. The street address, postcode
+// and place belong to the one point that was looked up, so the address
+// becomes "District, Province". The quality score rated that point's
+// street-level result, so it is cleared too.
+func coarseResult(result geocodeResult) geocodeResult {
+	var parts []string
+	for _, part := range []string{result.district, result.province} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	result.address = strings.Join(parts, ", ")
+	result.postcode = ""
+	result.place = placeInfo{}
+	result.quality = nil
+	return result
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// UTM and MGRS grid references, as survey teams write them:
+//
+//	48N 491234 1275432         UTM zone and hemisphere (N/S), easting, northing
+//	48P 491234mE 1275432mN     UTM zone and latitude band
+//	48PVU9123475432            MGRS, 1 m precision
+//	48P VU 912 754             MGRS, 100 m precision
+var (
+	utmReferencePattern  = regexp.MustCompile(`^(\d{1,2})\s*([C-HJ-NP-X])\s+(\d+(?:\.\d+)?)\s*(?:M?E)?\s+(\d+(?:\.\d+)?)\s*(?:M?N)?$`)
+	mgrsReferencePattern = regexp.MustCompile(`^(\d{1,2})\s*([C-HJ-NP-X])\s*([A-HJ-NP-Z])([A-HJ-NP-V])\s*(\d{0,10})\s*(\d{0,5})$`)
+)
+
+// latitudeBands are the 8° MGRS latitude bands from 80°S northwards
+const latitudeBands = "CDEFGHJKLMNPQRSTUVWX"
+
+// MGRS 100 km square letters: columns cycle through three sets by zone, rows
+// through twenty letters, starting at F in even zones
+var mgrsColumnSets = [3]string{"ABCDEFGH", "JKLMNPQR", "STUVWXYZ"}
+
+const mgrsRowLetters = "ABCDEFGHJKLMNPQRSTUV"
+
+// parseGridReference converts a UTM or MGRS reference to latitude and
+// longitude. ok is false when the text doesn't look like one.
+func parseGridReference(ref string) (coords Coordinates, ok bool, err error) {
+	ref = strings.ToUpper(strings.TrimSpace(ref))
+	if m := mgrsReferencePattern.FindStringSubmatch(ref); m != nil {
+		if m[6] != "" && len(m[5]) != len(m[6]) {
+			return Coordinates{}, true, fmt.Errorf("MGRS reference needs as many easting as northing digits")
+		}
+		coords, err = parseMGRS(m[1], m[2][0], m[3][0], m[4][0], m[5]+m[6])
+		return coords, true, err
+	}
+	if m := utmReferencePattern.FindStringSubmatch(ref); m != nil {
+		coords, err = parseUTMReference(m[1], m[2][0], m[3], m[4])
+		return coords, true, err
+	}
+	return Coordinates{}, false, nil
+}
+
+// isGridReference reports whether a cell holds a UTM or MGRS reference
+func isGridReference(cell string) bool {
+	_, ok, err := parseGridReference(cell)
+	return ok && err == nil
+}
+
+func parseUTMZone(s string) (int, error) {
+	zone, _ := strconv.Atoi(s)
+	if zone < 1 || zone > 60 {
+		return 0, fmt.Errorf("UTM zone %s is not between 1 and 60", s)
+	}
+	return zone, nil
+}
+
+// parseUTMReference reads "zone letter easting northing". N and S after the
+// zone mean the hemisphere, as in "zone 48N"; other letters are latitude bands.
+func parseUTMReference(zoneStr string, letter byte, eastingStr, northingStr string) (Coordinates, error) {
+	zone, err := parseUTMZone(zoneStr)
+	if err != nil {
+		return Coordinates{}, err
+	}
+	south := letter == 'S' || (letter != 'N' && letter < 'N')
+	easting, _ := strconv.ParseFloat(eastingStr, 64)
+	northing, _ := strconv.ParseFloat(northingStr, 64)
+	if easting <= 0 || easting >= 1000000 || northing < 0 || northing > 10000000 {
+		return Coordinates{}, fmt.Errorf("UTM easting %s or northing %s is out of range", eastingStr, northingStr)
+	}
+	return reproject(newUTM(zone, south), easting, northing)
+}
+
+// parseMGRS reads an MGRS reference: zone, latitude band, 100 km square and
+// an even number of digits split between easting and northing. The result is
+// the south-west corner of the referenced square, as MGRS defines it.
+func parseMGRS(zoneStr string, band, column, row byte, digits string) (Coordinates, error) {
+	zone, err := parseUTMZone(zoneStr)
+	if err != nil {
+		return Coordinates{}, err
+	}
+	if len(digits)%2 != 0 {
+		return Coordinates{}, fmt.Errorf("MGRS reference needs as many easting as northing digits")
+	}
+	colIndex := strings.IndexByte(mgrsColumnSets[(zone-1)%3], column)
+	if colIndex == -1 {
+		return Coordinates{}, fmt.Errorf("MGRS square %c%c does not exist in zone %d", column, row, zone)
+	}
+	rowIndex := strings.IndexByte(mgrsRowLetters, row)
+	if zone%2 == 0 {
+		rowIndex = (rowIndex + 15) % 20 // even zones start at F
+	}
+
+	half := len(digits) / 2
+	scale := math.Pow(10, float64(5-half))
+	var e, n float64
+	if half > 0 {
+		ev, _ := strconv.Atoi(digits[:half])
+		nv, _ := strconv.Atoi(digits[half:])
+		e, n = float64(ev)*scale, float64(nv)*scale
+	}
+	easting := float64(colIndex+1)*100000 + e
+	northing := float64(rowIndex)*100000 + n
+
+	// Row letters repeat every 2000 km; the band tells which repetition
+	bandIndex := strings.IndexByte(latitudeBands, band)
+	south := band < 'N'
+	proj := newUTM(zone, south)
+	_, minNorthing := proj.fromWGS84(float64(-80+8*bandIndex), proj.lng0*180/math.Pi)
+	for northing < minNorthing {
+		northing += 2000000
+	}
+	return reproject(proj, easting, northing)
+}
+
+// utmColumns add the UTM zone, easting and northing of each row
+func utmColumns() []*extraColumn {
+	project := func(c Coordinates) (zone int, south bool, x, y float64) {
+		zone, south = utmZone(c.Lat, c.Lng)
+		x, y = newUTM(zone, south).fromWGS84(c.Lat, c.Lng)
+		return zone, south, x, y
+	}
+	return []*extraColumn{
+		{header: "UTM Zone", key: "utm_zone", value: func(r rowResult) interface{} {
+			zone, south, _, _ := project(r.coords)
+			if south {
+				return fmt.Sprintf("%dS", zone)
+			}
+			return fmt.Sprintf("%dN", zone)
+		}},
+		{header: "Easting", key: "easting", value: func(r rowResult) interface{} {
+			_, _, x, _ := project(r.coords)
+			return int64(math.Round(x))
+		}},
+		{header: "Northing", key: "northing", value: func(r rowResult) interface{} {
+			_, _, _, y := project(r.coords)
+			return int64(math.Round(y))
+		}},
+	}
+}
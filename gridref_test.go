@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// closeTo reports whether c is within tol degrees of lat,lng
+func closeTo(c Coordinates, lat, lng, tol float64) bool {
+	return math.Abs(c.Lat-lat) <= tol && math.Abs(c.Lng-lng) <= tol
+}
+
+func TestParseGridReference(t *testing.T) {
+	// The Washington Monument, 38.8895°N 77.0353°W; MGRS names the
+	// south-west corner of the square, so the coarser references land
+	// further from it
+	for _, tt := range []struct {
+		ref      string
+		lat, lng float64
+		tol      float64
+	}{
+		{"18SUJ2337106519", 38.8898, -77.0365, 1e-4},
+		{"18S UJ 23371 06519", 38.8898, -77.0365, 1e-4},
+		{"18suj2337106519", 38.8898, -77.0365, 1e-4},
+		{"18SUJ233065", 38.8898, -77.0365, 1e-3},
+		{"18SUJ2306", 38.8898, -77.0365, 1e-2},
+		{"18N 323371 4306519", 38.8898, -77.0365, 1e-4},
+		{"18N 323371mE 4306519mN", 38.8898, -77.0365, 1e-4},
+	} {
+		c, ok, err := parseGridReference(tt.ref)
+		if !ok || err != nil {
+			t.Errorf("parseGridReference(%q) = ok %v, %v", tt.ref, ok, err)
+			continue
+		}
+		if !closeTo(c, tt.lat, tt.lng, tt.tol) {
+			t.Errorf("parseGridReference(%q) = %.5f,%.5f, want %.4f,%.4f", tt.ref, c.Lat, c.Lng, tt.lat, tt.lng)
+		}
+	}
+}
+
+func TestUTMReferenceSMeansSouth(t *testing.T) {
+	// After a UTM zone, S is the southern hemisphere rather than band S
+	c, _, err := parseGridReference("18S 323371 4306519")
+	if err != nil || c.Lat >= 0 {
+		t.Errorf("18S 323371 4306519 = %.4f,%.4f (%v), want a point south of the equator", c.Lat, c.Lng, err)
+	}
+}
+
+func TestParseUTMReferenceRoundTrips(t *testing.T) {
+	for _, p := range []Coordinates{
+		{11.5564, 104.9282},  // Phnom Penh, 48N
+		{-33.8568, 151.2153}, // Sydney, 56S
+		{64.1466, -21.9426},  // Reykjavik, 27N
+		{-54.8019, -68.3030}, // Ushuaia, 19S
+	} {
+		zone, south := utmZone(p.Lat, p.Lng)
+		hemisphere := "N"
+		if south {
+			hemisphere = "S"
+		}
+		x, y := newUTM(zone, south).fromWGS84(p.Lat, p.Lng)
+		ref := fmt.Sprintf("%d%s %.2f %.2f", zone, hemisphere, x, y)
+		c, ok, err := parseGridReference(ref)
+		if !ok || err != nil {
+			t.Errorf("parseGridReference(%q) = ok %v, %v", ref, ok, err)
+			continue
+		}
+		if !closeTo(c, p.Lat, p.Lng, 1e-6) {
+			t.Errorf("parseGridReference(%q) = %.6f,%.6f, want %.4f,%.4f", ref, c.Lat, c.Lng, p.Lat, p.Lng)
+		}
+	}
+}
+
+func TestParseGridReferenceErrors(t *testing.T) {
+	for _, ref := range []string{
+		"61N 500000 1000000",  // no zone 61
+		"48N 0 1275432",       // easting out of range
+		"48N 491234 10000001", // northing out of range
+		"18SAJ2337106519",     // column A is not used in zone 18
+		"18SUJ233710651",      // more easting than northing digits
+		"18SUJ23371 0651",     // the same, split
+		"0SUJ2337106519",      // no zone 0
+	} {
+		if _, ok, err := parseGridReference(ref); !ok || err == nil {
+			t.Errorf("parseGridReference(%q) = ok %v, %v, want an error", ref, ok, err)
+		}
+	}
+	for _, cell := range []string{"11.5564, 104.9282", "Phnom Penh", "48", ""} {
+		if isGridReference(cell) {
+			t.Errorf("isGridReference(%q) = true", cell)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"latlg-address/latlgpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// maxGRPCBatch is how many locations one ReverseGeocodeBatch call may hold
+const maxGRPCBatch = 1000
+
+// grpcServer implements the Geocoder service of latlgpb/geocode.proto with
+// one Service, so all calls share its cache and rate limit
+type grpcServer struct {
+	latlgpb.UnimplementedGeocoderServer
+	s     *Service
+	extra []*extraColumn
+}
+
+// runGRPC is gRPC mode: other services send coordinates and get addresses
+// back, one at a time, in batches or as a stream. On Ctrl+C it waits for
+// open calls to finish and saves the cache.
+func runGRPC(cfg *Config) error {
+	lis, err := net.Listen("tcp", cfg.GRPC)
+	if err != nil {
+		return err
+	}
+	s := NewService(nil, cfg)
+	if err := s.warmCache(); err != nil {
+		return err
+	}
+	defer s.persistCache()
+	if err := s.openRawResponses(); err != nil {
+		return err
+	}
+	defer s.closeRawResponses()
+
+	var opts []grpc.ServerOption
+	if cfg.apiClients != nil {
+		opts = append(opts, grpc.UnaryInterceptor(cfg.apiClients.unaryInterceptor), grpc.StreamInterceptor(cfg.apiClients.streamInterceptor))
+	}
+	srv := grpc.NewServer(opts...)
+	latlgpb.RegisterGeocoderServer(srv, &grpcServer{s: s, extra: cfg.extraColumns()})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(lis) }()
+	fmt.Printf("gRPC listening on %s (%d workers per batch or stream)\n", lis.Addr(), cfg.Workers)
+	if cfg.apiClients != nil {
+		fmt.Printf("Calls need one of the %d keys in %s\n", len(cfg.apiClients), cfg.APIKeys)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	// A second Ctrl+C exits without waiting
+	stop()
+	fmt.Println("Shutting down; waiting for open calls to finish (Ctrl+C again to quit)")
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		srv.Stop()
+	}
+	s.reportElevationErrors()
+	return nil
+}
+
+// resolve geocodes a location for a client, if it has rows left for today;
+// index only labels the result
+func (g *grpcServer) resolve(client *apiClient, index int, loc *latlgpb.Location) rowResult {
+	if err := client.takeRows(1); err != nil {
+		return rowResult{rowIndex: index, skipped: true, message: err.Error()}
+	}
+	return g.resolveLocation(index, loc)
+}
+
+// resolveLocation geocodes a location
+func (g *grpcServer) resolveLocation(index int, loc *latlgpb.Location) rowResult {
+	if loc.GetCoordinates() != "" {
+		return g.s.resolveRow(index, loc.GetCoordinates())
+	}
+	lat, lng := loc.GetLatitude(), loc.GetLongitude()
+	input := strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lng, 'f', -1, 64)
+	switch {
+	case lat == 0 && lng == 0:
+		return rowResult{rowIndex: index, skipped: true, message: "empty coordinates"}
+	case math.Abs(lat) > 90 || math.IsNaN(lat):
+		return rowResult{rowIndex: index, skipped: true, message: "invalid latitude: out of range", input: input}
+	case math.Abs(lng) > 180 || math.IsNaN(lng):
+		return rowResult{rowIndex: index, skipped: true, message: "invalid longitude: out of range", input: input}
+	}
+	return g.s.resolveCoordinates(index, input, Coordinates{Lat: lat, Lng: lng})
+}
+
+// place converts a result to its protobuf message
+func (g *grpcServer) place(id string, res rowResult) *latlgpb.Place {
+	if res.skipped {
+		return &latlgpb.Place{Id: id, Error: res.message}
+	}
+	p := &latlgpb.Place{
+		Id:        id,
+		Latitude:  res.coords.Lat,
+		Longitude: res.coords.Lng,
+		Address:   res.address,
+		District:  res.district,
+		Province:  res.province,
+	}
+	if len(g.extra) > 0 {
+		p.Extra = make(map[string]string, len(g.extra))
+		for _, c := range g.extra {
+			p.Extra[c.key] = fmt.Sprint(c.value(res))
+		}
+	}
+	return p
+}
+
+func (g *grpcServer) ReverseGeocode(ctx context.Context, loc *latlgpb.Location) (*latlgpb.Place, error) {
+	if err := clientFrom(ctx).takeRows(1); err != nil {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	res := g.resolveLocation(0, loc)
+	switch {
+	case res.geocodeErr != nil:
+		return nil, status.Error(codes.Unavailable, res.message)
+	case res.skipped:
+		return nil, status.Error(codes.InvalidArgument, res.message)
+	}
+	return g.place(loc.GetId(), res), nil
+}
+
+func (g *grpcServer) ReverseGeocodeBatch(ctx context.Context, req *latlgpb.BatchRequest) (*latlgpb.BatchResponse, error) {
+	locs := req.GetLocations()
+	if len(locs) > maxGRPCBatch {
+		return nil, status.Errorf(codes.InvalidArgument, "a batch holds at most %d locations (got %d); use ReverseGeocodeStream for more", maxGRPCBatch, len(locs))
+	}
+
+	client := clientFrom(ctx)
+	places := make([]*latlgpb.Place, len(locs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < g.s.cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				places[i] = g.place(locs[i].GetId(), g.resolve(client, i, locs[i]))
+			}
+		}()
+	}
+	for i := range locs {
+		if ctx.Err() != nil {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	return &latlgpb.BatchResponse{Places: places}, nil
+}
+
+func (g *grpcServer) ReverseGeocodeStream(stream latlgpb.Geocoder_ReverseGeocodeStreamServer) error {
+	client := clientFrom(stream.Context())
+	locs := make(chan *latlgpb.Location, g.s.cfg.Workers)
+	var (
+		wg      sync.WaitGroup
+		sendMu  sync.Mutex
+		sendErr error
+	)
+	for w := 0; w < g.s.cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for loc := range locs {
+				p := g.place(loc.GetId(), g.resolve(client, 0, loc))
+				sendMu.Lock()
+				if sendErr == nil {
+					sendErr = stream.Send(p)
+				}
+				sendMu.Unlock()
+			}
+		}()
+	}
+
+	var recvErr error
+	for {
+		loc, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				recvErr = err
+			}
+			break
+		}
+		locs <- loc
+	}
+	close(locs)
+	wg.Wait()
+	if recvErr != nil {
+		return recvErr
+	}
+	return sendErr
+}
+
+// authenticate finds the client of a call from its "authorization: Bearer
+// KEY" or "x-api-key" metadata and takes the call from its rate limit
+func (c apiClients) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key string
+	if v := md.Get("authorization"); len(v) > 0 {
+		if scheme, k, ok := strings.Cut(v[0], " "); ok && strings.EqualFold(scheme, "Bearer") {
+			key = strings.TrimSpace(k)
+		}
+	} else if v := md.Get("x-api-key"); len(v) > 0 {
+		key = v[0]
+	}
+	client := c.lookup(key)
+	if client == nil {
+		return nil, status.Error(codes.Unauthenticated, "a valid API key is required")
+	}
+	if wait := client.allow(time.Now()); wait > 0 {
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit of %d requests per minute exceeded; retry in %s",
+			client.RequestsPerMinute, wait.Round(time.Second))
+	}
+	return withClient(ctx, client), nil
+}
+
+func (c apiClients) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := c.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (c apiClients) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := c.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &clientStream{ServerStream: ss, ctx: ctx})
+}
+
+// clientStream is a server stream whose context carries its client
+type clientStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *clientStream) Context() context.Context {
+	return s.ctx
+}
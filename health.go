@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// readinessTTL is how long a readiness result is reused, so probes every
+// few seconds don't reach the provider that often
+const readinessTTL = 30 * time.Second
+
+// readinessTimeout bounds how long the provider may take to answer a check
+const readinessTimeout = 5 * time.Second
+
+// readiness remembers the last readiness checks of the server
+type readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+	checks  map[string]string // check to "ok" or what is wrong
+	ready   bool
+}
+
+// handleHealthz is the liveness probe: the server answers requests. It
+// checks nothing outside the process, so a provider outage doesn't get the
+// server restarted.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz is the readiness probe: the provider endpoints answer and
+// the cache file and jobs directory can be written. It responds 503 with
+// the failed checks while the server can't process jobs.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, checks := s.readiness.check(s.cfg)
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+// check runs the readiness checks, or returns the last results if they
+// are recent
+func (rd *readiness) check(cfg *Config) (bool, map[string]string) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if time.Since(rd.checked) < readinessTTL {
+		return rd.ready, rd.checks
+	}
+
+	checks := map[string]string{"jobs_dir": checkWritable(cfg.JobsDir)}
+	if cfg.CacheFile != "" {
+		checks["cache"] = checkWritable(filepath.Dir(cfg.CacheFile))
+	}
+	checks["provider"] = checkReachable(cfg)
+	countries := make([]string, 0, len(cfg.routes))
+	for country := range cfg.routes {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	for _, country := range countries {
+		checks["provider "+country] = checkReachable(cfg.routes[country])
+	}
+
+	rd.ready = true
+	for _, result := range checks {
+		rd.ready = rd.ready && result == "ok"
+	}
+	rd.checks, rd.checked = checks, time.Now()
+	return rd.ready, rd.checks
+}
+
+// checkReachable connects to the host of a provider's endpoint. Any HTTP
+// answer will do; no geocoding request is sent, so checks don't count
+// against the provider's quota.
+func checkReachable(cfg *Config) string {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return err.Error()
+	}
+	if cfg.Provider == "mock" {
+		return "ok"
+	}
+	probe := *cfg
+	probe.Record = "" // checks are not geocoding requests
+	client := newHTTPClient(&probe)
+	client.Timeout = readinessTimeout
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequest(http.MethodHead, u.Scheme+"://"+u.Host+"/", nil)
+	if err != nil {
+		return err.Error()
+	}
+	req.Header.Set("User-Agent", cfg.UserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("%s unreachable: %v", u.Host, err)
+	}
+	drainAndClose(resp.Body)
+	return "ok"
+}
+
+// checkWritable creates and removes a file in dir
+func checkWritable(dir string) string {
+	f, err := os.CreateTemp(dir, ".latlg-ready-*")
+	if err != nil {
+		return err.Error()
+	}
+	name := f.Name()
+	err = f.Close()
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
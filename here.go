@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// hereGeocoder speaks the HERE Geocoding & Search reverse geocode API
+// (https://www.here.com/docs/bundle/geocoding-and-search-api-developer-guide/page/topics/endpoint-reverse-geocode-brief.html),
+// authenticated with an API key
+type hereGeocoder struct {
+	cfg *Config
+}
+
+// hereResponse is the answer of the HERE reverse geocode API
+type hereResponse struct {
+	Items []struct {
+		Title      string `json:"title"`
+		ResultType string `json:"resultType"` // houseNumber, street, locality, administrativeArea, ...
+		Address    struct {
+			Label       string `json:"label"`
+			CountryName string `json:"countryName"`
+			State       string `json:"state"`
+			County      string `json:"county"`
+			City        string `json:"city"`
+			District    string `json:"district"`
+			Subdistrict string `json:"subdistrict"`
+			Street      string `json:"street"`
+			PostalCode  string `json:"postalCode"`
+			HouseNumber string `json:"houseNumber"`
+		} `json:"address"`
+		CountryInfo struct {
+			Alpha2 string `json:"alpha2"`
+		} `json:"countryInfo"`
+		Position struct {
+			Lat float64 `json:"lat"`
+			Lng float64 `json:"lng"`
+		} `json:"position"`
+	} `json:"items"`
+}
+
+func (g hereGeocoder) request(lat, lng float64) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("at", fmt.Sprintf("%.6f,%.6f", lat, lng))
+	params.Set("lang", "en-US")
+	params.Set("show", "countryInfo") // the ISO 3166-1 alpha-2 code the component rules are keyed by
+	params.Set("apiKey", g.cfg.APIKey)
+	return http.NewRequest("GET", g.cfg.Endpoint+"?"+params.Encode(), nil)
+}
+
+// parse maps the nearest item onto the Nominatim address keys: HERE's state
+// is the province, its county the district (amphoe, khan or srok), and its
+// district and subdistrict are the parts of a city, such as Bangkok's khet
+// and khwaeng
+func (g hereGeocoder) parse(body []byte) (GeocodeResponse, error) {
+	var hr hereResponse
+	if err := json.Unmarshal(body, &hr); err != nil {
+		return GeocodeResponse{}, err
+	}
+	if len(hr.Items) == 0 {
+		return GeocodeResponse{}, nil
+	}
+	item := hr.Items[0]
+	a := item.Address
+	resp := GeocodeResponse{
+		DisplayName: a.Label,
+		Type:        item.ResultType,
+		Lat:         strconv.FormatFloat(item.Position.Lat, 'f', -1, 64),
+		Lon:         strconv.FormatFloat(item.Position.Lng, 'f', -1, 64),
+		Address: Address{
+			HouseNumber:  a.HouseNumber,
+			Road:         a.Street,
+			Suburb:       a.Subdistrict,
+			CityDistrict: a.District,
+			City:         a.City,
+			County:       a.County,
+			State:        a.State,
+			Postcode:     a.PostalCode,
+			Country:      a.CountryName,
+			CountryCode:  strings.ToLower(item.CountryInfo.Alpha2),
+		},
+	}
+	if resp.DisplayName == "" {
+		resp.DisplayName = item.Title
+	}
+	return resp, nil
+}
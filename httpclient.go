@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// newHTTPClient builds the client shared by every geocoding request. One
+// Transport keeps connections alive between requests and negotiates HTTP/2
+// where the provider supports it.
+func newHTTPClient(cfg *Config) *http.Client {
+	maxIdle := cfg.MaxIdleConns
+	if maxIdle <= 0 {
+		// One idle connection per worker, so workers never wait on a handshake
+		maxIdle = cfg.Workers
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.proxyURL != nil {
+		proxy = http.ProxyURL(cfg.proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy:           proxy,
+		TLSClientConfig: cfg.tlsConfig,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   maxIdle,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	var roundTripper http.RoundTripper = transport
+	switch {
+	case cfg.replay != nil:
+		roundTripper = &replayTransport{cfg: cfg, next: transport}
+	case cfg.Provider == "mock":
+		roundTripper = &mockTransport{cfg: cfg, next: transport}
+	}
+	if cfg.Record != "" {
+		roundTripper = &recordTransport{cfg: cfg, next: roundTripper}
+	}
+
+	return &http.Client{
+		Transport: roundTripper,
+		Timeout:   cfg.HTTPTimeout,
+	}
+}
+
+// loadNetworkOptions parses --proxy and loads the certificates for the
+// geocoding client, so a bad path fails before any row is processed
+func (c *Config) loadNetworkOptions() error {
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid --proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("invalid --proxy %q: scheme must be http, https or socks5", c.Proxy)
+		}
+		c.proxyURL = u
+	}
+
+	if c.CACert == "" && c.ClientCert == "" && c.ClientKey == "" {
+		return nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CACert != "" {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return fmt.Errorf("reading --ca-cert: %w", err)
+		}
+		// Trust the bundle in addition to the system roots, so the corporate CA
+		// works for intercepting proxies and public providers still verify
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("--ca-cert %s contains no PEM certificates", c.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return fmt.Errorf("--client-cert and --client-key must be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	c.tlsConfig = tlsConfig
+	return nil
+}
+
+// SetHTTPClient replaces the client used for geocoding requests, e.g. to
+// point the service at a test server or a custom transport
+func (s *Service) SetHTTPClient(client *http.Client) {
+	s.client = client
+}
+
+// drainAndClose reads the rest of a response body before closing it so the
+// connection can be reused
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, 64*1024))
+	body.Close()
+}
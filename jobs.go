@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Job states
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobPaused  = "paused"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// maxQueuedJobs is how many jobs can wait for a free slot before new
+// submissions are refused
+const maxQueuedJobs = 1000
+
+// errQueueFull is returned when a job is submitted while the queue is full
+var errQueueFull = errors.New("job queue is full, try again later")
+
+// errShuttingDown is returned when a job is submitted while the server stops
+var errShuttingDown = errors.New("server is shutting down")
+
+// errNotRunning is returned when a job that isn't running is paused or
+// resumed
+var errNotRunning = errors.New("only running jobs can be paused or resumed")
+
+// runProgress counts the rows of a run so the job API can report progress;
+// a nil *runProgress ignores updates, which is the case outside serve mode
+type runProgress struct {
+	total  atomic.Int64
+	done   atomic.Int64
+	failed atomic.Int64
+	output atomic.Value // string: where the results were saved
+	client *apiClient   // charged for each row; nil without --api-keys
+	// quotaSpent is set once the client's rows_per_day quota refused rows
+	quotaSpent atomic.Bool
+}
+
+func (p *runProgress) setTotal(n int) {
+	if p != nil {
+		p.total.Store(int64(n))
+	}
+}
+
+// setOutput records where the results were saved
+func (p *runProgress) setOutput(path string) {
+	if p != nil {
+		p.output.Store(path)
+	}
+}
+
+// outputPath returns where the results were saved, or "" before they were
+func (p *runProgress) outputPath() string {
+	path, _ := p.output.Load().(string)
+	return path
+}
+
+// takeRows charges n rows to the client's rows_per_day quota before they
+// are looked up, or fails without charging them once it is used up
+func (p *runProgress) takeRows(n int) error {
+	if p == nil {
+		return nil
+	}
+	if err := p.client.takeRows(n); err != nil {
+		p.quotaSpent.Store(true)
+		return err
+	}
+	return nil
+}
+
+// row records a finished row
+func (p *runProgress) row(failed bool) {
+	if p == nil {
+		return
+	}
+	p.done.Add(1)
+	if failed {
+		p.failed.Add(1)
+	}
+}
+
+// jobStatus is what the API reports about a job
+type jobStatus struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Source   string     `json:"source,omitempty"` // storage URL the input is read from
+	Status   string     `json:"status"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Total    int64      `json:"total_rows"`
+	Done     int64      `json:"done_rows"`
+	Failed   int64      `json:"failed_rows"`
+	Rate     float64    `json:"rows_per_second,omitempty"`
+	ETA      float64    `json:"eta_seconds,omitempty"` // estimated time left of a running job
+	Error    string     `json:"error,omitempty"`
+	Result   string     `json:"result,omitempty"` // download path, once there is an output
+	// Resumable marks a job stopped by its client's rows_per_day quota;
+	// POST /jobs/{id}/resume continues it from its checkpoint
+	Resumable bool `json:"resumable,omitempty"`
+}
+
+// job is a file submitted to the server; its status is guarded by the
+// manager's lock
+type job struct {
+	jobStatus
+	input    string
+	output   string
+	progress runProgress
+	pause    *pauseGate
+	client   *apiClient  // who submitted the job; nil without --api-keys
+	trace    spanContext // the request that submitted the job
+	resume   bool        // continue from the checkpoint of the last run
+
+	coordinateColumn string
+}
+
+// jobManager queues submitted jobs and runs up to --max-jobs of them at once
+type jobManager struct {
+	cfg    *Config
+	mu     sync.Mutex
+	jobs   map[string]*job
+	order  []string // job IDs in submission order
+	queue  chan *job
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newJobManager(cfg *Config) *jobManager {
+	m := &jobManager{
+		cfg:   cfg,
+		jobs:  make(map[string]*job),
+		queue: make(chan *job, maxQueuedJobs),
+	}
+	for i := 0; i < cfg.MaxJobs; i++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for j := range m.queue {
+				m.run(j)
+			}
+		}()
+	}
+	return m
+}
+
+// newJobDir creates the directory of a new job and returns its ID
+func (m *jobManager) newJobDir() (string, string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	id := hex.EncodeToString(b)
+	dir := filepath.Join(m.cfg.JobsDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	return id, dir, nil
+}
+
+// submit queues a job whose input is a file in its directory, or a storage
+// URL; coordinateColumn overrides the server's --coordinate-column and trace
+// is the span of the submitting request. The job must have been counted
+// with client.startJob, and is released when it ends or can't be queued.
+func (m *jobManager) submit(client *apiClient, id, dir, name, input, coordinateColumn string, trace spanContext) (*job, error) {
+	j := &job{
+		jobStatus:        jobStatus{ID: id, Name: name, Status: jobQueued, Created: time.Now().UTC()},
+		input:            input,
+		pause:            newPauseGate(),
+		client:           client,
+		trace:            trace,
+		coordinateColumn: coordinateColumn,
+	}
+	j.progress.client = client
+	if isRemotePath(input) {
+		j.Source = input
+	}
+	j.output = filepath.Join(dir, m.cfg.outputName(name, time.Now()))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		os.RemoveAll(dir)
+		client.endJob()
+		return nil, errShuttingDown
+	}
+	select {
+	case m.queue <- j:
+	default:
+		os.RemoveAll(dir)
+		client.endJob()
+		return nil, errQueueFull
+	}
+	m.jobs[id] = j
+	m.order = append(m.order, id)
+	return j, nil
+}
+
+// run processes a job with the server's options, writing the result into
+// the job's directory
+func (m *jobManager) run(j *job) {
+	m.mu.Lock()
+	started := time.Now().UTC()
+	j.Status, j.Started = jobRunning, &started
+	m.mu.Unlock()
+	fmt.Printf("Job %s: processing %s\n", j.ID, j.Name)
+	span := startSpan(j.trace, "job", spanKindInternal, spanAttr{"job.id", j.ID}, spanAttr{"job.name", j.Name},
+		spanAttr{"job.queued_ms", started.Sub(j.Created).Milliseconds()})
+
+	cfg := *m.cfg
+	cfg.traceParent = span.context()
+	cfg.InPlace = false
+	cfg.Output = j.output
+	cfg.progress = &j.progress
+	cfg.pause = j.pause
+	// Jobs on the same URL each download their own copy, and jobs of the
+	// same file name keep their own checkpoint
+	cfg.remoteDir = filepath.Join(filepath.Dir(j.output), "remote")
+	cfg.checkpointDir = filepath.Dir(j.output)
+	if j.resume {
+		// The output of the stopped run is replaced by the whole result
+		cfg.Resume, cfg.Force = true, true
+	}
+	if j.coordinateColumn != "" {
+		cfg.CoordinateColumn = j.coordinateColumn
+	}
+	input, err := cfg.jobWorkbook(j.input, filepath.Dir(j.output))
+	if err == nil {
+		err = processFile(&cfg, input)
+	}
+
+	span.finish(err)
+	j.client.endJob()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	finished := time.Now().UTC()
+	j.Finished = &finished
+	j.Status = jobDone
+	if err != nil {
+		j.Status, j.Error = jobFailed, err.Error()
+	}
+	j.resume, j.Resumable = false, j.progress.quotaSpent.Load()
+	// An aborted run still saves the rows it processed
+	if _, statErr := os.Stat(j.output); statErr == nil {
+		j.Result = "/jobs/" + j.ID + "/result"
+	}
+	fmt.Printf("Job %s: %s in %s\n", j.ID, j.Status, finished.Sub(started).Round(time.Second))
+}
+
+// jobWorkbook returns the file a job processes: CSV input is converted to a
+// workbook in the job's directory first, other inputs are used as they are
+func (c *Config) jobWorkbook(input, dir string) (string, error) {
+	if !strings.EqualFold(filepath.Ext(input), ".csv") {
+		return input, nil
+	}
+	local, err := c.localInputPath(input)
+	if err != nil {
+		return "", err
+	}
+	table, err := readTable(local, "")
+	if err != nil {
+		return "", err
+	}
+	if len(table) == 0 {
+		return "", fmt.Errorf("%s is empty", path.Base(input))
+	}
+	workbook := filepath.Join(dir, strings.TrimSuffix(path.Base(input), path.Ext(input))+".xlsx")
+	p := &pipeline{header: table[0], rows: table[1:]}
+	if err := writeFileAtomic(workbook, p.writeXLSX); err != nil {
+		return "", err
+	}
+	return workbook, nil
+}
+
+// get returns the status of a job and the path of its output; clients only
+// see their own jobs
+func (m *jobManager) get(client *apiClient, id string) (jobStatus, string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok || j.client != client {
+		return jobStatus{}, "", false
+	}
+	return j.status(), j.output, true
+}
+
+// list returns the status of the client's jobs, oldest first
+func (m *jobManager) list(client *apiClient) []jobStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]jobStatus, 0, len(m.order))
+	for _, id := range m.order {
+		if j := m.jobs[id]; j.client == client {
+			jobs = append(jobs, j.status())
+		}
+	}
+	return jobs
+}
+
+// setPaused pauses or resumes a running job of the client and returns its
+// status
+func (m *jobManager) setPaused(client *apiClient, id string, paused bool) (jobStatus, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok || j.client != client {
+		return jobStatus{}, false, nil
+	}
+	if !paused && j.Resumable {
+		return j.status(), true, m.requeue(j)
+	}
+	if j.Status != jobRunning {
+		return j.status(), true, errNotRunning
+	}
+	if paused && j.pause.pause() {
+		fmt.Printf("Job %s: pausing\n", j.ID)
+	} else if !paused && j.pause.resume() {
+		fmt.Printf("Job %s: resuming\n", j.ID)
+	}
+	return j.status(), true, nil
+}
+
+// requeue queues a job stopped by its client's quota again, to continue from
+// its checkpoint once the client has rows left; the manager's lock must be
+// held
+func (m *jobManager) requeue(j *job) error {
+	if m.closed {
+		return errShuttingDown
+	}
+	if err := j.client.startJob(); err != nil {
+		return err
+	}
+	select {
+	case m.queue <- j:
+	default:
+		j.client.endJob()
+		return errQueueFull
+	}
+	// The worker that picks the job up waits for the lock
+	j.Status, j.Error, j.Started, j.Finished = jobQueued, "", nil, nil
+	j.Resumable, j.resume = false, true
+	j.progress.quotaSpent.Store(false)
+	fmt.Printf("Job %s: queued to continue where the quota stopped it\n", j.ID)
+	return nil
+}
+
+// status returns the job's status with the current row counts; the
+// manager's lock must be held
+func (j *job) status() jobStatus {
+	st := j.jobStatus
+	st.Total = j.progress.total.Load()
+	st.Done = j.progress.done.Load()
+	st.Failed = j.progress.failed.Load()
+	if st.Status == jobRunning && j.pause.isPaused() {
+		st.Status = jobPaused
+	} else if st.Status == jobRunning && st.Done > 0 {
+		elapsed := (time.Since(*st.Started) - j.pause.pausedFor()).Seconds()
+		st.Rate = math.Round(float64(st.Done)/elapsed*10) / 10
+		st.ETA = math.Round(float64(st.Total-st.Done) * elapsed / float64(st.Done))
+	}
+	return st
+}
+
+// finished reports whether the job has completed, successfully or not
+func (st jobStatus) finished() bool {
+	return st.Status == jobDone || st.Status == jobFailed
+}
+
+// close stops accepting jobs and waits for the queued and running ones
+func (m *jobManager) close() {
+	m.mu.Lock()
+	m.closed = true
+	close(m.queue)
+	// Paused jobs would never finish
+	for _, j := range m.jobs {
+		if j.pause.resume() {
+			fmt.Printf("Job %s: resuming so it can finish\n", j.ID)
+		}
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// waitForJob waits until a job has finished and returns its status
+func waitForJob(t *testing.T, m *jobManager, client *apiClient, id string) jobStatus {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if st, _, ok := m.get(client, id); ok && st.finished() {
+			return st
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return jobStatus{}
+}
+
+func TestJobStopsAtRowsPerDayAndResumes(t *testing.T) {
+	const rows, quota = 40, 15
+	cfg, err := parseConfig([]string{"--serve", "127.0.0.1:0", "--provider", "mock", "--max-jobs", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.JobsDir = t.TempDir()
+	m := newJobManager(cfg)
+	defer m.close()
+
+	client := &apiClient{apiKey: apiKey{Name: "billing", RowsPerDay: quota}}
+	if err := client.startJob(); err != nil {
+		t.Fatal(err)
+	}
+	id, dir, err := m.newJobDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "sites.xlsx")
+	f := excelize.NewFile()
+	sheet := f.GetSheetName(0)
+	f.SetSheetRow(sheet, "A1", &[]interface{}{"Coordinates", "Address", "District", "Province"})
+	for i := 1; i <= rows; i++ {
+		f.SetCellValue(sheet, fmt.Sprintf("A%d", i+1), fmt.Sprintf("%.6f, %.6f", 11.005+0.01*float64(i), 104.005))
+	}
+	if err := f.SaveAs(input); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := m.submit(client, id, dir, "sites.xlsx", input, "", spanContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	st := waitForJob(t, m, client, id)
+	if st.Status != jobFailed || !st.Resumable || st.Result == "" {
+		t.Fatalf("job stopped as %+v, want a failed, resumable job with a result", st)
+	}
+	if used := client.usage().RowsToday; used > quota || st.Done > quota {
+		t.Errorf("job processed %d rows and charged %d, over the quota of %d", st.Done, used, quota)
+	}
+	if _, _, err := m.setPaused(client, id, false); err == nil {
+		t.Error("resuming with the quota used up succeeded")
+	}
+
+	// A new day, with room for the rest
+	client.mu.Lock()
+	client.day, client.RowsPerDay = "2000-01-01", rows
+	client.mu.Unlock()
+	if _, _, err := m.setPaused(client, id, false); err != nil {
+		t.Fatalf("resuming: %v", err)
+	}
+	st = waitForJob(t, m, client, id)
+	if st.Status != jobDone || st.Done != rows {
+		t.Fatalf("resumed job ended as %+v, want done with %d rows", st, rows)
+	}
+	_, output, _ := m.get(client, id)
+	out, err := excelize.OpenFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	for i := 2; i <= rows+1; i++ {
+		if v, _ := out.GetCellValue(out.GetSheetName(0), fmt.Sprintf("B%d", i)); v == "" {
+			t.Errorf("row %d has no address", i)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// journalHeader is the first line of a results journal
+type journalHeader struct {
+	Source  string    `json:"source"`
+	Output  string    `json:"output"`
+	Sheet   string    `json:"sheet"`
+	Created time.Time `json:"created"`
+}
+
+// journalCell is one written cell in a results journal
+type journalCell struct {
+	Row   int         `json:"row"`
+	Col   int         `json:"col"`
+	Value interface{} `json:"value"`
+}
+
+// saveOutput saves the workbook to outputFile, retrying with backoff and then
+// falling back to --save-fallback and interactively entered paths. If every
+// attempt fails, the written cells are journaled so no API work is lost.
+// It returns the path the workbook was actually saved to. With --split-rows
+// the parts are named after that path and recorded in s.parts.
+func (s *Service) saveOutput(excelFile, outputFile string) (string, error) {
+	save := func(path string) error {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("creating output directory: %w", err)
+		}
+		if s.cfg.SplitRows > 0 {
+			var err error
+			s.parts, err = s.saveParts(path)
+			return err
+		}
+		return s.repo.SaveAs(path)
+	}
+
+	err := save(outputFile)
+	for attempt := 1; err != nil && attempt <= s.cfg.SaveRetries; attempt++ {
+		delay := s.cfg.SaveRetryDelay * time.Duration(attempt)
+		fmt.Printf("Warning: Could not save %s: %v (retry %d/%d in %s)\n", outputFile, err, attempt, s.cfg.SaveRetries, delay)
+		time.Sleep(delay)
+		err = save(outputFile)
+	}
+	if err == nil {
+		return outputFile, nil
+	}
+	fmt.Printf("Warning: Could not save %s: %v\n", outputFile, err)
+
+	if s.cfg.SaveFallback != "" {
+		fallback := filepath.Join(s.cfg.SaveFallback, filepath.Base(outputFile))
+		fmt.Printf("Trying fallback location %s...\n", fallback)
+		ferr := save(fallback)
+		if ferr == nil {
+			return fallback, nil
+		}
+		fmt.Printf("Warning: Could not save %s: %v\n", fallback, ferr)
+	}
+
+	if !s.cfg.NoPrompt && isTerminal(os.Stdin) {
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			fmt.Print("Enter another path to save the results to (empty to give up): ")
+			line, rerr := reader.ReadString('\n')
+			path := strings.TrimSpace(line)
+			if path == "" {
+				break
+			}
+			perr := save(path)
+			if perr == nil {
+				return path, nil
+			}
+			fmt.Printf("Warning: Could not save %s: %v\n", path, perr)
+			if rerr != nil {
+				break
+			}
+		}
+	}
+
+	journal, jerr := s.writeJournal(excelFile, outputFile)
+	if jerr != nil {
+		return "", fmt.Errorf("saving file: %w (journaling results also failed: %v)", err, jerr)
+	}
+	return "", fmt.Errorf("saving file: %w; results journaled to %s (recover with: latlg-address restore %s)", err, journal, journal)
+}
+
+// writeJournal writes every cell written during the run to a JSONL journal.
+// data/ is tried first, then the fallback directory and the system temp directory.
+func (s *Service) writeJournal(excelFile, outputFile string) (string, error) {
+	name := strings.TrimSuffix(filepath.Base(excelFile), filepath.Ext(excelFile)) + "_journal.jsonl"
+	dirs := []string{"data"}
+	if s.cfg.SaveFallback != "" {
+		dirs = append(dirs, s.cfg.SaveFallback)
+	}
+	dirs = append(dirs, os.TempDir())
+
+	var lastErr error
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		lastErr = writeFileAtomic(path, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			header := journalHeader{
+				Source:  s.repo.path,
+				Output:  outputFile,
+				Sheet:   s.repo.GetSheetName(),
+				Created: time.Now().UTC(),
+			}
+			if err := enc.Encode(header); err != nil {
+				return err
+			}
+			for row, cols := range s.repo.edits {
+				for col, value := range cols {
+					if err := enc.Encode(journalCell{Row: row, Col: col, Value: value}); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if lastErr == nil {
+			return path, nil
+		}
+	}
+	return "", lastErr
+}
+
+// runRestore applies a results journal to its source workbook and saves the
+// output, to --output if given or to the path recorded in the journal
+func runRestore(cfg *Config) error {
+	// The header names the workbook the cells belong to
+	header, err := readJournalHeader(cfg.InputFile)
+	if err != nil {
+		return fmt.Errorf("reading journal: %w", err)
+	}
+
+	repo, err := NewRepository(header.Source)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	repo.SetPreserveFormatting(cfg.Writer == writerPatch)
+	if repo.GetSheetName() != header.Sheet {
+		return fmt.Errorf("journal is for sheet %q but %s starts with %q", header.Sheet, header.Source, repo.GetSheetName())
+	}
+
+	cells := 0
+	_, truncated, err := readJournal(cfg.InputFile, func(cell journalCell) error {
+		name, err := excelize.CoordinatesToCellName(cell.Col, cell.Row)
+		if err != nil {
+			return err
+		}
+		if err := repo.SetCellValue(name, cell.Value); err != nil {
+			return fmt.Errorf("restoring %s: %w", name, err)
+		}
+		cells++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading journal: %w", err)
+	}
+	if truncated {
+		fmt.Println("Warning: The journal ends in a damaged record; the cells before it were restored")
+	}
+
+	output := header.Output
+	if cfg.Output != "" {
+		output = cfg.outputPath(header.Source, time.Now())
+	}
+	service := NewService(repo, cfg)
+	if !cfg.overwrites() {
+		_, output = service.versionOutput(output)
+	}
+	savedTo, err := service.saveOutput(header.Source, output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Restored %d cells from %s into %s\n", cells, cfg.InputFile, savedTo)
+	return nil
+}
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// defaultKafkaBatch is the number of messages polled, geocoded and committed
+// at a time when --batch-size is not set
+const defaultKafkaBatch = 500
+
+// maxKafkaRetryDelay caps the wait between retries of failed lookups
+const maxKafkaRetryDelay = time.Minute
+
+// checkKafkaOptions validates the --kafka-* flags of a Kafka run
+func (c *Config) checkKafkaOptions() error {
+	if c.KafkaTopic == "" || c.KafkaOutputTopic == "" {
+		return fmt.Errorf("--kafka-brokers needs --kafka-topic to consume and --kafka-output-topic to produce to")
+	}
+	if c.KafkaTopic == c.KafkaOutputTopic {
+		return fmt.Errorf("--kafka-output-topic must differ from --kafka-topic")
+	}
+	if c.KafkaGroup == "" {
+		return fmt.Errorf("--kafka-group must not be empty")
+	}
+	switch c.KafkaSASL {
+	case "", "plain", "scram-sha-256", "scram-sha-512":
+	default:
+		return fmt.Errorf("unknown --kafka-sasl %q (expected plain, scram-sha-256 or scram-sha-512)", c.KafkaSASL)
+	}
+	if c.KafkaSASL != "" && os.Getenv("KAFKA_USERNAME") == "" {
+		return fmt.Errorf("--kafka-sasl needs KAFKA_USERNAME and KAFKA_PASSWORD")
+	}
+	return nil
+}
+
+// kafkaOptions returns the client options of a Kafka run. Offsets are only
+// committed by hand, and rebalances wait until a poll's messages are
+// committed so no other consumer gets them twice.
+func (c *Config) kafkaOptions() []kgo.Opt {
+	var brokers []string
+	for _, b := range strings.Split(c.KafkaBrokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumerGroup(c.KafkaGroup),
+		kgo.ConsumeTopics(c.KafkaTopic),
+		kgo.DisableAutoCommit(),
+		kgo.BlockRebalanceOnPoll(),
+	}
+	if c.KafkaTLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	user, pass := os.Getenv("KAFKA_USERNAME"), os.Getenv("KAFKA_PASSWORD")
+	switch c.KafkaSASL {
+	case "plain":
+		opts = append(opts, kgo.SASL(plain.Auth{User: user, Pass: pass}.AsMechanism()))
+	case "scram-sha-256":
+		opts = append(opts, kgo.SASL(scram.Auth{User: user, Pass: pass}.AsSha256Mechanism()))
+	case "scram-sha-512":
+		opts = append(opts, kgo.SASL(scram.Auth{User: user, Pass: pass}.AsSha512Mechanism()))
+	}
+	return opts
+}
+
+// kafkaConsumer enriches the messages of a Kafka run
+type kafkaConsumer struct {
+	s      *Service
+	client *kgo.Client
+	extra  []*extraColumn
+}
+
+// runKafka is Kafka mode: coordinate messages are consumed from --kafka-topic
+// in the --kafka-group consumer group, geocoded, and produced with their
+// address to --kafka-output-topic. A poll's offsets are committed once its
+// messages are produced, so after a crash or Ctrl+C the messages that were
+// not finished are consumed again.
+func runKafka(cfg *Config) error {
+	client, err := kgo.NewClient(cfg.kafkaOptions()...)
+	if err != nil {
+		return fmt.Errorf("--kafka-brokers: %w", err)
+	}
+	defer client.CloseAllowingRebalance()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := client.Ping(ctx); err != nil {
+		return fmt.Errorf("connecting to Kafka: %w", err)
+	}
+
+	s := NewService(nil, cfg)
+	if err := s.warmCache(); err != nil {
+		return err
+	}
+	defer s.persistCache()
+	if err := s.openRawResponses(); err != nil {
+		return err
+	}
+	defer s.closeRawResponses()
+
+	k := &kafkaConsumer{s: s, client: client, extra: cfg.extraColumns()}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultKafkaBatch
+	}
+	fmt.Printf("Consuming %s as group %s, producing to %s (Ctrl+C to stop)\n", cfg.KafkaTopic, cfg.KafkaGroup, cfg.KafkaOutputTopic)
+
+	processed, failed := 0, 0
+	for ctx.Err() == nil && !s.failures.isAborted() {
+		fetches := client.PollRecords(ctx, batchSize)
+		if fetches.IsClientClosed() || ctx.Err() != nil {
+			break
+		}
+		var fetchErr error
+		fetches.EachError(func(topic string, partition int32, err error) {
+			fetchErr = fmt.Errorf("consuming %s partition %d: %w", topic, partition, err)
+		})
+		if fetchErr != nil {
+			return fetchErr
+		}
+		records := fetches.Records()
+		n, err := k.handle(ctx, records)
+		client.AllowRebalance()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		processed += len(records)
+		failed += n
+		if len(records) > 0 {
+			fmt.Printf("Enriched %d messages (%d failed)\n", processed, failed)
+		}
+	}
+
+	if ctx.Err() != nil {
+		fmt.Println("Stopped; messages that were not committed are consumed again on the next run")
+	}
+	fmt.Printf("✓ Processed %d messages (%d failed)\n", processed, failed)
+	s.reportElevationErrors()
+	return s.failures.err()
+}
+
+// handle geocodes the messages of a poll, produces the enriched messages and
+// commits their offsets; it returns how many could not be geocoded
+func (k *kafkaConsumer) handle(ctx context.Context, records []*kgo.Record) (int, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+	results, err := k.resolve(ctx, records)
+	if err != nil {
+		return 0, err
+	}
+
+	out := make([]*kgo.Record, len(records))
+	failed := 0
+	for i, rec := range records {
+		res := results[i]
+		if res.skipped {
+			k.s.failures.observe(res)
+			failed++
+			fmt.Fprintf(os.Stderr, "%s/%d@%d: %s\n", rec.Topic, rec.Partition, rec.Offset, res.message)
+		}
+		value, err := k.enrich(rec.Value, res)
+		if err != nil {
+			return 0, err
+		}
+		out[i] = &kgo.Record{Topic: k.s.cfg.KafkaOutputTopic, Key: rec.Key, Headers: rec.Headers, Value: value}
+	}
+	if err := k.client.ProduceSync(ctx, out...).FirstErr(); err != nil {
+		return 0, fmt.Errorf("producing to %s: %w", k.s.cfg.KafkaOutputTopic, err)
+	}
+	if err := k.client.CommitRecords(ctx, records...); err != nil {
+		return 0, fmt.Errorf("committing offsets: %w", err)
+	}
+	return failed, nil
+}
+
+// resolve geocodes messages concurrently. Lookups that fail are retried
+// with a growing delay until they succeed, so no message is committed
+// without its address while the geocoding API is down.
+func (k *kafkaConsumer) resolve(ctx context.Context, records []*kgo.Record) ([]rowResult, error) {
+	results := make([]rowResult, len(records))
+	pending := make([]int, len(records))
+	for i := range pending {
+		pending[i] = i
+	}
+	delay := k.s.cfg.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for {
+		next := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < k.s.cfg.Workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					results[i] = k.s.resolveRow(i, messageCoordinates(records[i].Value))
+				}
+			}()
+		}
+		for _, i := range pending {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+
+		var retry []int
+		for _, i := range pending {
+			if results[i].geocodeErr != nil {
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 {
+			return results, nil
+		}
+		fmt.Fprintf(os.Stderr, "%d lookups failed (%v); retrying in %s\n", len(retry), results[retry[0]].geocodeErr, delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		pending = retry
+		if delay *= 2; delay > maxKafkaRetryDelay {
+			delay = maxKafkaRetryDelay
+		}
+	}
+}
+
+// messageFields decodes a message: a JSON object as it is, anything else as
+// {"coordinates": text}
+func messageFields(value []byte) map[string]json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err == nil && fields != nil {
+		return fields
+	}
+	text, _ := json.Marshal(strings.TrimSpace(string(value)))
+	return map[string]json.RawMessage{"coordinates": text}
+}
+
+// messageCoordinates returns the coordinates of a message: a latitude and
+// longitude field (lat/latitude and lng/lon/long/longitude), a coordinate
+// field named like a coordinate column, or the whole message as text
+func messageCoordinates(value []byte) string {
+	fields := messageFields(value)
+	var lat, lng, coords string
+	for name, raw := range fields {
+		v := jsonText(raw)
+		switch strings.ToLower(name) {
+		case "lat", "latitude":
+			lat = v
+		case "lng", "lon", "long", "longitude":
+			lng = v
+		default:
+			if coords == "" && isCoordinateHeader(name) {
+				coords = v
+			}
+		}
+	}
+	if lat != "" && lng != "" {
+		return lat + "," + lng
+	}
+	return coords
+}
+
+// jsonText returns a JSON string's text or a number's digits
+func jsonText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && (raw[0] == '-' || raw[0] >= '0' && raw[0] <= '9') {
+		return string(raw)
+	}
+	return ""
+}
+
+// enrich returns a message with the address, district and province of its
+// result added, the extra columns under "extra" and the reason it failed
+// under "error"
+func (k *kafkaConsumer) enrich(value []byte, res rowResult) ([]byte, error) {
+	fields := messageFields(value)
+	add := func(name string, v interface{}) {
+		fields[name], _ = json.Marshal(v)
+	}
+	add("address", res.address)
+	add("district", res.district)
+	add("province", res.province)
+	if res.skipped {
+		add("error", res.message)
+	} else if len(k.extra) > 0 {
+		extra := make(map[string]interface{}, len(k.extra))
+		for _, c := range k.extra {
+			extra[c.key] = c.value(res)
+		}
+		add("extra", extra)
+	}
+	return json.Marshal(fields)
+}
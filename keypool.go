@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Ways of choosing the key of a request, for --key-rotation
+const (
+	keyRoundRobin = "round-robin" // each request takes the next key
+	keyFailover   = "failover"    // the first key until it is rate limited
+)
+
+// keyPool pools the quotas of several API keys of one provider, such as the
+// keys of different business units, given to --api-key as a comma-separated
+// list. A key that is rate limited, per second or for the day, is left out
+// for --key-cooldown while the others carry on.
+type keyPool struct {
+	mode     string
+	cooldown time.Duration
+	keys     []*poolKey
+	next     atomic.Uint64
+
+	mu sync.Mutex // guards the benchedUntil times
+}
+
+// poolKey is a key of a pool and what it has been used for
+type poolKey struct {
+	key          string
+	requests     atomic.Int64
+	limited      atomic.Int64
+	benchedUntil time.Time
+}
+
+// newKeyPool makes a pool of the comma-separated keys
+func newKeyPool(keys []string, mode string, cooldown time.Duration) (*keyPool, error) {
+	if mode != keyRoundRobin && mode != keyFailover {
+		return nil, fmt.Errorf("--key-rotation must be %s or %s, got %q", keyRoundRobin, keyFailover, mode)
+	}
+	p := &keyPool{mode: mode, cooldown: cooldown}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		p.keys = append(p.keys, &poolKey{key: key})
+	}
+	if len(p.keys) == 0 {
+		return nil, fmt.Errorf("--api-key has no keys")
+	}
+	return p, nil
+}
+
+// pick chooses the key for a request and counts the request against it.
+// When every key is benched, the one that comes back first is used.
+func (p *keyPool) pick() *poolKey {
+	now := time.Now()
+	start := 0
+	if p.mode == keyRoundRobin {
+		start = int((p.next.Add(1) - 1) % uint64(len(p.keys)))
+	}
+
+	p.mu.Lock()
+	soonest := p.keys[start]
+	var chosen *poolKey
+	for i := range p.keys {
+		k := p.keys[(start+i)%len(p.keys)]
+		if !now.Before(k.benchedUntil) {
+			chosen = k
+			break
+		}
+		if k.benchedUntil.Before(soonest.benchedUntil) {
+			soonest = k
+		}
+	}
+	p.mu.Unlock()
+	if chosen == nil {
+		chosen = soonest
+	}
+	chosen.requests.Add(1)
+	return chosen
+}
+
+// rateLimited benches a key the provider refused for its rate limit and
+// reports whether another key can be tried right away
+func (p *keyPool) rateLimited(k *poolKey) bool {
+	k.limited.Add(1)
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k.benchedUntil = now.Add(p.cooldown)
+	for _, other := range p.keys {
+		if other != k && !now.Before(other.benchedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply puts the key into a request built with the first key, whatever
+// query parameter the provider takes it in
+func (k *poolKey) apply(req *http.Request, first string) {
+	if k.key == first {
+		return
+	}
+	query := req.URL.Query()
+	for param, values := range query {
+		for i, v := range values {
+			if v == first {
+				values[i] = k.key
+			}
+		}
+		query[param] = values
+	}
+	req.URL.RawQuery = query.Encode()
+}
+
+// keyLabel shows a key by its last four characters, so usage can be told
+// apart without printing the key
+func keyLabel(key string) string {
+	if len(key) <= 4 {
+		return "…"
+	}
+	return "…" + key[len(key)-4:]
+}
+
+// keyUsage is how many requests a key made, and how many were rate limited
+type keyUsage struct {
+	requests, limited int64
+}
+
+// usage returns the counts of each key, in --api-key order
+func (p *keyPool) usage() []keyUsage {
+	if p == nil {
+		return nil
+	}
+	out := make([]keyUsage, len(p.keys))
+	for i, k := range p.keys {
+		out[i] = keyUsage{requests: k.requests.Load(), limited: k.limited.Load()}
+	}
+	return out
+}
+
+// apiKeys returns every API key of the provider, to keep them out of logs
+// and recordings
+func (c *Config) apiKeys() []string {
+	if c.keys == nil {
+		if c.APIKey == "" {
+			return nil
+		}
+		return []string{c.APIKey}
+	}
+	keys := make([]string, len(c.keys.keys))
+	for i, k := range c.keys.keys {
+		keys[i] = k.key
+	}
+	return keys
+}
+
+// reportKeyUsage prints the requests of each pooled key during the run,
+// given the usage at its start
+func (s *Service) reportKeyUsage(before map[*Service][]keyUsage) {
+	for _, provider := range append([]*Service{s}, s.routeList()...) {
+		pool := provider.cfg.keys
+		if pool == nil {
+			continue
+		}
+		start := before[provider]
+		for i, u := range pool.usage() {
+			if i < len(start) {
+				u.requests -= start[i].requests
+				u.limited -= start[i].limited
+			}
+			if u.requests == 0 {
+				continue
+			}
+			line := fmt.Sprintf("✓ %s key %s: %d requests", provider.cfg.providerName(), keyLabel(pool.keys[i].key), u.requests)
+			if u.limited > 0 {
+				line += fmt.Sprintf(", %d rate limited", u.limited)
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
+// keyUsageSnapshot records the usage of the run's pooled keys, for
+// reportKeyUsage
+func (s *Service) keyUsageSnapshot() map[*Service][]keyUsage {
+	snapshot := make(map[*Service][]keyUsage)
+	for _, provider := range append([]*Service{s}, s.routeList()...) {
+		if provider.cfg.keys != nil {
+			snapshot[provider] = provider.cfg.keys.usage()
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,304 @@
+// Package latlg maps arbitrary Go structs through the coordinate-to-address
+// enrichment pipeline using struct tags, so integrators don't have to
+// hand-roll column plumbing.
+//
+// Tag the coordinate inputs and the result outputs of a struct:
+//
+//	type Site struct {
+//		ID       string
+//		Lat      float64 `latlg:"lat"`
+//		Lng      float64 `latlg:"lng"`
+//		Address  string  `latlg:"address"`
+//		District string  `latlg:"district"`
+//		Province string  `latlg:"province"`
+//		Err      string  `latlg:"error"`
+//	}
+//
+//	err := latlg.Map(sites, enricher)
+//
+// A single string field tagged `latlg:"latlng"` holding "lat,lng" may be used
+// instead of separate lat and lng fields.
+package latlg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Result is the enrichment for one coordinate
+type Result struct {
+	Address  string
+	District string
+	Province string
+}
+
+// Enricher looks up the address of a coordinate
+type Enricher interface {
+	Enrich(lat, lng float64) (Result, error)
+}
+
+// EnricherFunc adapts an ordinary function to the Enricher interface
+type EnricherFunc func(lat, lng float64) (Result, error)
+
+// Enrich calls f(lat, lng)
+func (f EnricherFunc) Enrich(lat, lng float64) (Result, error) {
+	return f(lat, lng)
+}
+
+// RecordError is the failure of a single record
+type RecordError struct {
+	Index int
+	Err   error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Index, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Errors collects the records that failed during Map
+type Errors []*RecordError
+
+func (e Errors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%d records failed; first: %v", len(e), e[0])
+}
+
+// Option configures Map
+type Option func(*options)
+
+type options struct {
+	workers int
+}
+
+// WithWorkers sets how many records are enriched concurrently (default 1)
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
+
+// Map enriches records in place. T must be a struct or a pointer to a struct
+// with latlg tags. Records that fail are reported in the returned Errors (and
+// in the field tagged `latlg:"error"`, if any); the other records are still
+// enriched.
+func Map[T any](records []T, e Enricher, opts ...Option) error {
+	o := options{workers: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fields, err := fieldsFor(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return err
+	}
+
+	jobs := make(chan int)
+	var mu sync.Mutex
+	var errs Errors
+	var wg sync.WaitGroup
+	for w := 0; w < o.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fields.enrich(reflect.ValueOf(&records[i]).Elem(), e); err != nil {
+					mu.Lock()
+					errs = append(errs, &RecordError{Index: i, Err: err})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range records {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+	return errs
+}
+
+// tagFields holds the struct field indexes of each latlg tag
+type tagFields struct {
+	lat, lng, latlng                      []int
+	address, district, province, errField []int
+}
+
+var fieldCache sync.Map // reflect.Type -> *tagFields
+
+// fieldsFor resolves the tagged fields of a struct type (or pointer to struct)
+func fieldsFor(t reflect.Type) (*tagFields, error) {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.(*tagFields), nil
+	}
+
+	st := t
+	if st.Kind() == reflect.Pointer {
+		st = st.Elem()
+	}
+	if st.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("latlg: %s is not a struct", t)
+	}
+
+	f := &tagFields{}
+	for _, field := range reflect.VisibleFields(st) {
+		tag, ok := field.Tag.Lookup("latlg")
+		if !ok || !field.IsExported() {
+			continue
+		}
+		var target *[]int
+		switch strings.TrimSpace(tag) {
+		case "lat":
+			target = &f.lat
+		case "lng", "lon":
+			target = &f.lng
+		case "latlng":
+			target = &f.latlng
+		case "address":
+			target = &f.address
+		case "district":
+			target = &f.district
+		case "province":
+			target = &f.province
+		case "error":
+			target = &f.errField
+		default:
+			return nil, fmt.Errorf("latlg: unknown tag %q on %s.%s", tag, st.Name(), field.Name)
+		}
+		if *target != nil {
+			return nil, fmt.Errorf("latlg: duplicate tag %q on %s.%s", tag, st.Name(), field.Name)
+		}
+		*target = field.Index
+	}
+
+	if f.latlng == nil && (f.lat == nil || f.lng == nil) {
+		return nil, fmt.Errorf("latlg: %s needs fields tagged lat and lng, or latlng", st.Name())
+	}
+
+	fieldCache.Store(t, f)
+	return f, nil
+}
+
+// enrich reads the coordinates of one record, looks them up and writes the results
+func (f *tagFields) enrich(v reflect.Value, e Enricher) (err error) {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return fmt.Errorf("nil record")
+		}
+		v = v.Elem()
+	}
+
+	defer func() {
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		setString(v, f.errField, msg)
+	}()
+
+	lat, lng, err := f.coordinates(v)
+	if err != nil {
+		return err
+	}
+	result, err := e.Enrich(lat, lng)
+	if err != nil {
+		return err
+	}
+
+	setString(v, f.address, result.Address)
+	setString(v, f.district, result.District)
+	setString(v, f.province, result.Province)
+	return nil
+}
+
+// coordinates reads the latitude and longitude fields of a record
+func (f *tagFields) coordinates(v reflect.Value) (lat, lng float64, err error) {
+	if f.latlng != nil {
+		s, err := stringValue(v.FieldByIndex(f.latlng))
+		if err != nil {
+			return 0, 0, err
+		}
+		parts := strings.Split(s, ",")
+		if len(parts) != 2 {
+			return 0, 0, fmt.Errorf("invalid format, expected 'lat,lng'")
+		}
+		if lat, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid latitude: %w", err)
+		}
+		if lng, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid longitude: %w", err)
+		}
+		return lat, lng, nil
+	}
+
+	if lat, err = floatValue(v.FieldByIndex(f.lat)); err != nil {
+		return 0, 0, fmt.Errorf("invalid latitude: %w", err)
+	}
+	if lng, err = floatValue(v.FieldByIndex(f.lng)); err != nil {
+		return 0, 0, fmt.Errorf("invalid longitude: %w", err)
+	}
+	return lat, lng, nil
+}
+
+func floatValue(v reflect.Value) (float64, error) {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.String:
+		return strconv.ParseFloat(strings.TrimSpace(v.String()), 64)
+	case reflect.Pointer:
+		if v.IsNil() {
+			return 0, fmt.Errorf("missing value")
+		}
+		return floatValue(v.Elem())
+	}
+	return 0, fmt.Errorf("unsupported field type %s", v.Type())
+}
+
+func stringValue(v reflect.Value) (string, error) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			return "", fmt.Errorf("missing value")
+		}
+		return stringValue(v.Elem())
+	}
+	return "", fmt.Errorf("unsupported field type %s", v.Type())
+}
+
+// setString assigns a string field, allocating through a nil *string if needed
+func setString(v reflect.Value, index []int, s string) {
+	if index == nil {
+		return
+	}
+	field := v.FieldByIndex(index)
+	if field.Kind() == reflect.Pointer && field.Type().Elem().Kind() == reflect.String {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		field = field.Elem()
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(s)
+	}
+}
@@ -0,0 +1,250 @@
+// Reverse geocoding service of latlg-address (run with --grpc ADDR).
+//
+// Regenerate the Go code after changing this file:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	    --go-grpc_out=. --go-grpc_opt=paths=source_relative latlgpb/geocode.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v4.25.3
+// source: latlgpb/geocode.proto
+
+package latlgpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Geocoder_ReverseGeocode_FullMethodName       = "/latlg.v1.Geocoder/ReverseGeocode"
+	Geocoder_ReverseGeocodeBatch_FullMethodName  = "/latlg.v1.Geocoder/ReverseGeocodeBatch"
+	Geocoder_ReverseGeocodeStream_FullMethodName = "/latlg.v1.Geocoder/ReverseGeocodeStream"
+)
+
+// GeocoderClient is the client API for Geocoder service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Geocoder turns coordinates into addresses with the server's options
+// (provider, language, extra columns, cache).
+type GeocoderClient interface {
+	// ReverseGeocode resolves one location. Locations that cannot be geocoded
+	// (unreadable coordinates, outside --expect-country) fail with
+	// INVALID_ARGUMENT, failed lookups with UNAVAILABLE.
+	ReverseGeocode(ctx context.Context, in *Location, opts ...grpc.CallOption) (*Place, error)
+	// ReverseGeocodeBatch resolves up to 1000 locations concurrently; the
+	// places are returned in request order and failures are reported in
+	// Place.error instead of failing the call.
+	ReverseGeocodeBatch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	// ReverseGeocodeStream resolves locations as they arrive and sends each
+	// place as soon as it is ready, so answers may come out of order; match
+	// them by id. Failures are reported in Place.error.
+	ReverseGeocodeStream(ctx context.Context, opts ...grpc.CallOption) (Geocoder_ReverseGeocodeStreamClient, error)
+}
+
+type geocoderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGeocoderClient(cc grpc.ClientConnInterface) GeocoderClient {
+	return &geocoderClient{cc}
+}
+
+func (c *geocoderClient) ReverseGeocode(ctx context.Context, in *Location, opts ...grpc.CallOption) (*Place, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Place)
+	err := c.cc.Invoke(ctx, Geocoder_ReverseGeocode_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *geocoderClient) ReverseGeocodeBatch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, Geocoder_ReverseGeocodeBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *geocoderClient) ReverseGeocodeStream(ctx context.Context, opts ...grpc.CallOption) (Geocoder_ReverseGeocodeStreamClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Geocoder_ServiceDesc.Streams[0], Geocoder_ReverseGeocodeStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &geocoderReverseGeocodeStreamClient{ClientStream: stream}
+	return x, nil
+}
+
+type Geocoder_ReverseGeocodeStreamClient interface {
+	Send(*Location) error
+	Recv() (*Place, error)
+	grpc.ClientStream
+}
+
+type geocoderReverseGeocodeStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *geocoderReverseGeocodeStreamClient) Send(m *Location) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *geocoderReverseGeocodeStreamClient) Recv() (*Place, error) {
+	m := new(Place)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GeocoderServer is the server API for Geocoder service.
+// All implementations must embed UnimplementedGeocoderServer
+// for forward compatibility
+//
+// Geocoder turns coordinates into addresses with the server's options
+// (provider, language, extra columns, cache).
+type GeocoderServer interface {
+	// ReverseGeocode resolves one location. Locations that cannot be geocoded
+	// (unreadable coordinates, outside --expect-country) fail with
+	// INVALID_ARGUMENT, failed lookups with UNAVAILABLE.
+	ReverseGeocode(context.Context, *Location) (*Place, error)
+	// ReverseGeocodeBatch resolves up to 1000 locations concurrently; the
+	// places are returned in request order and failures are reported in
+	// Place.error instead of failing the call.
+	ReverseGeocodeBatch(context.Context, *BatchRequest) (*BatchResponse, error)
+	// ReverseGeocodeStream resolves locations as they arrive and sends each
+	// place as soon as it is ready, so answers may come out of order; match
+	// them by id. Failures are reported in Place.error.
+	ReverseGeocodeStream(Geocoder_ReverseGeocodeStreamServer) error
+	mustEmbedUnimplementedGeocoderServer()
+}
+
+// UnimplementedGeocoderServer must be embedded to have forward compatible implementations.
+type UnimplementedGeocoderServer struct {
+}
+
+func (UnimplementedGeocoderServer) ReverseGeocode(context.Context, *Location) (*Place, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReverseGeocode not implemented")
+}
+func (UnimplementedGeocoderServer) ReverseGeocodeBatch(context.Context, *BatchRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReverseGeocodeBatch not implemented")
+}
+func (UnimplementedGeocoderServer) ReverseGeocodeStream(Geocoder_ReverseGeocodeStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method ReverseGeocodeStream not implemented")
+}
+func (UnimplementedGeocoderServer) mustEmbedUnimplementedGeocoderServer() {}
+
+// UnsafeGeocoderServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GeocoderServer will
+// result in compilation errors.
+type UnsafeGeocoderServer interface {
+	mustEmbedUnimplementedGeocoderServer()
+}
+
+func RegisterGeocoderServer(s grpc.ServiceRegistrar, srv GeocoderServer) {
+	s.RegisterService(&Geocoder_ServiceDesc, srv)
+}
+
+func _Geocoder_ReverseGeocode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Location)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GeocoderServer).ReverseGeocode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Geocoder_ReverseGeocode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GeocoderServer).ReverseGeocode(ctx, req.(*Location))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Geocoder_ReverseGeocodeBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GeocoderServer).ReverseGeocodeBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Geocoder_ReverseGeocodeBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GeocoderServer).ReverseGeocodeBatch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Geocoder_ReverseGeocodeStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GeocoderServer).ReverseGeocodeStream(&geocoderReverseGeocodeStreamServer{ServerStream: stream})
+}
+
+type Geocoder_ReverseGeocodeStreamServer interface {
+	Send(*Place) error
+	Recv() (*Location, error)
+	grpc.ServerStream
+}
+
+type geocoderReverseGeocodeStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *geocoderReverseGeocodeStreamServer) Send(m *Place) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *geocoderReverseGeocodeStreamServer) Recv() (*Location, error) {
+	m := new(Location)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Geocoder_ServiceDesc is the grpc.ServiceDesc for Geocoder service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Geocoder_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "latlg.v1.Geocoder",
+	HandlerType: (*GeocoderServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ReverseGeocode",
+			Handler:    _Geocoder_ReverseGeocode_Handler,
+		},
+		{
+			MethodName: "ReverseGeocodeBatch",
+			Handler:    _Geocoder_ReverseGeocodeBatch_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ReverseGeocodeStream",
+			Handler:       _Geocoder_ReverseGeocodeStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "latlgpb/geocode.proto",
+}
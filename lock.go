@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+// runLock is the content of the lock file of an input being processed
+type runLock struct {
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	User    string    `json:"user,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// lockPath returns the lock file of an input: sites.xlsx is locked by
+// sites.xlsx.lock next to it
+func lockPath(inputFile string) string {
+	return inputFile + ".lock"
+}
+
+// lockInput keeps two runs, such as two people or overlapping cron jobs,
+// from processing the same file at once and overwriting each other's
+// progress and output files. It returns a func that releases the lock.
+// A lock left by a run that died on this host is taken over; others are
+// only removed with --force-unlock. If the lock can't be created, such as
+// next to a read-only input, the run goes on unlocked.
+func lockInput(inputFile string, forceUnlock bool) (release func(), err error) {
+	path := lockPath(inputFile)
+	if forceUnlock {
+		if err := os.Remove(path); err == nil {
+			fmt.Printf("Removed lock %s\n", path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("removing lock: %w", err)
+		}
+	}
+
+	host, _ := os.Hostname()
+	lock := runLock{Host: host, PID: os.Getpid(), Started: time.Now().UTC()}
+	if u, err := user.Current(); err == nil {
+		lock.User = u.Username
+	}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, werr := f.Write(append(data, '\n'))
+			if cerr := f.Close(); werr == nil {
+				werr = cerr
+			}
+			if werr != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("writing lock: %w", werr)
+			}
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			fmt.Printf("Warning: Could not lock %s: %v\n", inputFile, err)
+			return func() {}, nil
+		}
+
+		var holder runLock
+		raw, rerr := os.ReadFile(path)
+		if rerr == nil {
+			rerr = json.Unmarshal(raw, &holder)
+		}
+		if attempt == 0 && rerr == nil && holder.Host == host && holder.PID != os.Getpid() && !processAlive(holder.PID) {
+			fmt.Printf("Taking over lock %s left by process %d, which is no longer running\n", path, holder.PID)
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("removing stale lock: %w", err)
+			}
+			continue
+		}
+		if rerr != nil {
+			return nil, fmt.Errorf("%s is locked by %s; if no run is processing it, remove the lock with --force-unlock", inputFile, path)
+		}
+		by := fmt.Sprintf("process %d on %s", holder.PID, holder.Host)
+		if holder.User != "" {
+			by = holder.User + "'s " + by
+		}
+		return nil, fmt.Errorf("%s is being processed by %s since %s (lock %s); if that run is no longer going, remove the lock with --force-unlock",
+			inputFile, by, holder.Started.Local().Format(time.DateTime), path)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// longdoGeocoder speaks the Longdo Map address API
+// (https://map.longdo.com/docs/rest-api), which knows Thai addresses down to
+// the subdistrict and answers in Thai
+type longdoGeocoder struct {
+	cfg *Config
+}
+
+// longdoResponse is the answer of the Longdo address service
+type longdoResponse struct {
+	Geocode     string `json:"geocode"` // Thai administrative code of the subdistrict
+	Country     string `json:"country"`
+	Province    string `json:"province"`
+	District    string `json:"district"`
+	Subdistrict string `json:"subdistrict"`
+	Postcode    string `json:"postcode"`
+	Road        string `json:"road"`
+	AOI         string `json:"aoi"` // named area, such as a campus or estate
+}
+
+func (g longdoGeocoder) request(lat, lng float64) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("lat", fmt.Sprintf("%.6f", lat))
+	params.Set("lon", fmt.Sprintf("%.6f", lng))
+	params.Set("noelevation", "1")
+	params.Set("key", g.cfg.APIKey)
+	return http.NewRequest("GET", g.cfg.Endpoint+"?"+params.Encode(), nil)
+}
+
+// parse maps Longdo's flat answer onto the Nominatim address keys the Thai
+// component rules read: province, district (amphoe/khet) and subdistrict
+// (tambon/khwaeng). Longdo abbreviates the unit in front of each name, as in
+// "จ.เชียงใหม่"; the abbreviations are dropped.
+func (g longdoGeocoder) parse(body []byte) (GeocodeResponse, error) {
+	var lr longdoResponse
+	if err := json.Unmarshal(body, &lr); err != nil {
+		return GeocodeResponse{}, err
+	}
+	var resp GeocodeResponse
+	if lr.Province == "" {
+		return resp, nil // at sea or outside Longdo's coverage
+	}
+	resp.Address = Address{
+		Road:        lr.Road,
+		Suburb:      lr.AOI,
+		Subdistrict: trimThaiUnit(lr.Subdistrict, "ต.", "แขวง"),
+		District:    trimThaiUnit(lr.District, "อ.", "ข.", "เขต"),
+		Province:    trimThaiUnit(lr.Province, "จ."),
+		Postcode:    lr.Postcode,
+		Country:     lr.Country,
+	}
+	if lr.Geocode != "" || strings.Contains(lr.Country, "ไทย") {
+		resp.Address.CountryCode = "th"
+	}
+	var parts []string
+	for _, part := range []string{lr.AOI, lr.Road, lr.Subdistrict, lr.District, lr.Province, lr.Postcode} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	resp.DisplayName = strings.Join(parts, " ")
+	return resp, nil
+}
+
+// trimThaiUnit removes the administrative unit in front of a Thai place name
+func trimThaiUnit(name string, units ...string) string {
+	name = strings.TrimSpace(name)
+	for _, unit := range units {
+		if trimmed := strings.TrimPrefix(name, unit); trimmed != name {
+			return strings.TrimSpace(trimmed)
+		}
+	}
+	return name
+}
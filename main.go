@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -9,32 +11,118 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
+
+	"latlg-address/latlg"
 
 	"github.com/xuri/excelize/v2"
 )
 
 // GeocodeResponse represents the response from Nominatim API
 type GeocodeResponse struct {
-	DisplayName string `json:"display_name"`
-	Address     struct {
-		HouseNumber   string `json:"house_number"`
-		Road          string `json:"road"`
-		Suburb        string `json:"suburb"`
-		City          string `json:"city"`
-		County        string `json:"county"`
-		State         string `json:"state"`
-		StateDistrict string `json:"state_district"`
-		Postcode      string `json:"postcode"`
-		Country       string `json:"country"`
-		// Thailand specific fields
-		Subdistrict string `json:"subdistrict"`
-		District    string `json:"district"`
-		Province    string `json:"province"`
-	} `json:"address"`
+	DisplayName string  `json:"display_name"`
+	Address     Address `json:"address"`
+	// The OSM object the coordinate resolved to
+	Class     string  `json:"class"`
+	Type      string  `json:"type"`
+	PlaceRank flexInt `json:"place_rank"`
+	OSMType   string  `json:"osm_type"`
+	OSMID     flexInt `json:"osm_id"`
+	// Where the object is; Nominatim sends these as strings
+	Lat         string   `json:"lat"`
+	Lon         string   `json:"lon"`
+	BoundingBox []string `json:"boundingbox"`
+	// Returned only when requested with --extratags and --namedetails
+	ExtraTags   map[string]string `json:"extratags"`
+	NameDetails map[string]string `json:"namedetails"`
+}
+
+// Address holds the address components returned by Nominatim
+type Address struct {
+	HouseNumber   string `json:"house_number"`
+	Road          string `json:"road"`
+	Hamlet        string `json:"hamlet"`
+	Village       string `json:"village"`
+	Neighbourhood string `json:"neighbourhood"`
+	Quarter       string `json:"quarter"`
+	Suburb        string `json:"suburb"`
+	Town          string `json:"town"`
+	City          string `json:"city"`
+	CityDistrict  string `json:"city_district"`
+	Municipality  string `json:"municipality"`
+	County        string `json:"county"`
+	State         string `json:"state"`
+	StateDistrict string `json:"state_district"`
+	Region        string `json:"region"`
+	Postcode      string `json:"postcode"`
+	Country       string `json:"country"`
+	CountryCode   string `json:"country_code"`
+	// Thailand specific fields
+	Subdistrict string `json:"subdistrict"`
+	District    string `json:"district"`
+	Province    string `json:"province"`
+
+	// other holds the keys without a field above, such as "city_district"
+	other map[string]string
+}
+
+// UnmarshalJSON keeps every address key, including ones without a field
+func (a *Address) UnmarshalJSON(data []byte) error {
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	*a = Address{}
+	v := reflect.ValueOf(a).Elem()
+	for key, value := range all {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if i, known := addressFieldIndex[key]; known {
+			v.Field(i).SetString(str)
+			continue
+		}
+		if a.other == nil {
+			a.other = make(map[string]string)
+		}
+		a.other[key] = str
+	}
+	return nil
+}
+
+// addressFieldIndex maps Nominatim address keys to Address fields
+var addressFieldIndex = func() map[string]int {
+	t := reflect.TypeOf(Address{})
+	index := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" {
+			index[name] = i
+		}
+	}
+	return index
+}()
+
+// Field returns the address component with the given Nominatim key, such as
+// "road" or "city_district", or "" if the response didn't have it
+func (a Address) Field(key string) string {
+	i, ok := addressFieldIndex[key]
+	if !ok {
+		return a.other[key]
+	}
+	return reflect.ValueOf(a).Field(i).String()
+}
+
+// isAddressField reports whether key is a known Nominatim address key
+func isAddressField(key string) bool {
+	_, ok := addressFieldIndex[key]
+	return ok
 }
 
 // Coordinates represents latitude and longitude
@@ -46,12 +134,20 @@ type Coordinates struct {
 // Repository handles Excel file operations
 type Repository struct {
 	file      *excelize.File
+	path      string
 	sheetName string
 	rows      [][]string
+	preserve  bool
+	edits     cellEdits
+	reports   []reportSheet
+	linkStyle int // style of --map-link cells, created on first use
 }
 
 // NewRepository creates a new repository instance
 func NewRepository(excelFile string) (*Repository, error) {
+	if isTrackFile(excelFile) {
+		return openTrackFile(excelFile)
+	}
 	f, err := excelize.OpenFile(excelFile)
 	if err != nil {
 		return nil, fmt.Errorf("opening Excel file: %w", err)
@@ -76,8 +172,10 @@ func NewRepository(excelFile string) (*Repository, error) {
 
 	return &Repository{
 		file:      f,
+		path:      excelFile,
 		sheetName: sheetName,
 		rows:      rows,
+		edits:     make(cellEdits),
 	}, nil
 }
 
@@ -101,28 +199,125 @@ func (r *Repository) GetFile() *excelize.File {
 	return r.file
 }
 
-// SaveAs saves the file to the specified path
+// SetPreserveFormatting enables non-destructive saving: the original workbook
+// is copied as-is and only the cells written through SetCellValue are replaced
+func (r *Repository) SetPreserveFormatting(enabled bool) {
+	r.preserve = enabled
+}
+
+// SaveAs saves the file to the specified path. The workbook is written to a
+// temporary file first and renamed into place, so an interrupted save never
+// leaves a corrupt file at outputFile.
 func (r *Repository) SaveAs(outputFile string) error {
-	return r.file.SaveAs(outputFile)
+	return writeFileAtomic(outputFile, func(w io.Writer) error {
+		if r.preserve {
+			return patchWorkbook(r.path, w, r.sheetName, r.edits, r.reports)
+		}
+		return r.file.Write(w)
+	})
 }
 
-// SetCellValue sets a cell value
+// SetCellValue sets a cell value. Every write is also recorded so the results
+// can be journaled if the workbook cannot be saved.
 func (r *Repository) SetCellValue(cell string, value interface{}) error {
-	return r.file.SetCellValue(r.sheetName, cell, value)
+	col, row, err := excelize.CellNameToCoordinates(cell)
+	if err != nil {
+		return err
+	}
+	// excelize silently truncates long text; refuse it so the row is reported instead
+	if str, ok := value.(string); ok && utf8.RuneCountInString(str) > excelize.TotalCellChars {
+		return fmt.Errorf("value is %d characters, cells hold at most %d", utf8.RuneCountInString(str), excelize.TotalCellChars)
+	}
+	if link, ok := value.(hyperlink); ok {
+		err = r.setHyperlink(cell, link)
+	} else {
+		err = r.file.SetCellValue(r.sheetName, cell, value)
+	}
+	if err != nil {
+		return err
+	}
+	r.edits.set(row, col, value)
+	return nil
 }
 
 // Service handles business logic for coordinate to address conversion
 type Service struct {
-	repo  *Repository
-	cache *coordinateCache
+	repo              *Repository
+	cfg               *Config
+	cache             *coordinateCache
+	deadLetters       *deadLetterQueue
+	failures          *failurePolicy
+	client            *http.Client
+	checkpoint        *checkpoint
+	cpPath            string // where the checkpoint is, or is created when a small run pauses
+	cpHeader          journalHeader
+	cpCols            []int
+	resumed           map[int]bool // rows finished by the run being resumed
+	received          int          // results handled by this run
+	requests          atomic.Int64 // geocoding requests made, retries included
+	outOfBudget       atomic.Bool  // the run stopped because a request budget was used up
+	extraCols         []*extraColumn
+	statusCol         int // Status column, or -1
+	nextCol           int // first free column, for columns added during the run
+	writeErrors       int
+	countryMismatches int
+	notesCol          int   // --notes-column, or -1
+	notesFound        int64 // rows whose coordinates came from the notes column
+	rawResponses      *rawResponseLog
+	refreshBefore     time.Time // cached results geocoded before this are looked up again
+	elevationErrors   int64     // rows whose --elevation lookup failed
+	geoJSON           *geoJSONExport
+	resultsDB         *resultsDB
+	htmlMap           *mapExport
+	routes            map[string]*Service // --routes providers by country code
+	owner             *Service            // the run a route belongs to
+	batcher           *geocodeBatcher     // --request-batch lookups, or nil
+	limiter           *concurrencyLimiter // --adaptive-concurrency, or nil
+	span              *span               // what lookups are traced under, or nil
+
+	// highlights are the row highlights added to the sheet by applyHighlights
+	highlights []rowHighlight
+	// savedTo is where the output was saved, and parts the files a
+	// --split-rows output was saved as
+	savedTo string
+	parts   []string
 }
 
 // NewService creates a new service instance
-func NewService(repo *Repository) *Service {
-	return &Service{
-		repo:  repo,
-		cache: newCoordinateCache(),
+func NewService(repo *Repository, cfg *Config) *Service {
+	cache := newCoordinateCache()
+	if cfg.Zoom != defaultZoom {
+		cache.scope = fmt.Sprintf("@z%d", cfg.Zoom)
+	}
+	if cfg.redactLevel != redactNone {
+		// Redacted addresses are cached as such
+		cache.scope += "@redact-" + cfg.redactLevel.String()
+	}
+	if cfg.NormalizeNames {
+		// Normalized names are cached as such; keep them apart from raw ones
+		cache.scope += "@names"
+		if cfg.KeepAdminPrefixes {
+			cache.scope += "+prefixes"
+		}
 	}
+	cache.coarse = cfg.Coarse
+	cache.ttl = cfg.CacheTTL
+	if cfg.redis != nil {
+		cache.shared = redisCache{client: cfg.redis, ttl: cfg.CacheTTL}
+	}
+	s := &Service{
+		repo:      repo,
+		cfg:       cfg,
+		cache:     cache,
+		failures:  newFailurePolicy(cfg),
+		client:    newHTTPClient(cfg),
+		statusCol: -1,
+		notesCol:  -1,
+	}
+	s.batcher = newGeocodeBatcher(s)
+	s.limiter = newConcurrencyLimiter(cfg)
+	s.routes = s.newRoutes()
+	return s
 }
 
 // Process converts coordinates to addresses and saves the result
@@ -132,72 +327,278 @@ func (s *Service) Process(excelFile string) error {
 	rows := s.repo.GetRows()
 	totalRows := len(rows) - 1 // Exclude header
 	fmt.Printf("Total rows to process: %d\n", totalRows)
+	s.cfg.progress.setTotal(totalRows)
+	s.reportBudget()
+	keysBefore := s.keyUsageSnapshot()
 
 	latLngCol, addressCol, districtCol, provinceCol, err := s.findColumns(rows)
 	if err != nil {
 		return err
 	}
+	if err := s.findNotesColumn(rows[0]); err != nil {
+		return err
+	}
 
 	if addressCol == -1 || districtCol == -1 || provinceCol == -1 {
 		addressCol, districtCol, provinceCol = s.addAddressColumns(len(rows[0]))
 	}
+	s.setupColumns(rows[0], provinceCol)
+
+	if s.cfg.CoordinateReport {
+		if err := s.writeCoordinateReport(rows, latLngCol, excelFile); err != nil {
+			return err
+		}
+	}
+	if s.cfg.DuplicatesSheet {
+		if err := s.writeDuplicatesSheet(rows, latLngCol); err != nil {
+			return err
+		}
+	}
+
+	outputFile := s.cfg.outputPath(excelFile, time.Now())
+	previousOutput := outputFile
+	if !s.cfg.overwrites() {
+		previousOutput, outputFile = s.versionOutput(outputFile)
+	}
+
+	// The change feed compares this run with the results already in the output
+	var previous snapshot
+	var snapCols snapshotColumns
+	if s.cfg.ChangeFeed != "" {
+		if previous, err = s.previousSnapshot(previousOutput); err != nil {
+			return err
+		}
+		if snapCols.key, err = s.changeKeyColumn(rows[0]); err != nil {
+			return err
+		}
+		snapCols.coords, snapCols.address, snapCols.district, snapCols.province = latLngCol, addressCol, districtCol, provinceCol
+	}
+
+	// Failed geocodes are persisted as they happen so they can be replayed later
+	dlq, err := openDeadLetterQueue(deadLetterPath(excelFile), excelFile, outputFile, s.repo.GetSheetName())
+	if err != nil {
+		return err
+	}
+	s.deadLetters = dlq
+	defer func() {
+		if err := dlq.close(); err != nil {
+			fmt.Printf("Warning: Could not write dead letter file: %v\n", err)
+		} else if dlq.count > 0 {
+			fmt.Printf("✓ %d failed geocodes written to %s (retry with: latlg-address replay %s)\n", dlq.count, dlq.path, dlq.path)
+		}
+	}()
+
+	if err := s.warmCache(); err != nil {
+		return err
+	}
+	if err := s.openRawResponses(); err != nil {
+		return err
+	}
+	defer s.closeRawResponses()
+	if err := s.openGeoJSONExport(); err != nil {
+		return err
+	}
+	defer func() { s.geoJSON.discard() }() // no-op once committed
+	if err := s.openResultsDB(excelFile); err != nil {
+		return err
+	}
+	defer func() { s.finishResultsDB("") }() // no-op once finished
+	if s.cfg.ExportMap != "" {
+		s.htmlMap = &mapExport{path: s.cfg.ExportMap, minQuality: s.cfg.MinQuality}
+	}
+
+	s.cpPath = s.cfg.checkpointPath(excelFile)
+	s.cpHeader = journalHeader{Source: excelFile, Output: outputFile, Sheet: s.repo.GetSheetName(), Created: time.Now().UTC()}
+	s.cpCols = []int{addressCol + 1, districtCol + 1, provinceCol + 1}
+	if s.cfg.Resume {
+		if _, err := os.Stat(s.cpPath); err == nil {
+			if s.checkpoint, err = s.resumeCheckpoint(s.cpPath, excelFile, s.cpCols); err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("No checkpoint found at %s, starting from the beginning\n", s.cpPath)
+		}
+	}
+	if s.cfg.DiffAgainst != "" {
+		if err := s.reusePreviousOutput(rows, latLngCol, addressCol, districtCol, provinceCol); err != nil {
+			return err
+		}
+	}
 
 	// For large datasets (>100k rows), process in batches and save periodically
-	batchSize := 1000
 	if totalRows > 100000 {
-		fmt.Printf("Large dataset detected. Processing in batches of %d rows...\n", batchSize)
-		processed := s.processRowsInBatches(rows, latLngCol, addressCol, districtCol, provinceCol, batchSize, excelFile)
+		fmt.Println("Large dataset detected. Processing in batches with periodic checkpoints...")
+		if s.checkpoint == nil {
+			if s.checkpoint, err = createCheckpoint(s.cpPath, s.cpHeader, s.cpCols); err != nil {
+				return err
+			}
+		}
+		processed := s.processRowsInBatches(rows, latLngCol, addressCol, districtCol, provinceCol)
 		fmt.Printf("\n✓ Processed %d rows\n", processed)
 	} else {
 		processed := s.processRows(rows, latLngCol, addressCol, districtCol, provinceCol)
 		fmt.Printf("\n✓ Processed %d rows\n", processed)
 	}
 
-	// Save to data/ directory
-	dataDir := "data"
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return fmt.Errorf("creating data directory: %w", err)
+	if s.failures.isAborted() {
+		fmt.Printf("\n✗ Run %s\nSaving the rows processed so far...\n", s.failures.reason)
+	}
+
+	s.reportNotesCoordinates()
+	if s.cfg.QualityColumn {
+		low, err := s.highlightLowQuality(len(rows))
+		if err != nil {
+			fmt.Printf("Warning: Could not highlight low-quality rows: %v\n", err)
+		}
+		switch {
+		case low > 0 && s.repo.preserve:
+			fmt.Printf("⚠ %d rows scored below --min-quality %d; --writer patch only replaces cell values, so they are not filled in yellow\n", low, s.cfg.MinQuality)
+		case low > 0:
+			fmt.Printf("⚠ %d rows scored below --min-quality %d\n", low, s.cfg.MinQuality)
+		}
+	}
+	if s.cfg.HighlightFailed {
+		failed, err := s.highlightFailedRows(rows, latLngCol, addressCol)
+		if err != nil {
+			fmt.Printf("Warning: Could not highlight failed rows: %v\n", err)
+		}
+		switch {
+		case failed > 0 && s.repo.preserve:
+			fmt.Printf("⚠ %d rows failed; --writer patch only replaces cell values, so they are not filled in red\n", failed)
+		case failed > 0:
+			fmt.Printf("⚠ %d rows failed and are filled in red\n", failed)
+		}
+	}
+	if s.cfg.SummarySheet {
+		if err := s.writeSummarySheet(rows, latLngCol, addressCol, districtCol, provinceCol); err != nil {
+			fmt.Printf("Warning: Could not write the %s sheet: %v\n", summarySheet, err)
+		}
+	}
+	if err := s.applyHighlights(len(rows)); err != nil {
+		fmt.Printf("Warning: Could not highlight rows: %v\n", err)
+	}
+	if s.cfg.FormatSheet {
+		if err := s.formatSheet(len(rows)); err != nil {
+			fmt.Printf("Warning: Could not format the sheet: %v\n", err)
+		}
 	}
+	s.persistCache()
+	s.saveBudgets()
 
-	fileName := filepath.Base(excelFile)
-	outputFile := filepath.Join(dataDir, strings.TrimSuffix(fileName, ".xlsx")+"_with_addresses.xlsx")
-	if err := s.repo.SaveAs(outputFile); err != nil {
-		return fmt.Errorf("saving file: %w", err)
+	savedTo, err := s.saveOutput(excelFile, outputFile)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("✓ Output saved to: %s\n", outputFile)
-	return nil
+	if len(s.parts) > 0 {
+		fmt.Printf("✓ Output saved in %d parts of up to %d rows:\n", len(s.parts), s.cfg.SplitRows)
+		for _, part := range s.parts {
+			fmt.Printf("  %s\n", part)
+		}
+		savedTo = s.parts[0]
+	} else {
+		fmt.Printf("✓ Output saved to: %s\n", savedTo)
+	}
+	s.savedTo = savedTo
+	if s.outOfBudget.Load() {
+		// Keep the checkpoint so the next run picks up the rest
+		if err := s.saveProgress(); err != nil {
+			fmt.Printf("Warning: Could not save progress: %v\n", err)
+		}
+		fmt.Printf("%d rows left; continue with --resume once there is budget again\n", totalRows-len(s.resumed)-s.received)
+	} else if s.checkpoint != nil {
+		s.checkpoint.remove()
+	}
+	s.cfg.progress.setOutput(savedTo)
+	s.commitGeoJSONExport()
+	s.finishResultsDB(savedTo)
+	s.writeMap(filepath.Base(savedTo))
+	s.reportWriteErrors()
+	s.reportCountryMismatches()
+	s.reportElevationErrors()
+	s.reportConcurrency()
+	s.reportKeyUsage(keysBefore)
+	if previous != nil {
+		changes := diffSnapshots(previous, s.currentSnapshot(snapCols))
+		if err := s.emitChanges(changes, excelFile, savedTo); err != nil {
+			fmt.Printf("Warning: Could not write change feed: %v\n", err)
+		}
+	}
+	return s.failures.err()
+}
+
+// outputTaken reports whether an output is already saved at path; a
+// --split-rows output is there when its first part is
+func (s *Service) outputTaken(path string) bool {
+	if s.cfg.SplitRows > 0 {
+		path = partPath(path, 1)
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// versionOutput keeps an earlier output from being replaced: when path is
+// taken, the results are saved as its next free version instead. It returns
+// the newest earlier output, or path if there is none, and where to save.
+func (s *Service) versionOutput(path string) (previous, next string) {
+	latest, next := outputVersions(path, s.outputTaken)
+	if latest == "" {
+		return path, path
+	}
+	shown := latest
+	if s.cfg.SplitRows > 0 {
+		shown = partPath(latest, 1)
+	}
+	fmt.Printf("%s already exists; saving to %s (--force overwrites it)\n", shown, next)
+	return latest, next
 }
 
-// processRowsInBatches processes rows in batches for large datasets
-func (s *Service) processRowsInBatches(rows [][]string, latLngCol, addressCol, districtCol, provinceCol, batchSize int, excelFile string) int {
+// processRowsInBatches processes rows in batches for large datasets.
+// Batch sizes adapt to the measured throughput and checkpoint cost.
+func (s *Service) processRowsInBatches(rows [][]string, latLngCol, addressCol, districtCol, provinceCol int) int {
 	totalRows := len(rows) - 1
-	totalBatches := (totalRows + batchSize - 1) / batchSize
+	sizer := newBatchSizer(s.cfg)
 	processed := 0
 
-	for batch := 0; batch < totalBatches; batch++ {
-		start := batch*batchSize + 1 // +1 to skip header
-		end := start + batchSize
+	batch := 0
+	for start := 1; start < len(rows); { // start at 1 to skip header
+		batch++
+		end := start + sizer.next()
 		if end > len(rows) {
 			end = len(rows)
 		}
 
-		fmt.Printf("\n--- Processing batch %d/%d (rows %d-%d) ---\n", batch+1, totalBatches, start, end-1)
+		fmt.Printf("\n--- Processing batch %d (rows %d-%d of %d) ---\n", batch, start, end-1, totalRows)
 
 		// Process this batch
+		batchStart, pausedBefore := time.Now(), s.cfg.pause.pausedFor()
 		batchRows := rows[start:end]
-		// Adjust row indices for batch processing
-		batchProcessed := s.processBatch(batchRows, start-1, latLngCol, addressCol, districtCol, provinceCol)
+		batchProcessed := s.processBatch(batchRows, start, latLngCol, addressCol, districtCol, provinceCol)
 		processed += batchProcessed
+		// Time spent paused says nothing about the throughput
+		sizer.observeBatch(len(batchRows), time.Since(batchStart)-(s.cfg.pause.pausedFor()-pausedBefore))
+		start = end
+
+		// Save progress unless the rest of the run finishes faster than a
+		// save, or the batch only held rows restored from the checkpoint
+		if batchProcessed > 0 && sizer.shouldCheckpoint(len(rows)-start) {
+			saveStart := time.Now()
+			if err := s.saveCheckpoint(); err != nil {
+				fmt.Printf("Warning: Could not save progress: %v\n", err)
+			} else {
+				sizer.observeSave(time.Since(saveStart))
+				// Rows restored from the checkpoint being resumed are done too
+				done := processed + len(s.resumed)
+				fmt.Printf("Progress saved: %d/%d rows processed (%.1f%%)", done, totalRows, float64(done)/float64(totalRows)*100)
+				if len(s.resumed) > 0 {
+					fmt.Printf(", %d of them restored", len(s.resumed))
+				}
+				fmt.Println()
+			}
+		}
 
-		// Save progress after each batch
-		dataDir := "data"
-		fileName := filepath.Base(excelFile)
-		tempFile := filepath.Join(dataDir, strings.TrimSuffix(fileName, ".xlsx")+"_temp.xlsx")
-		if err := s.repo.SaveAs(tempFile); err != nil {
-			fmt.Printf("Warning: Could not save progress: %v\n", err)
-		} else {
-			fmt.Printf("Progress saved: %d/%d rows processed (%.1f%%)\n", processed, totalRows, float64(processed)/float64(totalRows)*100)
+		if s.failures.isAborted() {
+			break
 		}
 
 		// Small delay between batches to be respectful
@@ -207,123 +608,70 @@ func (s *Service) processRowsInBatches(rows [][]string, latLngCol, addressCol, d
 	return processed
 }
 
-// processBatch processes a batch of rows
-func (s *Service) processBatch(batchRows [][]string, startIndex, latLngCol, addressCol, districtCol, provinceCol int) int {
-	numWorkers := 10
-	requestDelay := 1500 * time.Millisecond
-
-	jobs := make(chan int, len(batchRows))
-	results := make(chan rowResult, len(batchRows))
-	var wg sync.WaitGroup
-
-	// Start workers
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			for batchIdx := range jobs {
-				rowIndex := startIndex + batchIdx
-				row := batchRows[batchIdx]
-
-				// Ensure row has enough columns
-				maxCol := latLngCol
-				if addressCol > maxCol {
-					maxCol = addressCol
-				}
-				if districtCol > maxCol {
-					maxCol = districtCol
-				}
-				if provinceCol > maxCol {
-					maxCol = provinceCol
-				}
-				for len(row) <= maxCol {
-					row = append(row, "")
-				}
-
-				coordStr := strings.TrimSpace(row[latLngCol])
-				if coordStr == "" {
-					results <- rowResult{rowIndex: rowIndex, skipped: true, message: "empty coordinates"}
-					continue
-				}
-
-				coords, err := s.parseCoordinates(coordStr)
-				if err != nil {
-					results <- rowResult{rowIndex: rowIndex, skipped: true, message: err.Error()}
-					continue
-				}
-
-				// Check cache first (for duplicate coordinates)
-				address, district, province, cached := s.cache.get(coords.Lat, coords.Lng)
-				if !cached {
-					// Rate limiting per worker
-					time.Sleep(requestDelay)
-
-					address, district, province, err = s.reverseGeocode(coords.Lat, coords.Lng)
-					if err != nil {
-						results <- rowResult{
-							rowIndex: rowIndex,
-							skipped:  true,
-							message:  fmt.Sprintf("geocode error: %v", err),
-						}
-						continue
-					}
-
-					// Cache the result
-					s.cache.set(coords.Lat, coords.Lng, address, district, province)
-				}
+// writeResult records the result of a row at its sheet row: the address
+// cells, the Status column and the exports. Both the single pass and the
+// batched pass write through it. It reports whether the address was written;
+// skipped rows and rows whose write failed are recorded as such.
+func (s *Service) writeResult(result rowResult, addressCol, districtCol, provinceCol int) bool {
+	rowNum := result.sheetRow()
+	s.cfg.progress.row(result.skipped)
+
+	if result.skipped {
+		s.recordFailure(rowNum, result)
+		s.htmlMap.add(rowNum, result)
+		if !result.budgetSpent {
+			s.resultsDB.add(rowNum, result)
+		}
+		s.failures.observe(result)
+		s.writeSkippedStatus(rowNum, result)
+		return false
+	}
 
-				results <- rowResult{
-					rowIndex: rowIndex,
-					address:  address,
-					district: district,
-					province: province,
-					coords:   coords,
-				}
-			}
-		}(w)
+	if err := s.writeAddressCells(rowNum, addressCol, districtCol, provinceCol, result); err != nil {
+		s.recordWriteError(rowNum, err)
+		return false
 	}
+	s.geoJSON.add(rowNum, result, s.extraCols)
+	s.htmlMap.add(rowNum, result)
+	s.resultsDB.add(rowNum, result)
+	s.checkpoint.add(rowNum)
+	return true
+}
 
-	// Send jobs
-	go func() {
-		for i := 0; i < len(batchRows); i++ {
-			jobs <- i
-		}
-		close(jobs)
+// processBatch processes a batch of rows, the first of which is rows[first]
+// of the sheet
+func (s *Service) processBatch(batchRows [][]string, first, latLngCol, addressCol, districtCol, provinceCol int) int {
+	numWorkers := s.cfg.Workers
+
+	run := s.span
+	s.span = startSpan(run.context(), "batch", spanKindInternal, spanAttr{"row.first", first + 1}, spanAttr{"rows", len(batchRows)})
+	defer func() {
+		s.span.finish(nil)
+		s.span = run
 	}()
 
-	// Close results channel when all workers are done
+	// Each unique coordinate is looked up once, for all its rows
+	groups, invalid := s.groupRows(batchRows, first, latLngCol)
+	results := make(chan rowResult, numWorkers)
 	go func() {
-		wg.Wait()
+		s.dispatchGroups(groups, invalid, numWorkers, results)
 		close(results)
 	}()
 
 	// Process results
 	batchProcessed := 0
-	for result := range results {
-		rowNum := result.rowIndex + 1
-
-		if result.skipped {
-			if rowNum%100 == 0 || strings.Contains(result.message, "rate limit") {
+	for {
+		result, ok := s.nextResult(results)
+		if !ok {
+			break
+		}
+		if !s.writeResult(result, addressCol, districtCol, provinceCol) {
+			if rowNum := result.sheetRow(); result.skipped && (rowNum%100 == 0 || strings.Contains(result.message, "rate limit")) {
 				fmt.Printf("Row %d: %s\n", rowNum, result.message)
 			}
 			continue
 		}
 
-		// Write full address
-		colName, _ := excelize.ColumnNumberToName(addressCol + 1)
-		cell := fmt.Sprintf("%s%d", colName, rowNum)
-		s.repo.SetCellValue(cell, result.address)
-
-		// Write district
-		colName, _ = excelize.ColumnNumberToName(districtCol + 1)
-		cell = fmt.Sprintf("%s%d", colName, rowNum)
-		s.repo.SetCellValue(cell, result.district)
-
-		// Write province
-		colName, _ = excelize.ColumnNumberToName(provinceCol + 1)
-		cell = fmt.Sprintf("%s%d", colName, rowNum)
-		s.repo.SetCellValue(cell, result.province)
-
 		batchProcessed++
 		if batchProcessed%100 == 0 {
 			fmt.Printf("  Processed %d rows in this batch...\n", batchProcessed)
@@ -336,20 +684,78 @@ func (s *Service) processBatch(batchRows [][]string, startIndex, latLngCol, addr
 // findColumns finds the latitude/longitude, address, district, and province columns
 func (s *Service) findColumns(rows [][]string) (latLngCol, addressCol, districtCol, provinceCol int, err error) {
 	headerRow := rows[0]
-	latLngCol = -1
-	addressCol = -1
-	districtCol = -1
-	provinceCol = -1
+	latLngCol, err = s.coordinateColumn(rows)
+	if err != nil {
+		return -1, -1, -1, -1, err
+	}
+	addressCol, districtCol, provinceCol = findResultColumns(headerRow)
+	if addressCol != -1 && districtCol != -1 && provinceCol != -1 {
+		addressCol = s.chooseAddressColumn(rows, addressCol, latLngCol)
+	}
 
-	// Check header row
+	fmt.Printf("Found coordinates column: %s (column %d)\n", headerRow[latLngCol], latLngCol+1)
+	return latLngCol, addressCol, districtCol, provinceCol, nil
+}
+
+// coordinateColumn returns the column named by --coordinate-column, or else
+// the likeliest coordinate column: one whose first values parse as
+// coordinates, better yet with a coordinate header. When several are as
+// likely, the user picks one on a terminal; otherwise the first is used.
+func (s *Service) coordinateColumn(rows [][]string) (int, error) {
+	headerRow := rows[0]
+	if s.cfg.CoordinateColumn != "" {
+		for i, cell := range headerRow {
+			if strings.EqualFold(strings.TrimSpace(cell), strings.TrimSpace(s.cfg.CoordinateColumn)) {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("--coordinate-column: no column named %q", s.cfg.CoordinateColumn)
+	}
+
+	candidates := s.coordinateCandidates(rows)
+	if len(candidates) == 0 {
+		return -1, fmt.Errorf("could not find latitude/longitude column. Please ensure your Excel file has a column with coordinates in format 'lat,lng' (e.g., '13.536964,105.927722') or a header containing 'latlg', 'lat', or 'coordinate'")
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.better(best) {
+			best = c
+		}
+	}
+	var tied []int
+	for _, c := range candidates {
+		if !c.better(best) && !best.better(c) {
+			tied = append(tied, c.col)
+		}
+	}
+	if len(tied) == 1 {
+		return best.col, nil
+	}
+
+	if s.cfg.canPrompt() {
+		fmt.Println("\nSeveral columns could hold the coordinates (marked *):")
+		return pickColumn(rows, tied, best.col, "Which column holds the coordinates?"), nil
+	}
+	names := make([]string, len(tied))
+	for i, col := range tied {
+		letter, _ := excelize.ColumnNumberToName(col + 1)
+		header := ""
+		if col < len(headerRow) {
+			header = headerRow[col]
+		}
+		names[i] = fmt.Sprintf("%s %q", letter, header)
+	}
+	fmt.Printf("Warning: Several columns could hold the coordinates (%s); using the first. Choose another with --coordinate-column\n",
+		strings.Join(names, ", "))
+	return best.col, nil
+}
+
+// findResultColumns returns the Address, District and Province columns of a
+// header row, or -1 for the ones that are missing
+func findResultColumns(headerRow []string) (addressCol, districtCol, provinceCol int) {
+	addressCol, districtCol, provinceCol = -1, -1, -1
 	for i, cell := range headerRow {
 		cellLower := strings.ToLower(strings.TrimSpace(cell))
-		if latLngCol == -1 && (strings.Contains(cellLower, "latlg") ||
-			strings.Contains(cellLower, "lat") ||
-			strings.Contains(cellLower, "coordinate") ||
-			strings.Contains(cellLower, "coord")) {
-			latLngCol = i
-		}
 		if strings.Contains(cellLower, "address") {
 			addressCol = i
 		}
@@ -360,35 +766,18 @@ func (s *Service) findColumns(rows [][]string) (latLngCol, addressCol, districtC
 			provinceCol = i
 		}
 	}
-
-	// If not found in header, check first data row for comma-separated format
-	if latLngCol == -1 && len(rows) > 1 {
-		latLngCol = s.detectCoordinateColumn(rows[1])
-	}
-
-	if latLngCol == -1 {
-		return -1, -1, -1, -1, fmt.Errorf("could not find latitude/longitude column. Please ensure your Excel file has a column with coordinates in format 'lat,lng' (e.g., '13.536964,105.927722') or a header containing 'latlg', 'lat', or 'coordinate'")
-	}
-
-	fmt.Printf("Found coordinates column: %s (column %d)\n", headerRow[latLngCol], latLngCol+1)
-	return latLngCol, addressCol, districtCol, provinceCol, nil
+	return addressCol, districtCol, provinceCol
 }
 
-// detectCoordinateColumn detects coordinate column by checking for comma-separated numbers
-func (s *Service) detectCoordinateColumn(row []string) int {
-	for i, cell := range row {
-		if strings.Contains(cell, ",") {
-			parts := strings.Split(cell, ",")
-			if len(parts) == 2 {
-				if _, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err1 == nil {
-					if _, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err2 == nil {
-						return i
-					}
-				}
-			}
-		}
-	}
-	return -1
+// isCoordinateHeader reports whether a header cell names a coordinate column
+func isCoordinateHeader(cell string) bool {
+	cellLower := strings.ToLower(strings.TrimSpace(cell))
+	return strings.Contains(cellLower, "latlg") ||
+		strings.Contains(cellLower, "lat") ||
+		strings.Contains(cellLower, "coordinate") ||
+		strings.Contains(cellLower, "coord") ||
+		strings.Contains(cellLower, "utm") ||
+		strings.Contains(cellLower, "mgrs")
 }
 
 // addAddressColumns adds Address, District, and Province columns to the Excel file
@@ -413,7 +802,16 @@ func (s *Service) addAddressColumns(currentColCount int) (addressCol, districtCo
 
 // parseCoordinates parses comma-separated coordinates string
 func (s *Service) parseCoordinates(coordStr string) (Coordinates, error) {
+	// UTM and MGRS references name their zone, so they need no --input-crs
+	if !strings.Contains(coordStr, ",") {
+		if coords, ok, err := parseGridReference(coordStr); ok {
+			return coords, err
+		}
+	}
 	parts := strings.Split(coordStr, ",")
+	if s.cfg != nil && s.cfg.projection != nil {
+		return s.parseProjected(parts)
+	}
 	if len(parts) != 2 {
 		return Coordinates{}, fmt.Errorf("invalid format, expected 'lat,lng'")
 	}
@@ -431,146 +829,338 @@ func (s *Service) parseCoordinates(coordStr string) (Coordinates, error) {
 	return Coordinates{Lat: lat, Lng: lng}, nil
 }
 
+// parseProjected parses an "x,y" pair in the --input-crs and converts it to WGS84
+func (s *Service) parseProjected(parts []string) (Coordinates, error) {
+	if len(parts) != 2 {
+		return Coordinates{}, fmt.Errorf("invalid format, expected 'x,y' in %s", s.cfg.InputCRS)
+	}
+
+	x, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return Coordinates{}, fmt.Errorf("invalid x (easting): %w", err)
+	}
+
+	y, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return Coordinates{}, fmt.Errorf("invalid y (northing): %w", err)
+	}
+
+	return reproject(s.cfg.projection, x, y)
+}
+
+// geocodeResult is what a coordinate resolves to
+type geocodeResult struct {
+	address  string
+	district string
+	province string
+	country  string // ISO 3166-1 alpha-2, lowercase
+	postcode string // as the provider returned it, empty when it gave none
+	place    placeInfo
+	quality  *int // confidence score, nil for results cached before scores existed
+	// elevation in metres, nil unless --elevation found one
+	elevation *float64
+	// provider and geocodedAt tell where and when the result was derived;
+	// both are kept in the cache file
+	provider   string
+	geocodedAt time.Time
+	// cached and attempts describe how this lookup got the result
+	cached   bool
+	attempts int
+}
+
+// placeInfo describes the OSM object a result resolved to, e.g. a building,
+// a village or a whole province
+type placeInfo struct {
+	Class     string `json:"class,omitempty"`
+	Type      string `json:"type,omitempty"`
+	PlaceRank int    `json:"place_rank,omitempty"`
+	OSMType   string `json:"osm_type,omitempty"`
+	OSMID     int64  `json:"osm_id,omitempty"`
+}
+
 // rowResult holds the result of processing a row
 type rowResult struct {
-	rowIndex int
+	rowIndex int // in a workbook run, the index in the sheet's rows, the header being 0
 	skipped  bool
 	message  string
-	address  string
-	district string
-	province string
-	coords   Coordinates
+	geocodeResult
+	coords     Coordinates
+	input      string
+	geocodeErr error
+	// countryMismatch marks a result outside --expect-country that was not written
+	countryMismatch bool
+	// budgetSpent marks a row left for a later run because the request budget ran out
+	budgetSpent bool
+}
+
+// sheetRow returns the 1-based row of the sheet a workbook run's result
+// belongs to
+func (r rowResult) sheetRow() int {
+	return r.rowIndex + 1
+}
+
+// writeAddressCells writes a row's address, district and province to the given sheet row
+func (s *Service) writeAddressCells(rowNum, addressCol, districtCol, provinceCol int, result rowResult) error {
+	// Write full address
+	if err := s.writeCell(rowNum, addressCol, result.address); err != nil {
+		return err
+	}
+
+	// Write district
+	if err := s.writeCell(rowNum, districtCol, result.district); err != nil {
+		return err
+	}
+
+	// Write province
+	if err := s.writeCell(rowNum, provinceCol, result.province); err != nil {
+		return err
+	}
+
+	if err := s.writeExtraCells(rowNum, result); err != nil {
+		return err
+	}
+
+	s.writeStatus(rowNum, statusOK)
+	return nil
+}
+
+// resolveRow parses a coordinate cell and looks up its address
+func (s *Service) resolveRow(rowIndex int, coordStr string) rowResult {
+	coordStr = strings.TrimSpace(coordStr)
+	coords, skipped, ok := s.parseRow(rowIndex, coordStr)
+	if !ok {
+		return skipped
+	}
+	return s.resolveCoordinates(rowIndex, coordStr, coords)
+}
+
+// parseRow parses the trimmed coordinate text of a row, or returns the
+// skipped result of a row without valid coordinates
+func (s *Service) parseRow(rowIndex int, coordStr string) (Coordinates, rowResult, bool) {
+	if coordStr == "" {
+		return Coordinates{}, rowResult{rowIndex: rowIndex, skipped: true, message: "empty coordinates"}, false
+	}
+	coords, err := s.parseCoordinates(coordStr)
+	if err != nil {
+		return Coordinates{}, rowResult{rowIndex: rowIndex, skipped: true, message: err.Error(), input: coordStr}, false
+	}
+	return coords, rowResult{}, true
 }
 
+// resolveCoordinates geocodes coordinates that are already parsed; coordStr
+// is the text they were read from
+func (s *Service) resolveCoordinates(rowIndex int, coordStr string, coords Coordinates) rowResult {
+	result, err := s.lookup(coords)
+	if errors.Is(err, errBudgetSpent) {
+		return rowResult{rowIndex: rowIndex, skipped: true, message: err.Error(), coords: coords, input: coordStr, budgetSpent: true}
+	}
+	if err != nil {
+		return rowResult{
+			rowIndex:   rowIndex,
+			skipped:    true,
+			message:    fmt.Sprintf("geocode error: %v", err),
+			coords:     coords,
+			input:      coordStr,
+			geocodeErr: err,
+		}
+	}
+
+	if msg := s.countryMismatch(coords, result); msg != "" {
+		return rowResult{
+			rowIndex:        rowIndex,
+			skipped:         true,
+			message:         msg,
+			coords:          coords,
+			input:           coordStr,
+			countryMismatch: true,
+		}
+	}
+
+	if err := applyTransforms(s.cfg.transforms, &result, coords); err != nil {
+		return rowResult{
+			rowIndex: rowIndex,
+			skipped:  true,
+			message:  err.Error(),
+			coords:   coords,
+			input:    coordStr,
+		}
+	}
+
+	return rowResult{
+		rowIndex:      rowIndex,
+		geocodeResult: result,
+		coords:        coords,
+		input:         coordStr,
+	}
+}
+
+// lookup returns the address of a coordinate, reusing cached results for
+// coordinates that were already geocoded
+func (s *Service) lookup(coords Coordinates) (result geocodeResult, err error) {
+	span := startSpan(s.span.context(), "lookup", spanKindInternal, spanAttr{"lat", coords.Lat}, spanAttr{"lng", coords.Lng})
+	defer func() { span.finish(err) }()
+
+	// Check cache first (for duplicate coordinates)
+	cacheSpan := startSpan(span.context(), "cache get", spanKindInternal)
+	result, cached := s.cache.get(coords.Lat, coords.Lng)
+	cacheSpan.set("cache.hit", cached)
+	cacheSpan.finish(nil)
+	if cached && !s.stale(result) {
+		s.cache.hit(coords.Lat, coords.Lng)
+		result.cached = true
+		result.attempts = 0
+		span.set("cached", true)
+		return s.withElevation(coords, result), nil
+	}
+
+	provider := s.route(coords)
+
+	request := startSpan(span.context(), "reverseGeocode", spanKindClient, spanAttr{"provider", provider.cfg.providerName()})
+	if provider.batcher != nil {
+		// Batches keep their own pace
+		request.set("batched", true)
+		result, err = provider.batcher.geocode(coords)
+	} else {
+		// Rate limiting per worker
+		time.Sleep(provider.requestDelay(s.cfg.Workers))
+		result, err = provider.reverseGeocode(coords.Lat, coords.Lng)
+	}
+	request.set("attempts", result.attempts)
+	request.finish(err)
+	if err != nil {
+		return geocodeResult{}, err
+	}
+	if s.cfg.Coarse > 0 {
+		result = coarseResult(result)
+	}
+	result = s.withElevation(coords, result)
+
+	// Cache the result
+	cacheSpan = startSpan(span.context(), "cache set", spanKindInternal)
+	s.cache.set(coords.Lat, coords.Lng, result)
+	cacheSpan.finish(nil)
+	return result, nil
+}
+
+// Enrich implements latlg.Enricher, so the struct mapper can run on the
+// same cached lookup as the spreadsheet pipeline
+func (s *Service) Enrich(lat, lng float64) (latlg.Result, error) {
+	result, err := s.lookup(Coordinates{Lat: lat, Lng: lng})
+	if err != nil {
+		return latlg.Result{}, err
+	}
+	return latlg.Result{Address: result.address, District: result.district, Province: result.province}, nil
+}
+
+var _ latlg.Enricher = (*Service)(nil)
+
 // coordinateCache caches geocoding results to avoid duplicate API calls
 type coordinateCache struct {
 	mu    sync.RWMutex
-	cache map[string]cacheEntry
+	cache map[string]geocodeResult
+	// scope is appended to keys for options that change the result, so a
+	// shared cache file never mixes them
+	scope string
+	// coarse keys results by their --coarse geohash cell instead of their
+	// coordinates; 0 when off
+	coarse int
+	// shared is the cache other instances use too, such as --redis-url, or
+	// nil. Results missing from cache are looked for in it.
+	shared sharedCache
+	// ttl expires results geocoded longer ago than this, for --cache-ttl;
+	// 0 keeps them
+	ttl time.Duration
+	// hits counts how often each result was reused, across the runs of a
+	// cache file
+	hits map[string]int
 }
 
-type cacheEntry struct {
-	address  string
-	district string
-	province string
+// sharedCache is a cache that several instances of the tool read and write,
+// so a coordinate geocoded by one is reused by all. It reports its own
+// errors; a lookup then goes on as if the result was not cached.
+type sharedCache interface {
+	get(key string) (geocodeResult, bool)
+	set(key string, result geocodeResult)
 }
 
 func newCoordinateCache() *coordinateCache {
 	return &coordinateCache{
-		cache: make(map[string]cacheEntry),
+		cache: make(map[string]geocodeResult),
+		hits:  make(map[string]int),
 	}
 }
 
-func (c *coordinateCache) get(lat, lng float64) (address, district, province string, found bool) {
-	key := fmt.Sprintf("%.6f,%.6f", lat, lng)
+func (c *coordinateCache) key(lat, lng float64) string {
+	if c.coarse > 0 {
+		return "cell:" + geohash(lat, lng, c.coarse) + c.scope
+	}
+	return fmt.Sprintf("%.6f,%.6f", lat, lng) + c.scope
+}
+
+func (c *coordinateCache) get(lat, lng float64) (geocodeResult, bool) {
+	key := c.key(lat, lng)
 	c.mu.RLock()
-	defer c.mu.RUnlock()
-	entry, exists := c.cache[key]
-	if exists {
-		return entry.address, entry.district, entry.province, true
+	result, exists := c.cache[key]
+	c.mu.RUnlock()
+	if exists && c.expired(result, time.Now()) {
+		exists = false
+	}
+	if exists || c.shared == nil {
+		return result, exists
+	}
+	if result, exists = c.shared.get(key); exists && !c.expired(result, time.Now()) {
+		c.mu.Lock()
+		c.cache[key] = result
+		c.mu.Unlock()
+		return result, true
 	}
-	return "", "", "", false
+	return geocodeResult{}, false
+}
+
+// hit counts a reuse of the cached result of a coordinate
+func (c *coordinateCache) hit(lat, lng float64) {
+	key := c.key(lat, lng)
+	c.mu.Lock()
+	c.hits[key]++
+	c.mu.Unlock()
 }
 
-func (c *coordinateCache) set(lat, lng float64, address, district, province string) {
-	key := fmt.Sprintf("%.6f,%.6f", lat, lng)
+// expired reports whether a result is older than the cache's --cache-ttl.
+// Results of unknown age count as expired.
+func (c *coordinateCache) expired(result geocodeResult, now time.Time) bool {
+	return c.ttl > 0 && result.geocodedAt.Before(now.Add(-c.ttl))
+}
+
+func (c *coordinateCache) set(lat, lng float64, result geocodeResult) {
+	key := c.key(lat, lng)
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.cache[key] = cacheEntry{
-		address:  address,
-		district: district,
-		province: province,
+	c.cache[key] = result
+	c.mu.Unlock()
+	if c.shared != nil {
+		c.shared.set(key, result)
 	}
 }
 
 // processRows processes all data rows and converts coordinates to addresses concurrently
 func (s *Service) processRows(rows [][]string, latLngCol, addressCol, districtCol, provinceCol int) int {
 	// Number of concurrent workers (10 workers for faster processing)
-	numWorkers := 10
-	// Rate limiting: delay between requests per worker (1.5 seconds per worker)
-	requestDelay := 1500 * time.Millisecond
-
-	// Channel for jobs
-	jobs := make(chan int, len(rows))
-	results := make(chan rowResult, len(rows))
-	var wg sync.WaitGroup
-
-	// Start workers
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			for rowIndex := range jobs {
-				row := rows[rowIndex]
-
-				// Ensure row has enough columns
-				maxCol := latLngCol
-				if addressCol > maxCol {
-					maxCol = addressCol
-				}
-				if districtCol > maxCol {
-					maxCol = districtCol
-				}
-				if provinceCol > maxCol {
-					maxCol = provinceCol
-				}
-				for len(row) <= maxCol {
-					row = append(row, "")
-				}
-
-				coordStr := strings.TrimSpace(row[latLngCol])
-				if coordStr == "" {
-					results <- rowResult{rowIndex: rowIndex, skipped: true, message: "empty coordinates"}
-					continue
-				}
-
-				coords, err := s.parseCoordinates(coordStr)
-				if err != nil {
-					results <- rowResult{rowIndex: rowIndex, skipped: true, message: err.Error()}
-					continue
-				}
-
-				// Check cache first (for duplicate coordinates)
-				address, district, province, cached := s.cache.get(coords.Lat, coords.Lng)
-				if !cached {
-					// Rate limiting per worker
-					time.Sleep(requestDelay)
-
-					address, district, province, err = s.reverseGeocode(coords.Lat, coords.Lng)
-					if err != nil {
-						results <- rowResult{
-							rowIndex: rowIndex,
-							skipped:  true,
-							message:  fmt.Sprintf("geocode error: %v", err),
-						}
-						continue
-					}
-
-					// Cache the result
-					s.cache.set(coords.Lat, coords.Lng, address, district, province)
-				}
-
-				results <- rowResult{
-					rowIndex: rowIndex,
-					address:  address,
-					district: district,
-					province: province,
-					coords:   coords,
-				}
-			}
-		}(w)
+	numWorkers := s.cfg.Workers
+
+	// Group duplicate coordinates up front, so each is looked up once and
+	// the queue holds unique points rather than rows
+	groups, invalid := s.groupRows(rows[1:], 1, latLngCol)
+	duplicates := 0
+	for _, g := range groups {
+		duplicates += len(g.rows) - 1
 	}
-
-	// Send jobs
-	go func() {
-		for i := 1; i < len(rows); i++ {
-			jobs <- i
-		}
-		close(jobs)
-	}()
-
-	// Close results channel when all workers are done
+	if s.cfg.Coarse > 0 {
+		fmt.Printf("%d geohash cells of %d characters to look up for %d rows\n", len(groups), s.cfg.Coarse, len(groups)+duplicates)
+	} else if duplicates > 0 {
+		fmt.Printf("%d unique coordinates (%d rows repeat one)\n", len(groups), duplicates)
+	}
+	results := make(chan rowResult, numWorkers)
 	go func() {
-		wg.Wait()
+		s.dispatchGroups(groups, invalid, numWorkers, results)
 		close(results)
 	}()
 
@@ -579,221 +1169,227 @@ func (s *Service) processRows(rows [][]string, latLngCol, addressCol, districtCo
 	completed := 0
 	total := len(rows) - 1
 
-	for result := range results {
+	for {
+		result, ok := s.nextResult(results)
+		if !ok {
+			break
+		}
 		completed++
-		rowNum := result.rowIndex + 1
-
-		if result.skipped {
-			fmt.Printf("Row %d: %s\n", rowNum, result.message)
+		if !s.writeResult(result, addressCol, districtCol, provinceCol) {
+			if result.skipped {
+				fmt.Printf("Row %d: %s\n", result.sheetRow(), result.message)
+			}
 			continue
 		}
 
-		// Write full address
-		colName, _ := excelize.ColumnNumberToName(addressCol + 1)
-		cell := fmt.Sprintf("%s%d", colName, rowNum)
-		s.repo.SetCellValue(cell, result.address)
-
-		// Write district
-		colName, _ = excelize.ColumnNumberToName(districtCol + 1)
-		cell = fmt.Sprintf("%s%d", colName, rowNum)
-		s.repo.SetCellValue(cell, result.district)
-
-		// Write province
-		colName, _ = excelize.ColumnNumberToName(provinceCol + 1)
-		cell = fmt.Sprintf("%s%d", colName, rowNum)
-		s.repo.SetCellValue(cell, result.province)
-
-		fmt.Printf("Row %d: ✓ [%d/%d] (%.6f, %.6f) -> %s\n", rowNum, completed, total, result.coords.Lat, result.coords.Lng, result.address)
+		fmt.Printf("Row %d: ✓ [%d/%d] (%.6f, %.6f) -> %s\n", result.sheetRow(), completed, total, result.coords.Lat, result.coords.Lng, result.address)
 		processed++
 	}
 
 	return processed
 }
 
-// reverseGeocode converts latitude and longitude to full address, district, and province using Nominatim API
-func (s *Service) reverseGeocode(lat, lng float64) (address, district, province string, err error) {
-	maxRetries := 3
-	baseDelay := 2 * time.Second
+// reverseGeocode converts latitude and longitude to full address, district, and province using the --provider API
+func (s *Service) reverseGeocode(lat, lng float64) (geocodeResult, error) {
+	maxRetries := s.cfg.Retries
+	baseDelay := s.cfg.RetryDelay
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			// Exponential backoff: 2s, 4s, 8s
+			// Exponential backoff: 2s, 4s, 8s with the default settings
 			delay := baseDelay * time.Duration(1<<uint(attempt-1))
 			time.Sleep(delay)
 		}
 
-		// Using OpenStreetMap Nominatim API (free, no API key required)
-		baseURL := "https://nominatim.openstreetmap.org/reverse"
-
-		params := url.Values{}
-		params.Set("lat", fmt.Sprintf("%.6f", lat))
-		params.Set("lon", fmt.Sprintf("%.6f", lng))
-		params.Set("format", "json")
-		params.Set("addressdetails", "1")
-		params.Set("accept-language", "en") // Request English language
-
-		reqURL := fmt.Sprintf("%s?%s", baseURL, params.Encode())
-
-		// Create HTTP request with proper headers (required by Nominatim)
-		req, err := http.NewRequest("GET", reqURL, nil)
+		// OpenStreetMap Nominatim by default; --provider, --endpoint or --preset
+		// select another API
+		baseURL := s.cfg.Endpoint
+		req, err := s.cfg.geocoder.request(lat, lng)
 		if err != nil {
-			return "", "", "", err
+			return geocodeResult{}, err
 		}
 
 		// Better User-Agent identification (required by Nominatim policy)
-		req.Header.Set("User-Agent", "latlg-address-converter/1.0")
-		req.Header.Set("Accept-Language", "en")
-		req.Header.Set("Referer", "https://github.com")
-
-		client := &http.Client{
-			Timeout: 15 * time.Second,
+		req.Header.Set("User-Agent", s.cfg.UserAgent)
+		for name, value := range s.cfg.Headers {
+			req.Header.Set(name, value)
 		}
 
-		resp, err := client.Do(req)
+		if !s.spendRequest() {
+			return geocodeResult{}, errBudgetSpent
+		}
+		var key *poolKey
+		if s.cfg.keys != nil {
+			key = s.cfg.keys.pick()
+			key.apply(req, s.cfg.APIKey)
+		}
+		finish := s.limiter.acquire()
+		resp, err := s.client.Do(req)
 		if err != nil {
+			finish(isTimeout(err))
 			if attempt < maxRetries-1 {
 				continue // Retry on network errors
 			}
-			return "", "", "", err
+			return geocodeResult{}, s.redactKey(err)
 		}
 
 		// Handle rate limiting (429) with retry
 		if resp.StatusCode == 429 {
-			resp.Body.Close()
+			drainAndClose(resp.Body)
+			finish(true)
+			if key != nil && s.cfg.keys.rateLimited(key) {
+				attempt-- // another key takes the request now
+				continue
+			}
 			if attempt < maxRetries-1 {
 				// Wait longer for rate limit
-				waitTime := time.Duration(attempt+1) * 10 * time.Second
+				waitTime := time.Duration(attempt+1) * s.cfg.RateLimitWait
 				time.Sleep(waitTime)
 				continue
 			}
-			return "", "", "", fmt.Errorf("API rate limit exceeded after %d retries", maxRetries)
+			return geocodeResult{}, fmt.Errorf("API rate limit exceeded after %d retries", maxRetries)
 		}
 
 		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
 			resp.Body.Close()
+			finish(resp.StatusCode >= 500)
+			s.rawResponses.add(lat, lng, baseURL, resp.StatusCode, body)
 			if attempt < maxRetries-1 && resp.StatusCode >= 500 {
 				continue // Retry on server errors
 			}
-			return "", "", "", fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+			return geocodeResult{}, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
 		}
 
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			s.rawResponses.add(lat, lng, baseURL, resp.StatusCode, body)
+		}
 		var geocodeResp GeocodeResponse
-		if err := json.NewDecoder(resp.Body).Decode(&geocodeResp); err != nil {
-			resp.Body.Close()
+		if err == nil {
+			geocodeResp, err = s.cfg.geocoder.parse(body)
+		}
+		finish(errors.Is(err, errRateLimited))
+		if errors.Is(err, errRateLimited) {
+			// Some APIs refuse requests over their quota with a 200, like a 429
+			if key != nil && s.cfg.keys.rateLimited(key) {
+				attempt--
+				continue
+			}
 			if attempt < maxRetries-1 {
-				continue // Retry on decode errors
+				time.Sleep(time.Duration(attempt+1) * s.cfg.RateLimitWait)
+				continue
 			}
-			return "", "", "", err
+			return geocodeResult{}, fmt.Errorf("API rate limit exceeded after %d retries", maxRetries)
 		}
-		resp.Body.Close()
-
-		if geocodeResp.DisplayName == "" {
-			return "", "", "", fmt.Errorf("no address found for coordinates")
+		if err != nil {
+			var permanent permanentError
+			if attempt < maxRetries-1 && !errors.As(err, &permanent) {
+				continue // Retry on read and decode errors
+			}
+			return geocodeResult{}, err
 		}
 
-		// Format full address and extract district and province
-		address = s.formatFullAddress(geocodeResp)
-		district, province = s.extractDistrictAndProvince(geocodeResp)
-		return address, district, province, nil
+		return s.geocodeResultFrom(lat, lng, geocodeResp, attempt+1)
 	}
 
-	return "", "", "", fmt.Errorf("failed after %d retries", maxRetries)
+	return geocodeResult{}, fmt.Errorf("failed after %d retries", maxRetries)
 }
 
-// formatFullAddress formats the complete address in English
-func (s *Service) formatFullAddress(resp GeocodeResponse) string {
-	addr := resp.Address
-	var parts []string
-
-	// Add road/house number if available
-	if addr.HouseNumber != "" && addr.Road != "" {
-		parts = append(parts, fmt.Sprintf("%s %s", addr.HouseNumber, addr.Road))
-	} else if addr.Road != "" {
-		parts = append(parts, addr.Road)
-	} else if addr.HouseNumber != "" {
-		parts = append(parts, addr.HouseNumber)
+// geocodeResultFrom formats the provider's answer for a coordinate into a
+// result, taking attempts requests
+func (s *Service) geocodeResultFrom(lat, lng float64, geocodeResp GeocodeResponse, attempts int) (geocodeResult, error) {
+	if geocodeResp.DisplayName == "" {
+		return geocodeResult{}, fmt.Errorf("no address found for coordinates")
 	}
 
-	// Add subdistrict/suburb if available
-	if addr.Subdistrict != "" {
-		parts = append(parts, addr.Subdistrict)
-	} else if addr.Suburb != "" {
-		parts = append(parts, addr.Suburb)
+	// Format full address and extract district and province
+	shown := geocodeResp
+	if s.cfg.redactLevel != redactNone {
+		// The display name would give the redacted components away
+		shown.Address = s.cfg.redactLevel.redact(shown.Address)
+		shown.DisplayName = ""
 	}
-
-	// Add district (in English)
-	if addr.District != "" {
-		parts = append(parts, addr.District)
-	} else if addr.County != "" {
-		parts = append(parts, addr.County)
-	} else if addr.StateDistrict != "" {
-		parts = append(parts, addr.StateDistrict)
+	result := geocodeResult{
+		address: s.formatFullAddress(shown),
+		place: placeInfo{
+			Class:     geocodeResp.Class,
+			Type:      geocodeResp.Type,
+			PlaceRank: int(geocodeResp.PlaceRank),
+			OSMType:   geocodeResp.OSMType,
+			OSMID:     int64(geocodeResp.OSMID),
+		},
 	}
-
-	// Add province/state (in English)
-	if addr.Province != "" {
-		parts = append(parts, addr.Province)
-	} else if addr.State != "" {
-		parts = append(parts, addr.State)
-	} else if addr.City != "" {
-		parts = append(parts, addr.City)
+	components := geocodeResp
+	if s.cfg.redactLevel != redactNone {
+		// The district fallback reads the display name; give it the
+		// redacted address so houses and roads can't reach the District
+		components.DisplayName = result.address
 	}
-
-	// Add postcode if available
-	if addr.Postcode != "" {
-		parts = append(parts, addr.Postcode)
+	result.district, result.province = s.extractDistrictAndProvince(components)
+	result.country = strings.ToLower(geocodeResp.Address.CountryCode)
+	result.postcode = strings.TrimSpace(geocodeResp.Address.Postcode)
+	if s.cfg.NormalizeNames {
+		result.district = s.cfg.nameRules.normalizeName(result.country, result.district, s.cfg.KeepAdminPrefixes)
+		result.province = s.cfg.nameRules.normalizeName(result.country, result.province, s.cfg.KeepAdminPrefixes)
 	}
+	quality := scoreResult(lat, lng, geocodeResp, result.district, result.province)
+	result.quality = &quality
+	result.provider = s.cfg.providerName()
+	result.geocodedAt = time.Now().UTC()
+	result.attempts = attempts
+	return result, nil
+}
 
-	// Add country if available
-	if addr.Country != "" {
-		parts = append(parts, addr.Country)
+// redactKey keeps the API key out of logs and the dead letter file
+func (s *Service) redactKey(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		for _, key := range s.cfg.apiKeys() {
+			urlErr.URL = strings.ReplaceAll(urlErr.URL, url.QueryEscape(key), "REDACTED")
+		}
 	}
+	return err
+}
 
-	// If no parts, return display name as fallback
-	if len(parts) == 0 {
-		return resp.DisplayName
+// formatFullAddress formats the complete address using the --address-template
+// for the result's country, or else the selected --address-style
+func (s *Service) formatFullAddress(resp GeocodeResponse) string {
+	if s.cfg != nil && s.cfg.addressTemplates != nil {
+		full, ok, err := formatWithTemplate(s.cfg.addressTemplates, resp.Address)
+		if err != nil {
+			fmt.Printf("Warning: address template: %v\n", err)
+		} else if ok && full != "" {
+			return full
+		}
 	}
-
-	return strings.Join(parts, ", ")
+	style := defaultAddressStyle
+	if s.cfg != nil && s.cfg.style != nil {
+		style = s.cfg.style
+	}
+	if full := style.format(resp.Address); full != "" {
+		return full
+	}
+	// If no parts, return display name as fallback
+	return resp.DisplayName
 }
 
-// extractDistrictAndProvince extracts district and province from the geocode response
+// extractDistrictAndProvince picks district and province from the geocode
+// response using the component rules for the result's country
 func (s *Service) extractDistrictAndProvince(resp GeocodeResponse) (district, province string) {
-	addr := resp.Address
-
-	// Extract district (in English) - try multiple fallbacks
-	// For Cambodia, district might be in different fields
-	if addr.District != "" {
-		district = addr.District
-	} else if addr.County != "" {
-		district = addr.County
-	} else if addr.StateDistrict != "" {
-		district = addr.StateDistrict
-	} else if addr.Subdistrict != "" {
-		district = addr.Subdistrict
-	} else if addr.Suburb != "" {
-		district = addr.Suburb
-	} else if addr.City != "" && addr.Province == "" {
-		// Use city as district if province is separate
-		district = addr.City
-	} else {
-		// Try to extract from display_name if available
-		district = s.extractDistrictFromDisplayName(resp.DisplayName, resp)
+	rules := defaultComponentRules
+	if s.cfg != nil && s.cfg.componentRules != nil {
+		rules = s.cfg.componentRules
 	}
+	rule := rules.forCountry(resp.Address.CountryCode)
 
-	// Extract province/state (in English)
-	if addr.Province != "" {
-		province = addr.Province
-	} else if addr.State != "" {
-		province = addr.State
-	} else if addr.City != "" {
-		province = addr.City
-	} else if addr.Country != "" {
-		// Fallback to country if province not found
-		province = addr.Country
+	district = pick(rule.District, resp.Address)
+	if district == "" && rule.DistrictFromDisplayName {
+		// Try to extract from display_name if available
+		district = s.extractDistrictFromDisplayName(resp.DisplayName, resp)
 	}
-
+	province = pick(rule.Province, resp.Address)
 	return district, province
 }
 
@@ -823,36 +1419,203 @@ func (s *Service) extractDistrictFromDisplayName(displayName string, addr Geocod
 	return ""
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <excel-file.xlsx>")
-		fmt.Println("Example: go run main.go coordinates.xlsx")
-		fmt.Println("Note: Input file must be in data/ directory, output will be saved to data/")
+// mustParseConfig parses command-line arguments, exiting on invalid input
+func mustParseConfig(args []string) *Config {
+	cfg, err := parseConfig(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		if !errors.Is(err, errUsage) {
+			fmt.Printf("Error: %v\n", err)
+		}
 		os.Exit(1)
 	}
+	if cfg.Pprof != "" {
+		if err := startDiagnostics(cfg.Pprof); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.OTLPEndpoint != "" {
+		if err := startTracing(cfg.OTLPEndpoint); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	return cfg
+}
 
-	fileName := os.Args[1]
+func main() {
+	// diff, merge and cache query no provider and take only their own options
+	if len(os.Args) > 1 {
+		var command func([]string) error
+		switch os.Args[1] {
+		case "diff":
+			command = runDiff
+		case "merge":
+			command = runMerge
+		case "cache":
+			command = runCache
+		}
+		if command != nil {
+			if err := command(os.Args[2:]); err != nil {
+				if !errors.Is(err, flag.ErrHelp) {
+					log.Fatalf("Error: %v", err)
+				}
+			}
+			return
+		}
+	}
+	if len(os.Args) > 1 {
+		var command func(*Config) error
+		switch os.Args[1] {
+		case "replay":
+			command = runReplay
+		case "restore":
+			command = runRestore
+		case "watch":
+			command = runWatch
+		case "run":
+			command = runPipeline
+		case "benchmark":
+			command = runBenchmark
+		case "validate":
+			command = runValidate
+		case "convert":
+			command = runConvert
+		}
+		if command != nil {
+			cfg := mustParseConfig(os.Args[2:])
+			if err := command(cfg); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			return
+		}
+	}
+
+	cfg := mustParseConfig(os.Args[1:])
+
+	if cfg.Stdin {
+		service := NewService(nil, cfg)
+		if err := service.runStream(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Ensure data/ directory exists
+	if cfg.DatabaseURL != "" {
+		if err := runDatabase(cfg); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if cfg.BigQuery != "" {
+		if err := runBigQuery(cfg); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if cfg.KafkaBrokers != "" {
+		if err := runKafka(cfg); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if cfg.Serve != "" {
+		if err := runServer(cfg); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if cfg.GRPC != "" {
+		if err := runGRPC(cfg); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	// Ensure data/ directory exists for progress files and reports
 	dataDir := "data"
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		log.Fatalf("Error creating data directory: %v", err)
 	}
 
-	// Excel file must be in data/ directory
-	excelFile := filepath.Join(dataDir, fileName)
-	if _, err := os.Stat(excelFile); os.IsNotExist(err) {
-		log.Fatalf("Error: File '%s' not found in data/ directory. Please place your Excel file in the data/ folder.", fileName)
+	cfg.pause = newPauseGate()
+	stopPausing := pauseOnSignals(cfg.pause)
+	defer stopPausing()
+
+	if cfg.Schedule != "" {
+		if err := runSchedule(cfg); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
 	}
 
+	if err := processFile(cfg, cfg.InputFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// processFile opens an input workbook, backs it up if asked and geocodes it
+func processFile(cfg *Config, inputFile string) error {
+	if cfg.notifies() {
+		return processFileNotifying(cfg, inputFile)
+	}
+	if isRemotePath(inputFile) || isRemotePath(cfg.Output) {
+		return processRemoteFile(cfg, inputFile)
+	}
+	excelFile, err := resolveInputPath(inputFile)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockInput(excelFile, cfg.ForceUnlock)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	repo, err := NewRepository(excelFile)
 	if err != nil {
-		log.Fatalf("Error: %v", err)
+		return err
 	}
 	defer repo.Close()
+	// Track files of --serve jobs have no formatting to keep; they are
+	// saved as a new workbook
+	repo.SetPreserveFormatting(cfg.Writer == writerPatch && !isTrackFile(excelFile))
 
-	service := NewService(repo)
-	if err := service.Process(excelFile); err != nil {
-		log.Fatalf("Error: %v", err)
+	if cfg.Backup {
+		backupPath, err := backupFile(excelFile)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✓ Original backed up to: %s\n", backupPath)
+	}
+
+	if cfg.Zip && cfg.progress == nil {
+		// The bundle's summary counts the rows
+		run := *cfg
+		run.progress = &runProgress{}
+		cfg = &run
+	}
+	service := NewService(repo, cfg)
+	started := time.Now()
+	service.span = startSpan(cfg.traceParent, "process file", spanKindInternal, spanAttr{"file", excelFile})
+	err = service.Process(excelFile)
+	if cfg.progress != nil {
+		service.span.set("rows.done", int(cfg.progress.done.Load()))
+		service.span.set("rows.failed", int(cfg.progress.failed.Load()))
+	}
+	service.span.finish(err)
+	defer flushTraces()
+	if cfg.Zip && service.savedTo != "" {
+		bundle, zerr := service.writeBundle(excelFile, summarizeRun(inputFile, cfg.progress, started, err))
+		if zerr != nil {
+			fmt.Printf("Warning: Could not write zip bundle: %v\n", zerr)
+		} else {
+			fmt.Printf("✓ Output, error files and summary bundled in %s\n", bundle)
+		}
 	}
+	return err
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// testBatchSize is the --batch-size of the batched runs in these tests
+const testBatchSize = 7
+
+// newTestService builds a workbook in memory from rows, the first being the
+// header, and a Service on it that looks addresses up with --provider mock
+func newTestService(t *testing.T, rows [][]string, args ...string) *Service {
+	t.Helper()
+	f := excelize.NewFile()
+	t.Cleanup(func() { f.Close() })
+	sheet := f.GetSheetName(0)
+	for i, row := range rows {
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make([]interface{}, len(row))
+		for j, v := range row {
+			values[j] = v
+		}
+		if err := f.SetSheetRow(sheet, cell, &values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sheetRows, err := f.GetRows(sheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseConfig(append([]string{"--provider", "mock", "--workers", "4"}, append(args, "test.xlsx")...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &Repository{file: f, path: "test.xlsx", sheetName: sheet, rows: sheetRows, edits: make(cellEdits)}
+	return NewService(repo, cfg)
+}
+
+// testRows makes a sheet of n data rows whose coordinates are each in their
+// own 0.01° cell, so the mock provider gives every row its own village.
+// Every fifth row repeats the coordinates of the row before it, and row 4
+// has none that parse.
+func testRows(n int) [][]string {
+	rows := [][]string{{"Name", "Coordinates", "Address", "District", "Province"}}
+	for i := 1; i <= n; i++ {
+		cell := i
+		if i%5 == 0 {
+			cell = i - 1
+		}
+		coords := fmt.Sprintf("%.6f, %.6f", 11.005+0.01*float64(cell), 104.005+0.01*float64(cell))
+		if i == 4 {
+			coords = "n/a"
+		}
+		rows = append(rows, []string{fmt.Sprintf("Site %d", i), coords, "", "", ""})
+	}
+	return rows
+}
+
+// resultCells returns the Address, District and Province cells of every
+// data row of the sheet
+func resultCells(t *testing.T, s *Service, n int) [][3]string {
+	t.Helper()
+	cells := make([][3]string, n)
+	for i := range cells {
+		for j, col := range []string{"C", "D", "E"} {
+			v, err := s.repo.GetFile().GetCellValue(s.repo.GetSheetName(), fmt.Sprintf("%s%d", col, i+2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cells[i][j] = v
+		}
+	}
+	return cells
+}
+
+func TestBatchedAndSinglePassWriteTheSameRows(t *testing.T) {
+	// Row counts below, at, just over and several times the batch size
+	for _, n := range []int{testBatchSize - 1, testBatchSize, testBatchSize + 1, 3*testBatchSize - 1} {
+		t.Run(fmt.Sprintf("%d rows", n), func(t *testing.T) {
+			rows := testRows(n)
+
+			single := newTestService(t, rows)
+			latLngCol, addressCol, districtCol, provinceCol, err := single.findColumns(single.repo.GetRows())
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotSingle := single.processRows(single.repo.GetRows(), latLngCol, addressCol, districtCol, provinceCol)
+
+			batched := newTestService(t, rows, "--batch-size", fmt.Sprint(testBatchSize))
+			gotBatched := batched.processRowsInBatches(batched.repo.GetRows(), latLngCol, addressCol, districtCol, provinceCol)
+
+			if want := n - 1; gotSingle != want || gotBatched != want {
+				t.Errorf("processed %d rows in one pass and %d in batches, want %d", gotSingle, gotBatched, want)
+			}
+
+			singleCells, batchedCells := resultCells(t, single, n), resultCells(t, batched, n)
+			for i := range singleCells {
+				sheetRow := i + 2
+				if singleCells[i] != batchedCells[i] {
+					t.Errorf("row %d: one pass wrote %q, batches wrote %q", sheetRow, singleCells[i], batchedCells[i])
+				}
+				coords, err := single.parseCoordinates(rows[i+1][latLngCol])
+				if err != nil {
+					if batchedCells[i] != [3]string{} {
+						t.Errorf("row %d has no valid coordinates but got %q", sheetRow, batchedCells[i])
+					}
+					continue
+				}
+				// The village names the 0.01° cell of the row's own coordinates
+				village := "Village " + mockCell(coords.Lat, coords.Lng, 2)
+				if !strings.Contains(batchedCells[i][0], village) {
+					t.Errorf("row %d: address %q, want one in %s", sheetRow, batchedCells[i][0], village)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteResultAddressesTheSheetRow(t *testing.T) {
+	s := newTestService(t, testRows(3))
+	// rowIndex counts from the header, which is sheet row 1
+	result := rowResult{rowIndex: 2, geocodeResult: geocodeResult{address: "Somewhere", district: "Some District", province: "Some Province"}}
+	if got := result.sheetRow(); got != 3 {
+		t.Fatalf("sheetRow() = %d, want 3", got)
+	}
+	if !s.writeResult(result, 2, 3, 4) {
+		t.Fatal("writeResult reported the row as not written")
+	}
+	cells := resultCells(t, s, 3)
+	if want := [3]string{"Somewhere", "Some District", "Some Province"}; cells[1] != want {
+		t.Errorf("sheet row 3 = %q, want %q", cells[1], want)
+	}
+	for _, i := range []int{0, 2} {
+		if cells[i] != [3]string{} {
+			t.Errorf("sheet row %d = %q, want it untouched", i+2, cells[i])
+		}
+	}
+}
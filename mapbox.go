@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// mapboxGeocoder speaks the Mapbox Geocoding API v6
+// (https://docs.mapbox.com/api/search/geocoding/), authenticated with an
+// access token. Requests are permanent, as results are stored in the output
+// and the cache; the token's account must have permanent geocoding enabled.
+type mapboxGeocoder struct {
+	cfg *Config
+}
+
+// mapboxResponse is the GeoJSON answer of the Mapbox reverse geocoding API
+type mapboxResponse struct {
+	Features []struct {
+		Properties struct {
+			FeatureType string `json:"feature_type"` // address, street, place, region, ...
+			FullAddress string `json:"full_address"`
+			Name        string `json:"name"`
+			Coordinates struct {
+				Latitude  float64 `json:"latitude"`
+				Longitude float64 `json:"longitude"`
+			} `json:"coordinates"`
+			Context struct {
+				Address struct {
+					AddressNumber string `json:"address_number"`
+					StreetName    string `json:"street_name"`
+				} `json:"address"`
+				Street       mapboxContext `json:"street"`
+				Neighborhood mapboxContext `json:"neighborhood"`
+				Postcode     mapboxContext `json:"postcode"`
+				Locality     mapboxContext `json:"locality"`
+				Place        mapboxContext `json:"place"`
+				District     mapboxContext `json:"district"`
+				Region       mapboxContext `json:"region"`
+				Country      struct {
+					Name        string `json:"name"`
+					CountryCode string `json:"country_code"`
+				} `json:"country"`
+			} `json:"context"`
+		} `json:"properties"`
+	} `json:"features"`
+}
+
+type mapboxContext struct {
+	Name string `json:"name"`
+}
+
+func (g mapboxGeocoder) request(lat, lng float64) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("latitude", fmt.Sprintf("%.6f", lat))
+	params.Set("longitude", fmt.Sprintf("%.6f", lng))
+	params.Set("language", "en")
+	params.Set("permanent", "true")
+	params.Set("access_token", g.cfg.APIKey)
+	return http.NewRequest("GET", g.cfg.Endpoint+"?"+params.Encode(), nil)
+}
+
+// parse maps the most specific feature onto the Nominatim address keys:
+// Mapbox's region is the province, its district the district, place the
+// city or town and locality a part of it
+func (g mapboxGeocoder) parse(body []byte) (GeocodeResponse, error) {
+	var mr mapboxResponse
+	if err := json.Unmarshal(body, &mr); err != nil {
+		return GeocodeResponse{}, err
+	}
+	if len(mr.Features) == 0 {
+		return GeocodeResponse{}, nil
+	}
+	p := mr.Features[0].Properties
+	c := p.Context
+	resp := GeocodeResponse{
+		DisplayName: p.FullAddress,
+		Type:        p.FeatureType,
+		Lat:         strconv.FormatFloat(p.Coordinates.Latitude, 'f', -1, 64),
+		Lon:         strconv.FormatFloat(p.Coordinates.Longitude, 'f', -1, 64),
+		Address: Address{
+			HouseNumber:   c.Address.AddressNumber,
+			Road:          c.Street.Name,
+			Neighbourhood: c.Neighborhood.Name,
+			Suburb:        c.Locality.Name,
+			City:          c.Place.Name,
+			County:        c.District.Name,
+			State:         c.Region.Name,
+			Postcode:      c.Postcode.Name,
+			Country:       c.Country.Name,
+			CountryCode:   strings.ToLower(c.Country.CountryCode),
+		},
+	}
+	if resp.Address.Road == "" {
+		resp.Address.Road = c.Address.StreetName
+	}
+	if resp.DisplayName == "" {
+		resp.DisplayName = p.Name
+	}
+	return resp, nil
+}
+
+func (g mapboxGeocoder) maxBatch() int {
+	return 1000
+}
+
+// batchEndpoint is the v6 batch URL, which takes reverse queries as JSON
+func (g mapboxGeocoder) batchEndpoint() string {
+	if g.cfg.BatchEndpoint != "" {
+		return g.cfg.BatchEndpoint
+	}
+	return strings.TrimSuffix(g.cfg.Endpoint, "/reverse") + "/batch"
+}
+
+func (g mapboxGeocoder) batchRequest(points []Coordinates) (*http.Request, error) {
+	type query struct {
+		Longitude float64 `json:"longitude"`
+		Latitude  float64 `json:"latitude"`
+		Language  string  `json:"language"`
+	}
+	queries := make([]query, len(points))
+	for i, p := range points {
+		queries[i] = query{Longitude: p.Lng, Latitude: p.Lat, Language: "en"}
+	}
+	body, err := json.Marshal(queries)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("permanent", "true")
+	params.Set("access_token", g.cfg.APIKey)
+	req, err := http.NewRequest("POST", g.batchEndpoint()+"?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// splitBatch returns the feature collection of each query; Mapbox answers
+// batches right away
+func (g mapboxGeocoder) splitBatch(body []byte) ([]json.RawMessage, *http.Request, error) {
+	var br struct {
+		Batch []json.RawMessage `json:"batch"`
+	}
+	err := json.Unmarshal(body, &br)
+	return br.Batch, nil, err
+}
+
+func (g mapboxGeocoder) parseBatchPart(part json.RawMessage) (GeocodeResponse, error) {
+	return g.parse(part)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//go:embed templates/map.html
+var mapTemplateSource string
+
+var mapTemplate = template.Must(template.New("map").Parse(mapTemplateSource))
+
+// mapPoint is a marker of the --export-map page
+type mapPoint struct {
+	Row      int     `json:"row"`
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	Kind     string  `json:"kind"` // ok, low (below --min-quality) or failed
+	Input    string  `json:"input"`
+	Address  string  `json:"address,omitempty"`
+	District string  `json:"district,omitempty"`
+	Province string  `json:"province,omitempty"`
+	Quality  *int    `json:"quality"`
+	Message  string  `json:"message,omitempty"`
+}
+
+// mapExport collects the rows of a run for a Leaflet map that is written
+// next to the workbook. Rows whose coordinates couldn't be read have no
+// position and are left off the map.
+type mapExport struct {
+	path       string
+	minQuality int
+	points     []mapPoint
+}
+
+// add records a row; a no-op on nil
+func (m *mapExport) add(rowNum int, result rowResult) {
+	if m == nil || result.coords == (Coordinates{}) {
+		return
+	}
+	p := mapPoint{Row: rowNum, Lat: result.coords.Lat, Lng: result.coords.Lng, Input: result.input}
+	switch {
+	case result.skipped:
+		p.Kind, p.Message = "failed", statusMessage(result)
+	default:
+		p.Kind = "ok"
+		if result.quality != nil && *result.quality < m.minQuality {
+			p.Kind = "low"
+		}
+		p.Address, p.District, p.Province, p.Quality = result.address, result.district, result.province, result.quality
+	}
+	m.points = append(m.points, p)
+}
+
+// write renders the page; it needs network access only for Leaflet and the map tiles
+func (m *mapExport) write(title string) error {
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, func(w io.Writer) error {
+		return mapTemplate.Execute(w, struct {
+			Title      string
+			MinQuality int
+			Points     []mapPoint
+		}{title, m.minQuality, m.points})
+	})
+}
+
+// writeMap writes the --export-map page after the workbook was saved
+func (s *Service) writeMap(title string) {
+	if s.htmlMap == nil {
+		return
+	}
+	if err := s.htmlMap.write(title); err != nil {
+		fmt.Printf("Warning: Could not write map %s: %v\n", s.htmlMap.path, err)
+		return
+	}
+	fmt.Printf("✓ Map of %d rows written to %s\n", len(s.htmlMap.points), s.htmlMap.path)
+}
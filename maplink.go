@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// mapLinkHeader names the --map-link column
+const mapLinkHeader = "Map Link"
+
+// mapLinkURLs format the --map-link URL of a coordinate, by map
+var mapLinkURLs = map[string]func(lat, lng float64) string{
+	"osm": func(lat, lng float64) string {
+		return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.6f&mlon=%.6f#map=18/%.6f/%.6f", lat, lng, lat, lng)
+	},
+	"google": func(lat, lng float64) string {
+		return fmt.Sprintf("https://www.google.com/maps/search/?api=1&query=%.6f,%.6f", lat, lng)
+	},
+}
+
+// hyperlink is a cell value that opens url when clicked. Outside a
+// workbook, such as in JSONL or CSV output, it is just the URL.
+type hyperlink struct {
+	url string
+}
+
+func (h hyperlink) String() string {
+	return h.url
+}
+
+// MarshalJSON writes the URL, leaving its & unescaped
+func (h hyperlink) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(h.url); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// mapLinkColumn adds a link to each row's coordinates on the --map-link map,
+// so a questionable address can be checked with one click
+func mapLinkColumn(mapName string) *extraColumn {
+	url := mapLinkURLs[mapName]
+	return &extraColumn{header: mapLinkHeader, key: "map_link", value: func(r rowResult) interface{} {
+		return hyperlink{url: url(r.coords.Lat, r.coords.Lng)}
+	}}
+}
+
+// setHyperlink writes a link cell with excelize: the URL as the cell text,
+// linked and styled as a link. Excel allows 65,530 links per sheet; rows
+// past that keep the URL as plain text.
+func (r *Repository) setHyperlink(cell string, link hyperlink) error {
+	if err := r.file.SetCellValue(r.sheetName, cell, link.url); err != nil {
+		return err
+	}
+	err := r.file.SetCellHyperLink(r.sheetName, cell, link.url, "External")
+	if errors.Is(err, excelize.ErrTotalSheetHyperlinks) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.linkStyle == 0 {
+		if r.linkStyle, err = r.file.NewStyle(&excelize.Style{
+			Font: &excelize.Font{Color: "#0563C1", Underline: "single"},
+		}); err != nil {
+			return err
+		}
+	}
+	return r.file.SetCellStyle(r.sheetName, cell, cell, r.linkStyle)
+}
+
+// hyperlinkFormula renders a link for the patch writer, which can't add
+// relationships to a sheet, as a HYPERLINK formula with the URL as its value
+func hyperlinkFormula(prefix, attrs string, link hyperlink) string {
+	var url bytes.Buffer
+	xml.EscapeText(&url, []byte(link.url))
+	formula := `HYPERLINK("` + url.String() + `")`
+	return "<" + prefix + "c" + attrs + ` t="str"><` + prefix + "f>" + formula + "</" + prefix + "f><" +
+		prefix + "v>" + url.String() + "</" + prefix + "v></" + prefix + "c>"
+}
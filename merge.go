@@ -0,0 +1,274 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ways of reconciling rows of several files with the same coordinates, for
+// merge --on-conflict
+const (
+	mergeLatest = "latest" // the row of the last file with a result wins
+	mergeFlag   = "flag"   // as latest, noting the values of the other files
+)
+
+// mergeConflictHeader is the column --on-conflict flag notes conflicts in
+const mergeConflictHeader = "Merge Conflict"
+
+// mergeGroup is the rows of the merged files that have the same coordinates
+type mergeGroup struct {
+	out       int  // index of the row kept in the merged table
+	hasResult bool // the row kept has a district or province
+	versions  []mergeVersion
+}
+
+// mergeVersion is the result a file has for a coordinate
+type mergeVersion struct {
+	file  string
+	parts addressParts
+}
+
+// mergedTable is the table the files are combined into; columns are matched
+// by header regardless of case and kept in the order they are first seen
+type mergedTable struct {
+	header []string
+	index  map[string]int
+	rows   [][]string
+}
+
+// column returns the merged column of a header, adding it if it is new
+func (t *mergedTable) column(name string) int {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if col, ok := t.index[key]; ok {
+		return col
+	}
+	t.index[key] = len(t.header)
+	t.header = append(t.header, name)
+	return len(t.header) - 1
+}
+
+// runMerge combines several geocoded outputs, such as the files of each
+// month, into one. Rows with the same coordinates (to six decimals, like
+// the cache) are kept once: the row of the last file that has a result
+// wins, so files are listed oldest first. Like diff, it queries no
+// provider and takes only its own options.
+func runMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	output := fs.String("output", filepath.Join("data", "merged.xlsx"),
+		"file to write: .xlsx, .csv, .jsonl, .parquet or .geojson")
+	onConflict := fs.String("on-conflict", mergeLatest,
+		"when files disagree on a coordinate's address: latest (the last file with a result wins) or flag (it wins and the other values go to a "+mergeConflictHeader+" column)")
+	coordinateColumn := fs.String("coordinate-column", "", "header of the coordinate column (default: detected in each file)")
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			printMergeUsage(fs)
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) < 2 {
+		printMergeUsage(fs)
+		return fmt.Errorf("merge combines several files (got %d)", len(files))
+	}
+	if *onConflict != mergeLatest && *onConflict != mergeFlag {
+		return fmt.Errorf("--on-conflict must be %s or %s, got %q", mergeLatest, mergeFlag, *onConflict)
+	}
+
+	cfg := &Config{CoordinateColumn: *coordinateColumn}
+	parser := NewService(nil, cfg)
+	merged := &mergedTable{index: make(map[string]int)}
+	groups := make(map[string]*mergeGroup)
+	read, duplicates := 0, 0
+	for _, name := range files {
+		path, err := resolveInputPath(name)
+		if err != nil {
+			return err
+		}
+		table, err := readTable(path, "")
+		if err != nil {
+			return err
+		}
+		if len(table) == 0 {
+			return fmt.Errorf("%s is empty", path)
+		}
+		coords, err := mergeCoordinates(table[0], *coordinateColumn)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		addressCol, districtCol, provinceCol := findResultColumns(table[0])
+		if districtCol == -1 && provinceCol == -1 {
+			return fmt.Errorf("%s has no District or Province column; is it a geocoded output?", path)
+		}
+		toMerged := make([]int, len(table[0]))
+		for i, header := range table[0] {
+			toMerged[i] = merged.column(header)
+		}
+		file := filepath.Base(path)
+		value := rowsValue(table)
+
+		for r, row := range table[1:] {
+			read++
+			out := make([]string, len(merged.header))
+			for i, cell := range row {
+				if i < len(toMerged) {
+					out[toMerged[i]] = cell
+				}
+			}
+			parts := addressParts{
+				Address:  value(r+2, addressCol),
+				District: value(r+2, districtCol),
+				Province: value(r+2, provinceCol),
+			}
+			hasResult := strings.TrimSpace(parts.District+parts.Province) != ""
+
+			c, err := parser.parseCoordinates(strings.TrimSpace(coords(row)))
+			if err != nil {
+				// Rows without usable coordinates can't be matched; all are kept
+				merged.rows = append(merged.rows, out)
+				continue
+			}
+			key := fmt.Sprintf("%.6f,%.6f", c.Lat, c.Lng)
+			g := groups[key]
+			if g == nil {
+				groups[key] = &mergeGroup{out: len(merged.rows), hasResult: hasResult,
+					versions: []mergeVersion{{file: file, parts: parts}}}
+				merged.rows = append(merged.rows, out)
+				continue
+			}
+			duplicates++
+			g.versions = append(g.versions, mergeVersion{file: file, parts: parts})
+			if hasResult || !g.hasResult {
+				merged.rows[g.out], g.hasResult = out, hasResult
+			}
+		}
+	}
+
+	conflicts := 0
+	conflictCol := -1
+	for _, g := range groups {
+		note := g.conflict()
+		if note == "" {
+			continue
+		}
+		conflicts++
+		if *onConflict == mergeFlag {
+			if conflictCol == -1 {
+				conflictCol = merged.column(mergeConflictHeader)
+			}
+			row := merged.rows[g.out]
+			if conflictCol >= len(row) {
+				row = append(row, make([]string, conflictCol+1-len(row))...)
+			}
+			row[conflictCol] = note
+			merged.rows[g.out] = row
+		}
+	}
+	for i, row := range merged.rows {
+		if len(row) < len(merged.header) {
+			merged.rows[i] = append(row, make([]string, len(merged.header)-len(row))...)
+		}
+	}
+
+	fmt.Printf("Merged %d rows of %d files into %d rows; %d duplicate coordinates removed\n",
+		read, len(files), len(merged.rows), duplicates)
+	if conflicts > 0 {
+		how := "the last file's address was kept"
+		if *onConflict == mergeFlag {
+			how = "noted in the " + mergeConflictHeader + " column"
+		}
+		fmt.Printf("⚠ %d coordinates have different addresses in different files (%s)\n", conflicts, how)
+	}
+
+	p := &pipeline{cfg: cfg, spec: &pipelineSpec{Name: "merged"}, header: merged.header, rows: merged.rows}
+	latLng, err := mergeCoordinates(merged.header, *coordinateColumn)
+	if err != nil {
+		return err
+	}
+	p.coords = latLng
+	if err := os.MkdirAll(filepath.Dir(*output), 0755); err != nil {
+		return err
+	}
+	return exportStep{*output}.run(p)
+}
+
+// conflict describes the district, province or address values the files
+// of a group disagree on, or returns ""
+func (g *mergeGroup) conflict() string {
+	var notes []string
+	for _, field := range []struct {
+		name  string
+		value func(addressParts) string
+	}{
+		{"District", func(a addressParts) string { return a.District }},
+		{"Province", func(a addressParts) string { return a.Province }},
+		{"Address", func(a addressParts) string { return a.Address }},
+	} {
+		var values []string
+		seen := make(map[string]bool)
+		for _, v := range g.versions {
+			value := field.value(v.parts)
+			norm := normalizeForCompare(value)
+			if norm == "" || seen[norm] {
+				continue
+			}
+			seen[norm] = true
+			values = append(values, fmt.Sprintf("%q in %s", value, v.file))
+		}
+		if len(values) > 1 {
+			notes = append(notes, field.name+" "+strings.Join(values, ", "))
+		}
+	}
+	return strings.Join(notes, "; ")
+}
+
+// mergeCoordinates returns how the coordinates of a row are read from the
+// header of a file: the named column, separate latitude and longitude
+// columns, or a coordinate column
+func mergeCoordinates(header []string, name string) (func(row []string) string, error) {
+	cell := func(row []string, col int) string {
+		if col < len(row) {
+			return row[col]
+		}
+		return ""
+	}
+	if name != "" {
+		col := columnIndex(header, name)
+		if col == -1 {
+			return nil, fmt.Errorf("--coordinate-column %q not found", name)
+		}
+		return func(row []string) string { return cell(row, col) }, nil
+	}
+	if latCol, lngCol := latLngColumns(header); latCol != -1 && lngCol != -1 {
+		return func(row []string) string {
+			if strings.TrimSpace(cell(row, latCol)+cell(row, lngCol)) == "" {
+				return ""
+			}
+			return cell(row, latCol) + "," + cell(row, lngCol)
+		}, nil
+	}
+	for i, h := range header {
+		if isCoordinateHeader(h) {
+			return func(row []string) string { return cell(row, i) }, nil
+		}
+	}
+	return nil, fmt.Errorf("no coordinate column found (name it with --coordinate-column)")
+}
+
+func printMergeUsage(fs *flag.FlagSet) {
+	fmt.Println("Usage: latlg-address merge [--output data/merged.xlsx] [--on-conflict latest|flag] <oldest.xlsx> ... <newest.xlsx>")
+	fmt.Println()
+	fmt.Println("Options:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+	fs.SetOutput(io.Discard)
+}
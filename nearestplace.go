@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// builtinPlaces lists provincial capitals and major towns of the region
+//
+//go:embed places/towns.tsv
+var builtinPlaces []byte
+
+// maxNearestPlaceKm leaves the Nearest Place column empty for points further
+// than this from every known place, rather than naming a town hours away
+const maxNearestPlaceKm = 150
+
+// namedPlace is a town or city that rows are described relative to
+type namedPlace struct {
+	country  string // ISO 3166-1 alpha-2, as given
+	name     string
+	lat, lng float64
+}
+
+// loadPlaces returns the towns for --nearest-place: the built-in list, or
+// the --places-file
+func loadPlaces(path string) ([]namedPlace, error) {
+	if path == "" {
+		return parsePlaces(bytes.NewReader(builtinPlaces))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("--places-file: %w", err)
+	}
+	defer f.Close()
+	places, err := parsePlaces(f)
+	if err != nil {
+		return nil, fmt.Errorf("--places-file %s: %w", path, err)
+	}
+	if len(places) == 0 {
+		return nil, fmt.Errorf("--places-file %s: no places", path)
+	}
+	return places, nil
+}
+
+// parsePlaces reads tab-separated places, either "country, name, latitude,
+// longitude" or a GeoNames dump (cities1000.txt, KH.txt, ...), from which
+// only populated places (feature class P) are kept
+func parsePlaces(r io.Reader) ([]namedPlace, error) {
+	var places []namedPlace
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024) // GeoNames lines carry long alternate name lists
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		var p namedPlace
+		var latStr, lngStr string
+		switch {
+		case len(fields) == 4:
+			p.country, p.name, latStr, lngStr = fields[0], fields[1], fields[2], fields[3]
+		case len(fields) >= 15:
+			if fields[6] != "P" {
+				continue
+			}
+			p.country, p.name, latStr, lngStr = fields[8], fields[1], fields[4], fields[5]
+		default:
+			return nil, fmt.Errorf("line %d: expected 4 columns or a GeoNames record, got %d", line, len(fields))
+		}
+		var err1, err2 error
+		p.lat, err1 = strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+		p.lng, err2 = strconv.ParseFloat(strings.TrimSpace(lngStr), 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("line %d: invalid coordinates %q, %q", line, latStr, lngStr)
+		}
+		places = append(places, p)
+	}
+	return places, scanner.Err()
+}
+
+// nearestPlace returns the place closest to a point and its distance in metres
+func nearestPlace(lat, lng float64, places []namedPlace) (namedPlace, float64, bool) {
+	// Compare with an equirectangular approximation, which orders nearby
+	// places correctly and is much cheaper than haversine over a large file
+	cosLat := math.Cos(lat * math.Pi / 180)
+	best, bestScore := -1, 0.0
+	for i, p := range places {
+		dLat, dLng := p.lat-lat, (p.lng-lng)*cosLat
+		if score := dLat*dLat + dLng*dLng; best == -1 || score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best == -1 {
+		return namedPlace{}, 0, false
+	}
+	p := places[best]
+	return p, haversineMeters(lat, lng, p.lat, p.lng), true
+}
+
+// compassPoint returns the 8-point compass direction from one point to another
+func compassPoint(fromLat, fromLng, toLat, toLng float64) string {
+	toRad := math.Pi / 180
+	phi1, phi2 := fromLat*toRad, toLat*toRad
+	dLambda := (toLng - fromLng) * toRad
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	bearing := math.Mod(math.Atan2(y, x)/toRad+360, 360)
+	return [...]string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}[int(math.Round(bearing/45))%8]
+}
+
+// describeNearestPlace says where a point is relative to the nearest place,
+// e.g. "12 km NE of Kampong Cham"
+func describeNearestPlace(lat, lng float64, places []namedPlace) string {
+	p, dist, ok := nearestPlace(lat, lng, places)
+	if !ok || dist > maxNearestPlaceKm*1000 {
+		return ""
+	}
+	km := math.Round(dist / 1000)
+	if km < 1 {
+		return "in " + p.name
+	}
+	return fmt.Sprintf("%.0f km %s of %s", km, compassPoint(p.lat, p.lng, lat, lng), p.name)
+}
+
+// nearestPlaceColumn adds the position of each row relative to the nearest town
+func nearestPlaceColumn(places []namedPlace) *extraColumn {
+	return &extraColumn{header: "Nearest Place", key: "nearest_place", value: func(r rowResult) interface{} {
+		return describeNearestPlace(r.coords.Lat, r.coords.Lng, places)
+	}}
+}
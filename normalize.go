@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
+)
+
+// builtinNameRules are the administrative words --normalize-names strips per country
+//
+//go:embed rules/names.yaml
+var builtinNameRules []byte
+
+// defaultNameRules are used when no --name-rules file was given
+var defaultNameRules = func() nameRules {
+	rules, err := parseNameRules(builtinNameRules)
+	if err != nil {
+		panic(fmt.Sprintf("rules/names.yaml: %v", err))
+	}
+	return rules
+}()
+
+// nameRules are the normalization rules by lowercase country code
+type nameRules map[string]*nameRule
+
+// nameRule lists the words stripped from and replaced in names of a country
+type nameRule struct {
+	Prefixes []string          `yaml:"prefixes"`
+	Suffixes []string          `yaml:"suffixes"`
+	Variants map[string]string `yaml:"variants"`
+}
+
+// loadNameRules returns the built-in rules, with the countries of the
+// --name-rules file replacing theirs
+func loadNameRules(path string) (nameRules, error) {
+	if path == "" {
+		return defaultNameRules, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("--name-rules: %w", err)
+	}
+	custom, err := parseNameRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("--name-rules %s: %w", path, err)
+	}
+	rules := make(nameRules, len(defaultNameRules)+len(custom))
+	for country, rule := range defaultNameRules {
+		rules[country] = rule
+	}
+	for country, rule := range custom {
+		rules[country] = rule
+	}
+	return rules, nil
+}
+
+// parseNameRules decodes and checks a name rules file
+func parseNameRules(data []byte) (nameRules, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var raw map[string]*nameRule
+	if err := dec.Decode(&raw); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	rules := make(nameRules, len(raw))
+	for country, rule := range raw {
+		country = strings.ToLower(country)
+		if country != defaultRulesCountry && len(country) != 2 {
+			return nil, fmt.Errorf("%q is not a two-letter country code or %q", country, defaultRulesCountry)
+		}
+		if rule == nil {
+			rule = &nameRule{}
+		}
+		for i, prefix := range rule.Prefixes {
+			rule.Prefixes[i] = norm.NFC.String(prefix)
+		}
+		for i, suffix := range rule.Suffixes {
+			rule.Suffixes[i] = norm.NFC.String(suffix)
+		}
+		variants := make(map[string]string, len(rule.Variants))
+		for word, replacement := range rule.Variants {
+			if strings.ContainsAny(word, " \t") {
+				return nil, fmt.Errorf("%s: variant %q is more than one word", country, word)
+			}
+			variants[strings.ToLower(norm.NFC.String(word))] = replacement
+		}
+		rule.Variants = variants
+		rules[country] = rule
+	}
+	return rules, nil
+}
+
+// forCountry returns the rule for a country code, or the default rule
+func (r nameRules) forCountry(code string) *nameRule {
+	if rule, ok := r[strings.ToLower(code)]; ok {
+		return rule
+	}
+	if rule, ok := r[defaultRulesCountry]; ok {
+		return rule
+	}
+	return &nameRule{}
+}
+
+// normalizeName returns the canonical form of a district or province name
+// of a country for --normalize-names: Unicode NFC, single spaces, the
+// country's administrative prefixes (unless keepPrefixes) and suffixes
+// stripped, names written all in upper or all in lower case put in title
+// case, and spelling variants replaced.
+func (r nameRules) normalizeName(country, name string, keepPrefixes bool) string {
+	name = strings.Join(strings.Fields(norm.NFC.String(name)), " ")
+	if name == "" {
+		return ""
+	}
+	rule := r.forCountry(country)
+	if !keepPrefixes {
+		name = stripPrefix(name, rule.Prefixes)
+	}
+	name = titleCaseUniform(stripSuffix(name, rule.Suffixes))
+
+	if len(rule.Variants) > 0 {
+		words := strings.Fields(name)
+		for i, word := range words {
+			if replacement, ok := rule.Variants[strings.ToLower(word)]; ok {
+				words[i] = replacement
+			}
+		}
+		name = strings.Join(words, " ")
+	}
+	return name
+}
+
+// stripPrefix removes the first matching prefix, ignoring case. The prefix
+// must be followed by a space, or end in a letter of a script written
+// without spaces; a name that is only the prefix is kept.
+func stripPrefix(name string, prefixes []string) string {
+	for _, prefix := range prefixes {
+		if len(name) <= len(prefix) || !strings.EqualFold(name[:len(prefix)], prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		last, _ := utf8.DecodeLastRuneInString(prefix)
+		if rest[0] == ' ' || last >= utf8.RuneSelf {
+			if rest = strings.TrimSpace(rest); rest != "" {
+				return rest
+			}
+		}
+	}
+	return name
+}
+
+// stripSuffix removes the first matching suffix word, ignoring case
+func stripSuffix(name string, suffixes []string) string {
+	for _, suffix := range suffixes {
+		if len(name) <= len(suffix)+1 {
+			continue
+		}
+		cut := len(name) - len(suffix)
+		if name[cut-1] == ' ' && strings.EqualFold(name[cut:], suffix) {
+			return strings.TrimSpace(name[:cut])
+		}
+	}
+	return name
+}
+
+// titleCaseUniform capitalizes each word of a name whose letters are all
+// upper or all lower case, such as "CHIANG MAI" or "chiang mai". Names with
+// mixed case, and scripts without case, are left as they are.
+func titleCaseUniform(name string) string {
+	hasUpper, hasLower := false, false
+	for _, r := range name {
+		hasUpper = hasUpper || unicode.IsUpper(r)
+		hasLower = hasLower || unicode.IsLower(r)
+	}
+	if hasUpper == hasLower {
+		return name
+	}
+	words := strings.Fields(name)
+	for i, word := range words {
+		first, size := utf8.DecodeRuneInString(word)
+		words[i] = string(unicode.ToTitle(first)) + strings.ToLower(word[size:])
+	}
+	return strings.Join(words, " ")
+}
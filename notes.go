@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// notesCoordinatePattern matches a decimal latitude/longitude pair inside free
+// text, e.g. "site at 13.7563, 100.5018 near temple" or "13.7563° N 100.5018° E".
+// At least three decimals are required so distances and prices ("1.5 km, 2.25")
+// are not mistaken for coordinates.
+var notesCoordinatePattern = regexp.MustCompile(
+	`(?:^|[^\d.])([-+]?\d{1,3}\.\d{3,})\s*°?\s*([NSns])?(?:\s*[,;/]\s*|\s+)([-+]?\d{1,3}\.\d{3,})\s*°?\s*([EWew])?`)
+
+// scanNotesCoordinates returns the first valid coordinate pair found in text
+// as "lat,lng"
+func scanNotesCoordinates(text string) (string, bool) {
+	for _, m := range notesCoordinatePattern.FindAllStringSubmatch(text, -1) {
+		lat, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			continue
+		}
+		lng, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(m[2], "S") {
+			lat = -lat
+		}
+		if strings.EqualFold(m[4], "W") {
+			lng = -lng
+		}
+		if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			continue
+		}
+		return strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lng, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// findNotesColumn locates the --notes-column in the header row
+func (s *Service) findNotesColumn(headerRow []string) error {
+	if s.cfg.NotesColumn == "" {
+		return nil
+	}
+	s.notesCol = columnIndex(headerRow, s.cfg.NotesColumn)
+	if s.notesCol == -1 {
+		return fmt.Errorf("--notes-column %q not found", s.cfg.NotesColumn)
+	}
+	return nil
+}
+
+// rowCoordinates returns the coordinate cell of a row. When it is empty the
+// notes column, if any, is scanned for coordinates instead.
+func (s *Service) rowCoordinates(row []string, latLngCol int) string {
+	coordStr := ""
+	if latLngCol < len(row) {
+		coordStr = row[latLngCol]
+	}
+	if strings.TrimSpace(coordStr) == "" {
+		if found, ok := s.notesCoordinates(row); ok {
+			return found
+		}
+	}
+	return coordStr
+}
+
+// notesCoordinates scans the notes column of a row for coordinates
+func (s *Service) notesCoordinates(row []string) (string, bool) {
+	if s.notesCol < 0 || s.notesCol >= len(row) {
+		return "", false
+	}
+	found, ok := scanNotesCoordinates(row[s.notesCol])
+	if ok {
+		atomic.AddInt64(&s.notesFound, 1)
+	}
+	return found, ok
+}
+
+// reportNotesCoordinates tells how many rows were geocoded from the notes column
+func (s *Service) reportNotesCoordinates() {
+	if n := atomic.LoadInt64(&s.notesFound); n > 0 {
+		fmt.Printf("✓ %d rows used coordinates found in the %s column\n", n, s.cfg.NotesColumn)
+	}
+}
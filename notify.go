@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+// Values of --notify-on
+const (
+	notifyAlways  = "always"
+	notifyFailure = "failure"
+)
+
+// notifyRetries is how many times a notification is attempted
+const notifyRetries = 3
+
+// Run outcomes reported in notifications
+const (
+	runFinished = "finished" // every row was processed and the output saved
+	runAborted  = "aborted"  // --max-errors or --fail-fast stopped the run; the rows so far were saved
+	runFailed   = "failed"   // the run stopped with an error before saving
+)
+
+// runSummary is the body of a --notify-webhook request
+type runSummary struct {
+	Event     string    `json:"event"`
+	Input     string    `json:"input"`
+	Output    string    `json:"output,omitempty"`
+	Rows      int64     `json:"rows"`
+	Processed int64     `json:"processed"`
+	Failed    int64     `json:"failed"`
+	Error     string    `json:"error,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Seconds   float64   `json:"duration_seconds"`
+	Host      string    `json:"host"`
+}
+
+// notifies reports whether a run sends notifications
+func (c *Config) notifies() bool {
+	return c.NotifyWebhook != "" || c.NotifySlack != ""
+}
+
+// processFileNotifying runs processFile and sends the notifications about
+// the run. The nested run has no notification URLs, so a remote input that
+// is processed through processFile again is reported once.
+func processFileNotifying(cfg *Config, inputFile string) error {
+	run := *cfg
+	run.NotifyWebhook, run.NotifySlack = "", ""
+	if run.progress == nil {
+		run.progress = &runProgress{}
+	}
+	started := time.Now()
+	err := processFile(&run, inputFile)
+
+	sum := summarizeRun(inputFile, run.progress, started, err)
+	if sum.Event != runFinished || cfg.NotifyOn == notifyAlways {
+		cfg.sendNotifications(sum)
+	}
+	return err
+}
+
+// summarizeRun describes a run that started at started and ended with err
+func summarizeRun(inputFile string, progress *runProgress, started time.Time, err error) runSummary {
+	sum := runSummary{
+		Event:     runFinished,
+		Input:     inputFile,
+		Output:    progress.outputPath(),
+		Rows:      progress.total.Load(),
+		Processed: progress.done.Load(),
+		Failed:    progress.failed.Load(),
+		Started:   started.UTC(),
+		Finished:  time.Now().UTC(),
+	}
+	sum.Seconds = sum.Finished.Sub(sum.Started).Round(time.Second).Seconds()
+	sum.Host, _ = os.Hostname()
+	if err != nil {
+		var aborted *abortError
+		sum.Event, sum.Error = runFailed, err.Error()
+		if errors.As(err, &aborted) {
+			sum.Event = runAborted
+		}
+	}
+	return sum
+}
+
+// sendNotifications posts a summary to the webhook and Slack; failures are
+// only reported, they don't fail the run
+func (c *Config) sendNotifications(sum runSummary) {
+	client := newHTTPClient(c)
+	if c.NotifyWebhook != "" {
+		if err := postJSON(client, c.NotifyWebhook, sum); err != nil {
+			fmt.Printf("Warning: Could not send webhook notification: %v\n", err)
+		}
+	}
+	if c.NotifySlack != "" {
+		if err := postJSON(client, c.NotifySlack, map[string]string{"text": sum.slackText()}); err != nil {
+			fmt.Printf("Warning: Could not send Slack notification: %v\n", err)
+		}
+	}
+}
+
+// slackText formats a summary as a Slack message
+func (sum runSummary) slackText() string {
+	icon := ":white_check_mark:"
+	if sum.Event != runFinished {
+		icon = ":x:"
+	}
+	text := fmt.Sprintf("%s *%s* %s on %s after %s", icon, path.Base(sum.Input), sum.Event, sum.Host,
+		time.Duration(sum.Seconds)*time.Second)
+	if sum.Rows > 0 {
+		text += fmt.Sprintf("\n%d of %d rows processed, %d failed", sum.Processed, sum.Rows, sum.Failed)
+	}
+	if sum.Error != "" {
+		text += "\nError: " + sum.Error
+	}
+	if sum.Output != "" {
+		text += "\nOutput: `" + sum.Output + "`"
+	}
+	return text
+}
+
+// postJSON posts v as JSON, retrying network and server errors. Errors
+// name only the host: the path of a Slack webhook is its secret.
+func postJSON(client *http.Client, target string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, target, nil)
+	if err != nil {
+		return fmt.Errorf("invalid notification URL")
+	}
+	host := req.URL.Host
+	var lastErr error
+	for attempt := 0; attempt < notifyRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		req, _ := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			lastErr = fmt.Errorf("%s: %w", host, err)
+			continue
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("%s answered %s", host, resp.Status)
+		case resp.StatusCode >= 300:
+			return fmt.Errorf("%s answered %s", host, resp.Status)
+		default:
+			return nil
+		}
+	}
+	return lastErr
+}
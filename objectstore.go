@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// remoteStagingDir holds the local copies of files read from or written to
+// object storage. The path of a copy depends only on its URL, so --resume
+// finds the journal of an interrupted run again. --serve jobs stage their
+// copies in the job's directory instead.
+const remoteStagingDir = "data/remote"
+
+// objectChunkSize is the part size of multipart uploads; smaller files are
+// uploaded in one request
+const objectChunkSize = 16 << 20
+
+// objectRetries is how often a failed object storage request is attempted
+const objectRetries = 4
+
+// objectStore reads and writes the files of one object storage service
+type objectStore interface {
+	// get writes the contents of an object to w
+	get(bucket, key string, w io.Writer) error
+	// put uploads the file to an object, in parts when it is large
+	put(bucket, key string, f *os.File, size int64) error
+}
+
+// objectURL is a parsed s3://, gs:// or az:// path
+type objectURL struct {
+	scheme string
+	bucket string
+	key    string
+}
+
+// isRemotePath reports whether p names a file in object storage
+func isRemotePath(p string) bool {
+	for _, prefix := range []string{"s3://", "gs://", "az://"} {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseObjectURL splits an object storage path into bucket and key. The
+// key is cleaned, and keys that would still climb out of the bucket, such
+// as s3://b/../../x.xlsx, are refused: the local copy is staged under the
+// key, so they would be written outside the staging directory.
+func parseObjectURL(p string) (objectURL, error) {
+	scheme, rest, _ := strings.Cut(p, "://")
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || bucket == "." || bucket == ".." || key == "" || strings.HasSuffix(key, "/") {
+		return objectURL{}, fmt.Errorf("%s: expected %s://bucket/path/to/file", p, scheme)
+	}
+	key = path.Clean(key)
+	escapes := strings.HasPrefix(key, "/") || strings.HasPrefix(key, `\`)
+	for _, segment := range strings.FieldsFunc(key, func(r rune) bool { return r == '/' || r == '\\' }) {
+		escapes = escapes || segment == ".." || filepath.VolumeName(segment) != ""
+	}
+	if escapes {
+		return objectURL{}, fmt.Errorf("%s: the path must not leave the bucket", p)
+	}
+	return objectURL{scheme: scheme, bucket: bucket, key: key}, nil
+}
+
+// stagingPath returns the local copy of a remote file: under the run's
+// staging directory, which is the job's own for --serve jobs
+func (c *Config) stagingPath(u objectURL) string {
+	dir := c.remoteDir
+	if dir == "" {
+		dir = remoteStagingDir
+	}
+	return filepath.Join(dir, u.scheme, u.bucket, filepath.FromSlash(u.key))
+}
+
+// objectStoreFor returns the client of a storage service. Transfers have no
+// overall timeout, since large files can take longer than --http-timeout.
+func (c *Config) objectStoreFor(scheme string) (objectStore, error) {
+	client := newHTTPClient(c)
+	client.Timeout = 0
+	switch scheme {
+	case "s3":
+		return newS3Store(client)
+	case "gs":
+		return newGCSStore(client)
+	case "az":
+		return newAzureStore(client)
+	}
+	return nil, fmt.Errorf("unsupported storage %s://", scheme)
+}
+
+// fetchRemote downloads a remote file to its staging path and returns that path
+func (c *Config) fetchRemote(p string) (string, error) {
+	u, err := parseObjectURL(p)
+	if err != nil {
+		return "", err
+	}
+	store, err := c.objectStoreFor(u.scheme)
+	if err != nil {
+		return "", err
+	}
+	local := c.stagingPath(u)
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	err = writeFileAtomic(local, func(w io.Writer) error {
+		return store.get(u.bucket, u.key, w)
+	})
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", p, err)
+	}
+	if info, err := os.Stat(local); err == nil {
+		fmt.Printf("✓ Downloaded %s (%s) in %s\n", p, formatBytes(info.Size()), time.Since(start).Round(time.Millisecond))
+	}
+	return local, nil
+}
+
+// pushRemote uploads a local file to a remote path
+func (c *Config) pushRemote(local, p string) error {
+	u, err := parseObjectURL(p)
+	if err != nil {
+		return err
+	}
+	store, err := c.objectStoreFor(u.scheme)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := store.put(u.bucket, u.key, f, info.Size()); err != nil {
+		return fmt.Errorf("uploading %s: %w", p, err)
+	}
+	fmt.Printf("✓ Uploaded %s (%s) in %s\n", p, formatBytes(info.Size()), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// localInputPath resolves an input file, downloading it first when it is in
+// object storage
+func (c *Config) localInputPath(name string) (string, error) {
+	if isRemotePath(name) {
+		return c.fetchRemote(name)
+	}
+	return resolveInputPath(name)
+}
+
+// remoteOutputPath returns the object storage path the results for
+// inputFile are uploaded to, or "" when they are written locally
+func (c *Config) remoteOutputPath(inputFile string, now time.Time) string {
+	switch {
+	case isRemotePath(c.Output):
+		if strings.HasSuffix(c.Output, "/") {
+			return c.Output + c.outputName(inputFile, now)
+		}
+		return c.Output
+	case c.Output != "" || !isRemotePath(inputFile):
+		return ""
+	case c.InPlace:
+		return inputFile
+	}
+	dir, _ := path.Split(inputFile)
+	return dir + c.outputName(inputFile, now)
+}
+
+// processRemoteFile processes a file when the input or the output is in
+// object storage: the input is downloaded to its staging path, processed there
+// like a local file, and the result is uploaded once processing succeeded
+func processRemoteFile(cfg *Config, inputFile string) error {
+	local := inputFile
+	if isRemotePath(inputFile) {
+		var err error
+		if local, err = cfg.fetchRemote(inputFile); err != nil {
+			return err
+		}
+	}
+
+	remoteOut := cfg.remoteOutputPath(inputFile, time.Now())
+	run := *cfg
+	if remoteOut != "" {
+		u, err := parseObjectURL(remoteOut)
+		if err != nil {
+			return err
+		}
+		run.InPlace = false
+		run.Output = cfg.stagingPath(u)
+		run.Force = true // the staged copy of an earlier upload is replaced
+		if err := os.MkdirAll(filepath.Dir(run.Output), 0755); err != nil {
+			return err
+		}
+	}
+	if err := processFile(&run, local); err != nil {
+		return err
+	}
+	if remoteOut == "" {
+		return nil
+	}
+	if err := cfg.pushRemote(run.Output, remoteOut); err != nil {
+		return fmt.Errorf("%w (the results are kept in %s)", err, run.Output)
+	}
+	cfg.progress.setOutput(remoteOut)
+	return nil
+}
+
+// sendObjectRequest sends the request built by newReq, retrying network
+// errors, throttling and server errors. newReq is called for every attempt,
+// so it can give each one a fresh body.
+func sendObjectRequest(client *http.Client, newReq func() (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt < objectRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt-1)) * time.Second)
+		}
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			lastErr = objectResponseError(req, resp)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// objectResponseError reads an error response and closes its body. The
+// query is left out of the message, as it may hold a SAS token.
+func objectResponseError(req *http.Request, resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s %s://%s%s: status %d: %s", req.Method, req.URL.Scheme, req.URL.Host, req.URL.Path,
+		resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// formatBytes formats a file size for progress messages
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseObjectURLRefusesPathsOutOfTheBucket(t *testing.T) {
+	for _, p := range []string{
+		"s3://b/../../../x.xlsx",
+		"s3://b/in/../../x.xlsx",
+		"gs://b//etc/x.xlsx",
+		`az://b/..\..\x.xlsx`,
+		"s3://../x.xlsx",
+		"s3://b/",
+		"s3://b",
+	} {
+		if u, err := parseObjectURL(p); err == nil {
+			t.Errorf("parseObjectURL(%q) = %+v, want an error", p, u)
+		}
+	}
+}
+
+func TestStagingPathStaysInTheStagingDirectory(t *testing.T) {
+	for p, key := range map[string]string{
+		"s3://b/in/sites.xlsx":         "in/sites.xlsx",
+		"s3://b/in/./sites.xlsx":       "in/sites.xlsx",
+		"gs://b/in/old/../sites.xlsx":  "in/sites.xlsx",
+		"az://b/a..b/sites..2024.xlsx": "a..b/sites..2024.xlsx",
+	} {
+		u, err := parseObjectURL(p)
+		if err != nil {
+			t.Errorf("parseObjectURL(%q): %v", p, err)
+			continue
+		}
+		if u.key != key {
+			t.Errorf("parseObjectURL(%q).key = %q, want %q", p, u.key, key)
+		}
+		for _, cfg := range []*Config{{}, {remoteDir: filepath.Join("data", "jobs", "1", "remote")}} {
+			dir := cfg.remoteDir
+			if dir == "" {
+				dir = remoteStagingDir
+			}
+			if local := cfg.stagingPath(u); !strings.HasPrefix(local, filepath.Clean(dir)+string(filepath.Separator)) {
+				t.Errorf("stagingPath(%q) = %s, outside %s", p, local, dir)
+			}
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outputDiff is the comparison of two geocoded outputs
+type outputDiff struct {
+	names       [2]string // file names, to label the columns
+	key         string    // --key column, or "" when rows are matched by number
+	compared    int       // rows present in both files with the same coordinates
+	moved       int       // rows whose coordinates differ, left out
+	onlyIn      [2]int
+	district    fieldAgreement
+	province    fieldAgreement
+	bothAgree   int // rows whose district and province both agree
+	bothChecked int // rows with a district and a province in both files
+	rows        []diffRow
+}
+
+// fieldAgreement counts how often a field matches in rows where both files
+// have a value
+type fieldAgreement struct {
+	checked, agreed int
+	oneSided        int // rows where only one file has a value
+}
+
+func (a fieldAgreement) String() string {
+	return fmt.Sprintf("%d of %d agree (%s); %d rows have a value in only one file",
+		a.agreed, a.checked, formatPercent(percentOf(a.agreed, a.checked)), a.oneSided)
+}
+
+// diffRow is a row whose district or province disagrees, or is missing in
+// one of the files
+type diffRow struct {
+	row     int
+	key     string
+	input   string
+	changed []string
+	parts   [2]addressParts
+}
+
+// runDiff compares the district and province of two geocoded outputs, such
+// as one provider against another or this month against last month, and
+// writes the rows that disagree to a CSV. Unlike the other commands it
+// queries no provider, so it takes only its own options.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	key := fs.String("key", "", "column identifying rows in both files (default: row number)")
+	report := fs.String("report", "", "CSV of the rows that disagree (default: data/<a>_vs_<b>_diff.csv)")
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			printDiffUsage(fs)
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) != 2 {
+		printDiffUsage(fs)
+		return fmt.Errorf("diff compares two outputs (got %d files)", len(files))
+	}
+
+	var snaps [2]snapshot
+	var d outputDiff
+	for i, name := range files {
+		path, err := resolveInputPath(name)
+		if err != nil {
+			return err
+		}
+		files[i] = path
+		d.names[i] = filepath.Base(path)
+		if snaps[i], err = outputSnapshot(path, *key); err != nil {
+			return err
+		}
+	}
+	if d.names[0] == d.names[1] {
+		d.names = [2]string{"A " + d.names[0], "B " + d.names[1]}
+	}
+	d.key = *key
+	d.compare(snaps[0], snaps[1])
+
+	d.print(os.Stdout)
+	if *report == "" {
+		stem := func(path string) string {
+			return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		*report = filepath.Join("data", stem(files[0])+"_vs_"+stem(files[1])+"_diff.csv")
+	}
+	if err := writeFileAtomic(*report, d.writeCSV); err != nil {
+		return fmt.Errorf("writing diff report: %w", err)
+	}
+	fmt.Printf("✓ %d rows that disagree or miss a value written to %s\n", len(d.rows), *report)
+	return nil
+}
+
+func printDiffUsage(fs *flag.FlagSet) {
+	fmt.Println("Usage: latlg-address diff [--key column] [--report path.csv] <a.xlsx> <b.xlsx>")
+	fmt.Println()
+	fmt.Println("Options:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+	fs.SetOutput(io.Discard)
+}
+
+// outputSnapshot reads the coordinates and results of a geocoded output
+func outputSnapshot(path, key string) (snapshot, error) {
+	repo, err := NewRepository(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer repo.Close()
+
+	rows := repo.GetRows()
+	cols := snapshotColumns{key: -1, coords: -1}
+	for i, cell := range rows[0] {
+		if isCoordinateHeader(cell) {
+			cols.coords = i
+			break
+		}
+	}
+	if key != "" {
+		if cols.key = columnIndex(rows[0], key); cols.key == -1 {
+			return nil, fmt.Errorf("%s: --key column %q not found", path, key)
+		}
+	}
+	cols.address, cols.district, cols.province = findResultColumns(rows[0])
+	if cols.district == -1 && cols.province == -1 {
+		return nil, fmt.Errorf("%s has no District or Province column; is it a geocoded output?", path)
+	}
+	return takeSnapshot(len(rows), cols, rowsValue(rows)), nil
+}
+
+// compare matches the rows of two snapshots and counts where they agree.
+// District and province are compared ignoring case and spacing.
+func (d *outputDiff) compare(a, b snapshot) {
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			d.onlyIn[1]++
+		}
+	}
+	for key, before := range a {
+		after, ok := b[key]
+		if !ok {
+			d.onlyIn[0]++
+			continue
+		}
+		if strings.Join(strings.Fields(before.input), "") != strings.Join(strings.Fields(after.input), "") {
+			d.moved++
+			continue
+		}
+		d.compared++
+
+		var changed []string
+		district := d.district.add(before.District, after.District)
+		province := d.province.add(before.Province, after.Province)
+		for _, f := range []struct {
+			name  string
+			match fieldMatch
+		}{{"district", district}, {"province", province}} {
+			switch f.match {
+			case fieldDiffers:
+				changed = append(changed, f.name)
+			case fieldOneSided:
+				changed = append(changed, f.name+" missing in one file")
+			}
+		}
+		if district >= fieldAgrees && province >= fieldAgrees {
+			d.bothChecked++
+			if district == fieldAgrees && province == fieldAgrees {
+				d.bothAgree++
+			}
+		}
+		if len(changed) > 0 {
+			row := diffRow{row: before.row, input: before.input, changed: changed,
+				parts: [2]addressParts{before.addressParts, after.addressParts}}
+			if d.key != "" {
+				row.key = key
+			}
+			d.rows = append(d.rows, row)
+		}
+	}
+	sort.Slice(d.rows, func(i, j int) bool { return d.rows[i].row < d.rows[j].row })
+}
+
+// fieldMatch is how a field of a row compares between the two files
+type fieldMatch int
+
+const (
+	fieldEmpty    fieldMatch = iota // neither file has a value
+	fieldOneSided                   // only one file has a value
+	fieldAgrees
+	fieldDiffers
+)
+
+// add counts a pair of values
+func (a *fieldAgreement) add(x, y string) fieldMatch {
+	x, y = normalizeForCompare(x), normalizeForCompare(y)
+	switch {
+	case x == "" && y == "":
+		return fieldEmpty
+	case x == "" || y == "":
+		a.oneSided++
+		return fieldOneSided
+	}
+	a.checked++
+	if x == y {
+		a.agreed++
+		return fieldAgrees
+	}
+	return fieldDiffers
+}
+
+// normalizeForCompare lower-cases a value and collapses its spacing
+func normalizeForCompare(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// percentOf returns n as a percentage of total, NaN for an empty total
+func percentOf(n, total int) float64 {
+	if total == 0 {
+		return math.NaN()
+	}
+	return float64(n) / float64(total) * 100
+}
+
+// print writes the summary of the comparison
+func (d *outputDiff) print(w io.Writer) {
+	matchedBy := "row number"
+	if d.key != "" {
+		matchedBy = "column " + d.key
+	}
+	fmt.Fprintf(w, "Compared %d rows of %s and %s (matched by %s)\n", d.compared, d.names[0], d.names[1], matchedBy)
+	fmt.Fprintf(w, "  District: %s\n", d.district)
+	fmt.Fprintf(w, "  Province: %s\n", d.province)
+	fmt.Fprintf(w, "  Both:     %d of %d agree (%s)\n", d.bothAgree, d.bothChecked, formatPercent(percentOf(d.bothAgree, d.bothChecked)))
+	if d.moved > 0 {
+		fmt.Fprintf(w, "  %d rows have different coordinates in the two files and were not compared\n", d.moved)
+	}
+	for i, n := range d.onlyIn {
+		if n > 0 {
+			fmt.Fprintf(w, "  %d rows are only in %s\n", n, d.names[i])
+		}
+	}
+}
+
+// writeCSV writes the rows that disagree or miss a value, side by side
+func (d *outputDiff) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{"Row", "Key", "Coordinates", "Differs"}
+	for _, field := range []string{"District", "Province", "Address"} {
+		header = append(header, d.names[0]+" "+field, d.names[1]+" "+field)
+	}
+	cw.Write(header)
+	for _, r := range d.rows {
+		cw.Write([]string{
+			strconv.Itoa(r.row), r.key, r.input, strings.Join(r.changed, ", "),
+			r.parts[0].District, r.parts[1].District,
+			r.parts[0].Province, r.parts[1].Province,
+			r.parts[0].Address, r.parts[1].Address,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
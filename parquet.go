@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetKind is how a column is stored in a Parquet file. Types without a
+// kind of their own, such as decimals, are read as text and written back as strings.
+type parquetKind int
+
+const (
+	parquetString parquetKind = iota
+	parquetBool
+	parquetInt32
+	parquetInt64
+	parquetFloat
+	parquetDouble
+	parquetDate
+	parquetTimestampMillis
+	parquetTimestampMicros
+	parquetTimestampNanos
+)
+
+// parquetColumn is the storage type of a table column
+type parquetColumn struct {
+	kind  parquetKind
+	scale int // decimal places of a DECIMAL column read as text
+}
+
+// unixEpochJulianDay is the Julian day number of 1970-01-01, for INT96 timestamps
+const unixEpochJulianDay = 2440588
+
+// isParquet reports whether path is a Parquet file
+func isParquet(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".parquet")
+}
+
+// parquetColumnOf maps a Parquet leaf type to the kind used to read and write it
+func parquetColumnOf(t parquet.Type) parquetColumn {
+	lt := t.LogicalType()
+	switch {
+	case lt != nil && lt.Decimal != nil:
+		return parquetColumn{kind: parquetString, scale: int(lt.Decimal.Scale)}
+	case lt != nil && lt.Date != nil:
+		return parquetColumn{kind: parquetDate}
+	case lt != nil && lt.Timestamp != nil:
+		switch {
+		case lt.Timestamp.Unit.Millis != nil:
+			return parquetColumn{kind: parquetTimestampMillis}
+		case lt.Timestamp.Unit.Nanos != nil:
+			return parquetColumn{kind: parquetTimestampNanos}
+		}
+		return parquetColumn{kind: parquetTimestampMicros}
+	}
+	switch t.Kind() {
+	case parquet.Boolean:
+		return parquetColumn{kind: parquetBool}
+	case parquet.Int32:
+		return parquetColumn{kind: parquetInt32}
+	case parquet.Int64:
+		return parquetColumn{kind: parquetInt64}
+	case parquet.Int96:
+		// Legacy timestamps written by Spark and Impala
+		return parquetColumn{kind: parquetTimestampNanos}
+	case parquet.Float:
+		return parquetColumn{kind: parquetFloat}
+	case parquet.Double:
+		return parquetColumn{kind: parquetDouble}
+	}
+	return parquetColumn{kind: parquetString}
+}
+
+// readParquet reads a flat Parquet file into a table with a header row, and
+// returns the storage type of each column so an export can restore it
+func readParquet(path string) ([][]string, []parquetColumn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	fields := pf.Schema().Fields()
+	header := make([]string, len(fields))
+	columns := make([]parquetColumn, len(fields))
+	for i, field := range fields {
+		if !field.Leaf() || field.Repeated() {
+			return nil, nil, fmt.Errorf("%s: column %s is nested or repeated; only flat files are supported", path, field.Name())
+		}
+		header[i] = field.Name()
+		columns[i] = parquetColumnOf(field.Type())
+	}
+
+	table := [][]string{header}
+	buf := make([]parquet.Row, 256)
+	for _, rg := range pf.RowGroups() {
+		rows := rg.Rows()
+		for {
+			n, err := rows.ReadRows(buf)
+			for _, row := range buf[:n] {
+				cells := make([]string, len(fields))
+				for _, v := range row {
+					if !v.IsNull() {
+						cells[v.Column()] = formatParquetValue(v, columns[v.Column()])
+					}
+				}
+				table = append(table, cells)
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				rows.Close()
+				return nil, nil, fmt.Errorf("reading %s: %w", path, err)
+			}
+		}
+		rows.Close()
+	}
+	return table, columns, nil
+}
+
+// formatParquetValue returns the text of a cell the way it would appear in a CSV export
+func formatParquetValue(v parquet.Value, col parquetColumn) string {
+	switch col.kind {
+	case parquetDate:
+		return time.Unix(int64(v.Int32())*86400, 0).UTC().Format("2006-01-02")
+	case parquetTimestampMillis, parquetTimestampMicros, parquetTimestampNanos:
+		var t time.Time
+		switch {
+		case v.Kind() == parquet.Int96:
+			i96 := v.Int96()
+			nanos := int64(i96[1])<<32 | int64(i96[0])
+			t = time.Unix((int64(i96[2])-unixEpochJulianDay)*86400, nanos)
+		case col.kind == parquetTimestampMillis:
+			t = time.UnixMilli(v.Int64())
+		case col.kind == parquetTimestampMicros:
+			t = time.UnixMicro(v.Int64())
+		default:
+			t = time.Unix(0, v.Int64())
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	case parquetFloat:
+		return strconv.FormatFloat(float64(v.Float()), 'f', -1, 32)
+	case parquetDouble:
+		return strconv.FormatFloat(v.Double(), 'f', -1, 64)
+	}
+	if col.scale > 0 {
+		var unscaled big.Int
+		switch v.Kind() {
+		case parquet.Int32:
+			unscaled.SetInt64(int64(v.Int32()))
+		case parquet.Int64:
+			unscaled.SetInt64(v.Int64())
+		default:
+			// Big-endian two's complement
+			b := v.ByteArray()
+			unscaled.SetBytes(b)
+			if len(b) > 0 && b[0]&0x80 != 0 {
+				unscaled.Sub(&unscaled, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+			}
+		}
+		return new(big.Rat).SetFrac(&unscaled, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(col.scale)), nil)).FloatString(col.scale)
+	}
+	return v.String()
+}
+
+// node returns the Parquet type a column is written with
+func (col parquetColumn) node() parquet.Node {
+	switch col.kind {
+	case parquetBool:
+		return parquet.Leaf(parquet.BooleanType)
+	case parquetInt32:
+		return parquet.Int(32)
+	case parquetInt64:
+		return parquet.Int(64)
+	case parquetFloat:
+		return parquet.Leaf(parquet.FloatType)
+	case parquetDouble:
+		return parquet.Leaf(parquet.DoubleType)
+	case parquetDate:
+		return parquet.Date()
+	case parquetTimestampMillis:
+		return parquet.Timestamp(parquet.Millisecond)
+	case parquetTimestampMicros:
+		return parquet.Timestamp(parquet.Microsecond)
+	case parquetTimestampNanos:
+		return parquet.Timestamp(parquet.Nanosecond)
+	}
+	return parquet.String()
+}
+
+// value parses the text of a cell back into a value of the column's type
+func (col parquetColumn) value(s string) (parquet.Value, error) {
+	switch col.kind {
+	case parquetBool:
+		b, err := strconv.ParseBool(s)
+		return parquet.BooleanValue(b), err
+	case parquetInt32:
+		n, err := strconv.ParseInt(s, 10, 32)
+		return parquet.Int32Value(int32(n)), err
+	case parquetInt64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		return parquet.Int64Value(n), err
+	case parquetFloat:
+		f, err := strconv.ParseFloat(s, 32)
+		return parquet.FloatValue(float32(f)), err
+	case parquetDouble:
+		f, err := strconv.ParseFloat(s, 64)
+		return parquet.DoubleValue(f), err
+	case parquetDate:
+		t, err := time.Parse("2006-01-02", s)
+		return parquet.Int32Value(int32(t.Unix() / 86400)), err
+	case parquetTimestampMillis, parquetTimestampMicros, parquetTimestampNanos:
+		t, err := time.Parse(time.RFC3339Nano, s)
+		switch col.kind {
+		case parquetTimestampMillis:
+			return parquet.Int64Value(t.UnixMilli()), err
+		case parquetTimestampMicros:
+			return parquet.Int64Value(t.UnixMicro()), err
+		}
+		return parquet.Int64Value(t.UnixNano()), err
+	}
+	return parquet.ByteArrayValue([]byte(s)), nil
+}
+
+// inferParquetColumn picks a type for a column added by a step, such as
+// Quality or Elevation: integers, then numbers, then strings
+func inferParquetColumn(rows [][]string, col int) parquetColumn {
+	kind, seen := parquetInt64, false
+	for _, row := range rows {
+		s := row[col]
+		if s == "" {
+			continue
+		}
+		seen = true
+		if kind == parquetInt64 {
+			if _, err := strconv.ParseInt(s, 10, 64); err != nil || (len(s) > 1 && s[0] == '0') {
+				kind = parquetDouble
+			}
+		}
+		if _, err := strconv.ParseFloat(s, 64); kind == parquetDouble && err != nil {
+			return parquetColumn{kind: parquetString}
+		}
+	}
+	if !seen {
+		return parquetColumn{kind: parquetString}
+	}
+	return parquetColumn{kind: kind}
+}
+
+// parquetGroup is a schema group that keeps its columns in table order;
+// parquet.Group sorts them by name
+type parquetGroup struct {
+	parquet.Group
+	fields []parquet.Field
+}
+
+func (g parquetGroup) Fields() []parquet.Field { return g.fields }
+
+// writeParquet writes the table with the input's column types restored;
+// empty cells of typed columns are written as nulls
+func (p *pipeline) writeParquet(w io.Writer) error {
+	columns := make([]parquetColumn, len(p.header))
+	group := make(parquet.Group, len(p.header))
+	for i, name := range p.header {
+		if col, ok := p.types[name]; ok {
+			columns[i] = col
+		} else {
+			columns[i] = inferParquetColumn(p.rows, i)
+		}
+		if _, dup := group[name]; dup {
+			return fmt.Errorf("duplicate column %q", name)
+		}
+		group[name] = parquet.Optional(columns[i].node())
+	}
+	byName := make(map[string]parquet.Field, len(p.header))
+	for _, f := range group.Fields() {
+		byName[f.Name()] = f
+	}
+	ordered := parquetGroup{Group: group, fields: make([]parquet.Field, len(p.header))}
+	for i, name := range p.header {
+		ordered.fields[i] = byName[name]
+	}
+
+	pw := parquet.NewWriter(w, parquet.NewSchema(p.spec.Name, ordered), parquet.Compression(&parquet.Zstd))
+	batch := make([]parquet.Row, 0, 1024)
+	for r, row := range p.rows {
+		out := make(parquet.Row, len(columns))
+		for j, cell := range row {
+			if cell == "" && columns[j].kind != parquetString {
+				out[j] = parquet.NullValue().Level(0, 0, j)
+				continue
+			}
+			v, err := columns[j].value(cell)
+			if err != nil {
+				return fmt.Errorf("row %d, column %s: %q is not a valid %s", r+2, p.header[j], cell, columns[j].node().Type())
+			}
+			out[j] = v.Level(0, 1, j)
+		}
+		if batch = append(batch, out); len(batch) == cap(batch) {
+			if _, err := pw.WriteRows(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if _, err := pw.WriteRows(batch); err != nil {
+		return err
+	}
+	return pw.Close()
+}
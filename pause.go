@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pauseGate lets a file run be paused between lookups. Workers wait at the
+// gate before each lookup, so while the run is paused the lookups in flight
+// finish and no new requests reach the geocoding API, leaving its quota to
+// other runs. A nil *pauseGate never pauses.
+type pauseGate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // closed when the run resumes; nil while it runs
+	since   time.Time     // when the current pause began
+	idle    time.Duration // time spent in earlier pauses
+	saves   chan struct{} // asks the run to save its state after pausing
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{saves: make(chan struct{}, 1)}
+}
+
+// pause pauses the run; it reports false if the run was already paused
+func (g *pauseGate) pause() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return false
+	}
+	g.resumed = make(chan struct{})
+	g.since = time.Now()
+	select {
+	case g.saves <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// resume lets a paused run continue; it reports false if it wasn't paused
+func (g *pauseGate) resume() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		return false
+	}
+	close(g.resumed)
+	g.resumed = nil
+	g.idle += time.Since(g.since)
+	return true
+}
+
+func (g *pauseGate) isPaused() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// pausedFor returns how long the run has been paused altogether
+func (g *pauseGate) pausedFor() time.Duration {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return g.idle + time.Since(g.since)
+	}
+	return g.idle
+}
+
+// wait blocks while the run is paused
+func (g *pauseGate) wait() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// saveRequests delivers a value after each pause; it never does for a nil
+// gate
+func (g *pauseGate) saveRequests() <-chan struct{} {
+	if g == nil {
+		return nil
+	}
+	return g.saves
+}
+
+// nextResult returns the next result of a run, saving the run's state when
+// it is paused meanwhile; ok is false once results is closed
+func (s *Service) nextResult(results <-chan rowResult) (rowResult, bool) {
+	for {
+		select {
+		case result, ok := <-results:
+			if ok && result.budgetSpent {
+				continue // the row is left for a later run
+			}
+			if ok {
+				s.received++
+			}
+			return result, ok
+		case <-s.cfg.pause.saveRequests():
+			s.savePaused()
+		}
+	}
+}
+
+// savePaused saves a paused run so it can also be stopped and continued
+// later with --resume. Rows whose lookups were still in flight are added at
+// the next save.
+func (s *Service) savePaused() {
+	if err := s.saveProgress(); err != nil {
+		fmt.Printf("Warning: Could not save the paused run: %v\n", err)
+		return
+	}
+	fmt.Printf("Paused; progress saved to %s (stop now and rerun with --resume to continue later)\n", s.cpPath)
+}
+
+// saveProgress saves the rows finished so far to the run's checkpoint,
+// which a small run only gets now, and saves the cache
+func (s *Service) saveProgress() error {
+	if s.checkpoint == nil {
+		cp, err := createCheckpoint(s.cpPath, s.cpHeader, s.cpCols)
+		if err != nil {
+			return err
+		}
+		s.checkpoint = cp
+		rows := make([]int, 0, len(s.repo.edits))
+		for row, cols := range s.repo.edits {
+			for _, col := range cp.cols {
+				if _, ok := cols[col]; ok {
+					rows = append(rows, row)
+					break
+				}
+			}
+		}
+		sort.Ints(rows)
+		for _, row := range rows {
+			cp.add(row)
+		}
+	}
+	if err := s.checkpoint.flush(s.repo); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	s.persistCache()
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// pauseOnSignals pauses a run on SIGUSR1 and resumes it on SIGUSR2 until
+// stop is called
+func pauseOnSignals(g *pauseGate) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if sig == syscall.SIGUSR1 && g.pause() {
+					fmt.Printf("\nPausing after the lookups in flight (resume with: kill -USR2 %d)\n", os.Getpid())
+				} else if sig == syscall.SIGUSR2 && g.resume() {
+					fmt.Println("\nResuming")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
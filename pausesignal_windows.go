@@ -0,0 +1,7 @@
+package main
+
+// pauseOnSignals does nothing on Windows, which has no SIGUSR1 or SIGUSR2;
+// runs there are paused through the job API of --serve
+func pauseOnSignals(g *pauseGate) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// peliasGeocoder speaks the Pelias /v1/reverse API (https://github.com/pelias/documentation),
+// self-hosted or from a hosted service such as geocode.earth, which takes
+// the key as api_key
+type peliasGeocoder struct {
+	cfg *Config
+}
+
+// peliasResponse is the GeoJSON answer of Pelias
+type peliasResponse struct {
+	Features []struct {
+		Geometry   *geoJSONPoint `json:"geometry"`
+		Properties struct {
+			Layer         string `json:"layer"` // venue, address, street, locality, region, ...
+			Source        string `json:"source"`
+			Label         string `json:"label"`
+			HouseNumber   string `json:"housenumber"`
+			Street        string `json:"street"`
+			Neighbourhood string `json:"neighbourhood"`
+			Borough       string `json:"borough"`
+			Locality      string `json:"locality"`
+			LocalAdmin    string `json:"localadmin"`
+			County        string `json:"county"`
+			Region        string `json:"region"`
+			PostalCode    string `json:"postalcode"`
+			Country       string `json:"country"`
+			CountryCode   string `json:"country_code"`
+			CountryA      string `json:"country_a"` // ISO 3166-1 alpha-3
+		} `json:"properties"`
+	} `json:"features"`
+}
+
+// alpha3Countries turns the alpha-3 codes of older Pelias versions into the
+// alpha-2 codes the component rules and --expect-country use, for the
+// region's countries
+var alpha3Countries = map[string]string{
+	"KHM": "kh", "LAO": "la", "THA": "th", "VNM": "vn", "MMR": "mm", "MYS": "my",
+	"SGP": "sg", "BRN": "bn", "IDN": "id", "PHL": "ph", "TLS": "tl", "CHN": "cn",
+}
+
+func (g peliasGeocoder) request(lat, lng float64) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("point.lat", fmt.Sprintf("%.6f", lat))
+	params.Set("point.lon", fmt.Sprintf("%.6f", lng))
+	params.Set("size", "1")
+	params.Set("lang", "en")
+	if g.cfg.APIKey != "" {
+		params.Set("api_key", g.cfg.APIKey)
+	}
+	return http.NewRequest("GET", g.cfg.Endpoint+"?"+params.Encode(), nil)
+}
+
+// parse maps Pelias' Who's On First hierarchy onto the Nominatim address
+// keys: region is the province, county the district, localadmin the
+// municipality, locality the city and borough a part of it
+func (g peliasGeocoder) parse(body []byte) (GeocodeResponse, error) {
+	var pr peliasResponse
+	if err := json.Unmarshal(body, &pr); err != nil {
+		return GeocodeResponse{}, err
+	}
+	if len(pr.Features) == 0 {
+		return GeocodeResponse{}, nil
+	}
+	f := pr.Features[0]
+	p := f.Properties
+	country := strings.ToLower(p.CountryCode)
+	if country == "" {
+		country = alpha3Countries[strings.ToUpper(p.CountryA)]
+	}
+	resp := GeocodeResponse{
+		DisplayName: p.Label,
+		Class:       p.Source,
+		Type:        p.Layer,
+		Address: Address{
+			HouseNumber:   p.HouseNumber,
+			Road:          p.Street,
+			Neighbourhood: p.Neighbourhood,
+			CityDistrict:  p.Borough,
+			City:          p.Locality,
+			Municipality:  p.LocalAdmin,
+			County:        p.County,
+			State:         p.Region,
+			Postcode:      p.PostalCode,
+			Country:       p.Country,
+			CountryCode:   country,
+		},
+	}
+	resp.Lat, resp.Lon = f.Geometry.latLon()
+	return resp, nil
+}
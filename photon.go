@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// photonGeocoder speaks the Photon reverse API (https://github.com/komoot/photon),
+// which answers from an OpenStreetMap index much like Nominatim
+type photonGeocoder struct {
+	cfg *Config
+}
+
+// latLon returns a feature's point as Nominatim's string coordinates
+func (p *geoJSONPoint) latLon() (lat, lon string) {
+	if p == nil {
+		return "", ""
+	}
+	return strconv.FormatFloat(p.Coordinates[1], 'f', -1, 64), strconv.FormatFloat(p.Coordinates[0], 'f', -1, 64)
+}
+
+// photonResponse is the GeoJSON answer of Photon
+type photonResponse struct {
+	Features []struct {
+		Geometry   *geoJSONPoint `json:"geometry"`
+		Properties struct {
+			OSMType     string `json:"osm_type"` // N, W or R
+			OSMID       int64  `json:"osm_id"`
+			OSMKey      string `json:"osm_key"`
+			OSMValue    string `json:"osm_value"`
+			Name        string `json:"name"`
+			HouseNumber string `json:"housenumber"`
+			Street      string `json:"street"`
+			Locality    string `json:"locality"`
+			District    string `json:"district"`
+			City        string `json:"city"`
+			County      string `json:"county"`
+			State       string `json:"state"`
+			Postcode    string `json:"postcode"`
+			Country     string `json:"country"`
+			CountryCode string `json:"countrycode"`
+		} `json:"properties"`
+	} `json:"features"`
+}
+
+// photonOSMTypes spells out Photon's one-letter OSM types as Nominatim does
+var photonOSMTypes = map[string]string{"N": "node", "W": "way", "R": "relation"}
+
+func (g photonGeocoder) request(lat, lng float64) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("lat", fmt.Sprintf("%.6f", lat))
+	params.Set("lon", fmt.Sprintf("%.6f", lng))
+	params.Set("lang", "en")
+	params.Set("limit", "1")
+	return http.NewRequest("GET", g.cfg.Endpoint+"?"+params.Encode(), nil)
+}
+
+// parse maps Photon's properties, which are Nominatim's address keys under
+// other names: district is a part of a city and locality a part of that
+func (g photonGeocoder) parse(body []byte) (GeocodeResponse, error) {
+	var pr photonResponse
+	if err := json.Unmarshal(body, &pr); err != nil {
+		return GeocodeResponse{}, err
+	}
+	if len(pr.Features) == 0 {
+		return GeocodeResponse{}, nil
+	}
+	f := pr.Features[0]
+	p := f.Properties
+	resp := GeocodeResponse{
+		Class:   p.OSMKey,
+		Type:    p.OSMValue,
+		OSMType: photonOSMTypes[p.OSMType],
+		OSMID:   flexInt(p.OSMID),
+		Address: Address{
+			HouseNumber:  p.HouseNumber,
+			Road:         p.Street,
+			Suburb:       p.Locality,
+			CityDistrict: p.District,
+			City:         p.City,
+			County:       p.County,
+			State:        p.State,
+			Postcode:     p.Postcode,
+			Country:      p.Country,
+			CountryCode:  strings.ToLower(p.CountryCode),
+		},
+	}
+	resp.Lat, resp.Lon = f.Geometry.latLon()
+
+	// Photon sends no display name; list the parts from the most specific
+	var parts []string
+	for _, part := range []string{p.Name, strings.TrimSpace(p.HouseNumber + " " + p.Street), p.Locality, p.District, p.City, p.County, p.State, p.Postcode, p.Country} {
+		if part != "" && (len(parts) == 0 || parts[len(parts)-1] != part) {
+			parts = append(parts, part)
+		}
+	}
+	resp.DisplayName = strings.Join(parts, ", ")
+	return resp, nil
+}
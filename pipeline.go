@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// pipelineSpec is a multi-step job run by `latlg-address run pipeline.yaml`:
+//
+//	name: kh-sites
+//	input:
+//	  file: data/sites.xlsx
+//	  coordinates: LatLng
+//	steps:
+//	  - validate: {on_invalid: flag}
+//	  - dedupe: {by: [LatLng]}
+//	  - geocode:
+//	      options: {zoom: 14, expect-country: KH}
+//	      providers:
+//	        - {preset: nominatim-selfhosted}
+//	        - {preset: nominatim-public}
+//	  - normalize: {strip: [Province, Khan]}
+//	  - join: {file: data/regions.csv, on: Province, columns: [Region]}
+//	  - export: [data/sites_out.xlsx, data/sites_out.parquet, data/sites_out.geojson]
+type pipelineSpec struct {
+	Name  string         `yaml:"name"`
+	Input pipelineInput  `yaml:"input"`
+	Steps []pipelineStep `yaml:"steps"`
+}
+
+// pipelineInput is the table a pipeline starts from
+type pipelineInput struct {
+	File  string `yaml:"file"`
+	Sheet string `yaml:"sheet"` // xlsx only; default: first sheet
+	// Coordinates names a "lat,lng" column; Latitude and Longitude name
+	// separate columns instead. Detected from the header if all are empty:
+	// lat/latitude and lng/lon/longitude columns, or a coordinate column.
+	Coordinates string `yaml:"coordinates"`
+	Latitude    string `yaml:"latitude"`
+	Longitude   string `yaml:"longitude"`
+}
+
+// pipelineStep is one entry of steps; exactly one field is set
+type pipelineStep struct {
+	Validate  *validateStep  `yaml:"validate"`
+	Dedupe    *dedupeStep    `yaml:"dedupe"`
+	Geocode   *geocodeStep   `yaml:"geocode"`
+	Normalize *normalizeStep `yaml:"normalize"`
+	Join      *joinStep      `yaml:"join"`
+	Export    exportStep     `yaml:"export"`
+}
+
+// pipelineStage is the work done by a step
+type pipelineStage interface {
+	run(p *pipeline) error
+}
+
+// stage returns the name and work of a step
+func (st pipelineStep) stage() (string, pipelineStage, error) {
+	var name string
+	var stage pipelineStage
+	set := 0
+	if st.Validate != nil {
+		name, stage, set = "validate", st.Validate, set+1
+	}
+	if st.Dedupe != nil {
+		name, stage, set = "dedupe", st.Dedupe, set+1
+	}
+	if st.Geocode != nil {
+		name, stage, set = "geocode", st.Geocode, set+1
+	}
+	if st.Normalize != nil {
+		name, stage, set = "normalize", st.Normalize, set+1
+	}
+	if st.Join != nil {
+		name, stage, set = "join", st.Join, set+1
+	}
+	if st.Export != nil {
+		name, stage, set = "export", st.Export, set+1
+	}
+	if set != 1 {
+		return "", nil, fmt.Errorf("each step needs exactly one of validate, dedupe, geocode, normalize, join or export")
+	}
+	return name, stage, nil
+}
+
+// loadPipeline reads and checks a pipeline file. Unknown keys are errors so
+// a typo doesn't silently skip part of a job.
+func loadPipeline(path string) (*pipelineSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var spec pipelineSpec
+	if err := dec.Decode(&spec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if spec.Input.File == "" {
+		return nil, fmt.Errorf("%s: input.file is required", path)
+	}
+	if (spec.Input.Latitude == "") != (spec.Input.Longitude == "") {
+		return nil, fmt.Errorf("%s: input.latitude and input.longitude must be given together", path)
+	}
+	if len(spec.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	for i, st := range spec.Steps {
+		if _, _, err := st.stage(); err != nil {
+			return nil, fmt.Errorf("%s: step %d: %w", path, i+1, err)
+		}
+	}
+	if spec.Name == "" {
+		spec.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return &spec, nil
+}
+
+// pipeline is the state passed from step to step: a table of strings with a
+// header row, like the sheet the main command works on
+type pipeline struct {
+	cfg    *Config
+	spec   *pipelineSpec
+	header []string
+	rows   [][]string
+	// coords returns the "lat,lng" text of a row
+	coords func(row []string) string
+	// types are the storage types of the input columns, restored by Parquet exports
+	types map[string]parquetColumn
+}
+
+// runPipeline executes the pipeline file given on the command line. Command
+// line options apply to every geocode step and override the file's options.
+func runPipeline(cfg *Config) error {
+	spec, err := loadPipeline(cfg.InputFile)
+	if err != nil {
+		return err
+	}
+	p := &pipeline{cfg: cfg, spec: spec}
+	if err := p.load(); err != nil {
+		return err
+	}
+	fmt.Printf("Pipeline %s: %d rows from %s\n", spec.Name, len(p.rows), spec.Input.File)
+
+	for i, st := range spec.Steps {
+		name, stage, _ := st.stage()
+		fmt.Printf("\n--- Step %d/%d: %s ---\n", i+1, len(spec.Steps), name)
+		start := time.Now()
+		if err := stage.run(p); err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, name, err)
+		}
+		fmt.Printf("✓ %s done in %s, %d rows\n", name, time.Since(start).Round(time.Millisecond), len(p.rows))
+	}
+	return nil
+}
+
+// load reads the input table and locates its coordinates
+func (p *pipeline) load() error {
+	path, err := p.cfg.localInputPath(p.spec.Input.File)
+	if err != nil {
+		return err
+	}
+	var table [][]string
+	var columns []parquetColumn
+	if isParquet(path) {
+		table, columns, err = readParquet(path)
+	} else {
+		table, err = readTable(path, p.spec.Input.Sheet)
+	}
+	if err != nil {
+		return err
+	}
+	if len(table) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+	// Every row is kept as wide as the header, so steps can index any column
+	// and ensureColumn can append to all rows alike
+	width := 0
+	for _, row := range table {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	for i, row := range table {
+		if len(row) < width {
+			table[i] = append(row, make([]string, width-len(row))...)
+		}
+	}
+	p.header = table[0]
+	p.rows = table[1:]
+	// Columns of CSV and xlsx input stay text; Parquet keeps its types
+	p.types = make(map[string]parquetColumn, len(p.header))
+	for i, name := range p.header {
+		if i < len(columns) {
+			p.types[name] = columns[i]
+		} else {
+			p.types[name] = parquetColumn{kind: parquetString}
+		}
+	}
+
+	in := p.spec.Input
+	latCol, lngCol := -1, -1
+	if in.Latitude != "" {
+		latCol, lngCol = p.column(in.Latitude), p.column(in.Longitude)
+		if latCol == -1 || lngCol == -1 {
+			return fmt.Errorf("input: columns %q and %q not found", in.Latitude, in.Longitude)
+		}
+	} else if in.Coordinates == "" {
+		latCol, lngCol = latLngColumns(p.header)
+	}
+	if latCol != -1 && lngCol != -1 {
+		p.coords = func(row []string) string {
+			if strings.TrimSpace(row[latCol]+row[lngCol]) == "" {
+				return ""
+			}
+			return row[latCol] + "," + row[lngCol]
+		}
+		return nil
+	}
+
+	coordCol := -1
+	if in.Coordinates != "" {
+		coordCol = p.column(in.Coordinates)
+	} else {
+		for i, cell := range p.header {
+			if isCoordinateHeader(cell) {
+				coordCol = i
+				break
+			}
+		}
+	}
+	if coordCol == -1 {
+		return fmt.Errorf("input: coordinate column not found (set input.coordinates)")
+	}
+	p.coords = func(row []string) string { return row[coordCol] }
+	return nil
+}
+
+// latLngColumns finds separate latitude and longitude columns by their
+// headers, as stream mode does, or returns -1
+func latLngColumns(header []string) (latCol, lngCol int) {
+	latCol, lngCol = -1, -1
+	for i, cell := range header {
+		switch strings.ToLower(strings.TrimSpace(cell)) {
+		case "lat", "latitude":
+			latCol = i
+		case "lng", "lon", "long", "longitude":
+			lngCol = i
+		}
+	}
+	return latCol, lngCol
+}
+
+// column returns the index of a header, or -1
+func (p *pipeline) column(name string) int {
+	return columnIndex(p.header, name)
+}
+
+// ensureColumn returns the index of a header, appending the column if it doesn't exist
+func (p *pipeline) ensureColumn(name string) int {
+	if col := p.column(name); col != -1 {
+		return col
+	}
+	p.header = append(p.header, name)
+	for i := range p.rows {
+		p.rows[i] = append(p.rows[i], "")
+	}
+	return len(p.header) - 1
+}
+
+// readTable reads every row of a CSV, JSON Lines, GeoJSON or Parquet file or
+// of one sheet of a workbook
+func readTable(path, sheet string) ([][]string, error) {
+	if isParquet(path) {
+		table, _, err := readParquet(path)
+		return table, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return readJSONLines(path)
+	case ".geojson":
+		return readGeoJSON(path)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		return r.ReadAll()
+	}
+
+	f, err := excelize.OpenFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer f.Close()
+	if sheet == "" {
+		sheet = f.GetSheetName(0)
+	}
+	rows, err := f.GetRows(sheet)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s sheet %q: %w", path, sheet, err)
+	}
+	return rows, nil
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// invalidCoordinatesStatus starts the Status of rows flagged by validate;
+// geocode skips them
+const invalidCoordinatesStatus = "invalid coordinates"
+
+// validateStep checks that every row has usable coordinates
+type validateStep struct {
+	// OnInvalid is flag (default: note the problem in the Status column),
+	// drop (remove the row) or fail (stop the pipeline)
+	OnInvalid string `yaml:"on_invalid"`
+}
+
+func (st *validateStep) run(p *pipeline) error {
+	mode := st.OnInvalid
+	if mode == "" {
+		mode = "flag"
+	}
+	if mode != "flag" && mode != "drop" && mode != "fail" {
+		return fmt.Errorf("on_invalid must be flag, drop or fail, not %q", st.OnInvalid)
+	}
+
+	parser := NewService(nil, p.cfg)
+	problems := make([]error, len(p.rows))
+	invalid := 0
+	for i, row := range p.rows {
+		if problems[i] = checkCoordinates(parser, p.coords(row)); problems[i] != nil {
+			invalid++
+			if mode == "fail" {
+				return fmt.Errorf("row %d: %s: %v", i+2, invalidCoordinatesStatus, problems[i])
+			}
+		}
+	}
+
+	statusCol := -1
+	if invalid > 0 && mode == "flag" {
+		statusCol = p.ensureColumn(statusHeader)
+	}
+	kept := p.rows[:0]
+	for i, row := range p.rows {
+		if problems[i] != nil {
+			if mode == "drop" {
+				continue
+			}
+			row[statusCol] = fmt.Sprintf("%s: %v", invalidCoordinatesStatus, problems[i])
+		}
+		kept = append(kept, row)
+	}
+	p.rows = kept
+
+	if invalid > 0 {
+		fmt.Printf("%d rows with invalid coordinates (%s)\n", invalid, map[string]string{
+			"flag": "flagged in the " + statusHeader + " column",
+			"drop": "dropped",
+		}[mode])
+	}
+	return nil
+}
+
+// checkCoordinates reports why a coordinate cell can't be geocoded
+func checkCoordinates(parser *Service, coordStr string) error {
+	coordStr = strings.TrimSpace(coordStr)
+	if coordStr == "" {
+		return fmt.Errorf("empty coordinates")
+	}
+	coords, err := parser.parseCoordinates(coordStr)
+	if err != nil {
+		return err
+	}
+	if coords.Lat < -90 || coords.Lat > 90 || coords.Lng < -180 || coords.Lng > 180 {
+		return fmt.Errorf("(%g, %g) is out of range", coords.Lat, coords.Lng)
+	}
+	if coords.Lat == 0 && coords.Lng == 0 {
+		return fmt.Errorf("(0, 0) is a placeholder, not a location")
+	}
+	return nil
+}
+
+// dedupeStep removes rows that repeat an earlier row, keeping the first
+type dedupeStep struct {
+	// By lists the columns that identify a row; default: the coordinates
+	By []string `yaml:"by"`
+}
+
+func (st *dedupeStep) run(p *pipeline) error {
+	var cols []int
+	for _, name := range st.By {
+		col := p.column(name)
+		if col == -1 {
+			return fmt.Errorf("column %q not found", name)
+		}
+		cols = append(cols, col)
+	}
+
+	parser := NewService(nil, p.cfg)
+	seen := make(map[string]bool, len(p.rows))
+	kept := p.rows[:0]
+	for _, row := range p.rows {
+		var key string
+		if len(cols) == 0 {
+			// Compare coordinates by value, so "11.5,104.9" equals "11.50, 104.90"
+			key = strings.TrimSpace(p.coords(row))
+			if coords, err := parser.parseCoordinates(key); err == nil {
+				key = fmt.Sprintf("%.6f,%.6f", coords.Lat, coords.Lng)
+			}
+		} else {
+			parts := make([]string, len(cols))
+			for i, col := range cols {
+				parts[i] = strings.ToLower(strings.TrimSpace(row[col]))
+			}
+			key = strings.Join(parts, "\x00")
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, row)
+	}
+	if removed := len(p.rows) - len(kept); removed > 0 {
+		fmt.Printf("Removed %d duplicate rows\n", removed)
+	}
+	p.rows = kept
+	return nil
+}
+
+// geocodeStep adds Address, District and Province columns. Options and
+// providers are command line options without the leading dashes. Providers
+// are tried in order: a row goes to the next one only if the previous one
+// failed to answer, not when its coordinates are invalid.
+type geocodeStep struct {
+	Options   map[string]interface{}   `yaml:"options"`
+	Providers []map[string]interface{} `yaml:"providers"`
+}
+
+func (st *geocodeStep) run(p *pipeline) error {
+	chain, err := st.providers(p.cfg)
+	if err != nil {
+		return err
+	}
+	primary := chain[0]
+	if err := primary.warmCache(); err != nil {
+		return err
+	}
+	defer primary.persistCache()
+	if err := primary.openRawResponses(); err != nil {
+		return err
+	}
+	defer primary.closeRawResponses()
+	// Every provider appends to the same file; entries name their endpoint
+	for _, svc := range chain[1:] {
+		svc.rawResponses = primary.rawResponses
+	}
+
+	addressCol := p.ensureColumn("Address")
+	districtCol := p.ensureColumn("District")
+	provinceCol := p.ensureColumn("Province")
+	extra := primary.cfg.extraColumns()
+	for _, c := range extra {
+		c.col = p.ensureColumn(c.header)
+	}
+	statusCol := p.column(statusHeader)
+
+	// Workers only read these, so the table can grow a Status column meanwhile
+	coords := make([]string, len(p.rows))
+	var pending []int
+	for i, row := range p.rows {
+		coords[i] = p.coords(row)
+		if statusCol == -1 || !strings.HasPrefix(row[statusCol], invalidCoordinatesStatus) {
+			pending = append(pending, i)
+		}
+	}
+
+	jobs := make(chan int, primary.cfg.Workers)
+	results := make(chan rowResult, primary.cfg.Workers)
+	var wg sync.WaitGroup
+	for w := 0; w < primary.cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results <- geocodeWithChain(chain, i, coords[i])
+			}
+		}()
+	}
+	go func() {
+		for _, i := range pending {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	geocoded, failed := 0, 0
+	for result := range results {
+		if result.skipped {
+			failed++
+			if statusCol == -1 {
+				statusCol = p.ensureColumn(statusHeader)
+			}
+			p.rows[result.rowIndex][statusCol] = statusMessage(result)
+			fmt.Printf("Row %d: %s\n", result.rowIndex+2, result.message)
+			continue
+		}
+		row := p.rows[result.rowIndex]
+		row[addressCol] = result.address
+		row[districtCol] = result.district
+		row[provinceCol] = result.province
+		for _, c := range extra {
+			row[c.col] = fmt.Sprint(c.value(result))
+		}
+		if statusCol != -1 {
+			row[statusCol] = statusOK
+		}
+		geocoded++
+	}
+	fmt.Printf("Geocoded %d rows, %d failed\n", geocoded, failed)
+	for _, svc := range chain {
+		svc.reportElevationErrors()
+	}
+	return nil
+}
+
+// providers builds a service per provider from the command line, the step's
+// options and the provider's own options, with the command line winning
+func (st *geocodeStep) providers(cfg *Config) ([]*Service, error) {
+	providers := st.Providers
+	if len(providers) == 0 {
+		providers = []map[string]interface{}{nil}
+	}
+	var chain []*Service
+	for i, provider := range providers {
+		args := append(append(optionArgs(st.Options), optionArgs(provider)...), cfg.args...)
+		pcfg, err := parseConfig(args)
+		if err != nil {
+			return nil, fmt.Errorf("provider %d: %w", i+1, err)
+		}
+		chain = append(chain, NewService(nil, pcfg))
+	}
+	return chain, nil
+}
+
+// optionArgs turns {zoom: 10, extratags: true} into command line arguments.
+// A list repeats the option, e.g. address-template: [..., ...].
+func optionArgs(options map[string]interface{}) []string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := make([]string, 0, len(names))
+	for _, name := range names {
+		flagName := strings.TrimLeft(name, "-")
+		values, ok := options[name].([]interface{})
+		if !ok {
+			values = []interface{}{options[name]}
+		}
+		for _, v := range values {
+			args = append(args, fmt.Sprintf("--%s=%v", flagName, v))
+		}
+	}
+	return args
+}
+
+// geocodeWithChain resolves a row with the first provider that answers.
+// Answers from fallback providers are cached with the first provider, so
+// the next run doesn't ask for them again.
+func geocodeWithChain(chain []*Service, rowIndex int, coordStr string) rowResult {
+	var result rowResult
+	for i, svc := range chain {
+		result = svc.resolveRow(rowIndex, coordStr)
+		if result.geocodeErr == nil {
+			if i > 0 && !result.skipped {
+				chain[0].cache.set(result.coords.Lat, result.coords.Lng, result.geocodeResult)
+			}
+			return result
+		}
+	}
+	return result
+}
+
+// normalizeStep cleans up text columns after geocoding
+type normalizeStep struct {
+	// Columns to clean; default Address, District and Province
+	Columns []string `yaml:"columns"`
+	// Strip lists words removed from the start or end of values, e.g. "Khan"
+	Strip []string `yaml:"strip"`
+	// Replace maps whole values (ignoring case) to a canonical spelling
+	Replace map[string]string `yaml:"replace"`
+}
+
+func (st *normalizeStep) run(p *pipeline) error {
+	names := st.Columns
+	if len(names) == 0 {
+		names = []string{"Address", "District", "Province"}
+	}
+	var cols []int
+	for _, name := range names {
+		col := p.column(name)
+		if col == -1 {
+			return fmt.Errorf("column %q not found", name)
+		}
+		cols = append(cols, col)
+	}
+	replace := make(map[string]string, len(st.Replace))
+	for from, to := range st.Replace {
+		replace[strings.ToLower(strings.Join(strings.Fields(from), " "))] = to
+	}
+
+	changed := 0
+	for _, row := range p.rows {
+		for _, col := range cols {
+			value := strings.Join(strings.Fields(row[col]), " ")
+			for _, word := range st.Strip {
+				value = stripWord(value, word)
+			}
+			if to, ok := replace[strings.ToLower(value)]; ok {
+				value = to
+			}
+			if value != row[col] {
+				row[col] = value
+				changed++
+			}
+		}
+	}
+	fmt.Printf("Normalized %d cells\n", changed)
+	return nil
+}
+
+// joinStep adds columns from a lookup table (CSV or xlsx), matching a column
+// of the pipeline with a key column of the lookup, ignoring case
+type joinStep struct {
+	File  string `yaml:"file"`
+	Sheet string `yaml:"sheet"`
+	// On is the column to match; Key is the lookup's column, default the same name
+	On  string `yaml:"on"`
+	Key string `yaml:"key"`
+	// Columns to copy from the lookup; default all but the key
+	Columns []string `yaml:"columns"`
+}
+
+func (st *joinStep) run(p *pipeline) error {
+	if st.File == "" || st.On == "" {
+		return fmt.Errorf("file and on are required")
+	}
+	onCol := p.column(st.On)
+	if onCol == -1 {
+		return fmt.Errorf("column %q not found", st.On)
+	}
+	path, err := p.cfg.localInputPath(st.File)
+	if err != nil {
+		return err
+	}
+	lookup, err := readTable(path, st.Sheet)
+	if err != nil {
+		return err
+	}
+	if len(lookup) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+
+	keyName := st.Key
+	if keyName == "" {
+		keyName = st.On
+	}
+	keyCol := columnIndex(lookup[0], keyName)
+	if keyCol == -1 {
+		return fmt.Errorf("%s has no %q column", path, keyName)
+	}
+	var from []int
+	if len(st.Columns) == 0 {
+		for i := range lookup[0] {
+			if i != keyCol {
+				from = append(from, i)
+			}
+		}
+	} else {
+		for _, name := range st.Columns {
+			col := columnIndex(lookup[0], name)
+			if col == -1 {
+				return fmt.Errorf("%s has no %q column", path, name)
+			}
+			from = append(from, col)
+		}
+	}
+
+	index := make(map[string][]string, len(lookup)-1)
+	for _, row := range lookup[1:] {
+		if keyCol >= len(row) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(row[keyCol]))
+		if _, dup := index[key]; !dup {
+			index[key] = row
+		}
+	}
+
+	to := make([]int, len(from))
+	for i, col := range from {
+		to[i] = p.ensureColumn(lookup[0][col])
+	}
+	unmatched := 0
+	for _, row := range p.rows {
+		match, ok := index[strings.ToLower(strings.TrimSpace(row[onCol]))]
+		if !ok {
+			unmatched++
+			continue
+		}
+		for i, col := range from {
+			if col < len(match) {
+				row[to[i]] = match[col]
+			}
+		}
+	}
+	if unmatched > 0 {
+		fmt.Printf("%d rows had no match in %s\n", unmatched, path)
+	}
+	return nil
+}
+
+// exportStep writes the table to each file, in the format of its
+// extension: .xlsx, .csv, .jsonl, .parquet or .geojson
+type exportStep []string
+
+func (st exportStep) run(p *pipeline) error {
+	for _, path := range st {
+		var write func(w io.Writer) error
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".xlsx":
+			write = p.writeXLSX
+		case ".csv":
+			write = p.writeCSV
+		case ".jsonl", ".ndjson":
+			write = p.writeJSONL
+		case ".parquet":
+			write = p.writeParquet
+		case ".geojson":
+			write = p.writeGeoJSON
+		default:
+			return fmt.Errorf("%s: unsupported export format (use .xlsx, .csv, .jsonl, .parquet or .geojson)", path)
+		}
+		local := path
+		if isRemotePath(path) {
+			u, err := parseObjectURL(path)
+			if err != nil {
+				return err
+			}
+			local = p.cfg.stagingPath(u)
+		}
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(local, write); err != nil {
+			return fmt.Errorf("writing %s: %w", path, err)
+		}
+		if local != path {
+			if err := p.cfg.pushRemote(local, path); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("✓ Exported %s\n", path)
+	}
+	return nil
+}
+
+func (p *pipeline) writeXLSX(w io.Writer) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return err
+	}
+	for i, row := range append([][]string{p.header}, p.rows...) {
+		cells := make([]interface{}, len(row))
+		for j, v := range row {
+			cells[j] = v
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := sw.SetRow(cell, cells); err != nil {
+			return err
+		}
+	}
+	if err := sw.Flush(); err != nil {
+		return err
+	}
+	return f.Write(w)
+}
+
+func (p *pipeline) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(p.header)
+	cw.WriteAll(p.rows)
+	return cw.Error()
+}
+
+// geoJSONFeature is a point with every column of its row as properties;
+// rows without usable coordinates get a null geometry
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONPoint          `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"` // longitude, latitude
+}
+
+func (p *pipeline) writeGeoJSON(w io.Writer) error {
+	parser := NewService(nil, p.cfg)
+	features := make([]geoJSONFeature, 0, len(p.rows))
+	for _, row := range p.rows {
+		feature := geoJSONFeature{Type: "Feature", Properties: make(map[string]interface{}, len(p.header))}
+		for i, name := range p.header {
+			feature.Properties[name] = row[i]
+		}
+		if coordStr := p.coords(row); checkCoordinates(parser, coordStr) == nil {
+			coords, _ := parser.parseCoordinates(strings.TrimSpace(coordStr))
+			feature.Geometry = &geoJSONPoint{Type: "Point", Coordinates: [2]float64{coords.Lng, coords.Lat}}
+		}
+		features = append(features, feature)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(struct {
+		Type     string           `json:"type"`
+		Features []geoJSONFeature `json:"features"`
+	}{"FeatureCollection", features})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// builtinPostcodes lists district postcodes for results without one
+//
+//go:embed postcodes/postcodes.tsv
+var builtinPostcodes []byte
+
+// postcodePatterns are the postcode formats of the region's countries; a
+// postcode of another country is written without being checked
+var postcodePatterns = map[string]*regexp.Regexp{
+	"th": regexp.MustCompile(`^[1-9][0-9]{4}$`),
+	"kh": regexp.MustCompile(`^[0-9]{5,6}$`), // six-digit since 2018, five-digit before
+	"la": regexp.MustCompile(`^[0-9]{5}$`),
+	"vn": regexp.MustCompile(`^[0-9]{5,6}$`), // five-digit since 2018, six-digit before
+	"mm": regexp.MustCompile(`^[0-9]{5}$`),
+	"my": regexp.MustCompile(`^[0-9]{5}$`),
+	"sg": regexp.MustCompile(`^[0-9]{6}$`),
+	"id": regexp.MustCompile(`^[0-9]{5}$`),
+	"ph": regexp.MustCompile(`^[0-9]{4}$`),
+	"cn": regexp.MustCompile(`^[0-9]{6}$`),
+}
+
+// Postcode Check values
+const (
+	postcodeOK      = "ok"      // the provider's postcode has the country's format
+	postcodeFilled  = "filled"  // the provider gave none; taken from the district table
+	postcodeInvalid = "invalid" // the provider's postcode does not have the country's format
+	postcodeMissing = "missing" // neither the provider nor the table has one
+)
+
+// postcodeTable maps the ISO 3166-2 province code and district matchKey to
+// the district's postcode
+type postcodeTable map[string]string
+
+func postcodeTableKey(provinceCode, districtKey string) string {
+	return provinceCode + "\x00" + districtKey
+}
+
+// defaultPostcodes are the districts of postcodes.tsv
+var defaultPostcodes = func() postcodeTable {
+	table := make(postcodeTable)
+	if err := table.parse(bytes.NewReader(builtinPostcodes)); err != nil {
+		panic(fmt.Sprintf("postcodes/postcodes.tsv: %v", err))
+	}
+	return table
+}()
+
+// loadPostcodes returns the built-in district postcodes, with the districts
+// of the --postcode-table file added or replacing theirs
+func loadPostcodes(path string) (postcodeTable, error) {
+	if path == "" {
+		return defaultPostcodes, nil
+	}
+	table := make(postcodeTable, len(defaultPostcodes))
+	for key, postcode := range defaultPostcodes {
+		table[key] = postcode
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("--postcode-table: %w", err)
+	}
+	defer f.Close()
+	if err := table.parse(f); err != nil {
+		return nil, fmt.Errorf("--postcode-table %s: %w", path, err)
+	}
+	return table, nil
+}
+
+// parse adds the districts of a postcode file
+func (t postcodeTable) parse(r io.Reader) error {
+	districts, err := parseDistricts(r)
+	if err != nil {
+		return err
+	}
+	for _, d := range districts {
+		for _, name := range d.names {
+			if key := matchKey(d.country, name); key != "" {
+				t[postcodeTableKey(d.province, key)] = d.postcode
+			}
+		}
+	}
+	return nil
+}
+
+// district is a row of a postcode file
+type district struct {
+	country  string // lowercase ISO 3166-1 alpha-2
+	province string // ISO 3166-2 code
+	postcode string
+	names    []string // the district name first, then its other spellings
+}
+
+// parseDistricts reads a tab-separated postcode file: country, province
+// code, postcode, district and other spellings
+func parseDistricts(r io.Reader) ([]district, error) {
+	var districts []district
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < 4 || len(fields) > 5 {
+			return nil, fmt.Errorf("line %d: expected country, province code, postcode, district and other spellings", line)
+		}
+		d := district{country: strings.ToLower(fields[0]), province: fields[1], postcode: strings.TrimSpace(fields[2])}
+		if !strings.HasPrefix(d.province, strings.ToUpper(d.country)+"-") {
+			return nil, fmt.Errorf("line %d: %q is not an ISO 3166-2 code of %s", line, d.province, d.country)
+		}
+		if pattern, ok := postcodePatterns[d.country]; ok && !pattern.MatchString(d.postcode) {
+			return nil, fmt.Errorf("line %d: %q is not a postcode of %s", line, d.postcode, d.country)
+		}
+		d.names = []string{fields[3]}
+		if len(fields) == 5 {
+			d.names = append(d.names, strings.Split(fields[4], ",")...)
+		}
+		districts = append(districts, d)
+	}
+	return districts, scanner.Err()
+}
+
+// postcodeFor returns the postcode of a result and its Postcode Check: the
+// provider's postcode checked against the country's format, or else the
+// one of the district table
+func postcodeFor(r rowResult, provinces *provinceMatcher, table postcodeTable) (string, string) {
+	if r.postcode != "" {
+		pattern, ok := postcodePatterns[r.country]
+		switch {
+		case !ok:
+			return r.postcode, ""
+		case pattern.MatchString(r.postcode):
+			return r.postcode, postcodeOK
+		default:
+			return r.postcode, postcodeInvalid
+		}
+	}
+	if found, _ := provinces.match(r.country, r.province); found.code != "" && r.district != "" {
+		if postcode, ok := table[postcodeTableKey(found.code, matchKey(r.country, r.district))]; ok {
+			return postcode, postcodeFilled
+		}
+	}
+	return "", postcodeMissing
+}
+
+// postcodeColumns add each row's postcode, filled from the district table
+// when the provider gave none, and whether it was checked or filled
+func postcodeColumns(m *provinceMatcher, table postcodeTable) []*extraColumn {
+	return []*extraColumn{
+		{header: "Postcode", key: "postcode", value: func(r rowResult) interface{} {
+			postcode, _ := postcodeFor(r, m, table)
+			return postcode
+		}},
+		{header: "Postcode Check", key: "postcode_check", value: func(r rowResult) interface{} {
+			_, check := postcodeFor(r, m, table)
+			return check
+		}},
+	}
+}
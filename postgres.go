@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// postgresDialect reads from and writes to PostgreSQL, with PostGIS geometries
+type postgresDialect struct{}
+
+func (postgresDialect) driver() string { return "postgres" }
+
+// dsn passes the URL on; lib/pq reads postgres:// URLs itself
+func (postgresDialect) dsn(u *url.URL) (string, error) {
+	return u.String(), nil
+}
+
+func (postgresDialect) quote(ident string) string { return pq.QuoteIdentifier(ident) }
+
+// geometryPoint reduces a geometry to a point on its surface and transforms
+// it to WGS84, so polygons and projected SRIDs work too
+func (d postgresDialect) geometryPoint(ctx context.Context, db *sql.DB, column string) (string, error) {
+	point := "ST_Transform(ST_PointOnSurface(" + d.quote(column) + "), 4326)"
+	return "ST_Y(" + point + "), ST_X(" + point + ")", nil
+}
+
+// updateQuery joins the table to a VALUES list:
+//
+//	UPDATE sites AS t SET address = v.address, ... FROM (VALUES ($1, $2, $3, $4), ...)
+//	AS v(key, address, district, province) WHERE t.id = v.key::int4
+//
+// Parameters arrive as text, so the key is cast to the type of the key
+// column; keyType is empty when the driver couldn't tell.
+func (d postgresDialect) updateQuery(c *Config, n int, keyType string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "UPDATE %s AS t SET ", quoteTable(d, c.DBTable))
+	for i, col := range c.dbColumns {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s = v.%s", d.quote(col), [...]string{"address", "district", "province"}[i])
+	}
+	b.WriteString(" FROM (VALUES ")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		p := i*4 + 1
+		fmt.Fprintf(&b, "($%d, $%d, $%d, $%d)", p, p+1, p+2, p+3)
+	}
+	b.WriteString(") AS v(key, address, district, province) WHERE ")
+	if keyType == "" {
+		fmt.Fprintf(&b, "t.%s::text = v.key", d.quote(c.DBKey))
+	} else {
+		fmt.Fprintf(&b, "t.%s = v.key::%s", d.quote(c.DBKey), keyType)
+	}
+	return b.String()
+}
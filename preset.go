@@ -0,0 +1,329 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultUserAgent identifies the tool to geocoding providers
+const defaultUserAgent = "latlg-address-converter/1.0"
+
+// providerPreset configures the request rate and headers to match a
+// provider's usage policy
+type providerPreset struct {
+	Description   string
+	Provider      string // the API the endpoint speaks; empty for Nominatim
+	Endpoint      string
+	Workers       int
+	RequestDelay  time.Duration // per worker, before each uncached request
+	Retries       int
+	RetryDelay    time.Duration // doubles with each attempt
+	RateLimitWait time.Duration // after a 429, grows with each attempt
+	Headers       map[string]string
+	KeyEnv        string // environment variable holding the API key; empty if none is needed
+	DailyBudget   int    // requests allowed per day; 0 if there is no daily limit
+	RequestBatch  int    // coordinates per batch request; 0 if the API has no batch endpoint
+	MaxWorkers    int    // ceiling for --adaptive-concurrency; 0 if the usage policy fixes Workers
+}
+
+// legacyPreset is used when no --preset is given
+var legacyPreset = providerPreset{
+	Endpoint:      "https://nominatim.openstreetmap.org/reverse",
+	Workers:       10,
+	RequestDelay:  1500 * time.Millisecond,
+	Retries:       3,
+	RetryDelay:    2 * time.Second,
+	RateLimitWait: 10 * time.Second,
+	Headers:       map[string]string{"Referer": "https://github.com"},
+}
+
+// presets holds the built-in provider presets
+var presets = map[string]providerPreset{
+	// https://operations.osmfoundation.org/policies/nominatim/
+	// At most 1 request per second, no parallel requests, identifying User-Agent
+	"nominatim-public": {
+		Description:   "openstreetmap.org: 1 request/second, single worker",
+		Endpoint:      "https://nominatim.openstreetmap.org/reverse",
+		Workers:       1,
+		RequestDelay:  1100 * time.Millisecond,
+		Retries:       3,
+		RetryDelay:    5 * time.Second,
+		RateLimitWait: 60 * time.Second,
+		Headers:       map[string]string{"Referer": "https://github.com/UddamSamrit/latlg-address"},
+	},
+	// Your own server: no usage policy, limited only by its capacity
+	"nominatim-selfhosted": {
+		Description:   "own Nominatim server (set --endpoint): 16 workers, no delay",
+		Endpoint:      "http://localhost:8080/reverse",
+		Workers:       16,
+		Retries:       3,
+		RetryDelay:    500 * time.Millisecond,
+		RateLimitWait: 5 * time.Second,
+		MaxWorkers:    64,
+	},
+	// https://locationiq.com/pricing: free plan allows 2 requests/second, 60/minute
+	// and 5,000/day
+	"locationiq-free": {
+		Description:   "LocationIQ free plan: 60 requests/minute, 5000/day, needs LOCATIONIQ_API_KEY or --api-key",
+		Endpoint:      "https://us1.locationiq.com/v1/reverse",
+		Workers:       1,
+		RequestDelay:  1 * time.Second,
+		Retries:       3,
+		RetryDelay:    2 * time.Second,
+		RateLimitWait: 60 * time.Second,
+		KeyEnv:        "LOCATIONIQ_API_KEY",
+		DailyBudget:   5000,
+	},
+	// https://developers.google.com/maps/documentation/geocoding/usage-and-billing:
+	// 3,000 queries per minute per project, billed per request
+	"google": {
+		Description:   "Google Geocoding API: 40 requests/second, billed per request, needs GOOGLE_MAPS_API_KEY or --api-key",
+		Provider:      "google",
+		Endpoint:      "https://maps.googleapis.com/maps/api/geocode/json",
+		Workers:       8,
+		RequestDelay:  200 * time.Millisecond,
+		Retries:       3,
+		RetryDelay:    time.Second,
+		RateLimitWait: 2 * time.Second,
+		KeyEnv:        "GOOGLE_MAPS_API_KEY",
+		MaxWorkers:    10,
+	},
+	// Self-hosted Photon and Pelias servers, like Nominatim's: limited only by
+	// their capacity
+	"photon-selfhosted": {
+		Description:   "own Photon server (set --endpoint): 16 workers, no delay",
+		Provider:      "photon",
+		Endpoint:      "http://localhost:2322/reverse",
+		Workers:       16,
+		Retries:       3,
+		RetryDelay:    500 * time.Millisecond,
+		RateLimitWait: 5 * time.Second,
+		MaxWorkers:    64,
+	},
+	"pelias-selfhosted": {
+		Description:   "own Pelias server (set --endpoint): 16 workers, no delay",
+		Provider:      "pelias",
+		Endpoint:      "http://localhost:4000/v1/reverse",
+		Workers:       16,
+		Retries:       3,
+		RetryDelay:    500 * time.Millisecond,
+		RateLimitWait: 5 * time.Second,
+		MaxWorkers:    64,
+	},
+	// Offline addresses for tests and demos; nothing is sent anywhere
+	"mock": {
+		Description:   "offline made-up addresses for tests and demos (or --mock-fixture); no network",
+		Provider:      "mock",
+		Endpoint:      mockEndpoint,
+		Workers:       8,
+		Retries:       1,
+		RetryDelay:    time.Millisecond,
+		RateLimitWait: time.Millisecond,
+		MaxWorkers:    64,
+	},
+	// https://www.here.com/get-started/pricing: the base plan allows 5 requests
+	// per second
+	"here": {
+		Description:   "HERE reverse geocoding: 4 requests/second, needs HERE_API_KEY or --api-key",
+		Provider:      "here",
+		Endpoint:      "https://revgeocode.search.hereapi.com/v1/revgeocode",
+		Workers:       4,
+		RequestDelay:  1 * time.Second,
+		Retries:       3,
+		RetryDelay:    time.Second,
+		RateLimitWait: 5 * time.Second,
+		KeyEnv:        "HERE_API_KEY",
+	},
+	// https://map.longdo.com/products: keys are rate limited per second and
+	// metered per day; stay well below the free tier's limits
+	"longdo": {
+		Description:   "Longdo Map address API for Thailand, Thai-language results, needs LONGDO_API_KEY or --api-key",
+		Provider:      "longdo",
+		Endpoint:      "https://api.longdo.com/map/services/address",
+		Workers:       2,
+		RequestDelay:  200 * time.Millisecond,
+		Retries:       3,
+		RetryDelay:    2 * time.Second,
+		RateLimitWait: 30 * time.Second,
+		KeyEnv:        "LONGDO_API_KEY",
+	},
+	// https://docs.mapbox.com/api/search/geocoding/#geocoding-api-pricing:
+	// 1,000 requests per minute by default; batches of up to 1,000 queries
+	"mapbox": {
+		Description:   "Mapbox permanent geocoding: batches of 100, 2 batches/second, needs MAPBOX_ACCESS_TOKEN or --api-key",
+		Provider:      "mapbox",
+		Endpoint:      "https://api.mapbox.com/search/geocode/v6/reverse",
+		Workers:       8,
+		RequestDelay:  500 * time.Millisecond,
+		Retries:       3,
+		RetryDelay:    time.Second,
+		RateLimitWait: 10 * time.Second,
+		KeyEnv:        "MAPBOX_ACCESS_TOKEN",
+		RequestBatch:  100,
+	},
+	// https://www.geoapify.com/pricing: the free plan allows 5 requests per
+	// second; batch jobs of up to 1,000 coordinates are answered asynchronously
+	"geoapify": {
+		Description:   "Geoapify reverse geocoding: batches of 100, 1 batch/second, needs GEOAPIFY_API_KEY or --api-key",
+		Provider:      "geoapify",
+		Endpoint:      "https://api.geoapify.com/v1/geocode/reverse",
+		Workers:       4,
+		RequestDelay:  time.Second,
+		Retries:       3,
+		RetryDelay:    time.Second,
+		RateLimitWait: 10 * time.Second,
+		KeyEnv:        "GEOAPIFY_API_KEY",
+		RequestBatch:  100,
+	},
+}
+
+// presetNames returns the built-in preset names in order
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreset fills the request settings from the named preset; options set
+// explicitly on the command line win over the preset
+func (c *Config) applyPreset(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	api, ok := providerAPIs[c.Provider]
+	if set["provider"] && !ok {
+		return fmt.Errorf("unknown provider %q (expected one of: %s)", c.Provider, strings.Join(providerAPINames(), ", "))
+	}
+	if c.Preset == "" && api.preset != "" {
+		c.Preset = api.preset // e.g. --provider longdo uses the longdo preset
+	}
+
+	preset := legacyPreset
+	if c.Preset != "" {
+		p, ok := presets[c.Preset]
+		if !ok {
+			return fmt.Errorf("unknown preset %q (expected one of: %s)", c.Preset, strings.Join(presetNames(), ", "))
+		}
+		preset = p
+	}
+	if !set["provider"] {
+		c.Provider = preset.Provider
+		if c.Provider == "" {
+			c.Provider = defaultProvider
+		}
+	}
+	c.geocoder = providerAPIs[c.Provider].new(c)
+
+	if !set["endpoint"] {
+		c.Endpoint = preset.Endpoint
+	}
+	if !set["workers"] {
+		c.Workers = preset.Workers
+	}
+	if !set["request-delay"] {
+		c.RequestDelay = preset.RequestDelay
+	}
+	if !set["retries"] {
+		c.Retries = preset.Retries
+	}
+	if !set["daily-budget"] {
+		c.DailyBudget = preset.DailyBudget
+	}
+	if !set["request-batch"] {
+		c.RequestBatch = preset.RequestBatch
+	}
+	if c.RequestBatch < 0 {
+		return fmt.Errorf("--request-batch must not be negative")
+	}
+	if c.RequestBatch > 1 && !set["workers"] {
+		// Enough lookups waiting to fill two batches in flight
+		c.Workers = 2 * c.RequestBatch
+	}
+	if c.AdaptiveConcurrency {
+		if c.RequestBatch > 1 {
+			return fmt.Errorf("--adaptive-concurrency doesn't apply to batches; use --request-batch 1")
+		}
+		if !set["max-workers"] {
+			c.MaxWorkers = max(preset.MaxWorkers, c.Workers)
+		}
+		if c.MaxWorkers < c.Workers {
+			return fmt.Errorf("--max-workers must be at least --workers")
+		}
+		// Run enough workers for the ceiling; the limiter decides how many
+		// send requests at once
+		c.startWorkers, c.Workers = c.Workers, c.MaxWorkers
+	} else if set["max-workers"] {
+		return fmt.Errorf("--max-workers needs --adaptive-concurrency")
+	}
+	c.RetryDelay = preset.RetryDelay
+	c.RateLimitWait = preset.RateLimitWait
+	c.Headers = preset.Headers
+
+	// A replay sends nothing: it needs no key and has no rate limit to keep
+	if c.Replay != "" {
+		if !set["request-delay"] {
+			c.RequestDelay = 0
+		}
+		if !set["daily-budget"] {
+			c.DailyBudget = 0
+		}
+		c.RetryDelay, c.RateLimitWait = 0, 0
+	}
+
+	if c.APIKey == "" && preset.KeyEnv != "" {
+		c.APIKey = os.Getenv(preset.KeyEnv)
+		if c.APIKey == "" && c.Replay == "" {
+			return fmt.Errorf("preset %s needs an API key: set %s or pass --api-key", c.Preset, preset.KeyEnv)
+		}
+	}
+	if c.Replay == "" {
+		var err error
+		if c.APIKey, err = resolveSecrets(c.APIKey); err != nil {
+			return err
+		}
+	}
+	if keys := strings.Split(c.APIKey, ","); len(keys) > 1 {
+		pool, err := newKeyPool(keys, c.KeyRotation, c.KeyCooldown)
+		if err != nil {
+			return err
+		}
+		c.keys, c.APIKey = pool, pool.keys[0].key
+	}
+
+	if c.Workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+	if c.Retries < 1 {
+		return fmt.Errorf("--retries must be at least 1")
+	}
+	return nil
+}
+
+// presetUsage describes the built-in presets for the usage message
+func presetUsage() string {
+	var b strings.Builder
+	for _, name := range presetNames() {
+		fmt.Fprintf(&b, "\n  %s: %s", name, presets[name].Description)
+	}
+	return b.String()
+}
+
+// providerName identifies the provider in provenance columns: the preset, or
+// the endpoint's host when no preset was chosen
+func (c *Config) providerName() string {
+	if c.Preset != "" {
+		return c.Preset
+	}
+	if u, err := url.Parse(c.Endpoint); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return c.Endpoint
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processAlive reports whether a process of this host is running
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM: it runs, as another user
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
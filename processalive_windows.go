@@ -0,0 +1,7 @@
+package main
+
+// processAlive assumes a process is running on Windows, so the lock of a run
+// that died there has to be removed with --force-unlock
+func processAlive(pid int) bool {
+	return true
+}
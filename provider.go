@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// defaultProvider is the API spoken by the built-in endpoints
+const defaultProvider = "nominatim"
+
+// Geocoder is a reverse geocoding API. Each provider maps its responses into
+// Nominatim's shape, so every provider goes through the same address,
+// district and province extraction.
+type Geocoder interface {
+	// request builds the request for a coordinate; the User-Agent and
+	// preset headers are added by the caller
+	request(lat, lng float64) (*http.Request, error)
+	// parse maps a successful response. A response without a DisplayName
+	// means the provider found no address.
+	parse(body []byte) (GeocodeResponse, error)
+}
+
+// errRateLimited is returned by parse when the provider answered, but
+// refused the request for going over its rate or quota
+var errRateLimited = errors.New("rate limited")
+
+// permanentError is a parse error that retrying won't fix, such as a
+// rejected API key
+type permanentError struct {
+	error
+}
+
+// providerAPI is a --provider: how to talk to it, and the preset used when
+// it is chosen without --preset
+type providerAPI struct {
+	preset string
+	new    func(cfg *Config) Geocoder
+}
+
+// providerAPIs holds the supported --provider values
+var providerAPIs = map[string]providerAPI{
+	defaultProvider: {new: func(cfg *Config) Geocoder { return nominatimGeocoder{cfg} }},
+	"geoapify":      {preset: "geoapify", new: func(cfg *Config) Geocoder { return geoapifyGeocoder{cfg} }},
+	"google":        {preset: "google", new: func(cfg *Config) Geocoder { return googleGeocoder{cfg} }},
+	"here":          {preset: "here", new: func(cfg *Config) Geocoder { return hereGeocoder{cfg} }},
+	"longdo":        {preset: "longdo", new: func(cfg *Config) Geocoder { return longdoGeocoder{cfg} }},
+	"mapbox":        {preset: "mapbox", new: func(cfg *Config) Geocoder { return mapboxGeocoder{cfg} }},
+	"mock":          {preset: "mock", new: func(cfg *Config) Geocoder { return nominatimGeocoder{cfg} }}, // answered by mockTransport
+	"pelias":        {preset: "pelias-selfhosted", new: func(cfg *Config) Geocoder { return peliasGeocoder{cfg} }},
+	"photon":        {preset: "photon-selfhosted", new: func(cfg *Config) Geocoder { return photonGeocoder{cfg} }},
+}
+
+// providerAPINames returns the --provider values in order
+func providerAPINames() []string {
+	names := make([]string, 0, len(providerAPIs))
+	for name := range providerAPIs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nominatimGeocoder speaks the Nominatim /reverse API, which LocationIQ and
+// self-hosted servers share
+type nominatimGeocoder struct {
+	cfg *Config
+}
+
+func (g nominatimGeocoder) request(lat, lng float64) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("lat", fmt.Sprintf("%.6f", lat))
+	params.Set("lon", fmt.Sprintf("%.6f", lng))
+	params.Set("format", "json")
+	params.Set("addressdetails", "1")
+	params.Set("accept-language", "en") // Request English language
+	if g.cfg.Zoom != defaultZoom {
+		params.Set("zoom", strconv.Itoa(g.cfg.Zoom))
+	}
+	if g.cfg.ExtraTags {
+		params.Set("extratags", "1")
+	}
+	if g.cfg.NameDetails {
+		params.Set("namedetails", "1")
+	}
+	if g.cfg.APIKey != "" {
+		params.Set("key", g.cfg.APIKey)
+	}
+	if g.cfg.Email != "" {
+		params.Set("email", g.cfg.Email)
+	}
+
+	req, err := http.NewRequest("GET", g.cfg.Endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Language", "en")
+	return req, nil
+}
+
+func (g nominatimGeocoder) parse(body []byte) (GeocodeResponse, error) {
+	var resp GeocodeResponse
+	err := json.Unmarshal(body, &resp)
+	return resp, err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// builtinProvinces lists the canonical provinces of Thailand and Cambodia
+//
+//go:embed provinces/provinces.tsv
+var builtinProvinces []byte
+
+// minProvinceMatch is the lowest match, in percent, for which a province is
+// given its canonical name; below it the Canonical Province cell stays empty
+// and only the score is written, so the row can be reviewed
+const minProvinceMatch = 80
+
+// canonicalProvince is a province of the embedded list
+type canonicalProvince struct {
+	country string // lowercase ISO 3166-1 alpha-2
+	code    string // ISO 3166-2, e.g. TH-50
+	name    string
+	local   string   // name in the local script
+	keys    []string // matchKey of the name, the local name and other spellings
+}
+
+// canonicalProvinces are the provinces of provinces.tsv by country
+var canonicalProvinces = func() map[string][]canonicalProvince {
+	provinces, err := parseProvinces(builtinProvinces)
+	if err != nil {
+		panic(fmt.Sprintf("provinces/provinces.tsv: %v", err))
+	}
+	return provinces
+}()
+
+func parseProvinces(data []byte) (map[string][]canonicalProvince, error) {
+	provinces := make(map[string][]canonicalProvince)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < 4 || len(fields) > 5 {
+			return nil, fmt.Errorf("line %d: expected country, code, name, local name and other spellings", line)
+		}
+		p := canonicalProvince{country: strings.ToLower(fields[0]), code: fields[1], name: fields[2], local: fields[3]}
+		if !strings.HasPrefix(p.code, strings.ToUpper(p.country)+"-") {
+			return nil, fmt.Errorf("line %d: %q is not an ISO 3166-2 code of %s", line, p.code, p.country)
+		}
+		names := []string{fields[2], fields[3]}
+		if len(fields) == 5 {
+			names = append(names, strings.Split(fields[4], ",")...)
+		}
+		for _, name := range names {
+			if key := matchKey(p.country, name); key != "" {
+				p.keys = append(p.keys, key)
+			}
+		}
+		provinces[p.country] = append(provinces[p.country], p)
+	}
+	return provinces, scanner.Err()
+}
+
+// matchKey reduces a province name to what matters for matching: the
+// built-in name rules applied, then only its letters and digits, in lower
+// case and without the accents of Latin letters (Takéo matches Takeo)
+func matchKey(country, name string) string {
+	name = norm.NFD.String(defaultNameRules.normalizeName(country, name, false))
+	var b strings.Builder
+	latin := false
+	for _, r := range name {
+		mark := unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r)
+		switch {
+		case mark && latin:
+			continue
+		case mark, unicode.IsLetter(r), unicode.IsDigit(r):
+			b.WriteRune(unicode.ToLower(r))
+		}
+		if !mark {
+			latin = unicode.Is(unicode.Latin, r)
+		}
+	}
+	return norm.NFC.String(b.String())
+}
+
+// provinceMatch is the canonical province found for a resolved name
+type provinceMatch struct {
+	name  string // empty when the best match scored below minProvinceMatch
+	code  string // ISO 3166-2, empty with name
+	local string // name in the local script, empty with name
+	score int    // 0-100
+}
+
+// provinceMatcher matches resolved provinces against the embedded list,
+// remembering names it has seen; safe for concurrent use
+type provinceMatcher struct {
+	mu   sync.Mutex
+	seen map[string]provinceMatch
+}
+
+// match returns the canonical province for a name resolved in a country.
+// A country without a list gives no match; for an unknown country, such as
+// results cached before the country was kept, every list is tried.
+func (m *provinceMatcher) match(country, province string) (provinceMatch, bool) {
+	country = strings.ToLower(country)
+	key := country + "\x00" + province
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if found, ok := m.seen[key]; ok {
+		return found, true
+	}
+
+	var candidates []canonicalProvince
+	if list, ok := canonicalProvinces[country]; ok {
+		candidates = list
+	} else if country == "" {
+		for _, list := range canonicalProvinces {
+			candidates = append(candidates, list...)
+		}
+	}
+	if len(candidates) == 0 || strings.TrimSpace(province) == "" {
+		return provinceMatch{}, false
+	}
+
+	var best provinceMatch
+	names := make(map[string]string) // matchKey of province by country
+	for _, c := range candidates {
+		name, ok := names[c.country]
+		if !ok {
+			name = matchKey(c.country, province)
+			names[c.country] = name
+		}
+		for _, k := range c.keys {
+			if score := similarity(name, k); score > best.score {
+				best = provinceMatch{name: c.name, code: c.code, local: c.local, score: score}
+			}
+		}
+	}
+	if best.score < minProvinceMatch {
+		best.name, best.code, best.local = "", "", ""
+	}
+	if m.seen == nil {
+		m.seen = make(map[string]provinceMatch)
+	}
+	m.seen[key] = best
+	return best, true
+}
+
+// similarity scores two strings from 0 to 100 by their edit distance
+// relative to the longer one
+func similarity(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 0
+	}
+	return int(math.Round(100 * (1 - float64(levenshtein(ra, rb))/float64(longest))))
+}
+
+// levenshtein returns the number of single-rune insertions, deletions and
+// substitutions that turn a into b
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// canonicalProvinceColumns add the canonical name of each row's province and
+// how closely the resolved name matched it
+func canonicalProvinceColumns(m *provinceMatcher) []*extraColumn {
+	return []*extraColumn{
+		{header: "Canonical Province", key: "canonical_province", value: func(r rowResult) interface{} {
+			found, _ := m.match(r.country, r.province)
+			return found.name
+		}},
+		{header: "Province Match", key: "province_match", value: func(r rowResult) interface{} {
+			if found, ok := m.match(r.country, r.province); ok {
+				return found.score
+			}
+			return ""
+		}},
+	}
+}
+
+// provinceCodeColumn adds the ISO 3166-2 code of each row's province, for
+// joining with other international datasets
+func provinceCodeColumn(m *provinceMatcher) *extraColumn {
+	return &extraColumn{header: "Province Code", key: "province_code", value: func(r rowResult) interface{} {
+		found, _ := m.match(r.country, r.province)
+		return found.code
+	}}
+}
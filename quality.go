@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// qualityHeader names the column holding each row's confidence score
+const qualityHeader = "Quality"
+
+// Weights of the quality score components; they add up to 100
+const (
+	qualityRankWeight     = 40
+	qualityFieldsWeight   = 30
+	qualityDistanceWeight = 30
+)
+
+// Distances between the input point and the centre of the result's bounding
+// box that count as a perfect and as a useless match
+const (
+	qualityNearMeters = 50.0
+	qualityFarMeters  = 5000.0
+)
+
+// scoreResult rates how much a reverse geocode can be trusted, from 0 to 100.
+// It combines how specific the matched object is (place_rank 30 is a building,
+// 16 a city, 8 a province), which address fields came back, and how far the
+// centre of the result is from the input coordinate.
+func scoreResult(lat, lng float64, resp GeocodeResponse, district, province string) int {
+	score := 0.0
+
+	// Specificity: unknown ranks (providers that don't send one) get half
+	if rank := int(resp.PlaceRank); rank > 0 {
+		score += qualityRankWeight * clamp01(float64(rank-4)/26)
+	} else {
+		score += qualityRankWeight / 2
+	}
+
+	// Completeness of the fields this tool writes
+	if district != "" {
+		score += 10
+	}
+	if province != "" {
+		score += 10
+	}
+	if resp.Address.Road != "" {
+		score += 5
+	}
+	if resp.Address.HouseNumber != "" {
+		score += 5
+	}
+
+	// Distance from the input to the result
+	if clat, clng, ok := resultCentre(resp); ok {
+		d := haversineMeters(lat, lng, clat, clng)
+		score += qualityDistanceWeight * (1 - clamp01((d-qualityNearMeters)/(qualityFarMeters-qualityNearMeters)))
+	} else {
+		score += qualityDistanceWeight / 2
+	}
+
+	return int(math.Round(score))
+}
+
+// resultCentre returns the centroid of the result's bounding box, or the
+// result point when no bounding box was sent
+func resultCentre(resp GeocodeResponse) (lat, lng float64, ok bool) {
+	if len(resp.BoundingBox) == 4 {
+		var bb [4]float64
+		for i, v := range resp.BoundingBox {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0, 0, false
+			}
+			bb[i] = f
+		}
+		// Nominatim orders the box as south, north, west, east
+		return (bb[0] + bb[1]) / 2, (bb[2] + bb[3]) / 2, true
+	}
+	lat, errLat := strconv.ParseFloat(resp.Lat, 64)
+	lng, errLng := strconv.ParseFloat(resp.Lon, 64)
+	return lat, lng, errLat == nil && errLng == nil
+}
+
+// haversineMeters is the great-circle distance between two WGS84 points
+func haversineMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadius = 6371000.0
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLng := (lng2 - lng1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// qualityColumn writes the score; results cached before scores were
+// computed leave the cell empty
+func qualityColumn() *extraColumn {
+	return &extraColumn{header: qualityHeader, key: "quality", value: func(r rowResult) interface{} {
+		if r.quality == nil {
+			return ""
+		}
+		return *r.quality
+	}}
+}
+
+// highlightLowQuality shades every row whose Quality is below --min-quality
+// and returns how many rows that is. The highlight is a conditional format,
+// so it follows the scores if they are edited later.
+func (s *Service) highlightLowQuality(numRows int) (int, error) {
+	col := -1
+	for _, c := range s.extraCols {
+		if c.header == qualityHeader {
+			col = c.col
+		}
+	}
+	if col == -1 || numRows < 2 {
+		return 0, nil
+	}
+
+	low := 0
+	for row := 2; row <= numRows; row++ {
+		if q, ok := s.repo.edits[row][col+1].(int); ok && q < s.cfg.MinQuality {
+			low++
+		}
+	}
+
+	if s.repo.preserve {
+		// The patch writer only replaces cell values, it can't add formats
+		return low, nil
+	}
+
+	qualityCol, err := excelize.ColumnNumberToName(col + 1)
+	if err != nil {
+		return low, err
+	}
+	s.highlightRows(fmt.Sprintf("AND(ISNUMBER($%s2),$%s2<%d)", qualityCol, qualityCol, s.cfg.MinQuality), yellowFill)
+	return low, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// rawResponse is one provider response in the --raw-responses file
+type rawResponse struct {
+	Time     time.Time       `json:"time"`
+	Lat      float64         `json:"lat"`
+	Lng      float64         `json:"lng"`
+	Endpoint string          `json:"endpoint"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+	// Body holds responses that aren't JSON, such as HTML error pages
+	Body string `json:"body,omitempty"`
+}
+
+// rawResponseLog appends provider responses to a JSONL file, compressed
+// with zstd when the name ends in .zst, so disputed addresses can be traced
+// back to what the provider actually sent
+type rawResponseLog struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	zw    io.WriteCloser
+	enc   *json.Encoder
+	count int
+	err   error // first write error; later writes are skipped
+}
+
+// openRawResponseLog opens path for appending; each run adds to it
+func openRawResponseLog(path string) (*rawResponseLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	zw, err := compressWriter(f, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	enc := json.NewEncoder(zw)
+	enc.SetEscapeHTML(false)
+	return &rawResponseLog{path: path, file: f, zw: zw, enc: enc}, nil
+}
+
+// add records a response body; safe for concurrent use and a no-op on nil
+func (l *rawResponseLog) add(lat, lng float64, endpoint string, status int, body []byte) {
+	if l == nil {
+		return
+	}
+	entry := rawResponse{Time: time.Now().UTC(), Lat: lat, Lng: lng, Endpoint: endpoint, Status: status}
+	if json.Valid(body) {
+		entry.Response = body
+	} else {
+		entry.Body = string(body)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return
+	}
+	if l.err = l.enc.Encode(entry); l.err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not write raw response to %s: %v\n", l.path, l.err)
+		return
+	}
+	l.count++
+}
+
+// close finishes the compressed frame and closes the file
+func (l *rawResponseLog) close() error {
+	if l == nil {
+		return nil
+	}
+	err := l.zw.Close()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openRawResponses starts capturing responses when --raw-responses is set
+func (s *Service) openRawResponses() error {
+	if s.cfg.RawResponses == "" {
+		return nil
+	}
+	log, err := openRawResponseLog(s.cfg.RawResponses)
+	if err != nil {
+		return fmt.Errorf("opening raw response file: %w", err)
+	}
+	s.rawResponses = log
+	for _, route := range s.routes {
+		route.rawResponses = log
+	}
+	return nil
+}
+
+// closeRawResponses flushes the captured responses
+func (s *Service) closeRawResponses() {
+	if s.rawResponses == nil {
+		return
+	}
+	if err := s.rawResponses.close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not write raw response file: %v\n", err)
+	} else if s.rawResponses.count > 0 {
+		fmt.Fprintf(os.Stderr, "✓ %d raw responses appended to %s\n", s.rawResponses.count, s.rawResponses.path)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordedExchange is one provider request and its answer in a --record file
+type recordedExchange struct {
+	Time        time.Time       `json:"time"`
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`               // API keys replaced by REDACTED
+	Request     json.RawMessage `json:"request,omitempty"` // the body of batch requests
+	Status      int             `json:"status,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	// Body holds responses that aren't JSON, such as HTML error pages
+	Body string `json:"body,omitempty"`
+	// Error is a request that got no answer, such as a timeout
+	Error string `json:"error,omitempty"`
+}
+
+// recordedKeyParams are the query parameters the providers send their API
+// key in; recordings leave them out so they can be attached to bug reports
+var recordedKeyParams = []string{"key", "apiKey", "api_key", "access_token"}
+
+// redactKeys returns a request URL with the API key replaced by REDACTED
+func redactKeys(u *url.URL) string {
+	redacted := *u
+	query := redacted.Query()
+	for _, param := range recordedKeyParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// exchangeKey identifies a request in a recording, whatever key it was made
+// with
+func exchangeKey(method string, u *url.URL, body []byte) string {
+	return method + " " + redactKeys(u) + " " + string(body)
+}
+
+// requestBody reads the body of a request and puts it back
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// isProviderRequest tells geocoding and elevation requests apart from the
+// other requests of the client, such as --notify-webhook calls
+func (c *Config) isProviderRequest(req *http.Request) bool {
+	u := req.URL.String()
+	if g, ok := c.geocoder.(batchGeocoder); ok && c.RequestBatch > 1 && strings.HasPrefix(u, g.batchEndpoint()) {
+		return true
+	}
+	return strings.HasPrefix(u, c.Endpoint) || (c.Elevation && strings.HasPrefix(u, c.ElevationEndpoint))
+}
+
+// recordTransport appends every provider request and response to the
+// --record file, so an extraction bug can be reproduced with --replay on the
+// exact payloads the provider sent
+type recordTransport struct {
+	cfg  *Config
+	next http.RoundTripper
+
+	once sync.Once
+	mu   sync.Mutex
+	file *os.File
+	err  error // opening or writing failed; later exchanges aren't recorded
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.cfg.isProviderRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+	entry := recordedExchange{Time: time.Now().UTC(), Method: req.Method, URL: redactKeys(req.URL)}
+	reqBody, err := requestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(reqBody) > 0 {
+		entry.Request = reqBody
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		entry.Error = err.Error()
+		t.add(entry)
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		entry.Error = err.Error()
+		t.add(entry)
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry.Status = resp.StatusCode
+	entry.ContentType = resp.Header.Get("Content-Type")
+	for _, key := range t.cfg.apiKeys() {
+		// Some answers carry the key, such as the URLs of batch jobs
+		body = bytes.ReplaceAll(body, []byte(key), []byte("REDACTED"))
+	}
+	if json.Valid(body) {
+		entry.Response = body
+	} else {
+		entry.Body = string(body)
+	}
+	t.add(entry)
+	return resp, nil
+}
+
+// add appends an exchange to the file, opening it on the first one. Each
+// line is written in one go, so runs and routes recording to the same file
+// don't interleave.
+func (t *recordTransport) add(entry recordedExchange) {
+	t.once.Do(func() {
+		if t.err = os.MkdirAll(filepath.Dir(t.cfg.Record), 0755); t.err == nil {
+			t.file, t.err = os.OpenFile(t.cfg.Record, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		}
+		if t.err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not open --record file: %v\n", t.err)
+		}
+	})
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(entry); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return
+	}
+	if _, t.err = t.file.Write(line.Bytes()); t.err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not write to %s: %v\n", t.cfg.Record, t.err)
+	}
+}
+
+// replayTransport answers provider requests from a --replay recording and
+// never reaches the provider. A request recorded several times, such as one
+// that was retried, gets its answers in the recorded order and then the last
+// one again.
+type replayTransport struct {
+	cfg  *Config
+	next http.RoundTripper
+}
+
+// replayRecording is a loaded --record file, by exchangeKey
+type replayRecording struct {
+	mu        sync.Mutex
+	exchanges map[string][]recordedExchange
+	served    map[string]int
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.cfg.isProviderRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+	body, err := requestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := t.cfg.replay.next(exchangeKey(req.Method, req.URL, body))
+	if !ok {
+		return nil, fmt.Errorf("not in the --replay recording %s", t.cfg.Replay)
+	}
+	if entry.Error != "" {
+		return nil, errors.New(entry.Error)
+	}
+	body = []byte(entry.Response)
+	if entry.Response == nil {
+		body = []byte(entry.Body)
+	}
+	header := http.Header{}
+	if entry.ContentType != "" {
+		header.Set("Content-Type", entry.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode:    entry.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// next returns the answer to serve for a request
+func (r *replayRecording) next(key string) (recordedExchange, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exchanges := r.exchanges[key]
+	if len(exchanges) == 0 {
+		return recordedExchange{}, false
+	}
+	i := r.served[key]
+	if i < len(exchanges)-1 {
+		r.served[key] = i + 1
+	}
+	return exchanges[i], true
+}
+
+// loadRecording reads a --record file (.zst or plain JSONL) for --replay
+func loadRecording(path string) (*replayRecording, error) {
+	rc, err := openCompressed(path)
+	if err != nil {
+		return nil, fmt.Errorf("--replay: %w", err)
+	}
+	defer rc.Close()
+	r := &replayRecording{exchanges: make(map[string][]recordedExchange), served: make(map[string]int)}
+	scanner := bufio.NewScanner(rc)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e recordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("--replay %s: line %d: %w", path, line, err)
+		}
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return nil, fmt.Errorf("--replay %s: line %d: %w", path, line, err)
+		}
+		key := exchangeKey(e.Method, u, e.Request)
+		r.exchanges[key] = append(r.exchanges[key], e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("--replay %s: %w", path, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// redactLevel is how much of each address --redact-level leaves out, for
+// datasets that may not keep precise home addresses
+type redactLevel int
+
+const (
+	redactNone        redactLevel = iota
+	redactHouse                   // house numbers and house names
+	redactRoad                    // also roads, buildings and named places
+	redactSubdistrict             // also villages, hamlets and neighbourhoods
+)
+
+var redactLevelNames = []string{"none", "house", "road", "subdistrict"}
+
+func (l redactLevel) String() string {
+	return redactLevelNames[l]
+}
+
+// parseRedactLevel parses a --redact-level value
+func parseRedactLevel(name string) (redactLevel, error) {
+	for i, n := range redactLevelNames {
+		if strings.EqualFold(name, n) {
+			return redactLevel(i), nil
+		}
+	}
+	return redactNone, fmt.Errorf("--redact-level must be one of %s, not %q", strings.Join(redactLevelNames, ", "), name)
+}
+
+// redact returns the address components left at this level. Of the keys
+// without an Address field only the ISO 3166 codes are kept past the house
+// level, since the others name buildings, shops and the like.
+func (l redactLevel) redact(a Address) Address {
+	if l == redactNone {
+		return a
+	}
+	a.HouseNumber = ""
+	other := a.other
+	a.other = nil
+	for key, value := range other {
+		if key == "house_name" || (l >= redactRoad && !strings.HasPrefix(key, "ISO3166")) {
+			continue
+		}
+		if a.other == nil {
+			a.other = make(map[string]string)
+		}
+		a.other[key] = value
+	}
+	if l >= redactRoad {
+		a.Road = ""
+	}
+	if l >= redactSubdistrict {
+		a.Hamlet, a.Village, a.Neighbourhood, a.Quarter = "", "", "", ""
+	}
+	return a
+}
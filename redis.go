@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisKeyPrefix starts every key the tool writes to Redis, so a shared
+// server can be told apart from other applications' keys
+const redisKeyPrefix = "latlg:"
+
+// redisTimeout bounds connecting to Redis and each command
+const redisTimeout = 5 * time.Second
+
+// redisRetryAfter is how long Redis is left alone after it failed, so an
+// unreachable server doesn't slow every lookup by redisTimeout
+const redisRetryAfter = 30 * time.Second
+
+// redisMaxIdle is how many connections are kept open between commands
+const redisMaxIdle = 16
+
+// errRedisDown is the error of commands skipped while Redis is left alone
+var errRedisDown = errors.New("redis unavailable")
+
+// redisError is an error reply of the server, such as WRONGTYPE; the
+// connection stays usable
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisClient is a small client of the Redis protocol (RESP) for
+// --redis-url: the few commands the shared cache and budget need, over a
+// pool of connections
+type redisClient struct {
+	addr     string
+	user     string
+	password string
+	db       int
+	tls      *tls.Config // nil for redis://
+	idle     chan *redisConn
+
+	mu        sync.Mutex
+	downUntil time.Time // commands are skipped until then after a failure
+	warned    bool
+}
+
+// redisConn is a connection to the server
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisClient connects to the server of a redis:// or rediss:// URL,
+// such as redis://:password@cache.internal:6379/2, and checks that it
+// answers
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("--redis-url: %w", err)
+	}
+	c := &redisClient{addr: u.Host, idle: make(chan *redisConn, redisMaxIdle)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("--redis-url must start with redis:// or rediss://, got %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("--redis-url has no host")
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("--redis-url: invalid database %q", db)
+		}
+	}
+	if _, err := c.do("PING"); err != nil {
+		return nil, fmt.Errorf("--redis-url: connecting to %s: %w", c.addr, err)
+	}
+	return c, nil
+}
+
+// dial opens a connection, logging in and selecting the database
+func (c *redisClient) dial() (*redisConn, error) {
+	d := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", c.addr, c.tls)
+	} else {
+		conn, err = d.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	var setup [][]string
+	switch {
+	case c.user != "":
+		setup = append(setup, []string{"AUTH", c.user, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := rc.roundTrip(args); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+	}
+	return rc, nil
+}
+
+// do runs a command on an idle connection or a new one
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	replies, err := c.doAll([][]string{args})
+	if replies == nil {
+		return nil, err
+	}
+	return replies[0], err
+}
+
+// doAll sends commands at once on an idle connection or a new one and
+// returns their replies. An error reply is returned as the first error
+// along with all the replies. A pooled connection the server has closed is
+// retried once on a new one.
+func (c *redisClient) doAll(cmds [][]string) ([]interface{}, error) {
+	for {
+		var rc *redisConn
+		pooled := true
+		select {
+		case rc = <-c.idle:
+		default:
+			var err error
+			if rc, err = c.dial(); err != nil {
+				return nil, err
+			}
+			pooled = false
+		}
+		replies, err := rc.roundTrip(cmds...)
+		var replyErr redisError
+		if err != nil && !errors.As(err, &replyErr) {
+			rc.conn.Close()
+			if pooled {
+				continue
+			}
+			return nil, err
+		}
+		select {
+		case c.idle <- rc:
+		default:
+			rc.conn.Close()
+		}
+		return replies, err
+	}
+}
+
+// call runs a command unless Redis failed in the last redisRetryAfter
+func (c *redisClient) call(args ...string) (interface{}, error) {
+	replies, err := c.callAll([][]string{args})
+	if replies == nil {
+		return nil, err
+	}
+	return replies[0], err
+}
+
+// callAll runs commands like doAll unless Redis failed in the last
+// redisRetryAfter. The first failure is reported; the run goes on without
+// Redis until it answers again.
+func (c *redisClient) callAll(cmds [][]string) ([]interface{}, error) {
+	c.mu.Lock()
+	down := time.Now().Before(c.downUntil)
+	c.mu.Unlock()
+	if down {
+		return nil, errRedisDown
+	}
+	replies, err := c.doAll(cmds)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.mu.Lock()
+		c.downUntil = time.Now().Add(redisRetryAfter)
+		if !c.warned {
+			fmt.Fprintf(os.Stderr, "Warning: Redis at %s failed: %v; going on without it until it answers again\n", c.addr, err)
+			c.warned = true
+		}
+		c.mu.Unlock()
+	}
+	return replies, err
+}
+
+// incr adds one to a counter that expires after ttl. The counter is created
+// with its expiry in the same transaction that counts, so no counter is
+// ever left without one.
+func (c *redisClient) incr(key string, ttl time.Duration) (int64, error) {
+	replies, err := c.callAll([][]string{
+		{"MULTI"},
+		{"SET", key, "0", "EX", strconv.Itoa(int(ttl / time.Second)), "NX"},
+		{"INCR", key},
+		{"EXEC"},
+	})
+	if len(replies) != 4 {
+		return 0, err
+	}
+	results, ok := replies[3].([]interface{})
+	if !ok || len(results) != 2 {
+		if err == nil {
+			err = fmt.Errorf("unexpected reply to EXEC: %v", replies[3])
+		}
+		return 0, err
+	}
+	// Once INCR ran the request is counted, whatever SET answered
+	n, ok := results[1].(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply to INCR: %v", results[1])
+	}
+	return n, nil
+}
+
+// roundTrip sends commands at once and reads their replies. Error replies
+// don't stop the reading, so the connection stays in step; the first is
+// returned.
+func (rc *redisConn) roundTrip(cmds ...[]string) ([]interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	for _, args := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	var first error
+	for i := range cmds {
+		reply, err := rc.readReply()
+		var replyErr redisError
+		if err != nil && !errors.As(err, &replyErr) {
+			return nil, err
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+		replies[i] = reply
+	}
+	return replies, first
+}
+
+// readReply reads a RESP2 reply: a string, an int64, a []byte, nil for a
+// missing value, or a []interface{} of replies. Error replies are returned
+// as a redisError, or as such an item of an array.
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, text := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return text, nil
+	case '-':
+		return nil, redisError(text)
+	case ':':
+		return strconv.ParseInt(text, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil // a missing value
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// The error replies of a transaction's commands are items of EXEC's reply
+			item, err := rc.readReply()
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				item = replyErr
+			} else if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("malformed reply %q", line)
+}
+
+// redisCache is the sharedCache of --redis-url. Results are stored as the
+// records of a cache file under latlg:cache:<key>. Without --cache-ttl they
+// don't expire; set a maxmemory policy on the server to bound them.
+type redisCache struct {
+	client *redisClient
+	ttl    time.Duration
+}
+
+func (r redisCache) get(key string) (geocodeResult, bool) {
+	reply, err := r.client.call("GET", redisKeyPrefix+"cache:"+key)
+	data, ok := reply.([]byte)
+	if err != nil || !ok {
+		return geocodeResult{}, false
+	}
+	var rec cacheRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return geocodeResult{}, false
+	}
+	return rec.result(), true
+}
+
+func (r redisCache) set(key string, result geocodeResult) {
+	data, err := json.Marshal(newCacheRecord(key, result))
+	if err != nil {
+		return
+	}
+	args := []string{"SET", redisKeyPrefix + "cache:" + key, string(data)}
+	if r.ttl > 0 {
+		// Expire the result when --cache-ttl would, counting from when it
+		// was geocoded
+		left := r.ttl - time.Since(result.geocodedAt)
+		if left < time.Second {
+			return
+		}
+		args = append(args, "EX", strconv.FormatInt(int64(left/time.Second), 10))
+	}
+	r.client.call(args...)
+}
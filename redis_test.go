@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replyConn is a connection whose replies are read from text
+func replyConn(text string) *redisConn {
+	return &redisConn{r: bufio.NewReader(strings.NewReader(text))}
+}
+
+func TestReadReply(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want interface{}
+		err  error
+	}{
+		{"+OK\r\n", "OK", nil},
+		{"-WRONGTYPE Operation against a key\r\n", nil, redisError("WRONGTYPE Operation against a key")},
+		{":42\r\n", int64(42), nil},
+		{":-3\r\n", int64(-3), nil},
+		{"$5\r\nhello\r\n", []byte("hello"), nil},
+		{"$0\r\n\r\n", []byte{}, nil},
+		{"$6\r\na\r\nb\nc\r\n", []byte("a\r\nb\nc"), nil}, // the length, not CRLF, ends a bulk string
+		{"$-1\r\n", nil, nil},
+		{"*-1\r\n", nil, nil},
+		{"*0\r\n", []interface{}{}, nil},
+		{"*3\r\n:1\r\n$3\r\nfoo\r\n*1\r\n+OK\r\n", []interface{}{int64(1), []byte("foo"), []interface{}{"OK"}}, nil},
+		// EXEC's reply holds the error replies of the transaction's commands
+		{"*2\r\n-ERR not an integer\r\n:2\r\n", []interface{}{redisError("ERR not an integer"), int64(2)}, nil},
+	} {
+		got, err := replyConn(tt.text).readReply()
+		if !reflect.DeepEqual(got, tt.want) || err != tt.err {
+			t.Errorf("readReply(%q) = %#v, %v, want %#v, %v", tt.text, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestReadReplyRefusesMalformedReplies(t *testing.T) {
+	for _, text := range []string{
+		"OK\r\n",
+		"+OK\n",
+		"\r\n",
+		":forty\r\n",
+		"$five\r\nhello\r\n",
+		"$5\r\nhel",
+		"*2\r\n:1\r\n",
+		"+OK",
+	} {
+		if got, err := replyConn(text).readReply(); err == nil {
+			t.Errorf("readReply(%q) = %#v, want an error", text, got)
+		}
+	}
+}
+
+func TestRoundTripPipelinesCommands(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	rc := &redisConn{conn: client, r: bufio.NewReader(client)}
+
+	// Arguments are sent as bulk strings, so they may hold CRLF
+	const want = "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$6\r\nv a\r\nl\r\n*2\r\n$4\r\nINCR\r\n$1\r\nk\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"
+	sent := make(chan string, 1)
+	go func() {
+		defer server.Close()
+		buf := make([]byte, len(want))
+		io.ReadFull(server, buf)
+		sent <- string(buf)
+		io.WriteString(server, "+OK\r\n-ERR value is not an integer\r\n$6\r\nv a\r\nl\r\n")
+	}()
+
+	replies, err := rc.roundTrip([]string{"SET", "k", "v a\r\nl"}, []string{"INCR", "k"}, []string{"GET", "k"})
+	if got := <-sent; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if err != redisError("ERR value is not an integer") {
+		t.Errorf("roundTrip error = %v, want the error reply of INCR", err)
+	}
+	// The replies after the error reply are read, so the connection stays in step
+	if wantReplies := []interface{}{"OK", nil, []byte("v a\r\nl")}; !reflect.DeepEqual(replies, wantReplies) {
+		t.Errorf("roundTrip replies = %#v, want %#v", replies, wantReplies)
+	}
+}
+
+// fakeRedis is a Redis server for tests, with the commands the client uses
+type fakeRedis struct {
+	addr string
+
+	mu       sync.Mutex
+	password string
+	data     map[string]string
+	expiry   map[string]int
+	commands [][]string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &fakeRedis{addr: l.Addr().String(), password: password, data: make(map[string]string), expiry: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	authed := s.password == ""
+	var queued [][]string
+	inMulti := false
+	for {
+		reply, err := rc.readReply()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		s.mu.Unlock()
+
+		var out string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[len(args)-1] == s.password
+			out = "+OK\r\n"
+			if !authed {
+				out = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			out = "-NOAUTH Authentication required.\r\n"
+		case cmd == "MULTI":
+			inMulti, queued = true, nil
+			out = "+OK\r\n"
+		case cmd == "EXEC":
+			out = fmt.Sprintf("*%d\r\n", len(queued))
+			for _, q := range queued {
+				out += s.run(q)
+			}
+			inMulti = false
+		case inMulti:
+			queued = append(queued, args)
+			out = "+QUEUED\r\n"
+		default:
+			out = s.run(args)
+		}
+		if _, err := io.WriteString(conn, out); err != nil {
+			return
+		}
+	}
+}
+
+// run runs a command outside a transaction and returns its reply
+func (s *fakeRedis) run(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := s.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		key := args[1]
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if _, ok := s.data[key]; ok {
+					return "$-1\r\n"
+				}
+			case "EX":
+				i++
+				s.expiry[key], _ = strconv.Atoi(args[i])
+			}
+		}
+		s.data[key] = args[2]
+		return "+OK\r\n"
+	case "INCR":
+		n, err := strconv.ParseInt(s.data[args[1]], 10, 64)
+		if _, ok := s.data[args[1]]; ok && err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		n++
+		s.data[args[1]] = strconv.FormatInt(n, 10)
+		return fmt.Sprintf(":%d\r\n", n)
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+func (s *fakeRedis) sawCommand(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, args := range s.commands {
+		if strings.EqualFold(args[0], name) {
+			return args
+		}
+	}
+	return nil
+}
+
+// expiresIn returns the EX a key was last set with, in seconds
+func (s *fakeRedis) expiresIn(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiry[key]
+}
+
+func TestRedisClientLogsInAndSelectsTheDatabase(t *testing.T) {
+	s := newFakeRedis(t, "s3cret")
+	if _, err := newRedisClient("redis://:wrong@" + s.addr); err == nil {
+		t.Error("connecting with the wrong password succeeded")
+	}
+	c, err := newRedisClient("redis://:s3cret@" + s.addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := s.sawCommand("SELECT"); !reflect.DeepEqual(args, []string{"SELECT", "2"}) {
+		t.Errorf("SELECT sent as %q", args)
+	}
+	if reply, err := c.call("PING"); reply != "PONG" || err != nil {
+		t.Errorf("PING = %#v, %v", reply, err)
+	}
+	// An error reply leaves the connection, and Redis, usable
+	if _, err := c.call("NOPE"); !errors.As(err, new(redisError)) {
+		t.Errorf("unknown command = %v, want an error reply", err)
+	}
+	if reply, err := c.call("PING"); reply != "PONG" || err != nil {
+		t.Errorf("PING after an error reply = %#v, %v", reply, err)
+	}
+}
+
+func TestRedisIncrCountsWithAnExpiry(t *testing.T) {
+	s := newFakeRedis(t, "")
+	c, err := newRedisClient("redis://" + s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := int64(1); want <= 3; want++ {
+		n, err := c.incr("latlg:budget:test", time.Hour)
+		if n != want || err != nil {
+			t.Errorf("incr = %d, %v, want %d", n, err, want)
+		}
+	}
+	if ttl := s.expiresIn("latlg:budget:test"); ttl != 3600 {
+		t.Errorf("counter expires in %ds, want 3600", ttl)
+	}
+}
+
+func TestRedisCacheStoresResults(t *testing.T) {
+	s := newFakeRedis(t, "")
+	c, err := newRedisClient("redis://" + s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := redisCache{client: c, ttl: time.Hour}
+	if _, ok := cache.get("11.5564,104.9282"); ok {
+		t.Error("get of a missing key found a result")
+	}
+	want := geocodeResult{address: "Street 1, Phnom Penh", district: "Daun Penh", province: "Phnom Penh", geocodedAt: time.Now()}
+	cache.set("11.5564,104.9282", want)
+	got, ok := cache.get("11.5564,104.9282")
+	if !ok || got.address != want.address || got.district != want.district || got.province != want.province {
+		t.Errorf("get = %+v, %v, want %+v", got, ok, want)
+	}
+	if ttl := s.expiresIn(redisKeyPrefix + "cache:11.5564,104.9282"); ttl < 3590 || ttl > 3600 {
+		t.Errorf("result expires in %ds, want about an hour", ttl)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// coordinateIssue describes a coordinate cell that could not be parsed
+type coordinateIssue struct {
+	row   int // 1-based sheet row
+	cell  string
+	raw   string
+	error string
+}
+
+// findCoordinateIssues returns every non-empty coordinate cell that fails to parse
+func (s *Service) findCoordinateIssues(rows [][]string, latLngCol int) []coordinateIssue {
+	colName, _ := excelize.ColumnNumberToName(latLngCol + 1)
+
+	var issues []coordinateIssue
+	for i := 1; i < len(rows); i++ {
+		if latLngCol >= len(rows[i]) {
+			continue
+		}
+		raw := rows[i][latLngCol]
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		if _, err := s.parseCoordinates(strings.TrimSpace(raw)); err != nil {
+			issues = append(issues, coordinateIssue{
+				row:   i + 1,
+				cell:  fmt.Sprintf("%s%d", colName, i+1),
+				raw:   raw,
+				error: err.Error(),
+			})
+		}
+	}
+	return issues
+}
+
+// coordinateReportPath returns where the coordinate report of a workbook is written
+func coordinateReportPath(excelFile string) string {
+	fileName := filepath.Base(excelFile)
+	return filepath.Join("data", strings.TrimSuffix(fileName, ".xlsx")+"_coordinate_errors.csv")
+}
+
+// writeCoordinateReport exports unparseable coordinate cells to data/<name>_coordinate_errors.csv
+func (s *Service) writeCoordinateReport(rows [][]string, latLngCol int, excelFile string) error {
+	issues := s.findCoordinateIssues(rows, latLngCol)
+	reportFile := coordinateReportPath(excelFile)
+
+	err := writeFileAtomic(reportFile, func(w io.Writer) error {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"Row", "Cell", "Raw Value", "Error"})
+		for _, issue := range issues {
+			cw.Write([]string{strconv.Itoa(issue.row), issue.cell, issue.raw, issue.error})
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+	if err != nil {
+		return fmt.Errorf("writing coordinate report: %w", err)
+	}
+
+	fmt.Printf("✓ Coordinate report: %d unparseable cells written to %s\n", len(issues), reportFile)
+	return nil
+}
+
+// duplicatesSheet is the sheet --duplicates-sheet writes
+const duplicatesSheet = "Duplicates"
+
+// duplicateCoordinate is a coordinate that appears on more than one row
+type duplicateCoordinate struct {
+	coords string // to six decimals, as rows are matched
+	rows   []int  // 1-based sheet rows
+}
+
+// findDuplicateCoordinates returns the coordinates shared by several rows,
+// most repeated first
+func (s *Service) findDuplicateCoordinates(rows [][]string, latLngCol int) []duplicateCoordinate {
+	byKey := make(map[string]*duplicateCoordinate)
+	var order []*duplicateCoordinate
+	for i := 1; i < len(rows); i++ {
+		if latLngCol >= len(rows[i]) {
+			continue
+		}
+		coords, err := s.parseCoordinates(strings.TrimSpace(rows[i][latLngCol]))
+		if err != nil {
+			continue
+		}
+		key := fmt.Sprintf("%.6f,%.6f", coords.Lat, coords.Lng)
+		d := byKey[key]
+		if d == nil {
+			d = &duplicateCoordinate{coords: key}
+			byKey[key] = d
+			order = append(order, d)
+		}
+		d.rows = append(d.rows, i+1)
+	}
+
+	var dups []duplicateCoordinate
+	for _, d := range order {
+		if len(d.rows) > 1 {
+			dups = append(dups, *d)
+		}
+	}
+	sort.SliceStable(dups, func(i, j int) bool { return len(dups[i].rows) > len(dups[j].rows) })
+	return dups
+}
+
+// writeDuplicatesSheet lists the repeated coordinates on a Duplicates sheet
+// of the output, with how many rows have each and which
+func (s *Service) writeDuplicatesSheet(rows [][]string, latLngCol int) error {
+	dups := s.findDuplicateCoordinates(rows, latLngCol)
+
+	sheet := [][]interface{}{{"Coordinates", "Count", "Rows"}}
+	repeated := 0
+	for _, d := range dups {
+		repeated += len(d.rows)
+		sheet = append(sheet, []interface{}{d.coords, len(d.rows), joinRowNumbers(d.rows, excelize.TotalCellChars)})
+	}
+	if err := s.repo.AddReportSheet(duplicatesSheet, sheet); err != nil {
+		return fmt.Errorf("writing %s sheet: %w", duplicatesSheet, err)
+	}
+
+	total := len(rows) - 1
+	share := 0.0
+	if total > 0 {
+		share = 100 * float64(repeated) / float64(total)
+	}
+	fmt.Printf("✓ %s sheet: %d coordinates repeat, on %d of %d rows (%.1f%%)\n", duplicatesSheet, len(dups), repeated, total, share)
+	return nil
+}
+
+// joinRowNumbers lists row numbers separated by commas, cut short with an
+// ellipsis when the list would not fit in limit characters
+func joinRowNumbers(rows []int, limit int) string {
+	var b strings.Builder
+	for i, row := range rows {
+		next := strconv.Itoa(row)
+		if i > 0 {
+			next = ", " + next
+		}
+		if b.Len()+len(next)+len(", …") > limit {
+			b.WriteString(", …")
+			break
+		}
+		b.WriteString(next)
+	}
+	return b.String()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// reportSheet is a sheet the run writes next to the data, such as Duplicates
+type reportSheet struct {
+	name  string
+	cells cellEdits
+}
+
+// AddReportSheet writes rows to a sheet of their own, replacing a sheet of
+// that name left by an earlier run. With the patch writer the sheet is
+// added to the package on save; the data sheet stays the first one.
+func (r *Repository) AddReportSheet(name string, rows [][]interface{}) error {
+	if name == r.sheetName {
+		return fmt.Errorf("sheet %q holds the data", name)
+	}
+	report := reportSheet{name: name, cells: make(cellEdits)}
+	for i, row := range rows {
+		for j, value := range row {
+			report.cells.set(i+1, j+1, value)
+		}
+	}
+
+	if idx, err := r.file.GetSheetIndex(name); err == nil && idx >= 0 {
+		if err := r.file.DeleteSheet(name); err != nil {
+			return err
+		}
+	}
+	if _, err := r.file.NewSheet(name); err != nil {
+		return err
+	}
+	for i := range rows {
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := r.file.SetSheetRow(name, cell, &rows[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := range r.reports {
+		if r.reports[i].name == name {
+			r.reports[i] = report
+			return nil
+		}
+	}
+	r.reports = append(r.reports, report)
+	return nil
+}
+
+// emptyWorksheet is the part report sheets are rendered into
+const emptyWorksheet = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+	`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><dimension ref="A1"/><sheetData/></worksheet>`
+
+const (
+	relsNamespace     = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	worksheetRelType  = relsNamespace + "/worksheet"
+	worksheetMimeType = "application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"
+)
+
+// zipPart is a package part that patchWorkbook adds to the copy
+type zipPart struct {
+	name string
+	data []byte
+}
+
+// addReportSheets renders the report sheets for patchWorkbook. A sheet the
+// workbook already has is rewritten in place; the others become new parts,
+// registered in the workbook, its relationships and the content types.
+// Rewritten parts are put in replaced, which may already hold patched parts.
+func addReportSheets(zr *zip.Reader, reports []reportSheet, replaced map[string][]byte) ([]zipPart, error) {
+	if len(reports) == 0 {
+		return nil, nil
+	}
+	read := func(name string) ([]byte, error) {
+		if data, ok := replaced[name]; ok {
+			return data, nil
+		}
+		f := findZipFile(zr, name)
+		if f == nil {
+			return nil, fmt.Errorf("package part %s not found", name)
+		}
+		return readZipFile(f)
+	}
+
+	workbookPart, err := findWorkbookPart(zr)
+	if err != nil {
+		return nil, err
+	}
+	dir, file := path.Split(workbookPart)
+	relsPart := path.Join(dir, "_rels", file+".rels")
+	const typesPart = "[Content_Types].xml"
+
+	workbookXML, err := read(workbookPart)
+	if err != nil {
+		return nil, err
+	}
+	relsXML, err := read(relsPart)
+	if err != nil {
+		return nil, err
+	}
+	typesXML, err := read(typesPart)
+	if err != nil {
+		return nil, err
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			Name    string `xml:"name,attr"`
+			SheetID int    `xml:"sheetId,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := xml.Unmarshal(workbookXML, &workbook); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", workbookPart, err)
+	}
+	var rels xmlRelationships
+	if err := xml.Unmarshal(relsXML, &rels); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", relsPart, err)
+	}
+	sheetNames := make(map[string]bool)
+	nextSheetID := 1
+	for _, sheet := range workbook.Sheets {
+		sheetNames[sheet.Name] = true
+		nextSheetID = max(nextSheetID, sheet.SheetID+1)
+	}
+	relIDs := make(map[string]bool)
+	for _, rel := range rels.Relationships {
+		relIDs[rel.ID] = true
+	}
+
+	var added []zipPart
+	partTaken := func(name string) bool {
+		for _, p := range added {
+			if p.name == name {
+				return true
+			}
+		}
+		return findZipFile(zr, name) != nil
+	}
+	for _, report := range reports {
+		data, _, err := patchSheetXML([]byte(emptyWorksheet), report.cells)
+		if err != nil {
+			return nil, fmt.Errorf("rendering sheet %q: %w", report.name, err)
+		}
+		if sheetNames[report.name] {
+			part, err := findSheetPart(zr, report.name)
+			if err != nil {
+				return nil, err
+			}
+			replaced[part] = data
+			continue
+		}
+
+		part := ""
+		for n := len(workbook.Sheets) + 1; part == "" || partTaken(part); n++ {
+			part = path.Join(dir, "worksheets", fmt.Sprintf("sheet%d.xml", n))
+		}
+		relID := ""
+		for n := len(rels.Relationships) + 1; relID == "" || relIDs[relID]; n++ {
+			relID = fmt.Sprintf("rId%d", n)
+		}
+		relIDs[relID] = true
+		added = append(added, zipPart{name: part, data: data})
+
+		if workbookXML, err = appendChild(workbookXML, "sheets", func(prefix string) string {
+			return fmt.Sprintf(`<%ssheet xmlns:r="%s" name="%s" sheetId="%d" r:id="%s"/>`,
+				prefix, relsNamespace, escapeXMLAttr(report.name), nextSheetID, relID)
+		}); err != nil {
+			return nil, fmt.Errorf("%s: %w", workbookPart, err)
+		}
+		nextSheetID++
+		if relsXML, err = appendChild(relsXML, "Relationships", func(prefix string) string {
+			return fmt.Sprintf(`<%sRelationship Id="%s" Type="%s" Target="/%s"/>`, prefix, relID, worksheetRelType, part)
+		}); err != nil {
+			return nil, fmt.Errorf("%s: %w", relsPart, err)
+		}
+		if typesXML, err = appendChild(typesXML, "Types", func(prefix string) string {
+			return fmt.Sprintf(`<%sOverride PartName="/%s" ContentType="%s"/>`, prefix, part, worksheetMimeType)
+		}); err != nil {
+			return nil, fmt.Errorf("%s: %w", typesPart, err)
+		}
+	}
+	if len(added) > 0 {
+		replaced[workbookPart] = workbookXML
+		replaced[relsPart] = relsXML
+		replaced[typesPart] = typesXML
+	}
+	return added, nil
+}
+
+// appendChild inserts the element rendered by child before the closing tag
+// of parent, in the namespace prefix the document uses for parent
+func appendChild(data []byte, parent string, child func(prefix string) string) ([]byte, error) {
+	pattern := regexp.MustCompile(`</([A-Za-z_][\w.-]*:)?` + parent + `\s*>`)
+	loc := pattern.FindSubmatchIndex(data)
+	if loc == nil {
+		return nil, fmt.Errorf("%s element not found", parent)
+	}
+	prefix := ""
+	if loc[2] >= 0 {
+		prefix = string(data[loc[2]:loc[3]])
+	}
+	var out bytes.Buffer
+	out.Write(data[:loc[0]])
+	out.WriteString(child(prefix))
+	out.Write(data[loc[0]:])
+	return out.Bytes(), nil
+}
+
+func escapeXMLAttr(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
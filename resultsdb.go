@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// resultsDBBatch is how many rows are inserted per transaction
+const resultsDBBatch = 500
+
+// resultsDBSchema creates the tables of a --results-db archive: a run per
+// processed file, and a result per processed row
+const resultsDBSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id          INTEGER PRIMARY KEY,
+	started_at  TEXT NOT NULL,
+	finished_at TEXT,
+	input_file  TEXT NOT NULL,
+	sheet       TEXT,
+	output_file TEXT,
+	provider    TEXT,
+	rows        INTEGER NOT NULL DEFAULT 0,
+	failed      INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS results (
+	id           INTEGER PRIMARY KEY,
+	run_id       INTEGER NOT NULL REFERENCES runs(id),
+	row          INTEGER NOT NULL,
+	input        TEXT,
+	lat          REAL,
+	lng          REAL,
+	address      TEXT,
+	district     TEXT,
+	province     TEXT,
+	country      TEXT,
+	postcode     TEXT,
+	quality      INTEGER,
+	provider     TEXT,
+	cached       INTEGER NOT NULL DEFAULT 0,
+	geocoded_at  TEXT,
+	error        TEXT,
+	processed_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_coordinates ON results(lat, lng);
+CREATE INDEX IF NOT EXISTS results_run ON results(run_id);
+`
+
+// resultsDB archives every processed row of a run in a SQLite database for
+// --results-db. Runs add to the same database, so it holds everything ever
+// geocoded. Rows are inserted in transactions of resultsDBBatch as they
+// complete; the run's row is finished once the workbook was saved.
+type resultsDB struct {
+	path   string
+	db     *sql.DB
+	tx     *sql.Tx
+	insert *sql.Stmt
+	runID  int64
+	rows   int // rows inserted
+	failed int // rows inserted with an error
+	err    error
+}
+
+// openResultsDB opens or creates the database at path and starts a run
+func openResultsDB(path, inputFile, sheet, provider string) (*resultsDB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// WAL and a busy timeout let --serve jobs write to the same file at once
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(resultsDBSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	res, err := db.Exec(`INSERT INTO runs (started_at, input_file, sheet, provider) VALUES (?, ?, ?, ?)`,
+		time.Now().UTC().Format(time.RFC3339), inputFile, sheet, provider)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	r := &resultsDB{path: path, db: db}
+	if r.runID, err = res.LastInsertId(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// add inserts a processed row with its coordinates, result and error; a
+// no-op on nil. Coordinates are left empty for rows whose input did not
+// parse.
+func (r *resultsDB) add(rowNum int, result rowResult) {
+	if r == nil || r.err != nil {
+		return
+	}
+	if r.tx == nil {
+		if r.tx, r.err = r.db.Begin(); r.err != nil {
+			return
+		}
+		r.insert, r.err = r.tx.Prepare(`INSERT INTO results (run_id, row, input, lat, lng, address, district, province,
+			country, postcode, quality, provider, cached, geocoded_at, error, processed_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		if r.err != nil {
+			return
+		}
+	}
+
+	var lat, lng, quality, geocodedAt, errText interface{}
+	if !result.skipped || result.geocodeErr != nil {
+		lat, lng = result.coords.Lat, result.coords.Lng
+	}
+	if result.quality != nil {
+		quality = *result.quality
+	}
+	if !result.geocodedAt.IsZero() {
+		geocodedAt = result.geocodedAt.UTC().Format(time.RFC3339)
+	}
+	if result.skipped {
+		errText = result.message
+		r.failed++
+	}
+	_, r.err = r.insert.Exec(r.runID, rowNum, result.input, lat, lng, result.address, result.district, result.province,
+		result.country, result.postcode, quality, result.provider, result.cached, geocodedAt, errText,
+		time.Now().UTC().Format(time.RFC3339))
+	if r.err != nil {
+		return
+	}
+	if r.rows++; r.rows%resultsDBBatch == 0 {
+		r.commit()
+	}
+}
+
+// commit ends the open transaction, if any
+func (r *resultsDB) commit() {
+	if r.tx == nil {
+		return
+	}
+	r.insert.Close()
+	if err := r.tx.Commit(); err != nil && r.err == nil {
+		r.err = err
+	}
+	r.tx, r.insert = nil, nil
+}
+
+// finish commits the remaining rows, records the run's output and counts,
+// and closes the database
+func (r *resultsDB) finish(outputFile string) error {
+	r.commit()
+	if r.err == nil {
+		_, r.err = r.db.Exec(`UPDATE runs SET finished_at = ?, output_file = ?, rows = ?, failed = ? WHERE id = ?`,
+			time.Now().UTC().Format(time.RFC3339), outputFile, r.rows, r.failed, r.runID)
+	}
+	if err := r.db.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// openResultsDB starts the --results-db run of a file
+func (s *Service) openResultsDB(inputFile string) error {
+	if s.cfg.ResultsDB == "" {
+		return nil
+	}
+	db, err := openResultsDB(s.cfg.ResultsDB, inputFile, s.repo.GetSheetName(), s.cfg.providerName())
+	if err != nil {
+		return fmt.Errorf("--results-db %s: %w", s.cfg.ResultsDB, err)
+	}
+	s.resultsDB = db
+	return nil
+}
+
+// finishResultsDB finishes the --results-db run, noting where the workbook
+// was saved, or "" when it wasn't
+func (s *Service) finishResultsDB(outputFile string) {
+	if s.resultsDB == nil {
+		return
+	}
+	db := s.resultsDB
+	s.resultsDB = nil
+	if err := db.finish(outputFile); err != nil {
+		fmt.Printf("Warning: Could not write results to %s: %v\n", db.path, err)
+		return
+	}
+	fmt.Printf("✓ %d rows archived in %s (run %d)\n", db.rows, db.path, db.runID)
+}
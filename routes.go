@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultRoute keys the provider for coordinates outside the routed countries
+const defaultRoute = "default"
+
+// builtinCountryBoxes are rough bounding boxes of the countries of the region
+//
+//go:embed countries/boxes.tsv
+var builtinCountryBoxes []byte
+
+// countryBox is a bounding box of a country, or of a part of it
+type countryBox struct {
+	country                  string // lowercase, as Nominatim returns country codes
+	south, west, north, east float64
+}
+
+func (b countryBox) contains(lat, lng float64) bool {
+	return lat >= b.south && lat <= b.north && lng >= b.west && lng <= b.east
+}
+
+var countryBoxes = func() []countryBox {
+	boxes, err := parseCountryBoxes(builtinCountryBoxes)
+	if err != nil {
+		panic(fmt.Sprintf("countries/boxes.tsv: %v", err))
+	}
+	return boxes
+}()
+
+// borderTowns settle which country a point in overlapping boxes is in
+var borderTowns = func() []namedPlace {
+	towns, err := parsePlaces(bytes.NewReader(builtinPlaces))
+	if err != nil {
+		panic(fmt.Sprintf("places/towns.tsv: %v", err))
+	}
+	for i := range towns {
+		towns[i].country = strings.ToLower(towns[i].country)
+	}
+	return towns
+}()
+
+// parseCountryBoxes reads "country, south, west, north, east" lines
+func parseCountryBoxes(data []byte) ([]countryBox, error) {
+	var boxes []countryBox
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("line %d: expected 5 columns, got %d", line, len(fields))
+		}
+		var edges [4]float64
+		for i := range edges {
+			v, err := strconv.ParseFloat(strings.TrimSpace(fields[i+1]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid coordinate %q", line, fields[i+1])
+			}
+			edges[i] = v
+		}
+		boxes = append(boxes, countryBox{
+			country: strings.ToLower(strings.TrimSpace(fields[0])),
+			south:   edges[0], west: edges[1], north: edges[2], east: edges[3],
+		})
+	}
+	return boxes, scanner.Err()
+}
+
+// countryAt guesses the country of a point from the built-in boxes without
+// a request, or returns "" outside all of them. Boxes overlap near borders;
+// a point in the boxes of several countries goes to the country of the
+// nearest town among them.
+func countryAt(lat, lng float64) string {
+	candidates := make(map[string]bool)
+	country := ""
+	for _, b := range countryBoxes {
+		if b.contains(lat, lng) {
+			candidates[b.country] = true
+			country = b.country
+		}
+	}
+	if len(candidates) < 2 {
+		return country
+	}
+	var towns []namedPlace
+	for _, t := range borderTowns {
+		if candidates[t.country] {
+			towns = append(towns, t)
+		}
+	}
+	if town, _, ok := nearestPlace(lat, lng, towns); ok {
+		return town.country
+	}
+	return country
+}
+
+// boxedCountries returns the upper-case codes of the countries with boxes
+func boxedCountries() []string {
+	seen := make(map[string]bool)
+	var codes []string
+	for _, b := range countryBoxes {
+		if !seen[b.country] {
+			seen[b.country] = true
+			codes = append(codes, strings.ToUpper(b.country))
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// loadRoutes reads the --routes file, which maps country codes and
+// "default" to provider options such as {preset: ..., api-key: ...}, and
+// returns the config of each route: the command line with the route's
+// options winning
+func loadRoutes(cfg *Config) (map[string]*Config, error) {
+	if cfg.Routes == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.Routes)
+	if err != nil {
+		return nil, fmt.Errorf("--routes: %w", err)
+	}
+	var raw map[string]map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("--routes %s: %w", cfg.Routes, err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("--routes %s: no routes", cfg.Routes)
+	}
+
+	boxed := make(map[string]bool)
+	for _, b := range countryBoxes {
+		boxed[b.country] = true
+	}
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	routes := make(map[string]*Config, len(raw))
+	budgets := make(map[string]*requestBudget) // routes to one provider share its budget
+	for _, key := range keys {
+		country := strings.ToLower(key)
+		if country != defaultRoute && !boxed[country] {
+			return nil, fmt.Errorf("--routes %s: %q is not one of the countries that can be routed (%s) or %q",
+				cfg.Routes, key, strings.Join(boxedCountries(), ", "), defaultRoute)
+		}
+		if _, dup := routes[country]; dup {
+			return nil, fmt.Errorf("--routes %s: %s is listed twice", cfg.Routes, strings.ToUpper(country))
+		}
+		// The empty --routes keeps a route from loading the routes again
+		args := append(append(append([]string{}, cfg.args...), optionArgs(raw[key])...), "--routes=")
+		rcfg, err := parseConfig(args)
+		if err != nil {
+			return nil, fmt.Errorf("--routes %s: %s: %w", cfg.Routes, key, err)
+		}
+		if rcfg.budget != nil {
+			if b, ok := budgets[rcfg.providerName()]; ok {
+				rcfg.budget = b
+			} else {
+				budgets[rcfg.providerName()] = rcfg.budget
+			}
+		}
+		routes[country] = rcfg
+	}
+	return routes, nil
+}
+
+// newRoutes builds a service per --routes provider. Routes answer into the
+// run's cache and count their requests against the run.
+func (s *Service) newRoutes() map[string]*Service {
+	if len(s.cfg.routes) == 0 {
+		return nil
+	}
+	routes := make(map[string]*Service, len(s.cfg.routes))
+	for country, rcfg := range s.cfg.routes {
+		route := NewService(nil, rcfg)
+		route.owner = s
+		routes[country] = route
+	}
+	return routes
+}
+
+// routeList returns the route services ordered by country code
+func (s *Service) routeList() []*Service {
+	countries := make([]string, 0, len(s.routes))
+	for country := range s.routes {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	list := make([]*Service, len(countries))
+	for i, country := range countries {
+		list[i] = s.routes[country]
+	}
+	return list
+}
+
+// route returns the service whose provider looks up a coordinate: the
+// route for its country, the default route, or the run's own provider
+func (s *Service) route(coords Coordinates) *Service {
+	if len(s.routes) == 0 {
+		return s
+	}
+	if route, ok := s.routes[countryAt(coords.Lat, coords.Lng)]; ok {
+		return route
+	}
+	if route, ok := s.routes[defaultRoute]; ok {
+		return route
+	}
+	return s
+}
+
+// requestDelay is how long each of the run's workers waits before a request
+// to this provider. A route shares the run's workers, so a route to a
+// provider allowing fewer workers waits longer to keep to its request rate.
+func (s *Service) requestDelay(workers int) time.Duration {
+	if workers <= s.cfg.Workers {
+		return s.cfg.RequestDelay
+	}
+	return s.cfg.RequestDelay * time.Duration(workers) / time.Duration(s.cfg.Workers)
+}
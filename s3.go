@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Store talks to Amazon S3, or to an S3-compatible service such as MinIO
+// when AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL is set. Requests are signed
+// with AWS Signature Version 4.
+type s3Store struct {
+	client       *http.Client
+	endpoint     *url.URL // custom endpoint, addressed path-style; nil for AWS
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newS3Store reads the credentials the AWS CLI uses: the AWS_* environment
+// variables, then the AWS_PROFILE (or default) profile of ~/.aws/credentials
+func newS3Store(client *http.Client) (*s3Store, error) {
+	s := &s3Store{
+		client:       client,
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.accessKey == "" {
+		if err := s.loadSharedCredentials(); err != nil {
+			return nil, err
+		}
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("no AWS credentials found; set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or configure ~/.aws/credentials")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint != "" {
+		u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		s.endpoint = u
+	}
+	return s, nil
+}
+
+// loadSharedCredentials reads the keys of the current profile from the
+// shared credentials file, if there is one
+func (s *s3Store) loadSharedCredentials() error {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			s.accessKey = value
+		case "aws_secret_access_key":
+			s.secretKey = value
+		case "aws_session_token":
+			s.sessionToken = value
+		}
+	}
+	return scanner.Err()
+}
+
+// objectURL returns the URL of an object with the given query, which must
+// already be in canonical form
+func (s *s3Store) objectURL(bucket, key, query string) string {
+	path := "/" + awsEscape(key, false)
+	var base string
+	if s.endpoint != nil {
+		base = s.endpoint.String() + "/" + bucket
+	} else {
+		base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, s.region)
+	}
+	if query != "" {
+		return base + path + "?" + query
+	}
+	return base + path
+}
+
+// request builds a signed request; payloadHash is the hex SHA-256 of body
+func (s *s3Store) request(method, rawURL string, body []byte, payloadHash string) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, r)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds the Signature Version 4 Authorization header
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	s.signFor("s3", req, payloadHash, now)
+}
+
+// signFor signs a request to an AWS service with the same credentials, such
+// as Secrets Manager
+func (s *s3Store) signFor(service string, req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func (s *s3Store) get(bucket, key string, w io.Writer) error {
+	resp, err := sendObjectRequest(s.client, func() (*http.Request, error) {
+		return s.request("GET", s.objectURL(bucket, key, ""), nil, emptyPayloadHash)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectResponseError(resp.Request, resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (s *s3Store) put(bucket, key string, f *os.File, size int64) error {
+	if size <= objectChunkSize {
+		body, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		_, err = s.send("PUT", s.objectURL(bucket, key, ""), body)
+		return err
+	}
+	return s.putMultipart(bucket, key, f, size)
+}
+
+// putMultipart uploads a large file in objectChunkSize parts. A failed
+// upload is aborted, so its parts are not stored (and billed) forever.
+func (s *s3Store) putMultipart(bucket, key string, f *os.File, size int64) error {
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	body, err := s.send("POST", s.objectURL(bucket, key, "uploads="), nil)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(body, &created); err != nil || created.UploadID == "" {
+		return fmt.Errorf("starting multipart upload: unexpected response %q", body)
+	}
+	uploadQuery := "uploadId=" + awsEscape(created.UploadID, true)
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	err = func() error {
+		buf := make([]byte, objectChunkSize)
+		for offset, number := int64(0), 1; offset < size; offset, number = offset+objectChunkSize, number+1 {
+			n, err := f.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			query := fmt.Sprintf("partNumber=%d&%s", number, uploadQuery)
+			resp, err := s.sendResponse("PUT", s.objectURL(bucket, key, query), buf[:n])
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			parts = append(parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+			fmt.Printf("  uploaded %s of %s\n", formatBytes(offset+int64(n)), formatBytes(size))
+		}
+		complete, err := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []part   `xml:"Part"`
+		}{Parts: parts})
+		if err != nil {
+			return err
+		}
+		body, err := s.send("POST", s.objectURL(bucket, key, uploadQuery), complete)
+		if err != nil {
+			return err
+		}
+		// CompleteMultipartUpload can fail after answering 200
+		if bytes.Contains(body, []byte("<Error>")) {
+			return fmt.Errorf("completing multipart upload: %s", body)
+		}
+		return nil
+	}()
+	if err != nil {
+		if _, abortErr := s.send("DELETE", s.objectURL(bucket, key, uploadQuery), nil); abortErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not abort multipart upload %s: %v\n", created.UploadID, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// send makes a request and returns the body of a successful response
+func (s *s3Store) send(method, rawURL string, body []byte) ([]byte, error) {
+	resp, err := s.sendResponse(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// sendResponse makes a request and returns a successful response
+func (s *s3Store) sendResponse(method, rawURL string, body []byte) (*http.Response, error) {
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		payloadHash = sha256Hex(body)
+	}
+	resp, err := sendObjectRequest(s.client, func() (*http.Request, error) {
+		return s.request(method, rawURL, body, payloadHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, objectResponseError(resp.Request, resp)
+	}
+	return resp, nil
+}
+
+// awsEscape percent-encodes s the way Signature Version 4 expects: every
+// byte except unreserved characters, and '/' too when encodeSlash is set
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultScheduleCache is the --cache-file of a --schedule daemon when none is
+// given, so every run reuses the results of the previous ones
+const defaultScheduleCache = "data/schedule_cache.jsonl.zst"
+
+// cronSchedule is a parsed five-field cron expression. Each field is a bit
+// set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, when both day fields are restricted a day matching either one runs
+	domStar, dowStar bool
+}
+
+// cronMacros are the @ shorthands cron understands
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseCron parses "minute hour day-of-month month day-of-week" with the
+// usual *, lists, ranges, steps and month and weekday names, or an @daily
+// style macro
+func parseCron(expr string) (*cronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields (minute hour day month weekday)", expr)
+	}
+	// As in cron, a day field starting with * ("*" or "*/2") counts as
+	// unrestricted, so the other day field alone picks the days
+	s := &cronSchedule{domStar: strings.HasPrefix(fields[2], "*"), dowStar: strings.HasPrefix(fields[4], "*")}
+	var err error
+	parts := []struct {
+		bits     *uint64
+		min, max int
+		names    []string
+		what     string
+	}{
+		{&s.minute, 0, 59, nil, "minute"},
+		{&s.hour, 0, 23, nil, "hour"},
+		{&s.dom, 1, 31, nil, "day of month"},
+		{&s.month, 1, 12, cronMonths, "month"},
+		{&s.dow, 0, 7, cronDays, "weekday"},
+	}
+	for i, p := range parts {
+		if *p.bits, err = parseCronField(fields[i], p.min, p.max, p.names); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s: %w", expr, p.what, err)
+		}
+	}
+	// Sunday is both 0 and 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseCronField parses one field into a bit set of the values it matches
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				// Months are numbered from 1, weekdays from 0
+				return i + min, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			from, to, _ := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			if hi, err = value(to); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		default:
+			n, err := value(rangePart)
+			if err != nil {
+				return 0, err
+			}
+			lo = n
+			if !hasStep {
+				hi = n
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matchesDay reports whether the schedule runs on the day of t
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first minute after t the schedule runs at, or the zero
+// time if there is none within five years (e.g. "0 0 30 2 *")
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// isPipelineFile reports whether a --schedule source is a pipeline to run
+func isPipelineFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// runSchedule is the --schedule daemon: it processes every source each time
+// the cron expression fires, until interrupted. Sources are workbooks, CSV
+// and track files, s3:// gs:// az:// URLs or pipeline files; all runs share
+// the --cache-file, so unchanged coordinates are not looked up again.
+func runSchedule(cfg *Config) error {
+	if err := os.MkdirAll("data", 0755); err != nil {
+		return fmt.Errorf("creating data directory: %w", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("Scheduled %q for %d source(s), cache %s (Ctrl+C to stop)\n", cfg.Schedule, len(cfg.sources), cfg.CacheFile)
+	for {
+		next := cfg.schedule.next(time.Now())
+		if next.IsZero() {
+			return fmt.Errorf("schedule %q never runs", cfg.Schedule)
+		}
+		fmt.Printf("Next run at %s\n", next.Format(time.DateTime))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			fmt.Println("Stopped scheduler")
+			return nil
+		case <-timer.C:
+		}
+		runScheduledSources(cfg)
+		if ctx.Err() != nil {
+			fmt.Println("Stopped scheduler")
+			return nil
+		}
+	}
+}
+
+// runScheduledSources processes each source once; a failing source is
+// reported and the others still run
+func runScheduledSources(cfg *Config) {
+	start := time.Now()
+	failed := 0
+	for _, source := range cfg.sources {
+		fmt.Printf("\n=== %s: processing %s ===\n", time.Now().Format(time.DateTime), source)
+		run := *cfg
+		var err error
+		if isPipelineFile(source) {
+			run.InputFile = source
+			err = runPipeline(&run)
+		} else {
+			err = processFile(&run, source)
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("Error processing %s: %v\n", source, err)
+		}
+	}
+	fmt.Printf("\n✓ Scheduled run finished in %s: %d source(s), %d failed\n",
+		time.Since(start).Round(time.Second), len(cfg.sources), failed)
+}
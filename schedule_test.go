@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// Wednesday 15 May 2024, 10:30
+	from := time.Date(2024, time.May, 15, 10, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		expr string
+		want string
+	}{
+		{"* * * * *", "2024-05-15 10:31"},
+		{"@hourly", "2024-05-15 11:00"},
+		{"@daily", "2024-05-16 00:00"},
+		{"30 10 * * *", "2024-05-16 10:30"},
+		{"*/15 * * * *", "2024-05-15 10:45"},
+		{"0 9-17/4 * * *", "2024-05-15 13:00"},
+		{"0 0 1 * *", "2024-06-01 00:00"},
+		{"0 0 * * sun", "2024-05-19 00:00"},
+		{"0 0 * * 7", "2024-05-19 00:00"},
+		{"0 0 * jan-mar mon", "2025-01-06 00:00"},
+		{"0 0 29 2 *", "2028-02-29 00:00"},
+		// Both day fields restricted: either one runs
+		{"0 0 20 * fri", "2024-05-17 00:00"},
+		{"0 0 16 * sun", "2024-05-16 00:00"},
+		// A day field starting with * leaves the days to the other one
+		{"0 0 */2 * mon", "2024-05-27 00:00"},
+		{"0 0 */10 * *", "2024-05-21 00:00"},
+		{"0 0 1 * */3", "2024-06-01 00:00"},
+		{"0 0 30 2 *", ""},
+	} {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		got := s.next(from)
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q: next = %s, want none", tt.expr, got.Format("2006-01-02 15:04"))
+			}
+			continue
+		}
+		if got.Format("2006-01-02 15:04") != tt.want {
+			t.Errorf("%q: next = %s, want %s", tt.expr, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+}
+
+func TestParseCronRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// secretTimeout bounds a request to Vault or Secrets Manager
+const secretTimeout = 15 * time.Second
+
+// resolveSecrets reads the API keys referred to by --api-key, so no key has
+// to be written in a command line, routes file or pipeline:
+//
+//	env:NAME                     the environment variable NAME
+//	file:/run/secrets/key        a file, such as a Docker or Kubernetes secret
+//	vault:secret/data/geo#key    a field of a HashiCorp Vault secret
+//	aws-sm:geo/locationiq#key    an AWS Secrets Manager secret, or a field of it
+//
+// Anything else is a key itself. Each of comma-separated pooled keys may be
+// a reference, and a reference may hold a comma-separated list.
+func resolveSecrets(value string) (string, error) {
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		secret, err := resolveSecret(strings.TrimSpace(part))
+		if err != nil {
+			return "", fmt.Errorf("reading --api-key %s: %w", part, err)
+		}
+		parts[i] = secret
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func resolveSecret(ref string) (string, error) {
+	kind, name, _ := strings.Cut(ref, ":")
+	var secret string
+	var err error
+	switch kind {
+	case "env":
+		var ok bool
+		if secret, ok = os.LookupEnv(name); !ok {
+			err = fmt.Errorf("%s is not set", name)
+		}
+	case "file":
+		var data []byte
+		data, err = os.ReadFile(name)
+		secret = string(data)
+	case "vault":
+		secret, err = vaultSecret(name)
+	case "aws-sm":
+		secret, err = awsSecret(name)
+	default:
+		return ref, nil
+	}
+	secret = strings.TrimSpace(secret)
+	if err == nil && secret == "" {
+		err = fmt.Errorf("the secret is empty")
+	}
+	return secret, err
+}
+
+// vaultSecret reads a field of a Vault secret, path#field, from the KV
+// engine at VAULT_ADDR with VAULT_TOKEN or the token of `vault login`.
+// Paths of a KV version 2 engine include data/, as in the Vault API.
+func vaultSecret(ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return "", fmt.Errorf("name the field of the secret, e.g. vault:%s#api_key", ref)
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			data, _ := os.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(data))
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("no Vault token; set VAULT_TOKEN or run vault login")
+	}
+
+	client := &http.Client{Timeout: secretTimeout}
+	if caFile := os.Getenv("VAULT_CACERT"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return "", err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("VAULT_CACERT %s has no certificates", caFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.Transport = transport
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	body, err := readSecretResponse(client, req)
+	if err != nil {
+		return "", err
+	}
+
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("reading Vault answer: %w", err)
+	}
+	fields := secret.Data
+	if nested, ok := fields["data"]; ok {
+		// KV version 2 keeps the fields under data.data, next to metadata
+		var v2 map[string]json.RawMessage
+		if err := json.Unmarshal(nested, &v2); err == nil {
+			fields = v2
+		}
+	}
+	return secretField(fields, field)
+}
+
+// awsSecret reads a Secrets Manager secret, name or name#field for a field
+// of a JSON secret, with the AWS credentials and region of the S3 client.
+// AWS_ENDPOINT_URL_SECRETS_MANAGER points it at another endpoint.
+func awsSecret(ref string) (string, error) {
+	id, field, _ := strings.Cut(ref, "#")
+	aws, err := newS3Store(&http.Client{Timeout: secretTimeout})
+	if err != nil {
+		return "", err
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", aws.region)
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	aws.signFor("secretsmanager", req, sha256Hex(payload), time.Now().UTC())
+	body, err := readSecretResponse(aws.client, req)
+	if err != nil {
+		return "", err
+	}
+
+	var secret struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("reading Secrets Manager answer: %w", err)
+	}
+	if secret.SecretString == nil {
+		return "", fmt.Errorf("secret %s is binary; store the key as a string", id)
+	}
+	if field == "" {
+		return *secret.SecretString, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*secret.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not JSON, so it has no field %s", id, field)
+	}
+	return secretField(fields, field)
+}
+
+// secretField returns a string field of a secret
+func secretField(fields map[string]json.RawMessage, field string) (string, error) {
+	raw, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("the secret has no field %s", field)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("field %s is not a string", field)
+	}
+	return value, nil
+}
+
+// readSecretResponse sends a request and returns the body of a successful
+// answer. Errors carry the service's message, never a secret.
+func readSecretResponse(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s returned status %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
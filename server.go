@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxUploadSize limits the files accepted by POST /jobs
+const maxUploadSize = 1 << 30
+
+// progressInterval is how often a job's event stream checks for progress
+const progressInterval = 500 * time.Millisecond
+
+// sseKeepAlive is how long an event stream may stay silent
+const sseKeepAlive = 15 * time.Second
+
+// jobInputFormats are the file types a job can process
+var jobInputFormats = map[string]bool{".xlsx": true, ".xlsm": true, ".csv": true, ".gpx": true, ".kml": true, ".kmz": true}
+
+// previewRows is how many data rows POST /preview returns
+const previewRows = 5
+
+//go:embed templates/webui.html
+var webUIPage []byte
+
+// filePreview is the answer of POST /preview
+type filePreview struct {
+	Name        string     `json:"name"`
+	Header      []string   `json:"header"`
+	Rows        [][]string `json:"rows"`
+	Total       int        `json:"total_rows"`
+	Coordinates string     `json:"coordinates,omitempty"` // the column that would be geocoded
+	Problem     string     `json:"problem,omitempty"`     // why no coordinate column was found
+}
+
+// server is the HTTP API of serve mode
+type server struct {
+	cfg       *Config
+	jobs      *jobManager
+	readiness readiness
+}
+
+// runServer is serve mode: an HTTP API to which files are submitted as jobs,
+// processed with the server's options --max-jobs at a time. On Ctrl+C it
+// stops accepting jobs and waits for the submitted ones to finish.
+func runServer(cfg *Config) error {
+	if err := os.MkdirAll(cfg.JobsDir, 0755); err != nil {
+		return fmt.Errorf("creating jobs directory: %w", err)
+	}
+	s := &server{cfg: cfg, jobs: newJobManager(cfg)}
+	srv := &http.Server{
+		Addr:              cfg.Serve,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	fmt.Printf("Listening on %s (%d jobs at a time, files in %s)\n", cfg.Serve, cfg.MaxJobs, cfg.JobsDir)
+	if cfg.apiClients != nil {
+		fmt.Printf("Requests need one of the %d keys in %s\n", len(cfg.apiClients), cfg.APIKeys)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	// A second Ctrl+C exits without waiting
+	stop()
+	fmt.Println("Shutting down; waiting for submitted jobs to finish (Ctrl+C again to quit)")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	s.jobs.close()
+	flushTraces()
+	return nil
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleUI)
+	mux.HandleFunc("/preview", s.authorize(s.handlePreview))
+	mux.HandleFunc("/jobs", s.authorize(s.handleJobs))
+	mux.HandleFunc("/jobs/", s.authorize(s.handleJob))
+	mux.HandleFunc("/usage", s.authorize(s.handleUsage))
+	// Probes come from Kubernetes, which has no API key
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	return traceRequests(mux)
+}
+
+// authorize checks the API key and rate limit of a request when the server
+// was started with --api-keys, and passes the client on in its context
+func (s *server) authorize(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.apiClients == nil {
+			h(w, r)
+			return
+		}
+		client := s.cfg.apiClients.lookup(requestKey(r))
+		if client == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="latlg-address"`)
+			writeError(w, http.StatusUnauthorized, "a valid API key is required")
+			return
+		}
+		if wait := client.allow(time.Now()); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, fmt.Sprintf("rate limit of %d requests per minute exceeded", client.RequestsPerMinute))
+			return
+		}
+		h(w, r.WithContext(withClient(r.Context(), client)))
+	}
+}
+
+// handleUsage reports the caller's limits and what it has used of them
+func (s *server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	client := clientFrom(r.Context())
+	if client == nil {
+		writeError(w, http.StatusNotFound, "the server has no API keys")
+		return
+	}
+	writeJSON(w, http.StatusOK, client.usage())
+}
+
+// handleJobs lists jobs (GET) or submits one (POST)
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.jobs.list(clientFrom(r.Context())))
+	case http.MethodPost:
+		s.submitJob(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// submitJob accepts a multipart upload in the "file" field, or an s3://,
+// gs:// or az:// URL in the "url" field
+func (s *server) submitJob(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer func() {
+		if r.MultipartForm != nil {
+			r.MultipartForm.RemoveAll()
+		}
+	}()
+
+	source := r.FormValue("url")
+	file, header, err := r.FormFile("file")
+	switch {
+	case err == nil:
+		defer file.Close()
+	case source == "":
+		writeError(w, http.StatusBadRequest, `send the input as a "file" upload or an s3://, gs:// or az:// "url"`)
+		return
+	}
+
+	name := source
+	if file != nil {
+		name = uploadName(header)
+	} else if !isRemotePath(source) {
+		writeError(w, http.StatusBadRequest, "url must be an s3://, gs:// or az:// path")
+		return
+	} else if _, err := parseObjectURL(source); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name = path.Base(name)
+	if !jobInputFormats[strings.ToLower(path.Ext(name))] {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s: unsupported file type (use .xlsx, .csv, .gpx, .kml or .kmz)", name))
+		return
+	}
+
+	client := clientFrom(r.Context())
+	if err := client.startJob(); err != nil {
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	id, dir, err := s.jobs.newJobDir()
+	if err != nil {
+		client.endJob()
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	input := source
+	if file != nil {
+		input = filepath.Join(dir, name)
+		err := writeFileAtomic(input, func(w io.Writer) error {
+			_, err := io.Copy(w, file)
+			return err
+		})
+		if err != nil {
+			os.RemoveAll(dir)
+			client.endJob()
+			writeError(w, http.StatusInternalServerError, "saving upload: "+err.Error())
+			return
+		}
+	}
+
+	j, err := s.jobs.submit(client, id, dir, name, input, strings.TrimSpace(r.FormValue("coordinate_column")), spanFrom(r.Context()))
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	st, _, _ := s.jobs.get(client, j.ID)
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, st)
+}
+
+// uploadName returns the base name of an uploaded file, so it can't escape
+// the directory it is saved in
+func uploadName(header *multipart.FileHeader) string {
+	return path.Base(strings.ReplaceAll(header.Filename, `\`, "/"))
+}
+
+// handlePreview reads the first rows of an uploaded file without starting
+// a job, and reports the coordinate column that would be used
+func (s *server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, `send the file as a "file" upload`)
+		return
+	}
+	defer file.Close()
+	defer r.MultipartForm.RemoveAll()
+	name := uploadName(header)
+	ext := strings.ToLower(path.Ext(name))
+	if !jobInputFormats[ext] {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s: unsupported file type (use .xlsx, .csv, .gpx, .kml or .kmz)", name))
+		return
+	}
+
+	// The readers need a file with the right extension
+	tmp, err := os.CreateTemp("", "latlg-preview-*"+ext)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, file)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "saving upload: "+err.Error())
+		return
+	}
+
+	var rows [][]string
+	if ext == ".csv" {
+		rows, err = readTable(tmp.Name(), "")
+	} else {
+		var repo *Repository
+		if repo, err = NewRepository(tmp.Name()); err == nil {
+			rows = repo.GetRows()
+			repo.Close()
+		}
+	}
+	if err == nil && len(rows) == 0 {
+		err = fmt.Errorf("the file is empty")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", name, err))
+		return
+	}
+
+	p := filePreview{Name: name, Header: rows[0], Total: len(rows) - 1}
+	p.Rows = rows[1:]
+	if len(p.Rows) > previewRows {
+		p.Rows = p.Rows[:previewRows]
+	}
+	cfg := *s.cfg
+	cfg.CoordinateColumn = strings.TrimSpace(r.FormValue("coordinate_column"))
+	if col, err := NewService(nil, &cfg).coordinateColumn(rows); err != nil {
+		p.Problem = err.Error()
+	} else {
+		p.Coordinates = rows[0][col]
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// handleUI serves the upload page
+func (s *server) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(webUIPage)
+}
+
+// handleJob serves /jobs/{id}, /jobs/{id}/events, /jobs/{id}/result and
+// /jobs/{id}/pause and /resume
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	if rest == "pause" || rest == "resume" {
+		s.pauseJob(w, r, id, rest == "pause")
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	st, output, ok := s.jobs.get(clientFrom(r.Context()), id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	switch rest {
+	case "":
+		writeJSON(w, http.StatusOK, st)
+	case "events":
+		s.streamJob(w, r, id)
+	case "result":
+		if st.Result == "" {
+			writeError(w, http.StatusConflict, fmt.Sprintf("job is %s and has no result yet", st.Status))
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(output)))
+		http.ServeFile(w, r, output)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// pauseJob pauses or resumes a running job. A paused job finishes the
+// lookups in flight and sends no more until it is resumed. Resuming a job
+// stopped by its client's rows_per_day quota queues it again.
+func (s *server) pauseJob(w http.ResponseWriter, r *http.Request, id string, pause bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	st, ok, err := s.jobs.setPaused(clientFrom(r.Context()), id, pause)
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, "no such job")
+	case errors.Is(err, errNotRunning):
+		writeError(w, http.StatusConflict, fmt.Sprintf("job is %s; %v", st.Status, err))
+	case errors.Is(err, errQueueFull), errors.Is(err, errShuttingDown):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case err != nil:
+		// The client's quota or max_jobs doesn't allow the job to go on yet
+		writeError(w, http.StatusTooManyRequests, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+// streamJob sends the progress of a job as Server-Sent Events: a "progress"
+// event whenever its status or row counts change, then a "finished" event
+// once it is done or failed, after which the stream ends
+func (s *server) streamJob(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	var last jobStatus
+	lastSent := time.Now()
+	for seq := 1; ; {
+		st, _, _ := s.jobs.get(clientFrom(r.Context()), id)
+		event := "progress"
+		if st.finished() {
+			event = "finished"
+		}
+		// ETA and rate change on every tick; only send when the job moved
+		if seq == 1 || st.Status != last.Status || st.Done != last.Done || st.Total != last.Total {
+			data, _ := json.Marshal(st)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", seq, event, data)
+			flusher.Flush()
+			seq++
+			last, lastSent = st, time.Now()
+		} else if time.Since(lastSent) >= sseKeepAlive {
+			// A comment keeps proxies from closing an idle connection
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			lastSent = time.Now()
+		}
+		if st.finished() {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
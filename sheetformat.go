@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Column widths set by formatSheet, in characters
+const (
+	minColumnWidth = 8
+	maxColumnWidth = 60
+)
+
+// formatSheet makes the output ready to review: the columns this run wrote
+// are widened to fit their values, the header row is frozen and filters are
+// added to it. Panes the sheet already has are kept, and columns are only
+// ever widened.
+func (s *Service) formatSheet(numRows int) error {
+	if s.repo.preserve {
+		// The patch writer only replaces cell values
+		return nil
+	}
+	f, sheet := s.repo.file, s.repo.sheetName
+
+	widths := make(map[int]int) // 1-based column to widest value
+	for _, cols := range s.repo.edits {
+		for col, value := range cols {
+			if w := displayWidth(fmt.Sprint(value)); w > widths[col] {
+				widths[col] = w
+			}
+		}
+	}
+	for col, w := range widths {
+		name, err := excelize.ColumnNumberToName(col)
+		if err != nil {
+			return err
+		}
+		current, err := f.GetColWidth(sheet, name)
+		if err != nil {
+			return err
+		}
+		width := float64(min(max(w+2, minColumnWidth), maxColumnWidth))
+		if width > current {
+			if err := f.SetColWidth(sheet, name, name, width); err != nil {
+				return err
+			}
+		}
+	}
+
+	panes, err := f.GetPanes(sheet)
+	if err != nil {
+		return err
+	}
+	if !panes.Freeze && !panes.Split {
+		if err := f.SetPanes(sheet, &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"}); err != nil {
+			return err
+		}
+	}
+
+	// A table brings its own filters, and a sheet can't have both
+	tables, err := f.GetTables(sheet)
+	if err != nil || len(tables) > 0 || numRows < 2 {
+		return err
+	}
+	lastCol, err := excelize.ColumnNumberToName(s.nextCol)
+	if err != nil {
+		return err
+	}
+	return f.AutoFilter(sheet, fmt.Sprintf("A1:%s%d", lastCol, numRows), nil)
+}
+
+// displayWidth estimates how many characters wide a value shows: combining
+// marks, such as Thai and Khmer vowel signs, take no room of their own and
+// East Asian wide characters take two
+func displayWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		switch {
+		case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			w += 2
+		default:
+			w++
+		}
+	}
+	return w
+}
+
+// Row highlights: failed rows in red, low-quality ones in yellow
+var (
+	redFill = excelize.Style{
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"#FFC7CE"}},
+		Font: &excelize.Font{Color: "#9C0006"},
+	}
+	yellowFill = excelize.Style{
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"#FFEB9C"}},
+		Font: &excelize.Font{Color: "#9C5700"},
+	}
+)
+
+// highlightFailedRows fills the rows that failed in red and returns how many
+// there are. A row failed when it has coordinates but no address, or when
+// its Status is something other than OK, such as a geocode error or a write
+// error that left an older address in place. Like the low-quality highlight
+// it is a conditional format, so it clears once a row is filled in.
+func (s *Service) highlightFailedRows(rows [][]string, latLngCol, addressCol int) (int, error) {
+	numRows := len(rows)
+	if numRows < 2 {
+		return 0, nil
+	}
+	cell := func(i, col int) string { return s.cellText(rows, i, col) }
+	failed := 0
+	for i := 1; i < numRows; i++ {
+		if cell(i, latLngCol) == "" {
+			continue
+		}
+		if status := cell(i, s.statusCol); cell(i, addressCol) == "" || (status != "" && status != statusOK) {
+			failed++
+		}
+	}
+
+	if s.repo.preserve {
+		return failed, nil
+	}
+	coordsCol, err := excelize.ColumnNumberToName(latLngCol + 1)
+	if err != nil {
+		return failed, err
+	}
+	addrCol, err := excelize.ColumnNumberToName(addressCol + 1)
+	if err != nil {
+		return failed, err
+	}
+	criteria := fmt.Sprintf(`AND($%s2<>"",$%s2="")`, coordsCol, addrCol)
+	if s.statusCol != -1 {
+		statusCol, err := excelize.ColumnNumberToName(s.statusCol + 1)
+		if err != nil {
+			return failed, err
+		}
+		criteria = fmt.Sprintf(`AND($%s2<>"",OR($%s2="",AND($%s2<>"",$%s2<>"%s")))`,
+			coordsCol, addrCol, statusCol, statusCol, statusOK)
+	}
+	s.highlightRows(criteria, redFill)
+	return failed, nil
+}
+
+// rowHighlight fills the data rows for which criteria, a formula written
+// for row 2, holds
+type rowHighlight struct {
+	criteria string
+	fill     excelize.Style
+}
+
+// highlightRows adds a highlight; highlights are added to the sheet together
+// by applyHighlights
+func (s *Service) highlightRows(criteria string, fill excelize.Style) {
+	s.highlights = append(s.highlights, rowHighlight{criteria: criteria, fill: fill})
+}
+
+// applyHighlights adds the row highlights to the sheet
+func (s *Service) applyHighlights(numRows int) error {
+	return addHighlights(s.repo.file, s.repo.sheetName, s.nextCol, numRows, s.highlights)
+}
+
+// addHighlights adds row highlights to the first numRows rows and lastCol
+// columns of a sheet as one conditional format. Highlights an earlier run
+// added are removed first, so rerunning on an output doesn't stack copies of
+// them.
+func addHighlights(f *excelize.File, sheet string, lastCol, numRows int, highlights []rowHighlight) error {
+	if len(highlights) == 0 || numRows < 2 {
+		return nil
+	}
+	ours := make(map[string]bool, len(highlights))
+	for _, h := range highlights {
+		ours[h.criteria] = true
+	}
+	for {
+		existing, err := f.GetConditionalFormats(sheet)
+		if err != nil {
+			return err
+		}
+		stale := ""
+		for ref, rules := range existing {
+			highlight := len(rules) > 0
+			for _, rule := range rules {
+				highlight = highlight && rule.Type == "formula" && ours[rule.Criteria]
+			}
+			if highlight {
+				stale = ref
+			}
+		}
+		if stale == "" {
+			break
+		}
+		if err := f.UnsetConditionalFormat(sheet, stale); err != nil {
+			return err
+		}
+	}
+
+	rules := make([]excelize.ConditionalFormatOptions, len(highlights))
+	for i, h := range highlights {
+		style, err := f.NewConditionalStyle(&h.fill)
+		if err != nil {
+			return err
+		}
+		rules[i] = excelize.ConditionalFormatOptions{Type: "formula", Criteria: h.criteria, Format: style}
+	}
+	last, err := excelize.ColumnNumberToName(lastCol)
+	if err != nil {
+		return err
+	}
+	return f.SetConditionalFormat(sheet, fmt.Sprintf("A2:%s%d", last, numRows), rules)
+}
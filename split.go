@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// partPath names part n (1-based) of a --split-rows output:
+// data/file.xlsx becomes data/file_part1.xlsx, data/file_part2.xlsx, ...
+func partPath(outputFile string, n int) string {
+	ext := filepath.Ext(outputFile)
+	return fmt.Sprintf("%s_part%d%s", strings.TrimSuffix(outputFile, ext), n, ext)
+}
+
+// saveParts writes the sheet as parts of at most --split-rows data rows,
+// each starting with the header row, and returns their paths. Outputs
+// ending in .csv are split into CSV files, others into workbooks that keep
+// the column widths, frozen header and row highlights of the sheet. Other
+// sheets, such as Duplicates, are left out.
+func (s *Service) saveParts(outputFile string) ([]string, error) {
+	rows := s.repo.partRows()
+	header, data := rows[0], rows[1:]
+	write := s.writeXLSXPart
+	if strings.EqualFold(filepath.Ext(outputFile), ".csv") {
+		write = writeCSVPart
+	}
+
+	var parts []string
+	for start := 0; start == 0 || start < len(data); start += s.cfg.SplitRows {
+		part := data[start:min(start+s.cfg.SplitRows, len(data))]
+		path := partPath(outputFile, len(parts)+1)
+		if err := writeFileAtomic(path, func(w io.Writer) error {
+			return write(w, header, part)
+		}); err != nil {
+			return parts, fmt.Errorf("writing %s: %w", path, err)
+		}
+		parts = append(parts, path)
+	}
+	return parts, nil
+}
+
+// partRows returns the rows of the sheet with the values written this run,
+// keeping the type of written values
+func (r *Repository) partRows() [][]interface{} {
+	numRows := len(r.rows)
+	for row := range r.edits {
+		numRows = max(numRows, row)
+	}
+	rows := make([][]interface{}, numRows)
+	for i := range rows {
+		var cells []interface{}
+		if i < len(r.rows) {
+			cells = make([]interface{}, len(r.rows[i]))
+			for j, cell := range r.rows[i] {
+				cells[j] = cell
+			}
+		}
+		for col, value := range r.edits[i+1] {
+			for len(cells) < col {
+				cells = append(cells, nil)
+			}
+			cells[col-1] = value
+		}
+		rows[i] = cells
+	}
+	return rows
+}
+
+// writeXLSXPart writes a part as a workbook with a sheet of the same name
+func (s *Service) writeXLSXPart(w io.Writer, header []interface{}, rows [][]interface{}) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	part := &Repository{file: f, sheetName: s.repo.sheetName}
+	if err := f.SetSheetName(f.GetSheetName(0), part.sheetName); err != nil {
+		return err
+	}
+
+	for i, row := range append([][]interface{}{header}, rows...) {
+		var links []int
+		cells := make([]interface{}, len(row))
+		for j, value := range row {
+			if link, ok := value.(hyperlink); ok {
+				links = append(links, j)
+				value = link.url
+			}
+			cells[j] = value
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := f.SetSheetRow(part.sheetName, cell, &cells); err != nil {
+			return err
+		}
+		for _, j := range links {
+			cell, _ := excelize.CoordinatesToCellName(j+1, i+1)
+			if err := part.setHyperlink(cell, row[j].(hyperlink)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.cfg.FormatSheet {
+		for col := 1; col <= len(header); col++ {
+			name, err := excelize.ColumnNumberToName(col)
+			if err != nil {
+				return err
+			}
+			width, err := s.repo.file.GetColWidth(s.repo.sheetName, name)
+			if err != nil {
+				return err
+			}
+			if err := f.SetColWidth(part.sheetName, name, name, width); err != nil {
+				return err
+			}
+		}
+		if err := f.SetPanes(part.sheetName, &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"}); err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			lastCol, err := excelize.ColumnNumberToName(len(header))
+			if err != nil {
+				return err
+			}
+			if err := f.AutoFilter(part.sheetName, fmt.Sprintf("A1:%s%d", lastCol, len(rows)+1), nil); err != nil {
+				return err
+			}
+		}
+	}
+	if err := addHighlights(f, part.sheetName, s.nextCol, len(rows)+1, s.highlights); err != nil {
+		return err
+	}
+	return f.Write(w)
+}
+
+// writeCSVPart writes a part as CSV
+func writeCSVPart(w io.Writer, header []interface{}, rows [][]interface{}) error {
+	cw := csv.NewWriter(w)
+	record := func(row []interface{}) []string {
+		out := make([]string, len(row))
+		for i, value := range row {
+			switch v := value.(type) {
+			case nil:
+			case float64:
+				out[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				out[i] = fmt.Sprint(v)
+			}
+		}
+		return out
+	}
+	cw.Write(record(header))
+	for _, row := range rows {
+		cw.Write(record(row))
+	}
+	cw.Flush()
+	return cw.Error()
+}
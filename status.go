@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// statusHeader names the column that records the outcome of each row
+const statusHeader = "Status"
+
+// statusOK marks a row whose results were written
+const statusOK = "OK"
+
+// writeAttempts is how often a failing cell write is tried before the row is given up
+const writeAttempts = 3
+
+// findStatusColumn returns the Status column of a header row, or -1
+func findStatusColumn(headerRow []string) int {
+	return columnIndex(headerRow, statusHeader)
+}
+
+// setupStatusColumn reuses an existing Status column, or adds one after the
+// last column when --status-column is given. Without the flag the column is
+// only added once a row fails to write.
+func (s *Service) setupStatusColumn(headerRow []string) {
+	s.statusCol = findStatusColumn(headerRow)
+	if s.statusCol == -1 && s.cfg.StatusColumn {
+		s.addStatusColumn()
+	}
+}
+
+// addStatusColumn appends the Status header
+func (s *Service) addStatusColumn() {
+	col := s.nextCol
+	if err := s.writeCell(1, col, statusHeader); err != nil {
+		fmt.Printf("Warning: Could not add %s column: %v\n", statusHeader, err)
+		return
+	}
+	s.statusCol = col
+	s.nextCol++
+	fmt.Printf("Added %s column at column %d\n", statusHeader, col+1)
+}
+
+// writeCell writes a value to a 1-based row and 0-based column, retrying
+// transient failures with a short backoff
+func (s *Service) writeCell(rowNum, col int, value interface{}) error {
+	cell, err := excelize.CoordinatesToCellName(col+1, rowNum)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = s.repo.SetCellValue(cell, value)
+		if err == nil || attempt == writeAttempts {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", cell, err)
+	}
+	return nil
+}
+
+// writeStatus records the outcome of a row when the Status column is in use
+func (s *Service) writeStatus(rowNum int, status string) {
+	if s.statusCol == -1 {
+		return
+	}
+	if err := s.writeCell(rowNum, s.statusCol, status); err != nil {
+		fmt.Printf("Row %d: could not write status: %v\n", rowNum, err)
+	}
+}
+
+// recordWriteError isolates a failed write to its row: the error goes to the
+// Status column and processing continues with the next row
+func (s *Service) recordWriteError(rowNum int, err error) {
+	s.writeErrors++
+	fmt.Printf("Row %d: ✗ %v\n", rowNum, err)
+	if s.statusCol == -1 {
+		s.addStatusColumn()
+	}
+	s.writeStatus(rowNum, "write error: "+err.Error())
+}
+
+// reportWriteErrors summarizes rows whose results could not be written
+func (s *Service) reportWriteErrors() {
+	if s.writeErrors == 0 {
+		return
+	}
+	fmt.Printf("⚠ %d rows could not be written; see the %s column\n", s.writeErrors, statusHeader)
+}
+
+// statusMessage is the Status text for a row that was skipped
+func statusMessage(result rowResult) string {
+	return strings.TrimSpace(result.message)
+}
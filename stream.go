@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Output formats for stream mode
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+)
+
+// streamRecord is one input record in stream mode
+type streamRecord struct {
+	seq    int
+	fields []string
+	coords string
+}
+
+// streamItem pairs an input record with its geocoding result
+type streamItem struct {
+	record streamRecord
+	result rowResult
+}
+
+// streamResult is an enriched record written in JSONL format
+type streamResult struct {
+	Line     int                    `json:"line"`
+	Input    string                 `json:"input"`
+	Lat      *float64               `json:"lat,omitempty"`
+	Lng      *float64               `json:"lng,omitempty"`
+	Address  string                 `json:"address"`
+	District string                 `json:"district"`
+	Province string                 `json:"province"`
+	Error    string                 `json:"error,omitempty"`
+	Extra    map[string]interface{} `json:"extra,omitempty"`
+	Fields   map[string]string      `json:"fields,omitempty"`
+}
+
+// streamInput reads coordinate records from plain "lat,lng" lines or from CSV
+// with a header row
+type streamInput struct {
+	header []string
+	next   func() ([]string, error)
+	coords func(fields []string) string
+}
+
+// newStreamInput detects the input layout from the first line
+func (s *Service) newStreamInput(r io.Reader) (*streamInput, error) {
+	br := bufio.NewReader(r)
+	first, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if strings.TrimSpace(first) == "" && err == io.EOF {
+		return nil, fmt.Errorf("no input on stdin")
+	}
+
+	// Plain coordinate lines: every line is "lat,lng"
+	if _, perr := s.parseCoordinates(strings.TrimSpace(first)); perr == nil {
+		pending := first
+		scanner := bufio.NewScanner(br)
+		return &streamInput{
+			header: []string{"LatLng"},
+			next: func() ([]string, error) {
+				if pending != "" {
+					line := pending
+					pending = ""
+					return []string{strings.TrimSpace(line)}, nil
+				}
+				for scanner.Scan() {
+					if line := strings.TrimSpace(scanner.Text()); line != "" {
+						return []string{line}, nil
+					}
+				}
+				if err := scanner.Err(); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			},
+			coords: func(fields []string) string { return fields[0] },
+		}, nil
+	}
+
+	// CSV with a header row
+	cr := csv.NewReader(io.MultiReader(strings.NewReader(first), br))
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	return s.detectStreamCoordinates(&streamInput{header: header, next: cr.Read})
+}
+
+// detectStreamCoordinates sets how the coordinates of a record are read from
+// its header: separate latitude and longitude (or x and y) columns, or a
+// coordinate column named like in Excel files
+func (s *Service) detectStreamCoordinates(in *streamInput) (*streamInput, error) {
+	header := in.header
+	latCol, lngCol := -1, -1
+	xCol, yCol := -1, -1
+	for i, cell := range header {
+		switch strings.ToLower(strings.TrimSpace(cell)) {
+		case "lat", "latitude":
+			latCol = i
+		case "lng", "lon", "long", "longitude":
+			lngCol = i
+		case "x", "easting":
+			xCol = i
+		case "y", "northing":
+			yCol = i
+		}
+	}
+	// Projected coordinates are read as "x,y", lat/lng as "lat,lng"
+	if s.cfg.projection != nil && xCol >= 0 && yCol >= 0 {
+		latCol, lngCol = xCol, yCol
+	}
+	if latCol >= 0 && lngCol >= 0 {
+		in.coords = func(fields []string) string {
+			if latCol >= len(fields) || lngCol >= len(fields) ||
+				strings.TrimSpace(fields[latCol]+fields[lngCol]) == "" {
+				return ""
+			}
+			return fields[latCol] + "," + fields[lngCol]
+		}
+		return s.scanStreamNotes(in)
+	}
+
+	coordCol := -1
+	for i, cell := range header {
+		if isCoordinateHeader(cell) {
+			coordCol = i
+			break
+		}
+	}
+	if coordCol == -1 {
+		return nil, fmt.Errorf("could not find a coordinate column in header %q", strings.Join(header, ","))
+	}
+	in.coords = func(fields []string) string {
+		if coordCol >= len(fields) {
+			return ""
+		}
+		return fields[coordCol]
+	}
+	return s.scanStreamNotes(in)
+}
+
+// scanStreamNotes falls back to coordinates found in the --notes-column of a
+// CSV record when its coordinate fields are empty
+func (s *Service) scanStreamNotes(in *streamInput) (*streamInput, error) {
+	if err := s.findNotesColumn(in.header); err != nil || s.notesCol < 0 {
+		return in, err
+	}
+	coords := in.coords
+	in.coords = func(fields []string) string {
+		c := coords(fields)
+		if strings.TrimSpace(c) == "" {
+			if found, ok := s.notesCoordinates(fields); ok {
+				return found
+			}
+		}
+		return c
+	}
+	return in, nil
+}
+
+// runStream reads coordinates from r, geocodes them concurrently and writes
+// enriched records to w in input order. Progress and errors go to stderr so
+// stdout stays clean for pipelines.
+func (s *Service) runStream(r io.Reader, w io.Writer) error {
+	in, err := s.newStreamInput(r)
+	if err != nil {
+		return err
+	}
+	if err := s.warmCache(); err != nil {
+		return err
+	}
+	defer s.persistCache()
+	if err := s.openRawResponses(); err != nil {
+		return err
+	}
+	defer s.closeRawResponses()
+
+	numWorkers := s.cfg.Workers
+	// Bound the records in flight so a slow row can't make the reorder buffer grow without limit
+	inFlight := make(chan struct{}, numWorkers*4)
+	jobs := make(chan streamRecord, numWorkers)
+	results := make(chan streamItem, numWorkers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range jobs {
+				if s.failures.isAborted() {
+					results <- streamItem{record: rec, result: rowResult{rowIndex: rec.seq, skipped: true, message: "skipped: run aborted"}}
+					continue
+				}
+				results <- streamItem{record: rec, result: s.resolveRow(rec.seq, rec.coords)}
+			}
+		}()
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		for seq := 0; ; seq++ {
+			fields, err := in.next()
+			if err == io.EOF {
+				readErr <- nil
+				return
+			}
+			if err != nil {
+				readErr <- fmt.Errorf("reading input: %w", err)
+				return
+			}
+			if s.failures.isAborted() {
+				readErr <- nil
+				return
+			}
+			inFlight <- struct{}{}
+			jobs <- streamRecord{seq: seq, fields: fields, coords: in.coords(fields)}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	out := newStreamWriter(w, s.cfg.Format, in.header, s.cfg.extraColumns())
+	pending := make(map[int]streamItem)
+	nextSeq, failed := 0, 0
+	for res := range results {
+		pending[res.record.seq] = res
+		for {
+			ready, ok := pending[nextSeq]
+			if !ok {
+				break
+			}
+			delete(pending, nextSeq)
+			nextSeq++
+			<-inFlight
+
+			if ready.result.skipped {
+				s.failures.observe(ready.result)
+				failed++
+				fmt.Fprintf(os.Stderr, "Line %d: %s\n", ready.record.seq+1, ready.result.message)
+			}
+			if err := out.write(ready.record, ready.result); err != nil {
+				return fmt.Errorf("writing output: %w", err)
+			}
+		}
+		// Flush what is ready so downstream commands see records as they complete
+		if err := out.flush(); err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+	}
+
+	if err := out.flush(); err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+	if err := <-readErr; err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "✓ Processed %d records (%d failed)\n", nextSeq, failed)
+	s.reportElevationErrors()
+	return s.failures.err()
+}
+
+// streamWriter writes enriched records as CSV or JSONL
+type streamWriter struct {
+	header []string
+	extra  []*extraColumn
+	csv    *csv.Writer
+	json   *json.Encoder
+	buf    *bufio.Writer
+}
+
+func newStreamWriter(w io.Writer, format string, header []string, extra []*extraColumn) *streamWriter {
+	buf := bufio.NewWriter(w)
+	sw := &streamWriter{header: header, extra: extra, buf: buf}
+	if format == formatJSONL {
+		sw.json = json.NewEncoder(buf)
+		sw.json.SetEscapeHTML(false)
+	} else {
+		sw.csv = csv.NewWriter(buf)
+		out := append(append([]string{}, header...), "Address", "District", "Province")
+		for _, c := range extra {
+			out = append(out, c.header)
+		}
+		sw.csv.Write(append(out, "Error"))
+	}
+	return sw
+}
+
+func (sw *streamWriter) write(rec streamRecord, res rowResult) error {
+	errMsg := ""
+	if res.skipped {
+		errMsg = res.message
+	}
+
+	if sw.csv != nil {
+		out := append(append([]string{}, rec.fields...), res.address, res.district, res.province)
+		for _, c := range sw.extra {
+			if res.skipped {
+				out = append(out, "")
+			} else {
+				out = append(out, fmt.Sprint(c.value(res)))
+			}
+		}
+		return sw.csv.Write(append(out, errMsg))
+	}
+
+	out := streamResult{
+		Line:     rec.seq + 1,
+		Input:    rec.coords,
+		Address:  res.address,
+		District: res.district,
+		Province: res.province,
+		Error:    errMsg,
+	}
+	if len(sw.extra) > 0 && !res.skipped {
+		out.Extra = make(map[string]interface{}, len(sw.extra))
+		for _, c := range sw.extra {
+			out.Extra[c.key] = c.value(res)
+		}
+	}
+	if res.coords != (Coordinates{}) {
+		lat, lng := res.coords.Lat, res.coords.Lng
+		out.Lat, out.Lng = &lat, &lng
+	}
+	if len(sw.header) > 1 {
+		out.Fields = make(map[string]string, len(sw.header))
+		for i, name := range sw.header {
+			if i < len(rec.fields) {
+				out.Fields[name] = rec.fields[i]
+			}
+		}
+	}
+	return sw.json.Encode(out)
+}
+
+func (sw *streamWriter) flush() error {
+	if sw.csv != nil {
+		sw.csv.Flush()
+		if err := sw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return sw.buf.Flush()
+}
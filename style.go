@@ -0,0 +1,227 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// defaultStyleName is the address style used when --address-style is not given
+const defaultStyleName = "international"
+
+// builtinStyles holds the address style packs shipped with the binary
+//
+//go:embed styles/*.json
+var builtinStyles embed.FS
+
+// defaultAddressStyle formats addresses when no style was configured
+var defaultAddressStyle = mustLoadBuiltinStyle(defaultStyleName)
+
+// addressStyle is a formatting pack describing how an address is assembled
+// for a locale: component order, separators, honorific prefixes and where the
+// postcode goes. Packs are JSON files so conventions can change without code.
+type addressStyle struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Separator is placed between components unless a component overrides it
+	Separator string `json:"separator"`
+
+	// Honorifics are locality prefixes such as "Soi" or "Moo"; a prefix is not
+	// added to a value that already starts with one
+	Honorifics []string `json:"honorifics"`
+
+	Components []styleComponent `json:"components"`
+}
+
+// styleComponent is one part of a formatted address
+type styleComponent struct {
+	// Fields are Nominatim address keys; the first non-empty one is used
+	Fields []string `json:"fields"`
+
+	// Join lists keys whose non-empty values are all used, joined by a space
+	Join []string `json:"join"`
+
+	// Strip removes these words from the start or end of the value, e.g. "District"
+	Strip []string `json:"strip"`
+
+	// Prefix is prepended to the value; the first matching entry is used
+	Prefix []stylePrefix `json:"prefix"`
+
+	// Separator replaces the style separator before this component, e.g. " "
+	// to keep the postcode next to the province
+	Separator *string `json:"separator"`
+}
+
+// stylePrefix is a prefix applied when the address matches When
+type stylePrefix struct {
+	Value string `json:"value"`
+
+	// When restricts the prefix to addresses whose fields equal these values,
+	// e.g. {"state": "Bangkok"}
+	When map[string]string `json:"when"`
+}
+
+// builtinStyleNames lists the address styles shipped with the binary
+func builtinStyleNames() []string {
+	entries, _ := builtinStyles.ReadDir("styles")
+	var names []string
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadAddressStyle returns a built-in style by name, or reads a style pack
+// from a JSON file
+func loadAddressStyle(name string) (*addressStyle, error) {
+	data, err := builtinStyles.ReadFile(path.Join("styles", name+".json"))
+	if err != nil {
+		data, err = os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown address style %q (built in: %s, or a path to a JSON style file)",
+				name, strings.Join(builtinStyleNames(), ", "))
+		}
+	}
+	return parseAddressStyle(name, data)
+}
+
+func mustLoadBuiltinStyle(name string) *addressStyle {
+	style, err := loadAddressStyle(name)
+	if err != nil {
+		panic(err)
+	}
+	return style
+}
+
+// parseAddressStyle decodes and validates a style pack
+func parseAddressStyle(name string, data []byte) (*addressStyle, error) {
+	var style addressStyle
+	if err := json.Unmarshal(data, &style); err != nil {
+		return nil, fmt.Errorf("address style %s: %w", name, err)
+	}
+	if len(style.Components) == 0 {
+		return nil, fmt.Errorf("address style %s: no components", name)
+	}
+	for i, c := range style.Components {
+		if len(c.Fields) == 0 && len(c.Join) == 0 {
+			return nil, fmt.Errorf("address style %s: component %d has no fields", name, i+1)
+		}
+		keys := append(append([]string{}, c.Fields...), c.Join...)
+		for _, p := range c.Prefix {
+			for key := range p.When {
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			if !isAddressField(key) {
+				return nil, fmt.Errorf("address style %s: component %d: unknown field %q", name, i+1, key)
+			}
+		}
+	}
+	if style.Name == "" {
+		style.Name = name
+	}
+	return &style, nil
+}
+
+// format assembles an address; it returns "" when no component has a value
+func (st *addressStyle) format(addr Address) string {
+	var b strings.Builder
+	for _, c := range st.Components {
+		value := st.value(c, addr)
+		if value == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			if c.Separator != nil {
+				b.WriteString(*c.Separator)
+			} else {
+				b.WriteString(st.Separator)
+			}
+		}
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+// value renders a single component, or "" if the address has no value for it
+func (st *addressStyle) value(c styleComponent, addr Address) string {
+	var value string
+	if len(c.Join) > 0 {
+		var parts []string
+		for _, key := range c.Join {
+			if v := addr.Field(key); v != "" {
+				parts = append(parts, v)
+			}
+		}
+		value = strings.Join(parts, " ")
+	} else {
+		for _, key := range c.Fields {
+			if v := addr.Field(key); v != "" {
+				value = v
+				break
+			}
+		}
+	}
+
+	for _, word := range c.Strip {
+		value = stripWord(value, word)
+	}
+	if value == "" {
+		return ""
+	}
+
+	for _, p := range c.Prefix {
+		if !p.matches(addr) {
+			continue
+		}
+		if !st.hasHonorific(value) {
+			value = p.Value + value
+		}
+		break
+	}
+	return value
+}
+
+// hasHonorific reports whether value already starts with one of the style's honorifics
+func (st *addressStyle) hasHonorific(value string) bool {
+	for _, h := range st.Honorifics {
+		if hasWordPrefix(value, h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p stylePrefix) matches(addr Address) bool {
+	for key, want := range p.When {
+		if !strings.EqualFold(addr.Field(key), want) {
+			return false
+		}
+	}
+	return true
+}
+
+// stripWord removes word from the start or end of value when it stands alone,
+// so "Watthana District" becomes "Watthana" but "Districtville" is left alone
+func stripWord(value, word string) string {
+	value = strings.TrimSpace(value)
+	if hasWordPrefix(value, word) {
+		value = strings.TrimSpace(value[len(word):])
+	}
+	if n := len(value) - len(word); n > 0 && strings.EqualFold(value[n:], word) && value[n-1] == ' ' {
+		value = strings.TrimSpace(value[:n])
+	}
+	return value
+}
+
+// hasWordPrefix reports whether value starts with word followed by a space
+func hasWordPrefix(value, word string) bool {
+	return len(value) > len(word) && strings.EqualFold(value[:len(word)], word) && value[len(word)] == ' '
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// summarySheet is the sheet --summary-sheet writes
+const summarySheet = "Summary"
+
+// summaryNone stands for a province or district a row has no value for,
+// such as a row that could not be geocoded
+const summaryNone = "(none)"
+
+// summaryGroup counts the rows of a province and district
+type summaryGroup struct {
+	province, district string
+	rows, failed       int
+}
+
+// cellText returns the text of a cell as it will be saved: the value the
+// run wrote, or else the input's. i is the 0-based index into rows.
+func (s *Service) cellText(rows [][]string, i, col int) string {
+	if col < 0 {
+		return ""
+	}
+	if value, written := s.repo.edits[i+1][col+1]; written {
+		return strings.TrimSpace(fmt.Sprint(value))
+	}
+	if i >= len(rows) || col >= len(rows[i]) {
+		return ""
+	}
+	return strings.TrimSpace(rows[i][col])
+}
+
+// writeSummarySheet counts the rows of each province and district, and how
+// many of them failed, on a Summary sheet: the pivot table managers build
+// from every output. Rows without coordinates are left out, like in
+// --highlight-failed.
+func (s *Service) writeSummarySheet(rows [][]string, latLngCol, addressCol, districtCol, provinceCol int) error {
+	groups := make(map[[2]string]*summaryGroup)
+	total := summaryGroup{province: "Total"}
+	for i := 1; i < len(rows); i++ {
+		if s.cellText(rows, i, latLngCol) == "" {
+			continue
+		}
+		province, district := s.cellText(rows, i, provinceCol), s.cellText(rows, i, districtCol)
+		if province == "" {
+			province = summaryNone
+		}
+		if district == "" {
+			district = summaryNone
+		}
+		key := [2]string{province, district}
+		g := groups[key]
+		if g == nil {
+			g = &summaryGroup{province: province, district: district}
+			groups[key] = g
+		}
+		g.rows++
+		total.rows++
+		if status := s.cellText(rows, i, s.statusCol); s.cellText(rows, i, addressCol) == "" || (status != "" && status != statusOK) {
+			g.failed++
+			total.failed++
+		}
+	}
+
+	sorted := make([]*summaryGroup, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	// Provinces and their districts by name; rows without a value go last
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.province != b.province {
+			return summaryLess(a.province, b.province)
+		}
+		return summaryLess(a.district, b.district)
+	})
+
+	sheet := [][]interface{}{{"Province", "District", "Rows", "Failed"}}
+	for _, g := range sorted {
+		sheet = append(sheet, []interface{}{g.province, g.district, g.rows, g.failed})
+	}
+	sheet = append(sheet, []interface{}{total.province, "", total.rows, total.failed})
+	if err := s.repo.AddReportSheet(summarySheet, sheet); err != nil {
+		return fmt.Errorf("writing %s sheet: %w", summarySheet, err)
+	}
+
+	provinces := make(map[string]bool)
+	for _, g := range sorted {
+		provinces[g.province] = true
+	}
+	fmt.Printf("✓ %s sheet: %d rows in %d provinces and %d districts, %d failed\n",
+		summarySheet, total.rows, len(provinces), len(sorted), total.failed)
+	return nil
+}
+
+// summaryLess orders names case-insensitively, with summaryNone last
+func summaryLess(a, b string) bool {
+	if (a == summaryNone) != (b == summaryNone) {
+		return b == summaryNone
+	}
+	return strings.ToLower(a) < strings.ToLower(b)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// zoneTab is the tz database's zone.tab: every IANA timezone with its country
+// and the coordinates of its principal city
+//
+//go:embed timezones/zone.tab
+var zoneTab []byte
+
+// tzZone is one line of zone.tab
+type tzZone struct {
+	country  string // lowercase ISO 3166-1 alpha-2
+	name     string // IANA name, e.g. Asia/Phnom_Penh
+	lat, lng float64
+}
+
+// tzZones are the timezones of zone.tab, grouped by country
+var tzZones = func() map[string][]tzZone {
+	zones, err := parseZoneTab(zoneTab)
+	if err != nil {
+		panic(fmt.Sprintf("timezones/zone.tab: %v", err))
+	}
+	return zones
+}()
+
+func parseZoneTab(data []byte) (map[string][]tzZone, error) {
+	zones := make(map[string][]tzZone)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected country, coordinates and timezone", line)
+		}
+		lat, lng, err := parseISO6709(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		country := strings.ToLower(fields[0])
+		zones[country] = append(zones[country], tzZone{country: country, name: fields[2], lat: lat, lng: lng})
+	}
+	return zones, scanner.Err()
+}
+
+// parseISO6709 reads zone.tab coordinates: ±DDMM±DDDMM or ±DDMMSS±DDDMMSS
+func parseISO6709(s string) (lat, lng float64, err error) {
+	split := strings.LastIndexAny(s, "+-")
+	if split <= 0 {
+		return 0, 0, fmt.Errorf("invalid coordinates %q", s)
+	}
+	if lat, err = parseSexagesimal(s[:split], 2); err != nil {
+		return 0, 0, err
+	}
+	if lng, err = parseSexagesimal(s[split:], 3); err != nil {
+		return 0, 0, err
+	}
+	return lat, lng, nil
+}
+
+// parseSexagesimal reads ±D..DMM[SS] with degDigits digits of degrees
+func parseSexagesimal(s string, degDigits int) (float64, error) {
+	digits := s[1:]
+	if len(digits) != degDigits+2 && len(digits) != degDigits+4 {
+		return 0, fmt.Errorf("invalid coordinate %q", s)
+	}
+	var parts [3]float64
+	for i, j := 0, 0; j < len(digits); i++ {
+		width := 2
+		if i == 0 {
+			width = degDigits
+		}
+		v, err := strconv.Atoi(digits[j : j+width])
+		if err != nil {
+			return 0, fmt.Errorf("invalid coordinate %q", s)
+		}
+		parts[i] = float64(v)
+		j += width
+	}
+	v := parts[0] + parts[1]/60 + parts[2]/3600
+	if s[0] == '-' {
+		v = -v
+	}
+	return v, nil
+}
+
+// nearestTimezone returns the IANA timezone of a coordinate in the given
+// country. It is an approximation: no timezone boundaries are embedded.
+// Countries with one timezone need no geometry; in countries with several,
+// and when the country is unknown, the timezone whose principal city is
+// nearest is used, which can be wrong close to a timezone border.
+func nearestTimezone(lat, lng float64, country string) string {
+	if zones, ok := tzZones[strings.ToLower(country)]; ok {
+		if len(zones) == 1 {
+			return zones[0].name
+		}
+		best, _ := nearestZone(lat, lng, zones, "", 0)
+		return best
+	}
+	best, bestDist := "", 0.0
+	for _, zones := range tzZones {
+		best, bestDist = nearestZone(lat, lng, zones, best, bestDist)
+	}
+	return best
+}
+
+// nearestZone returns the zone of zones whose principal city is nearer than
+// best (at bestDist metres), or best if none is
+func nearestZone(lat, lng float64, zones []tzZone, best string, bestDist float64) (string, float64) {
+	for _, z := range zones {
+		if d := haversineMeters(lat, lng, z.lat, z.lng); best == "" || d < bestDist {
+			best, bestDist = z.name, d
+		}
+	}
+	return best, bestDist
+}
+
+// nearestTimezoneColumn adds the approximate IANA timezone of each row
+func nearestTimezoneColumn() *extraColumn {
+	return &extraColumn{header: "Nearest Timezone", key: "nearest_timezone", value: func(r rowResult) interface{} {
+		return nearestTimezone(r.coords.Lat, r.coords.Lng, r.country)
+	}}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenTelemetry tracing. Spans are sent to an OTLP collector as OTLP/HTTP
+// JSON, which every collector accepts, so the tool needs no SDK for it.
+const (
+	spanExportInterval = 5 * time.Second
+	spanExportBatch    = 512
+	// maxQueuedSpans bounds the spans waiting to be sent; like the SDK's
+	// batch processor, spans past it are dropped rather than held in memory
+	maxQueuedSpans = 8192
+)
+
+// Span kinds of the OTLP protocol
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// spanContext identifies a span within its trace
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+func (c spanContext) valid() bool {
+	return c.traceID != [16]byte{}
+}
+
+// parseTraceparent reads a W3C traceparent header, such as the one a
+// traced client sends with its request
+func parseTraceparent(header string) (spanContext, bool) {
+	var c spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return c, false
+	}
+	if _, err := hex.Decode(c.traceID[:], []byte(parts[1])); err != nil {
+		return c, false
+	}
+	if _, err := hex.Decode(c.spanID[:], []byte(parts[2])); err != nil {
+		return c, false
+	}
+	return c, c.valid() && c.spanID != [8]byte{}
+}
+
+type spanContextKey struct{}
+
+// withSpan passes a span on to the handlers of a request
+func withSpan(ctx context.Context, sp *span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sp.context())
+}
+
+// spanFrom returns the span of a request, or an invalid context when
+// tracing is off
+func spanFrom(ctx context.Context) spanContext {
+	c, _ := ctx.Value(spanContextKey{}).(spanContext)
+	return c
+}
+
+// span is a timed operation of a trace. A nil span, which startSpan returns
+// when tracing is off, ignores everything.
+type span struct {
+	ctx    spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  []spanAttr
+	err    error
+}
+
+// spanAttr is an attribute of a span: a string, bool, int or float64
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+// startSpan starts a span under parent, or a new trace when parent is not
+// valid
+func startSpan(parent spanContext, name string, kind int, attrs ...spanAttr) *span {
+	if tracer == nil {
+		return nil
+	}
+	sp := &span{name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent.valid() {
+		sp.ctx.traceID, sp.parent = parent.traceID, parent.spanID
+	} else {
+		rand.Read(sp.ctx.traceID[:])
+	}
+	rand.Read(sp.ctx.spanID[:])
+	return sp
+}
+
+// context returns the span's context, to start child spans with
+func (sp *span) context() spanContext {
+	if sp == nil {
+		return spanContext{}
+	}
+	return sp.ctx
+}
+
+// set adds an attribute
+func (sp *span) set(key string, value interface{}) {
+	if sp != nil {
+		sp.attrs = append(sp.attrs, spanAttr{key: key, value: value})
+	}
+}
+
+// finish ends the span, marking it failed when err is set, and queues it
+// for export
+func (sp *span) finish(err error) {
+	if sp == nil {
+		return
+	}
+	sp.end, sp.err = time.Now(), err
+	tracer.add(sp)
+}
+
+// tracer exports the spans of the process; nil when tracing is off
+var tracer *spanExporter
+
+// spanExporter sends finished spans to an OTLP/HTTP collector in batches
+type spanExporter struct {
+	url     string
+	headers map[string]string
+	service string
+	client  *http.Client
+
+	mu      sync.Mutex
+	queue   []*span
+	dropped int
+
+	sending sync.Mutex // one export at a time, so spans go out in order
+}
+
+// startTracing sends spans to the OTLP collector at endpoint, e.g.
+// http://localhost:4318. The OTEL_EXPORTER_OTLP_TRACES_ENDPOINT,
+// OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME variables are honoured
+// as in the OpenTelemetry SDKs.
+func startTracing(endpoint string) error {
+	url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if url == "" {
+		url = strings.TrimRight(endpoint, "/") + "/v1/traces"
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("--otlp-endpoint must be an http:// or https:// URL, got %q", endpoint)
+	}
+	e := &spanExporter{
+		url:     url,
+		headers: make(map[string]string),
+		service: os.Getenv("OTEL_SERVICE_NAME"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if e.service == "" {
+		e.service = "latlg-address"
+	}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if name, value, ok := strings.Cut(pair, "="); ok {
+			e.headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	tracer = e
+
+	go func() {
+		for range time.Tick(spanExportInterval) {
+			e.flush()
+		}
+	}()
+	return nil
+}
+
+// flushTraces sends the spans that are still queued; runs call it before
+// they exit
+func flushTraces() {
+	if tracer != nil {
+		tracer.flush()
+	}
+}
+
+func (e *spanExporter) add(sp *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= maxQueuedSpans {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, sp)
+}
+
+// flush sends the queued spans
+func (e *spanExporter) flush() {
+	e.sending.Lock()
+	defer e.sending.Unlock()
+	e.mu.Lock()
+	spans, dropped := e.queue, e.dropped
+	e.queue, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: Dropped %d spans; the collector at %s is not keeping up\n", dropped, e.url)
+	}
+	for len(spans) > 0 {
+		batch := spans[:min(spanExportBatch, len(spans))]
+		spans = spans[len(batch):]
+		if err := e.export(batch); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not export %d spans: %v\n", len(batch)+len(spans), err)
+			return
+		}
+	}
+}
+
+// export posts spans as an OTLP ExportTraceServiceRequest
+func (e *spanExporter) export(spans []*span) error {
+	out := make([]map[string]interface{}, len(spans))
+	for i, sp := range spans {
+		s := map[string]interface{}{
+			"traceId":           hex.EncodeToString(sp.ctx.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.ctx.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(sp.attrs),
+		}
+		if sp.parent != [8]byte{} {
+			s["parentSpanId"] = hex.EncodeToString(sp.parent[:])
+		}
+		if sp.err != nil {
+			s["status"] = map[string]interface{}{"code": 2, "message": sp.err.Error()}
+		}
+		out[i] = s
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]spanAttr{{"service.name", e.service}}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "latlg-address"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned status %d: %s", e.url, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	drainAndClose(resp.Body)
+	return nil
+}
+
+// otlpAttributes encodes attributes as OTLP KeyValues
+func otlpAttributes(attrs []spanAttr) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]interface{}
+		switch v := a.value.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": a.key, "value": value})
+	}
+	return out
+}
+
+// traceRequests wraps the handlers of the job API in server spans. A
+// traceparent header from the client continues its trace, so a job shows
+// up under the request that submitted it.
+func traceRequests(h http.Handler) http.Handler {
+	if tracer == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := parseTraceparent(r.Header.Get("traceparent"))
+		sp := startSpan(parent, r.Method+" "+routeName(r.URL.Path), spanKindServer,
+			spanAttr{"http.request.method", r.Method}, spanAttr{"url.path", r.URL.Path})
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(withSpan(r.Context(), sp)))
+		sp.set("http.response.status_code", rec.status)
+		var err error
+		if rec.status >= 500 {
+			err = fmt.Errorf("status %d", rec.status)
+		}
+		sp.finish(err)
+	})
+}
+
+// routeName names a request path by its route, leaving out job IDs so
+// spans of one endpoint share a name
+func routeName(path string) string {
+	rest, ok := strings.CutPrefix(path, "/jobs/")
+	if !ok || rest == "" {
+		return path
+	}
+	if _, action, ok := strings.Cut(rest, "/"); ok {
+		return "/jobs/{id}/" + action
+	}
+	return "/jobs/{id}"
+}
+
+// statusRecorder remembers the status code a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets progress streams through
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// transformFlag collects repeated --transform options, applied in the order
+// given. Each names a result field and a Go template for its new value:
+//
+//	--transform 'province={{upper .Province}}'
+//	--transform 'district={{lookup "district-synonyms.csv" .District}}'
+type transformFlag []string
+
+func (f *transformFlag) String() string {
+	return strings.Join(*f, "; ")
+}
+
+func (f *transformFlag) Set(value string) error {
+	field, _, ok := strings.Cut(value, "=")
+	if !ok || transformTarget(&geocodeResult{}, field) == nil {
+		return fmt.Errorf("%q should be FIELD=TEMPLATE with FIELD one of %s", value, strings.Join(transformFields, ", "))
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// transformFields are the result fields a --transform can set
+var transformFields = []string{"address", "district", "province", "postcode"}
+
+// transformTarget returns the field of a result a --transform sets, or nil
+func transformTarget(r *geocodeResult, field string) *string {
+	switch strings.ToLower(strings.TrimSpace(field)) {
+	case "address":
+		return &r.address
+	case "district":
+		return &r.district
+	case "province":
+		return &r.province
+	case "postcode":
+		return &r.postcode
+	}
+	return nil
+}
+
+// resultTransform is a compiled --transform
+type resultTransform struct {
+	field string
+	tmpl  *template.Template
+}
+
+// transformData is what a --transform template sees: the result as left by
+// the transforms before it
+type transformData struct {
+	Address  string
+	District string
+	Province string
+	Postcode string
+	Country  string // ISO 3166-1 alpha-2, upper case
+	Lat, Lng float64
+}
+
+// parseTransforms compiles the --transform options and runs them on an
+// empty result, so unknown fields and unreadable lookup files fail at startup
+func parseTransforms(sources transformFlag) ([]resultTransform, error) {
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	funcs := template.FuncMap{
+		"title": titleCaseUniform,
+		"trim":  strings.TrimSpace,
+		// replace and replaceRegex take the value last, for pipelines:
+		// {{.District | replace "Muang" "Mueang"}}
+		"replace": func(old, new, value string) string { return strings.ReplaceAll(value, old, new) },
+		"replaceRegex": func(pattern, repl, value string) (string, error) {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return "", err
+			}
+			return re.ReplaceAllString(value, repl), nil
+		},
+		"lookup": (&lookupTables{}).lookup,
+	}
+	for name, fn := range templateFuncs {
+		funcs[name] = fn
+	}
+
+	transforms := make([]resultTransform, 0, len(sources))
+	for _, src := range sources {
+		field, text, _ := strings.Cut(src, "=")
+		tmpl, err := template.New(field).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("--transform %s: %w", field, err)
+		}
+		if err := tmpl.Execute(io.Discard, transformData{}); err != nil {
+			return nil, fmt.Errorf("--transform %s: %w", field, err)
+		}
+		transforms = append(transforms, resultTransform{field: field, tmpl: tmpl})
+	}
+	return transforms, nil
+}
+
+// applyTransforms runs the --transform templates on a result in order
+func applyTransforms(transforms []resultTransform, result *geocodeResult, coords Coordinates) error {
+	for _, t := range transforms {
+		data := transformData{
+			Address:  result.address,
+			District: result.district,
+			Province: result.province,
+			Postcode: result.postcode,
+			Country:  strings.ToUpper(result.country),
+			Lat:      coords.Lat,
+			Lng:      coords.Lng,
+		}
+		var buf bytes.Buffer
+		if err := t.tmpl.Execute(&buf, data); err != nil {
+			return fmt.Errorf("--transform %s: %w", t.field, err)
+		}
+		*transformTarget(result, t.field) = strings.TrimSpace(buf.String())
+	}
+	return nil
+}
+
+// lookupTables are the files read by the lookup template function, loaded
+// once each; safe for concurrent use
+type lookupTables struct {
+	mu     sync.Mutex
+	tables map[string]map[string]string
+}
+
+// lookup returns what a two-column CSV (or .tsv) file maps value to,
+// ignoring case and surrounding spaces, or value itself when the file does
+// not list it: {{lookup "district-synonyms.csv" .District}}
+func (l *lookupTables) lookup(path, value string) (string, error) {
+	l.mu.Lock()
+	table, ok := l.tables[path]
+	if !ok {
+		var err error
+		if table, err = readLookupTable(path); err != nil {
+			l.mu.Unlock()
+			return "", err
+		}
+		if l.tables == nil {
+			l.tables = make(map[string]map[string]string)
+		}
+		l.tables[path] = table
+	}
+	l.mu.Unlock()
+
+	if mapped, ok := table[strings.ToLower(strings.TrimSpace(value))]; ok {
+		return mapped, nil
+	}
+	return value, nil
+}
+
+// readLookupTable reads the from and to columns of a lookup file; lines
+// starting with # are comments
+func readLookupTable(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	if strings.EqualFold(filepath.Ext(path), ".tsv") {
+		r.Comma = '\t'
+	}
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	table := make(map[string]string, len(records))
+	for _, rec := range records {
+		table[strings.ToLower(strings.TrimSpace(rec[0]))] = strings.TrimSpace(rec[1])
+	}
+	return table, nil
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// localScripts are the scripts --transliterate converts from and to, by
+// lowercase country code
+var localScripts = map[string]*unicode.RangeTable{
+	"th": unicode.Thai,
+	"kh": unicode.Khmer,
+}
+
+// transliterator finds the Latin and local-script forms of resolved names:
+// from the embedded province and district lists where the name is in them,
+// and otherwise, towards Latin only, by romanizing letter by letter
+type transliterator struct {
+	provinces *provinceMatcher
+	districts map[string]district // by province code and district matchKey
+}
+
+func newTransliterator(provinces *provinceMatcher) *transliterator {
+	districts, err := parseDistricts(bytes.NewReader(builtinPostcodes))
+	if err != nil {
+		panic(fmt.Sprintf("postcodes/postcodes.tsv: %v", err))
+	}
+	t := &transliterator{provinces: provinces, districts: make(map[string]district)}
+	for _, d := range districts {
+		for _, name := range d.names {
+			if key := matchKey(d.country, name); key != "" {
+				t.districts[postcodeTableKey(d.province, key)] = d
+			}
+		}
+	}
+	return t
+}
+
+// province returns the Latin and local-script forms of a resolved province
+func (t *transliterator) province(country, name string) (latin, local string) {
+	if found, _ := t.provinces.match(country, name); found.name != "" {
+		return found.name, found.local
+	}
+	return t.fallback(country, name)
+}
+
+// district returns the Latin and local-script forms of a resolved district
+// of a province
+func (t *transliterator) district(country, province, name string) (latin, local string) {
+	if found, _ := t.provinces.match(country, province); found.code != "" && name != "" {
+		if d, ok := t.districts[postcodeTableKey(found.code, matchKey(country, name))]; ok {
+			return d.names[0], localName(d.country, d.names)
+		}
+	}
+	return t.fallback(country, name)
+}
+
+// fallback romanizes a name that is not in the lists; its local-script
+// form is only known when the name is already written in it
+func (t *transliterator) fallback(country, name string) (latin, local string) {
+	if script, ok := localScripts[strings.ToLower(country)]; ok && inScript(name, script) {
+		local = name
+	}
+	return romanize(name), local
+}
+
+// localName returns the first of names written in the country's script
+func localName(country string, names []string) string {
+	script, ok := localScripts[country]
+	if !ok {
+		return ""
+	}
+	for _, name := range names {
+		if inScript(name, script) {
+			return name
+		}
+	}
+	return ""
+}
+
+// inScript reports whether s has a letter of the script
+func inScript(s string, script *unicode.RangeTable) bool {
+	for _, r := range s {
+		if unicode.Is(script, r) && unicode.IsLetter(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// romanize writes Thai and Khmer text in Latin letters and drops the
+// accents of Latin letters (Takéo becomes Takeo). The romanization follows
+// the letters rather than the pronunciation, so it is readable but not
+// always the official spelling; text in other scripts is left as it is.
+func romanize(s string) string {
+	var out []string
+	for _, word := range strings.Fields(s) {
+		var b strings.Builder
+		runes := []rune(word)
+		for start := 0; start < len(runes); {
+			end := start + 1
+			script := scriptOf(runes[start])
+			for end < len(runes) && scriptOf(runes[end]) == script {
+				end++
+			}
+			switch script {
+			case unicode.Thai:
+				b.WriteString(capitalize(romanizeThai(runes[start:end])))
+			case unicode.Khmer:
+				b.WriteString(capitalize(romanizeKhmer(runes[start:end])))
+			default:
+				b.WriteString(foldLatin(string(runes[start:end])))
+			}
+			start = end
+		}
+		if b.Len() > 0 {
+			out = append(out, b.String())
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// scriptOf returns the script of r if it is one romanize converts
+func scriptOf(r rune) *unicode.RangeTable {
+	for _, script := range []*unicode.RangeTable{unicode.Thai, unicode.Khmer} {
+		if unicode.Is(script, r) {
+			return script
+		}
+	}
+	return nil
+}
+
+// foldLatin drops the accents of Latin letters
+func foldLatin(s string) string {
+	var b strings.Builder
+	latin := false
+	for _, r := range norm.NFD.String(s) {
+		mark := unicode.Is(unicode.Mn, r)
+		switch {
+		case mark && latin:
+			continue
+		case r == 'đ':
+			r = 'd'
+		case r == 'Đ':
+			r = 'D'
+		}
+		if !mark {
+			latin = unicode.Is(unicode.Latin, r)
+		}
+		b.WriteRune(r)
+	}
+	return norm.NFC.String(b.String())
+}
+
+// capitalize upper-cases the first letter of a romanized word
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// thaiConsonants gives the initial and final sound of each Thai consonant,
+// after the Royal Thai General System of Transcription
+var thaiConsonants = map[rune][2]string{
+	'ก': {"k", "k"}, 'ข': {"kh", "k"}, 'ฃ': {"kh", "k"}, 'ค': {"kh", "k"}, 'ฅ': {"kh", "k"}, 'ฆ': {"kh", "k"},
+	'ง': {"ng", "ng"}, 'จ': {"ch", "t"}, 'ฉ': {"ch", "t"}, 'ช': {"ch", "t"}, 'ซ': {"s", "t"}, 'ฌ': {"ch", "t"},
+	'ญ': {"y", "n"}, 'ฎ': {"d", "t"}, 'ฏ': {"t", "t"}, 'ฐ': {"th", "t"}, 'ฑ': {"th", "t"}, 'ฒ': {"th", "t"},
+	'ณ': {"n", "n"}, 'ด': {"d", "t"}, 'ต': {"t", "t"}, 'ถ': {"th", "t"}, 'ท': {"th", "t"}, 'ธ': {"th", "t"},
+	'น': {"n", "n"}, 'บ': {"b", "p"}, 'ป': {"p", "p"}, 'ผ': {"ph", "p"}, 'ฝ': {"f", "p"}, 'พ': {"ph", "p"},
+	'ฟ': {"f", "p"}, 'ภ': {"ph", "p"}, 'ม': {"m", "m"}, 'ย': {"y", "i"}, 'ร': {"r", "n"}, 'ล': {"l", "n"},
+	'ว': {"w", "o"}, 'ศ': {"s", "t"}, 'ษ': {"s", "t"}, 'ส': {"s", "t"}, 'ห': {"h", ""}, 'ฬ': {"l", "n"},
+	'อ': {"", ""}, 'ฮ': {"h", ""},
+}
+
+// thaiVowels are the Thai vowels as they read once leading vowels have been
+// moved after their consonant, longest first
+var thaiVowels = []struct {
+	thai  string
+	latin string
+}{
+	{"เือ", "uea"}, {"เาะ", "o"}, {"เีย", "ia"},
+	{"เา", "ao"}, {"เอ", "oe"}, {"เะ", "e"}, {"แะ", "ae"}, {"โะ", "o"}, {"ัว", "ua"}, {"ือ", "ue"},
+	{"เ", "e"}, {"แ", "ae"}, {"โ", "o"}, {"ใ", "ai"}, {"ไ", "ai"},
+	{"ะ", "a"}, {"ั", "a"}, {"า", "a"}, {"ำ", "am"}, {"ิ", "i"}, {"ี", "i"},
+	{"ึ", "ue"}, {"ื", "ue"}, {"ุ", "u"}, {"ู", "u"}, {"ฤ", "rue"}, {"ฦ", "lue"},
+}
+
+// isThaiLeadingVowel reports whether r is written before the consonant it follows in speech
+func isThaiLeadingVowel(r rune) bool {
+	return r >= 'เ' && r <= 'ไ'
+}
+
+// isThaiVowel reports whether r is a vowel sign, leading or following
+func isThaiVowel(r rune) bool {
+	return isThaiLeadingVowel(r) || r == 'ะ' || (r >= 'ั' && r <= 'ู')
+}
+
+// romanizeThai writes a run of Thai text in Latin letters
+func romanizeThai(word []rune) string {
+	// Drop tone marks and silent letters, and move leading vowels after
+	// their consonant or consonant cluster so the text reads in order
+	var runes []rune
+	for _, r := range word {
+		switch {
+		case r == '์':
+			if len(runes) > 0 {
+				runes = runes[:len(runes)-1]
+			}
+		case r >= '็' && r <= '๋', r == 'ๆ', r == 'ฯ', r == 'ๅ':
+		case r >= '๐' && r <= '๙':
+			runes = append(runes, '0'+r-'๐')
+		default:
+			runes = append(runes, r)
+		}
+	}
+	for i := 0; i < len(runes)-1; i++ {
+		if !isThaiLeadingVowel(runes[i]) {
+			continue
+		}
+		n := 1
+		if i+2 < len(runes) && thaiCluster(runes[i+1], runes[i+2]) {
+			n = 2
+		}
+		leading := runes[i]
+		copy(runes[i:], runes[i+1:i+1+n])
+		runes[i+n] = leading
+		i += n
+	}
+
+	var b strings.Builder
+	voweled := false // the current syllable has its vowel
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		if isThaiVowel(r) || r == 'ฤ' || r == 'ฦ' {
+			matched := false
+			for _, v := range thaiVowels {
+				if strings.HasPrefix(string(runes[i:]), v.thai) {
+					b.WriteString(v.latin)
+					i += len([]rune(v.thai))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				i++
+			}
+			voweled = true
+			continue
+		}
+		sounds, ok := thaiConsonants[r]
+		if !ok {
+			b.WriteRune(r)
+			voweled = false
+			i++
+			continue
+		}
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		if voweled && !isThaiVowel(next) && next != 'อ' {
+			// Closes the syllable
+			final := sounds[1]
+			if r == 'ย' && strings.HasSuffix(b.String(), "i") {
+				final = ""
+			}
+			b.WriteString(final)
+			voweled = false
+			i++
+			continue
+		}
+		if r == 'ห' && strings.ContainsRune("งญนมยรลว", next) {
+			i++ // a silent ห marking the tone of the next consonant
+			continue
+		}
+		b.WriteString(sounds[0])
+		i++
+		if _, nextConsonant := thaiConsonants[next]; !nextConsonant || thaiCluster(r, next) && i+1 < len(runes) && isThaiVowel(runes[i+1]) {
+			continue
+		}
+		// A consonant without a written vowel: ว and อ between two
+		// consonants are the vowels ua and o, otherwise the vowel is an
+		// unwritten o
+		after := rune(0)
+		if i+1 < len(runes) {
+			after = runes[i+1]
+		}
+		switch {
+		case isThaiVowel(after):
+			b.WriteString("a")
+			voweled = true
+		case next == 'ว' && after != 0:
+			b.WriteString("ua")
+			i++
+			voweled = true
+		case next == 'อ':
+			b.WriteString("o")
+			i++
+			voweled = true
+		default:
+			b.WriteString("o")
+			voweled = true
+		}
+	}
+	return b.String()
+}
+
+// thaiCluster reports whether two Thai consonants are read together, as in
+// กร (kr), ปล (pl) or ขว (khw)
+func thaiCluster(first, second rune) bool {
+	switch {
+	case first == 'ห' && strings.ContainsRune("งญนมยรลว", second):
+		return true
+	case strings.ContainsRune("กขคตปผพ", first) && strings.ContainsRune("รลว", second):
+		return true
+	}
+	return false
+}
+
+// khmerConsonants gives the sound of each Khmer consonant, after the UNGEGN
+// romanization; as a final, ប is read p
+var khmerConsonants = map[rune]string{
+	'ក': "k", 'ខ': "kh", 'គ': "k", 'ឃ': "kh", 'ង': "ng",
+	'ច': "ch", 'ឆ': "chh", 'ជ': "ch", 'ឈ': "chh", 'ញ': "nh",
+	'ដ': "d", 'ឋ': "th", 'ឌ': "d", 'ឍ': "th", 'ណ': "n",
+	'ត': "t", 'ថ': "th", 'ទ': "t", 'ធ': "th", 'ន': "n",
+	'ប': "b", 'ផ': "ph", 'ព': "p", 'ភ': "ph", 'ម': "m",
+	'យ': "y", 'រ': "r", 'ល': "l", 'វ': "v", 'ឝ': "s", 'ឞ': "s",
+	'ស': "s", 'ហ': "h", 'ឡ': "l", 'អ': "",
+}
+
+// khmerVowels are the Khmer vowel signs and independent vowels
+var khmerVowels = map[rune]string{
+	'ា': "a", 'ិ': "e", 'ី': "ei", 'ឹ': "oe", 'ឺ': "eu", 'ុ': "o", 'ូ': "ou", 'ួ': "uo",
+	'ើ': "aeu", 'ឿ': "oea", 'ៀ': "ie", 'េ': "e", 'ែ': "ae", 'ៃ': "ai", 'ោ': "ao", 'ៅ': "au",
+	'ៈ': "a",
+	'ឥ': "e", 'ឦ': "ei", 'ឧ': "u", 'ឩ': "u", 'ឪ': "au", 'ឫ': "rue", 'ឬ': "rueu",
+	'ឭ': "lue", 'ឮ': "lueu", 'ឯ': "ae", 'ឰ': "ai", 'ឱ': "ao", 'ឲ': "ao", 'ឳ': "au",
+}
+
+const khmerCoeng = '្' // makes the next consonant a subscript of the one before
+
+// romanizeKhmer writes a run of Khmer text in Latin letters
+func romanizeKhmer(word []rune) string {
+	var b strings.Builder
+	voweled := false // the current syllable has its vowel
+	for i := 0; i < len(word); i++ {
+		r := word[i]
+		if vowel, ok := khmerVowels[r]; ok {
+			b.WriteString(vowel)
+			voweled = true
+			continue
+		}
+		switch {
+		case r == 'ំ':
+			// A final m that closes the syllable
+			if voweled {
+				b.WriteString("m")
+			} else {
+				b.WriteString("om")
+			}
+			voweled = false
+			continue
+		case r == 'ះ':
+			if voweled {
+				b.WriteString("h")
+			} else {
+				b.WriteString("eah")
+			}
+			voweled = false
+			continue
+		case r >= '០' && r <= '៩':
+			b.WriteRune('0' + r - '០')
+			voweled = false
+			continue
+		case r == '។' || r == '៕':
+			b.WriteRune('.')
+			voweled = false
+			continue
+		}
+		sound, ok := khmerConsonants[r]
+		if !ok {
+			continue // diacritics that change the vowel's series or tone
+		}
+		// Take the consonant with its subscripts
+		cluster := sound
+		for i+2 < len(word) && word[i+1] == khmerCoeng {
+			cluster += khmerConsonants[word[i+2]]
+			i += 2
+		}
+		if voweled {
+			// A consonant after a vowel closes the syllable
+			if r == 'ប' && cluster == sound {
+				cluster = "p"
+			}
+			b.WriteString(cluster)
+			voweled = false
+			continue
+		}
+		b.WriteString(cluster)
+		next := rune(0)
+		if i+1 < len(word) {
+			next = word[i+1]
+		}
+		if _, consonant := khmerConsonants[next]; consonant {
+			// No written vowel: the inherent one
+			b.WriteString("a")
+			voweled = true
+		}
+	}
+	return b.String()
+}
+
+// transliterationColumns add the Latin form of the address, district and
+// province, and the local-script form of the district and province
+func transliterationColumns(m *provinceMatcher) []*extraColumn {
+	t := newTransliterator(m)
+	return []*extraColumn{
+		{header: "Address (Latin)", key: "address_latin", value: func(r rowResult) interface{} {
+			return romanize(r.address)
+		}},
+		{header: "District (Latin)", key: "district_latin", value: func(r rowResult) interface{} {
+			latin, _ := t.district(r.country, r.province, r.district)
+			return latin
+		}},
+		{header: "Province (Latin)", key: "province_latin", value: func(r rowResult) interface{} {
+			latin, _ := t.province(r.country, r.province)
+			return latin
+		}},
+		{header: "District (Local)", key: "district_local", value: func(r rowResult) interface{} {
+			_, local := t.district(r.country, r.province, r.district)
+			return local
+		}},
+		{header: "Province (Local)", key: "province_local", value: func(r rowResult) interface{} {
+			_, local := t.province(r.country, r.province)
+			return local
+		}},
+	}
+}
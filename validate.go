@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// validateSamples is how many rows of each kind of problem validate lists
+const validateSamples = 3
+
+// coordinateProblem is a kind of malformed coordinate and the cells that
+// have it
+type coordinateProblem struct {
+	kind    string
+	count   int
+	samples []string
+}
+
+// runValidate checks an input file without geocoding it, for `latlg-address
+// validate file.xlsx`: it finds the columns, counts the coordinates that parse
+// and lists examples of each problem. It fails when the file can't be
+// processed, so an upload pipeline can reject it before a run.
+func runValidate(cfg *Config) error {
+	inputFile := cfg.InputFile
+	if isRemotePath(inputFile) {
+		var err error
+		if inputFile, err = cfg.fetchRemote(inputFile); err != nil {
+			return err
+		}
+	}
+	excelFile, err := resolveInputPath(inputFile)
+	if err != nil {
+		return err
+	}
+	repo, err := NewRepository(excelFile)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	// A pre-flight check reports an ambiguous column instead of asking
+	run := *cfg
+	run.NoPrompt = true
+	service := NewService(repo, &run)
+
+	rows := repo.GetRows()
+	fmt.Printf("Validating %s, sheet %s\n", cfg.InputFile, repo.GetSheetName())
+	if len(rows) < 2 {
+		return fmt.Errorf("%s has a header but no data rows", cfg.InputFile)
+	}
+	latLngCol, addressCol, districtCol, provinceCol, err := service.findColumns(rows)
+	if err != nil {
+		return err
+	}
+	if addressCol == -1 || districtCol == -1 || provinceCol == -1 {
+		fmt.Println("Address, District and Province columns will be added")
+	} else {
+		fmt.Printf("Results go to columns %s, %s and %s\n", rows[0][addressCol], rows[0][districtCol], rows[0][provinceCol])
+	}
+	if err := service.findNotesColumn(rows[0]); err != nil {
+		return err
+	}
+
+	valid := 0
+	colName, _ := excelize.ColumnNumberToName(latLngCol + 1)
+	issues := make(map[string]*coordinateProblem)
+	for i, row := range rows[1:] {
+		cell := service.rowCoordinates(row, latLngCol)
+		problem := checkCoordinates(service, cell)
+		if problem == nil {
+			valid++
+			continue
+		}
+		kind := coordinateProblemKind(problem)
+		issue := issues[kind]
+		if issue == nil {
+			issue = &coordinateProblem{kind: kind}
+			issues[kind] = issue
+		}
+		issue.count++
+		if len(issue.samples) < validateSamples {
+			sample := fmt.Sprintf("%s%d", colName, i+2)
+			if text := strings.TrimSpace(cell); text != "" {
+				sample += fmt.Sprintf(" %q: %v", previewCell(text), problem)
+			}
+			issue.samples = append(issue.samples, sample)
+		}
+	}
+
+	total := len(rows) - 1
+	fmt.Printf("\n%d data rows: %d with valid coordinates, %d without\n", total, valid, total-valid)
+	sorted := make([]*coordinateProblem, 0, len(issues))
+	for _, issue := range issues {
+		sorted = append(sorted, issue)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].kind < sorted[j].kind
+	})
+	for _, issue := range sorted {
+		fmt.Printf("  %s: %d rows\n", issue.kind, issue.count)
+		for _, sample := range issue.samples {
+			fmt.Printf("      %s\n", sample)
+		}
+	}
+
+	if valid == 0 {
+		return fmt.Errorf("no row of %s has valid coordinates", cfg.InputFile)
+	}
+	fmt.Printf("\n✓ %s can be processed\n", cfg.InputFile)
+	return nil
+}
+
+// coordinateProblemKind groups the problems checkCoordinates reports, so
+// rows with the same kind of mistake are counted together
+func coordinateProblemKind(err error) string {
+	msg := err.Error()
+	switch {
+	case msg == "empty coordinates":
+		return "empty"
+	case strings.Contains(msg, "placeholder"):
+		return "(0, 0) placeholder"
+	case strings.Contains(msg, "out of range"), strings.Contains(msg, "outside the input CRS"):
+		return "out of range"
+	case strings.HasPrefix(msg, "invalid format"):
+		return "invalid format"
+	case strings.Contains(msg, "UTM"), strings.Contains(msg, "MGRS"):
+		return "invalid UTM/MGRS reference"
+	}
+	kind, _, _ := strings.Cut(msg, ":")
+	return kind
+}
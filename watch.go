@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func statStamp(path string) (fileStamp, bool) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return fileStamp{}, false
+	}
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}, true
+}
+
+// watcher reprocesses workbooks whenever they change
+type watcher struct {
+	cfg       *Config
+	target    string
+	done      map[string]fileStamp // version of each file that was last processed
+	pending   map[string]fileStamp // changed files waiting to settle
+	generated map[string]bool      // files written by the watcher itself
+}
+
+// runWatch watches a workbook, or every .xlsx file in a directory, and
+// processes it again each time it changes. A file is processed once it has
+// stopped changing for one interval, so half-copied files are never read.
+func runWatch(cfg *Config) error {
+	if err := os.MkdirAll("data", 0755); err != nil {
+		return fmt.Errorf("creating data directory: %w", err)
+	}
+	target := cfg.InputFile
+	if _, err := os.Stat(target); err != nil {
+		if target, err = resolveInputPath(cfg.InputFile); err != nil {
+			return err
+		}
+	}
+
+	w := &watcher{
+		cfg:       cfg,
+		target:    target,
+		done:      make(map[string]fileStamp),
+		pending:   make(map[string]fileStamp),
+		generated: make(map[string]bool),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("Watching %s every %s (Ctrl+C to stop)\n", target, cfg.WatchInterval)
+	ticker := time.NewTicker(cfg.WatchInterval)
+	defer ticker.Stop()
+	for {
+		w.poll()
+		select {
+		case <-ctx.Done():
+			fmt.Println("Stopped watching")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// candidates lists the workbooks under watch
+func (w *watcher) candidates() []string {
+	info, err := os.Stat(w.target)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return nil
+	}
+	if !info.IsDir() {
+		return []string{w.target}
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(w.target, "*.xlsx"))
+	var files []string
+	for _, path := range matches {
+		base := filepath.Base(path)
+		// Skip Excel lock files, checkpoints and our own outputs
+		if strings.HasPrefix(base, "~$") || strings.HasSuffix(base, "_temp.xlsx") || w.generated[path] {
+			continue
+		}
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// poll processes every file whose new version has settled
+func (w *watcher) poll() {
+	for _, path := range w.candidates() {
+		stamp, ok := statStamp(path)
+		if !ok || stamp == w.done[path] {
+			delete(w.pending, path)
+			continue
+		}
+		// Wait one interval for the file to stop changing
+		if seen, ok := w.pending[path]; !ok || seen != stamp {
+			w.pending[path] = stamp
+			continue
+		}
+		delete(w.pending, path)
+
+		fmt.Printf("\n=== %s changed, processing (%s) ===\n", path, time.Now().Format(time.DateTime))
+		run := *w.cfg
+		if run.progress == nil {
+			run.progress = &runProgress{}
+		}
+		if err := processFile(&run, path); err != nil {
+			fmt.Printf("Error processing %s: %v\n", path, err)
+		}
+
+		// Remember our output so writing it doesn't trigger another run; with
+		// --in-place the output is the input itself. It may be a new version
+		// of an earlier output.
+		output := run.progress.outputPath()
+		if output == "" {
+			output = w.cfg.outputPath(path, time.Now())
+		}
+		if filepath.Clean(output) != filepath.Clean(path) {
+			w.generated[filepath.Clean(output)] = true
+		}
+		if after, ok := statStamp(path); ok {
+			w.done[path] = after
+		}
+	}
+}
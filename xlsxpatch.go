@@ -0,0 +1,706 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// cellEdits holds pending cell values keyed by 1-based row and column numbers
+type cellEdits map[int]map[int]interface{}
+
+// set records a value for the given 1-based row and column
+func (e cellEdits) set(row, col int, value interface{}) {
+	cols, ok := e[row]
+	if !ok {
+		cols = make(map[int]interface{})
+		e[row] = cols
+	}
+	cols[col] = value
+}
+
+var (
+	sheetDataPattern = regexp.MustCompile(`<([A-Za-z_][\w.-]*:)?sheetData[\s/>]`)
+	dimensionPattern = regexp.MustCompile(`(<(?:[A-Za-z_][\w.-]*:)?dimension\s+ref=")([^"]*)(")`)
+	calcChainPattern = regexp.MustCompile(`<(?:[A-Za-z_][\w.-]*:)?(?:Override|Relationship)\s[^>]*calcChain[^>]*/>`)
+	rowAttrPattern   = attrPattern("r")
+	styleAttrPattern = attrPattern("s")
+	spansAttrPattern = attrPattern("spans")
+)
+
+// patchWorkbook copies the workbook at src to w, rewriting only the edited cells
+// of the named sheet and adding the report sheets. Every other part of the
+// package (styles, number formats, formulas, other sheets, drawings) is copied
+// byte-for-byte.
+func patchWorkbook(src string, w io.Writer, sheetName string, edits cellEdits, reports []reportSheet) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return fmt.Errorf("opening workbook package: %w", err)
+	}
+	defer zr.Close()
+
+	sheetPart, err := findSheetPart(&zr.Reader, sheetName)
+	if err != nil {
+		return err
+	}
+
+	sheetFile := findZipFile(&zr.Reader, sheetPart)
+	if sheetFile == nil {
+		return fmt.Errorf("worksheet part %s not found", sheetPart)
+	}
+	data, err := readZipFile(sheetFile)
+	if err != nil {
+		return fmt.Errorf("reading worksheet: %w", err)
+	}
+	patched, replacedFormula, err := patchSheetXML(data, edits)
+	if err != nil {
+		return fmt.Errorf("patching worksheet: %w", err)
+	}
+	replaced := map[string][]byte{sheetPart: patched}
+	added, err := addReportSheets(&zr.Reader, reports, replaced)
+	if err != nil {
+		return fmt.Errorf("adding report sheets: %w", err)
+	}
+
+	zw := zip.NewWriter(w)
+	// Untouched parts are copied compressed; only the patched parts are
+	// deflated again, favouring speed for large worksheets
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.BestSpeed)
+	})
+	for _, f := range zr.File {
+		content, isReplaced := replaced[f.Name]
+		switch {
+		case replacedFormula && path.Base(f.Name) == "calcChain.xml":
+			// The calculation chain references the overwritten formula cells;
+			// Excel rebuilds it on load when it is missing
+			continue
+		case replacedFormula && (f.Name == "[Content_Types].xml" || strings.HasSuffix(f.Name, "workbook.xml.rels")):
+			if !isReplaced {
+				if content, err = readZipFile(f); err != nil {
+					return fmt.Errorf("reading %s: %w", f.Name, err)
+				}
+			}
+			if err := writeZipFile(zw, f, calcChainPattern.ReplaceAll(content, nil)); err != nil {
+				return err
+			}
+		case isReplaced:
+			if err := writeZipFile(zw, f, content); err != nil {
+				return err
+			}
+		default:
+			if err := zw.Copy(f); err != nil {
+				return fmt.Errorf("copying %s: %w", f.Name, err)
+			}
+		}
+	}
+	for _, part := range added {
+		if err := writeZipPart(zw, part.name, time.Now(), part.data); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// findWorkbookPart resolves the package path of the workbook part
+func findWorkbookPart(zr *zip.Reader) (string, error) {
+	var rootRels xmlRelationships
+	if err := unmarshalZipFile(zr, "_rels/.rels", &rootRels); err != nil {
+		return "", err
+	}
+	workbookPart := rootRels.target("", "/officeDocument")
+	if workbookPart == "" {
+		workbookPart = "xl/workbook.xml"
+	}
+	return workbookPart, nil
+}
+
+// findSheetPart resolves the package path of the worksheet with the given name
+func findSheetPart(zr *zip.Reader, sheetName string) (string, error) {
+	workbookPart, err := findWorkbookPart(zr)
+	if err != nil {
+		return "", err
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			RID  string `xml:"id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := unmarshalZipFile(zr, workbookPart, &workbook); err != nil {
+		return "", err
+	}
+
+	relID := ""
+	for _, sheet := range workbook.Sheets {
+		if sheet.Name == sheetName {
+			relID = sheet.RID
+			break
+		}
+	}
+	if relID == "" {
+		return "", fmt.Errorf("sheet %q not found in workbook", sheetName)
+	}
+
+	dir, file := path.Split(workbookPart)
+	var workbookRels xmlRelationships
+	if err := unmarshalZipFile(zr, path.Join(dir, "_rels", file+".rels"), &workbookRels); err != nil {
+		return "", err
+	}
+	for _, rel := range workbookRels.Relationships {
+		if rel.ID == relID {
+			return resolvePartTarget(dir, rel.Target), nil
+		}
+	}
+	return "", fmt.Errorf("relationship %s for sheet %q not found", relID, sheetName)
+}
+
+// xmlRelationships is the content of an OPC .rels part
+type xmlRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Type   string `xml:"Type,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// target returns the resolved target of the first relationship whose type has the given suffix
+func (r xmlRelationships) target(dir, typeSuffix string) string {
+	for _, rel := range r.Relationships {
+		if strings.HasSuffix(rel.Type, typeSuffix) {
+			return resolvePartTarget(dir, rel.Target)
+		}
+	}
+	return ""
+}
+
+// resolvePartTarget resolves a relationship target relative to the source part directory
+func resolvePartTarget(dir, target string) string {
+	if strings.HasPrefix(target, "/") {
+		return strings.TrimPrefix(target, "/")
+	}
+	return path.Clean(path.Join(dir, target))
+}
+
+func findZipFile(zr *zip.Reader, name string) *zip.File {
+	for _, f := range zr.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func unmarshalZipFile(zr *zip.Reader, name string, v interface{}) error {
+	f := findZipFile(zr, name)
+	if f == nil {
+		return fmt.Errorf("package part %s not found", name)
+	}
+	data, err := readZipFile(f)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+func writeZipFile(zw *zip.Writer, f *zip.File, data []byte) error {
+	return writeZipPart(zw, f.Name, f.Modified, data)
+}
+
+func writeZipPart(zw *zip.Writer, name string, modified time.Time, data []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	return nil
+}
+
+// patchSheetXML applies edits to the sheetData of a worksheet part, leaving
+// rows and cells that are not edited untouched. It reports whether any
+// replaced cell held a formula.
+func patchSheetXML(data []byte, edits cellEdits) ([]byte, bool, error) {
+	loc := sheetDataPattern.FindSubmatchIndex(data)
+	if loc == nil {
+		return nil, false, fmt.Errorf("sheetData element not found")
+	}
+	prefix := ""
+	if loc[2] >= 0 {
+		prefix = string(data[loc[2]:loc[3]])
+	}
+	p := &sheetPatcher{prefix: prefix, edits: edits}
+	for row := range edits {
+		p.pendingRows = append(p.pendingRows, row)
+	}
+	sort.Ints(p.pendingRows)
+
+	start := loc[0]
+	openEnd := tagEnd(data, start)
+	if openEnd < 0 {
+		return nil, false, fmt.Errorf("unterminated sheetData element")
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:start])
+	out.WriteString("<" + prefix + "sheetData>")
+
+	closeTag := []byte("</" + prefix + "sheetData>")
+	rest := data[openEnd+1:]
+	if data[openEnd-1] != '/' {
+		end := bytes.Index(data[openEnd+1:], closeTag)
+		if end < 0 {
+			return nil, false, fmt.Errorf("unterminated sheetData element")
+		}
+		if err := p.patchRows(&out, data[openEnd+1:openEnd+1+end]); err != nil {
+			return nil, false, err
+		}
+		rest = data[openEnd+1+end+len(closeTag):]
+	}
+	p.flushRows(&out, 0)
+	out.Write(closeTag)
+	out.Write(rest)
+
+	return updateDimension(out.Bytes(), p.maxRow, p.maxCol), p.replacedFormula, nil
+}
+
+// sheetPatcher tracks state while rewriting the rows of a sheetData element
+type sheetPatcher struct {
+	prefix          string
+	edits           cellEdits
+	pendingRows     []int
+	maxRow          int
+	maxCol          int
+	replacedFormula bool
+}
+
+// rowSpan locates a row element, or a run of other markup, inside sheetData
+type rowSpan struct {
+	num         int // row number; 0 for markup that is not a row
+	start, end  int // element bounds in the sheetData content
+	attrs       []byte
+	inner       []byte
+	selfClosing bool
+}
+
+// scanRows splits sheetData content into row elements and the markup between them
+func (p *sheetPatcher) scanRows(content []byte) ([]rowSpan, error) {
+	rowOpen := "<" + p.prefix + "row"
+	rowClose := []byte("</" + p.prefix + "row>")
+	var spans []rowSpan
+	lastRow := 0
+	pos := 0
+
+	for pos < len(content) {
+		next := bytes.Index(content[pos:], []byte(rowOpen))
+		for next >= 0 && !hasElementPrefix(content[pos+next:], rowOpen) {
+			skip := bytes.Index(content[pos+next+1:], []byte(rowOpen))
+			if skip < 0 {
+				next = -1
+				break
+			}
+			next += 1 + skip
+		}
+		if next < 0 {
+			spans = append(spans, rowSpan{start: pos, end: len(content)})
+			break
+		}
+		if next > 0 {
+			spans = append(spans, rowSpan{start: pos, end: pos + next})
+		}
+		pos += next
+
+		openEnd := tagEnd(content, pos)
+		if openEnd < 0 {
+			return nil, fmt.Errorf("unterminated row element")
+		}
+		span := rowSpan{start: pos, selfClosing: content[openEnd-1] == '/'}
+		span.attrs = content[pos+len(rowOpen) : openEnd]
+		if span.selfClosing {
+			span.attrs = span.attrs[:len(span.attrs)-1]
+		}
+
+		span.num = lastRow + 1
+		if r := xmlAttr(span.attrs, rowAttrPattern); r != "" {
+			n, err := strconv.Atoi(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid row number %q", r)
+			}
+			span.num = n
+		}
+		lastRow = span.num
+
+		span.end = openEnd + 1
+		if !span.selfClosing {
+			end := bytes.Index(content[openEnd+1:], rowClose)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated row %d", span.num)
+			}
+			span.inner = content[openEnd+1 : openEnd+1+end]
+			span.end = openEnd + 1 + end + len(rowClose)
+		}
+		spans = append(spans, span)
+		pos = span.end
+	}
+	return spans, nil
+}
+
+// patchRows copies the rows in content to out, patching edited rows and
+// inserting new rows in order. Edited rows are rendered in parallel; the
+// untouched markup in between is copied as-is.
+func (p *sheetPatcher) patchRows(out *bytes.Buffer, content []byte) error {
+	spans, err := p.scanRows(content)
+	if err != nil {
+		return err
+	}
+
+	var edited []int
+	for i, span := range spans {
+		if span.num > 0 {
+			p.trackBounds(span.num, 0)
+			if _, ok := p.edits[span.num]; ok {
+				edited = append(edited, i)
+			}
+		}
+	}
+
+	rendered := make([][]byte, len(spans))
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(edited) {
+		workers = len(edited)
+	}
+	renderers := make([]*sheetPatcher, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		renderers[w] = &sheetPatcher{prefix: p.prefix, edits: p.edits}
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := renderers[w]
+			for n := w; n < len(edited); n += workers {
+				i := edited[n]
+				var buf bytes.Buffer
+				if err := r.patchRow(&buf, spans[i]); err != nil {
+					errs[w] = err
+					return
+				}
+				rendered[i] = buf.Bytes()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w, r := range renderers {
+		if errs[w] != nil {
+			return errs[w]
+		}
+		p.trackBounds(r.maxRow, r.maxCol)
+		p.replacedFormula = p.replacedFormula || r.replacedFormula
+	}
+
+	for i, span := range spans {
+		if span.num > 0 {
+			p.flushRows(out, span.num)
+		}
+		if rendered[i] != nil {
+			out.Write(rendered[i])
+			// The pending entry for an existing row is consumed here
+			p.pendingRows = p.pendingRows[1:]
+			continue
+		}
+		out.Write(content[span.start:span.end])
+	}
+	return nil
+}
+
+// patchRow renders an existing row with its edits applied
+func (p *sheetPatcher) patchRow(out *bytes.Buffer, span rowSpan) error {
+	out.WriteString("<" + p.prefix + "row")
+	out.Write(spansAttrPattern.ReplaceAll(span.attrs, nil))
+	out.WriteString(">")
+	if err := p.patchCells(out, span.inner, span.num, p.edits[span.num]); err != nil {
+		return err
+	}
+	out.WriteString("</" + p.prefix + "row>")
+	return nil
+}
+
+// flushRows writes new rows for pending edits with row numbers below before.
+// A before value of 0 flushes every remaining row.
+func (p *sheetPatcher) flushRows(out *bytes.Buffer, before int) {
+	for len(p.pendingRows) > 0 && (before == 0 || p.pendingRows[0] < before) {
+		row := p.pendingRows[0]
+		p.pendingRows = p.pendingRows[1:]
+		out.WriteString(fmt.Sprintf(`<%srow r="%d">`, p.prefix, row))
+		p.writeNewCells(out, row, p.edits[row], sortedCols(p.edits[row]))
+		out.WriteString("</" + p.prefix + "row>")
+	}
+}
+
+// patchCells copies the cells of a row, replacing edited cells and inserting new ones in column order
+func (p *sheetPatcher) patchCells(out *bytes.Buffer, content []byte, row int, rowEdits map[int]interface{}) error {
+	cellOpen := "<" + p.prefix + "c"
+	cellClose := []byte("</" + p.prefix + "c>")
+	pending := sortedCols(rowEdits)
+	lastCol := 0
+	pos := 0
+
+	for pos < len(content) {
+		next := bytes.IndexByte(content[pos:], '<')
+		if next < 0 {
+			out.Write(content[pos:])
+			break
+		}
+		out.Write(content[pos : pos+next])
+		pos += next
+
+		if !hasElementPrefix(content[pos:], cellOpen) {
+			// Anything after the cells (e.g. extLst) must follow the new cells
+			p.writeNewCells(out, row, rowEdits, pending)
+			pending = nil
+			out.Write(content[pos:])
+			break
+		}
+
+		openEnd := tagEnd(content, pos)
+		if openEnd < 0 {
+			return fmt.Errorf("unterminated cell in row %d", row)
+		}
+		selfClosing := content[openEnd-1] == '/'
+		attrs := content[pos+len(cellOpen) : openEnd]
+		if selfClosing {
+			attrs = attrs[:len(attrs)-1]
+		}
+
+		col := lastCol + 1
+		if ref := xmlAttr(attrs, rowAttrPattern); ref != "" {
+			c, _, err := excelize.CellNameToCoordinates(ref)
+			if err != nil {
+				return fmt.Errorf("invalid cell reference %q", ref)
+			}
+			col = c
+		}
+		lastCol = col
+		p.trackBounds(row, col)
+
+		elemEnd := openEnd + 1
+		if !selfClosing {
+			end := bytes.Index(content[openEnd+1:], cellClose)
+			if end < 0 {
+				return fmt.Errorf("unterminated cell in row %d", row)
+			}
+			elemEnd = openEnd + 1 + end + len(cellClose)
+		}
+
+		n := 0
+		for n < len(pending) && pending[n] < col {
+			n++
+		}
+		p.writeNewCells(out, row, rowEdits, pending[:n])
+		pending = pending[n:]
+
+		if value, ok := rowEdits[col]; ok {
+			if bytes.Contains(content[openEnd:elemEnd], []byte("<"+p.prefix+"f")) {
+				p.replacedFormula = true
+			}
+			out.WriteString(p.renderCell(row, col, xmlAttr(attrs, styleAttrPattern), value))
+			if len(pending) > 0 && pending[0] == col {
+				pending = pending[1:]
+			}
+		} else {
+			out.Write(content[pos:elemEnd])
+		}
+		pos = elemEnd
+	}
+
+	p.writeNewCells(out, row, rowEdits, pending)
+	return nil
+}
+
+// writeNewCells writes the given columns of a row as new cells
+func (p *sheetPatcher) writeNewCells(out *bytes.Buffer, row int, rowEdits map[int]interface{}, cols []int) {
+	for _, col := range cols {
+		p.trackBounds(row, col)
+		out.WriteString(p.renderCell(row, col, "", rowEdits[col]))
+	}
+}
+
+func (p *sheetPatcher) trackBounds(row, col int) {
+	if row > p.maxRow {
+		p.maxRow = row
+	}
+	if col > p.maxCol {
+		p.maxCol = col
+	}
+}
+
+// renderCell renders a cell element holding value, keeping the given style index
+func (p *sheetPatcher) renderCell(row, col int, style string, value interface{}) string {
+	ref, _ := excelize.CoordinatesToCellName(col, row)
+	attrs := fmt.Sprintf(` r="%s"`, ref)
+	if style != "" {
+		attrs += fmt.Sprintf(` s="%s"`, style)
+	}
+
+	c := "<" + p.prefix + "c"
+	v := func(s string) string {
+		return "<" + p.prefix + "v>" + s + "</" + p.prefix + "v>"
+	}
+
+	switch val := value.(type) {
+	case nil:
+		return c + attrs + "/>"
+	case int:
+		return c + attrs + ">" + v(strconv.Itoa(val)) + "</" + p.prefix + "c>"
+	case int64:
+		return c + attrs + ">" + v(strconv.FormatInt(val, 10)) + "</" + p.prefix + "c>"
+	case float64:
+		return c + attrs + ">" + v(strconv.FormatFloat(val, 'f', -1, 64)) + "</" + p.prefix + "c>"
+	case bool:
+		b := "0"
+		if val {
+			b = "1"
+		}
+		return c + attrs + ` t="b">` + v(b) + "</" + p.prefix + "c>"
+	case hyperlink:
+		return hyperlinkFormula(p.prefix, attrs, val)
+	}
+
+	text := fmt.Sprint(value)
+	if text == "" {
+		return c + attrs + "/>"
+	}
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(text))
+	space := ""
+	if strings.TrimSpace(text) != text {
+		space = ` xml:space="preserve"`
+	}
+	return c + attrs + ` t="inlineStr"><` + p.prefix + "is><" + p.prefix + "t" + space + ">" +
+		escaped.String() + "</" + p.prefix + "t></" + p.prefix + "is></" + p.prefix + "c>"
+}
+
+// updateDimension widens the sheet dimension reference to cover maxRow and maxCol
+func updateDimension(data []byte, maxRow, maxCol int) []byte {
+	loc := dimensionPattern.FindSubmatchIndex(data)
+	if loc == nil || maxRow == 0 || maxCol == 0 {
+		return data
+	}
+
+	ref := string(data[loc[4]:loc[5]])
+	first, last := ref, ref
+	if i := strings.IndexByte(ref, ':'); i >= 0 {
+		first, last = ref[:i], ref[i+1:]
+	}
+	col, row, err := excelize.CellNameToCoordinates(last)
+	if err != nil {
+		return data
+	}
+	if col >= maxCol && row >= maxRow {
+		return data
+	}
+	if maxCol > col {
+		col = maxCol
+	}
+	if maxRow > row {
+		row = maxRow
+	}
+	newLast, _ := excelize.CoordinatesToCellName(col, row)
+
+	var out bytes.Buffer
+	out.Write(data[:loc[4]])
+	out.WriteString(first + ":" + newLast)
+	out.Write(data[loc[5]:])
+	return out.Bytes()
+}
+
+// sortedCols returns the column numbers of a row's edits in ascending order
+func sortedCols(rowEdits map[int]interface{}) []int {
+	cols := make([]int, 0, len(rowEdits))
+	for col := range rowEdits {
+		cols = append(cols, col)
+	}
+	sort.Ints(cols)
+	return cols
+}
+
+// hasElementPrefix reports whether data starts with the open tag name followed by a delimiter
+func hasElementPrefix(data []byte, name string) bool {
+	if !bytes.HasPrefix(data, []byte(name)) || len(data) == len(name) {
+		return false
+	}
+	switch data[len(name)] {
+	case ' ', '\t', '\r', '\n', '>', '/':
+		return true
+	}
+	return false
+}
+
+// tagEnd returns the index of the '>' closing the tag starting at start,
+// skipping over quoted attribute values
+func tagEnd(data []byte, start int) int {
+	var quote byte
+	for i := start; i < len(data); i++ {
+		switch c := data[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i
+		}
+	}
+	return -1
+}
+
+// attrPattern matches the named attribute and captures its double- or single-quoted value
+func attrPattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?:^|\s)` + regexp.QuoteMeta(name) + `\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+}
+
+// xmlAttr returns the value of an attribute in a raw attribute list
+func xmlAttr(attrs []byte, re *regexp.Regexp) string {
+	m := re.FindSubmatch(attrs)
+	if m == nil {
+		return ""
+	}
+	if m[1] != nil {
+		return string(m[1])
+	}
+	return string(m[2])
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const testSheet = "Sites"
+
+var (
+	testRowPattern  = regexp.MustCompile(`(?s)<row [^>]*?r="(\d+)"[^>]*?(?:/>|>.*?</row>)`)
+	testCellPattern = regexp.MustCompile(`(?s)<c [^>]*?r="([A-Z]+\d+)"[^>]*?(?:/>|>.*?</c>)`)
+)
+
+// writeStyledWorkbook saves a workbook with formulas, cell styles, number
+// formats, merged cells, a second sheet and a calculation chain, the parts
+// the patch writer must leave alone, and returns its path
+func writeStyledWorkbook(t *testing.T) string {
+	t.Helper()
+	f := excelize.NewFile()
+	defer f.Close()
+	if err := f.SetSheetName(f.GetSheetName(0), testSheet); err != nil {
+		t.Fatal(err)
+	}
+	set := func(cell string, value interface{}) {
+		if err := f.SetCellValue(testSheet, cell, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, header := range []string{"Name", "Coordinates", "Share", "Double", "Address"} {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		set(cell, header)
+	}
+	sites := []struct {
+		name, coords string
+		share        float64
+	}{
+		{"Site 1", "11.556400, 104.928200", 0.25},
+		{"Site 2", "13.361800, 103.859700", 0.5},
+		{"Site 3", "10.609300, 103.529600", 0.125},
+	}
+	for i, site := range sites {
+		row := strconv.Itoa(i + 2)
+		set("A"+row, site.name)
+		set("B"+row, site.coords)
+		set("C"+row, site.share)
+		if err := f.SetCellFormula(testSheet, "D"+row, "C"+row+"*2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("A6", "Checked by the field team")
+	if err := f.MergeCell(testSheet, "A6", "C6"); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}, Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"DDEBF7"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	percent, err := f.NewStyle(&excelize.Style{NumFmt: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := "#,##0.000"
+	double, err := f.NewStyle(&excelize.Style{CustomNumFmt: &custom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := f.NewStyle(&excelize.Style{Alignment: &excelize.Alignment{WrapText: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []struct {
+		from, to string
+		style    int
+	}{{"A1", "E1", header}, {"C2", "C4", percent}, {"D2", "D4", double}, {"E2", "E4", address}} {
+		if err := f.SetCellStyle(testSheet, s.from, s.to, s.style); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := f.NewSheet("Totals"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetCellFormula("Totals", "A1", "SUM("+testSheet+"!D2:D4)"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := f.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "styled.xlsx")
+	if err := os.WriteFile(path, addCalcChain(t, buf.Bytes()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// addCalcChain adds the calculation chain Excel saves with formulas to a
+// package that lacks one, with its content type and relationship
+func addCalcChain(t *testing.T, pkg []byte) []byte {
+	t.Helper()
+	parts := readPackage(t, pkg)
+	if _, ok := parts["xl/calcChain.xml"]; ok {
+		return pkg
+	}
+	parts["xl/calcChain.xml"] = []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<calcChain xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<c r="D2" i="1"/><c r="D3"/><c r="D4"/><c r="A1" i="2"/></calcChain>`)
+	parts["[Content_Types].xml"] = bytes.Replace(parts["[Content_Types].xml"], []byte("</Types>"),
+		[]byte(`<Override PartName="/xl/calcChain.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.calcChain+xml"/></Types>`), 1)
+	parts["xl/_rels/workbook.xml.rels"] = bytes.Replace(parts["xl/_rels/workbook.xml.rels"], []byte("</Relationships>"),
+		[]byte(`<Relationship Id="rIdCalcChain" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/calcChain" Target="calcChain.xml"/></Relationships>`), 1)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range packageOrder(t, pkg, "xl/calcChain.xml") {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(parts[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// packageOrder returns the part names of a package in order, followed by
+// the extra names
+func packageOrder(t *testing.T, pkg []byte, extra ...string) []string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	return append(names, extra...)
+}
+
+// readPackage returns the uncompressed content of every part of a package
+func readPackage(t *testing.T, pkg []byte) map[string][]byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[string][]byte, len(zr.File))
+	for _, f := range zr.File {
+		data, err := readZipFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[f.Name] = data
+	}
+	return parts
+}
+
+// patchTestWorkbook patches the workbook at src and returns the patched
+// package, the parts before and after, and the name of the patched
+// worksheet part
+func patchTestWorkbook(t *testing.T, src string, edits cellEdits) (patched []byte, before, after map[string][]byte, sheetPart string) {
+	t.Helper()
+	pkg, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sheetPart, err = findSheetPart(zr, testSheet); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := patchWorkbook(src, &out, testSheet, edits, nil); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes(), readPackage(t, pkg), readPackage(t, out.Bytes()), sheetPart
+}
+
+// elementsByRef returns the row or cell elements of a worksheet matched by
+// pattern, keyed by their r attribute
+func elementsByRef(pattern *regexp.Regexp, data []byte) map[string]string {
+	elements := make(map[string]string)
+	for _, m := range pattern.FindAllSubmatch(data, -1) {
+		elements[string(m[1])] = string(m[0])
+	}
+	return elements
+}
+
+// reopen opens a patched package with excelize
+func reopen(t *testing.T, pkg []byte) *excelize.File {
+	t.Helper()
+	f, err := excelize.OpenReader(bytes.NewReader(pkg))
+	if err != nil {
+		t.Fatalf("excelize can't reopen the patched workbook: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestPatchWorkbookLeavesTheRestUntouched(t *testing.T) {
+	src := writeStyledWorkbook(t)
+	edits := make(cellEdits)
+	edits.set(2, 5, "Street 1, Phnom Penh")      // E2, a styled empty cell
+	edits.set(3, 5, "Street 2, Siem Reap")       // E3
+	edits.set(4, 6, "a cell after the last one") // F4, a new cell
+	edits.set(8, 2, 42)                          // B8, a new row
+	patched, before, after, sheetPart := patchTestWorkbook(t, src, edits)
+
+	for name, data := range before {
+		if name == sheetPart {
+			continue
+		}
+		if !bytes.Equal(after[name], data) {
+			t.Errorf("%s changed", name)
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			t.Errorf("%s was added", name)
+		}
+	}
+
+	// Outside sheetData only the dimension may change
+	outside := func(data []byte) string {
+		data = dimensionPattern.ReplaceAll(data, nil)
+		start, end := bytes.Index(data, []byte("<sheetData")), bytes.Index(data, []byte("</sheetData>"))
+		return string(data[:start]) + string(data[end:])
+	}
+	if outside(before[sheetPart]) != outside(after[sheetPart]) {
+		t.Errorf("worksheet markup outside sheetData changed:\n%s\n%s", outside(before[sheetPart]), outside(after[sheetPart]))
+	}
+	rowsBefore, rowsAfter := elementsByRef(testRowPattern, before[sheetPart]), elementsByRef(testRowPattern, after[sheetPart])
+	for ref, row := range rowsBefore {
+		if !map[string]bool{"2": true, "3": true, "4": true}[ref] && rowsAfter[ref] != row {
+			t.Errorf("row %s changed:\n%s\n%s", ref, row, rowsAfter[ref])
+		}
+	}
+	cellsBefore, cellsAfter := elementsByRef(testCellPattern, before[sheetPart]), elementsByRef(testCellPattern, after[sheetPart])
+	if len(rowsBefore) < 5 || len(cellsBefore) < 20 {
+		t.Fatalf("found %d rows and %d cells in the worksheet, want the whole sheet", len(rowsBefore), len(cellsBefore))
+	}
+	for ref, cell := range cellsBefore {
+		if ref != "E2" && ref != "E3" && cellsAfter[ref] != cell {
+			t.Errorf("cell %s changed:\n%s\n%s", ref, cell, cellsAfter[ref])
+		}
+	}
+
+	orig, err := excelize.OpenFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	f := reopen(t, patched)
+	for cell, want := range map[string]string{"E2": "Street 1, Phnom Penh", "E3": "Street 2, Siem Reap", "F4": "a cell after the last one", "B8": "42"} {
+		if got, _ := f.GetCellValue(testSheet, cell); got != want {
+			t.Errorf("%s = %q, want %q", cell, got, want)
+		}
+	}
+	for _, cell := range []string{"A1", "C2", "D3", "E2", "E3"} {
+		want, _ := orig.GetCellStyle(testSheet, cell)
+		if got, _ := f.GetCellStyle(testSheet, cell); got != want {
+			t.Errorf("%s has style %d, want %d", cell, got, want)
+		}
+	}
+	for _, cell := range []string{"C2", "D2"} {
+		want, _ := orig.GetCellValue(testSheet, cell)
+		if got, _ := f.GetCellValue(testSheet, cell); got != want {
+			t.Errorf("%s is formatted as %q, want %q", cell, got, want)
+		}
+	}
+	if got, _ := f.GetCellFormula(testSheet, "D3"); got != "C3*2" {
+		t.Errorf("D3 formula = %q, want C3*2", got)
+	}
+	merged, err := f.GetMergeCells(testSheet)
+	if err != nil || len(merged) != 1 || merged[0].GetStartAxis() != "A6" || merged[0].GetEndAxis() != "C6" {
+		t.Errorf("merged cells = %v (%v), want A6:C6", merged, err)
+	}
+	if _, ok := after["xl/calcChain.xml"]; !ok {
+		t.Error("calcChain.xml was dropped though no formula was overwritten")
+	}
+}
+
+func TestPatchWorkbookDropsCalcChainOfOverwrittenFormulas(t *testing.T) {
+	src := writeStyledWorkbook(t)
+	edits := make(cellEdits)
+	edits.set(3, 4, "Street 2, Siem Reap") // D3 held =C3*2
+	patched, before, after, sheetPart := patchTestWorkbook(t, src, edits)
+
+	if _, ok := after["xl/calcChain.xml"]; ok {
+		t.Error("calcChain.xml kept though it references an overwritten formula")
+	}
+	for _, name := range []string{"[Content_Types].xml", "xl/_rels/workbook.xml.rels"} {
+		if bytes.Contains(after[name], []byte("calcChain")) {
+			t.Errorf("%s still references calcChain.xml", name)
+		}
+	}
+	for name, data := range before {
+		switch name {
+		case sheetPart, "xl/calcChain.xml", "[Content_Types].xml", "xl/_rels/workbook.xml.rels":
+			continue
+		}
+		if !bytes.Equal(after[name], data) {
+			t.Errorf("%s changed", name)
+		}
+	}
+
+	f := reopen(t, patched)
+	if got, _ := f.GetCellValue(testSheet, "D3"); got != "Street 2, Siem Reap" {
+		t.Errorf("D3 = %q, want the new value", got)
+	}
+	if got, _ := f.GetCellFormula(testSheet, "D3"); got != "" {
+		t.Errorf("D3 still has the formula %q", got)
+	}
+	for cell, want := range map[string]string{"D2": "C2*2", "D4": "C4*2"} {
+		if got, _ := f.GetCellFormula(testSheet, cell); got != want {
+			t.Errorf("%s formula = %q, want %q", cell, got, want)
+		}
+	}
+	if got, _ := f.GetCellFormula("Totals", "A1"); got != "SUM("+testSheet+"!D2:D4)" {
+		t.Errorf("Totals!A1 formula = %q", got)
+	}
+	if err := f.SetCellValue(testSheet, "E3", "edited again"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Write(new(bytes.Buffer)); err != nil {
+		t.Errorf("excelize can't save the patched workbook: %v", err)
+	}
+}